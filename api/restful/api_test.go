@@ -1,177 +1,429 @@
 package restful
 
 import (
-	"bytes"
+	"bufio"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"git.internal.yunify.com/qxp/persona/internal/persona"
+	"git.internal.yunify.com/qxp/persona/pkg/code"
 	"git.internal.yunify.com/qxp/persona/pkg/config"
+	"git.internal.yunify.com/qxp/persona/pkg/db"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/error2"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/id2"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/resp"
 	"git.internal.yunify.com/qxp/persona/pkg/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/go-logr/logr"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"os"
 	"testing"
 )
 
 var (
-	BaseURL    = "http://127.0.0.1"
+	BaseURL    string
 	httpClient http.Client
 	KeyID      string
 )
 
 func TestMain(m *testing.M) {
 	var (
-		configPath = flag.String("config", "../../configs/config.yml", "-config 配置文件地址")
+		configPath = flag.String("config", "", "-config 配置文件地址，为空时不依赖外部服务")
+		backend    = flag.String("backend", "memory", "-backend 测试使用的后端存储")
 	)
 	flag.Parse()
-	err := config.Init(*configPath)
+	config.Config = &config.Configs{Model: DebugMode, HostName: "persona"}
+	if *configPath != "" {
+		if err := config.Init(*configPath); err != nil {
+			panic(err)
+		}
+	}
+	config.Config.BackendStorage = *backend
+
+	router, err := NewRouter(config.Config, logr.Discard())
 	if err != nil {
 		panic(err)
 	}
-	m.Run()
+	server := httptest.NewServer(router.engine)
+	BaseURL = server.URL
+
+	code := m.Run()
+	server.Close()
+	router.Close()
+	os.Exit(code)
 }
 
-// TestCreateDataSet 创建数据集测试
-func TestCreateDataSet(t *testing.T) {
-	path := "/api/v1/structor/dataset/m/create"
-	url := fmt.Sprintf("%s%s%s", BaseURL, config.Config.Port, path)
-	reqData := persona.CreateDataSetReq{
-		Name:    "persona_test",
-		Tag:     "tag_1111",
-		Type:    1,
-		Content: "_test_content_test_content",
+// post 发送请求并解析返回的data
+func post(t *testing.T, path string, reqData interface{}, entity interface{}) {
+	r := request(t, path, nil, reqData, entity)
+	if r.Code != error2.Success {
+		t.Fatal(fmt.Sprintf("error code: %d, msg: %s", r.Code, r.Msg))
 	}
-	buf, err := utils.Struct2Bytes(&reqData)
+}
+
+// request 携带header发送请求，返回解析后的响应，不检查错误码
+func request(t *testing.T, path string, header http.Header, reqData interface{}, entity interface{}) *resp.R {
+	return requestTo(t, BaseURL, path, header, reqData, entity)
+}
+
+// requestTo 向指定的服务发送请求
+func requestTo(t *testing.T, baseURL string, path string, header http.Header, reqData interface{}, entity interface{}) *resp.R {
+	url := fmt.Sprintf("%s%s", baseURL, path)
+	buf, err := utils.Struct2Bytes(reqData)
 	if err != nil {
 		t.Fatal(err)
 	}
-	resp, err := httpClient.Post(url, "application/json", buf)
+	req, err := http.NewRequest(http.MethodPost, url, buf)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if resp.StatusCode >= 400 {
-		t.Fatal(fmt.Sprintf("error response code: %d", resp.StatusCode))
+	req.Header = header.Clone()
+	if req.Header == nil {
+		req.Header = http.Header{}
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	req.Header.Set("Content-Type", "application/json")
+	response, err := httpClient.Do(req)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode >= 400 {
+		t.Fatalf("error response code: %d, body: %s", response.StatusCode, body)
+	}
 
-	fmt.Printf("Response: %s", string(body))
+	r := &resp.R{Data: entity}
+	if err := json.Unmarshal(body, r); err != nil {
+		t.Fatalf("decode response %s: %s", body, err)
+	}
+	return r
+}
+
+// TestCreateDataSet 创建数据集测试
+func TestCreateDataSet(t *testing.T) {
+	reqData := persona.CreateDataSetReq{
+		Name:    "persona_test",
+		Tag:     "tag_1111",
+		Type:    1,
+		Content: "_test_content_test_content",
+	}
+	var data persona.CreateDataSetResp
+	post(t, "/api/v1/persona/dataset/m/create", &reqData, &data)
+	if data.ID == "" {
+		t.Fatal("empty dataset id")
+	}
+	KeyID = data.ID
 }
 
 // TestGetDataSetByID 根据ID获取数据
 func TestGetDataSetByID(t *testing.T) {
-	path := "/api/v1/structor/dataset/m/get"
-	url := fmt.Sprintf("%s%s%s", BaseURL, config.Config.Port, path)
 	reqData := persona.GetDataSetReq{
-		ID: "0d6dccff-980f-49e8-ba7b-7f95b1520d04",
+		ID: KeyID,
 	}
-	buf, err := utils.Struct2Bytes(&reqData)
-	if err != nil {
-		t.Fatal(err)
+	var data persona.GetDataSetResp
+	post(t, "/api/v1/persona/dataset/m/get", &reqData, &data)
+	if data.ID != KeyID || data.Name != "persona_test" {
+		t.Fatal(fmt.Sprintf("unexpected dataset: %+v", data))
 	}
-	resp, err := httpClient.Post(url, "application/json", buf)
-	if err != nil {
-		t.Fatal(err)
-	}
-	if resp.StatusCode >= 400 {
-		t.Fatal(fmt.Sprintf("error response code: %d", resp.StatusCode))
+}
+
+// TestUpdateDataSet 更新数据集
+func TestUpdateDataSet(t *testing.T) {
+	reqData := persona.UpdateDataSetReq{
+		ID:      KeyID,
+		Name:    "persona_test",
+		Tag:     "tag_2222",
+		Type:    1,
+		Content: "_test_content_update",
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		t.Fatal(err)
+	post(t, "/api/v1/persona/dataset/m/update", &reqData, nil)
+
+	var data persona.GetDataSetResp
+	post(t, "/api/v1/persona/dataset/m/get", &persona.GetDataSetReq{ID: KeyID}, &data)
+	if data.Tag != reqData.Tag || data.Content != reqData.Content {
+		t.Fatal(fmt.Sprintf("update fail: %+v", data))
 	}
+}
 
-	fmt.Printf("Response: %s", string(body))
+// TestGetDataSetByCondition 根据条件获取数据
+func TestGetDataSetByCondition(t *testing.T) {
+	reqData := persona.GetByConditionSetReq{
+		Tag: "tag_2222",
+	}
+	var data persona.GetByConditionSetResp
+	post(t, "/api/v1/persona/dataset/m/getByCondition", &reqData, &data)
+	if len(data.List) != 1 || data.List[0].ID != KeyID {
+		t.Fatal(fmt.Sprintf("unexpected list: %+v", data.List))
+	}
 }
 
-// TestUpdateDataSet 更新数据集
-func TestUpdateDataSet(t *testing.T) {
-	path := "/api/v1/structor/dataset/m/get"
-	url := fmt.Sprintf("%s%s%s", BaseURL, config.Config.Port, path)
+// TestGetDataSetByIDHome 根据key获取数据集
+func TestGetDataSetByIDHome(t *testing.T) {
 	reqData := persona.GetDataSetReq{
-		ID: "0d6dccff-980f-49e8-ba7b-7f95b1520d04",
+		ID: KeyID,
 	}
-	buf, err := utils.Struct2Bytes(&reqData)
-	if err != nil {
-		t.Fatal(err)
-	}
-	resp, err := httpClient.Post(url, "application/json", buf)
-	if err != nil {
-		t.Fatal(err)
+	var data persona.GetDataSetResp
+	post(t, "/api/v1/persona/dataset/home/get", &reqData, &data)
+	if data.ID != KeyID {
+		t.Fatal(fmt.Sprintf("unexpected dataset: %+v", data))
 	}
-	if resp.StatusCode >= 400 {
-		t.Fatal(fmt.Sprintf("error response code: %d", resp.StatusCode))
+}
+
+// TestDeleteDataSet 删除数据集
+func TestDeleteDataSet(t *testing.T) {
+	reqData := persona.DeleteDataSetReq{
+		ID: KeyID,
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		t.Fatal(err)
+	post(t, "/api/v1/persona/dataset/m/delete", &reqData, nil)
+
+	var data persona.GetDataSetResp
+	post(t, "/api/v1/persona/dataset/m/get", &persona.GetDataSetReq{ID: KeyID}, &data)
+	if data.ID != "" {
+		t.Fatal(fmt.Sprintf("delete fail: %+v", data))
 	}
+}
 
-	fmt.Printf("Response: %s", string(body))
+func TestMainOrder(t *testing.T) {
+	t.Run("TestCreateDataSet", TestCreateDataSet)
+	t.Run("TestGetDataSetByID", TestGetDataSetByID)
+	t.Run("TestUpdateDataSet", TestUpdateDataSet)
+	t.Run("TestGetDataSetByCondition", TestGetDataSetByCondition)
+	t.Run("TestGetDataSetByIDHome", TestGetDataSetByIDHome)
+	t.Run("TestDeleteDataSet", TestDeleteDataSet)
 }
 
-// TestGetDataSetByCondition 根据条件获取数据
-func TestGetDataSetByCondition(t *testing.T) {
-	path := "/api/v1/structor/dataset/m/get"
-	url := fmt.Sprintf("%s%s%s", BaseURL, config.Config.Port, path)
-	reqData := persona.GetDataSetReq{
-		ID: "0d6dccff-980f-49e8-ba7b-7f95b1520d04",
+// TestExportDataStream 流式导出
+func TestExportDataStream(t *testing.T) {
+	appID := "export_" + id2.GenID()
+	keys := make([]persona.VersionKeyValue, 0)
+	for i := 0; i < 250; i++ {
+		keys = append(keys, persona.VersionKeyValue{
+			Version: "v1",
+			Key:     fmt.Sprintf("app_id:%s:key_%d", appID, i),
+			Value:   fmt.Sprintf("value_%d", i),
+		})
 	}
-	buf, err := utils.Struct2Bytes(&reqData)
+	post(t, "/api/v1/persona/batchSetValue", &persona.BatchSetValueReq{Keys: keys}, nil)
+
+	buf, err := utils.Struct2Bytes(&persona.ExportDataReq{AppID: appID})
 	if err != nil {
 		t.Fatal(err)
 	}
-	resp, err := httpClient.Post(url, "application/json", buf)
+	response, err := httpClient.Post(BaseURL+"/api/v1/persona/app/exportStream", "application/json", buf)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if resp.StatusCode >= 400 {
-		t.Fatal(fmt.Sprintf("error response code: %d", resp.StatusCode))
+	defer response.Body.Close()
+	if ct := response.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Fatalf("unexpected content type: %s", ct)
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
+
+	got := make(map[string]string)
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		var data db.ImportReqData
+		if err := json.Unmarshal(scanner.Bytes(), &data); err != nil {
+			t.Fatal(err)
+		}
+		got[data.Key] = data.Value
+	}
+	if err := scanner.Err(); err != nil {
 		t.Fatal(err)
 	}
-
-	fmt.Printf("Response: %s", string(body))
+	if len(got) != len(keys) {
+		t.Fatalf("expect %d lines, got %d", len(keys), len(got))
+	}
+	if e := response.Trailer.Get("X-Export-Error"); e != "" {
+		t.Fatalf("unexpected error: %s", e)
+	}
 }
 
-// TestGetDataSetByIDHome 根据key获取数据集
-func TestGetDataSetByIDHome(t *testing.T) {
-	path := "/api/v1/structor/dataset/m/create"
-	url := fmt.Sprintf("%s:%s%s", BaseURL, config.Config.Port, path)
-	reqData := persona.CreateDataSetReq{
-		Name:    "persona_test",
-		Tag:     "tag_1111",
-		Type:    1,
-		Content: "_test_content_test_content",
+// TestExportData 导出结果逐条写入，可按统一的返回值格式解析
+func TestExportData(t *testing.T) {
+	appID := "export_" + id2.GenID()
+	dataSet := &persona.CreateDataSetResp{}
+	post(t, "/api/v1/persona/dataset/m/create", &persona.CreateDataSetReq{Name: "export"}, dataSet)
+	keys := []persona.VersionKeyValue{{
+		Version: "v1",
+		Key:     fmt.Sprintf("app_id:%s:ref", appID),
+		Value:   fmt.Sprintf(`{"dataSet":"%s"}`, dataSet.ID),
+	}}
+	for i := 0; i < 150; i++ {
+		keys = append(keys, persona.VersionKeyValue{
+			Version: "v1",
+			Key:     fmt.Sprintf("app_id:%s:key_%d", appID, i),
+			Value:   fmt.Sprintf("value_%d", i),
+		})
 	}
-	var buf bytes.Buffer
-	err := json.NewEncoder(&buf).Encode(reqData)
-	if err != nil {
-		t.Fatal(err)
+	post(t, "/api/v1/persona/batchSetValue", &persona.BatchSetValueReq{Keys: keys}, nil)
+
+	exportResp := &persona.ExportDataResp{}
+	post(t, "/api/v1/persona/app/export", &persona.ExportDataReq{AppID: appID}, exportResp)
+	if exportResp.SchemaVersion != persona.ExportSchemaVersion || exportResp.AppID != appID || exportResp.ExportedAt == 0 {
+		t.Fatalf("unexpected envelope: %+v", exportResp)
 	}
-	resp, err := httpClient.Post(url, "application/json", &buf)
+	if len(exportResp.AppData) != len(keys) {
+		t.Fatalf("expect %d app data, got %d", len(keys), len(exportResp.AppData))
+	}
+	if len(exportResp.DataSets) != 1 || exportResp.DataSets[0].ID != dataSet.ID {
+		t.Fatalf("expect referenced data set, got %+v", exportResp.DataSets)
+	}
+
+	// 空应用
+	exportResp = &persona.ExportDataResp{}
+	post(t, "/api/v1/persona/app/export", &persona.ExportDataReq{AppID: "empty_" + appID}, exportResp)
+	if exportResp.AppID != "empty_"+appID || len(exportResp.AppData) != 0 {
+		t.Fatalf("unexpected envelope: %+v", exportResp)
+	}
+}
+
+// TestTenantIsolation 不同租户的数据互不可见，开启多租户后只接受登记的租户
+func TestTenantIsolation(t *testing.T) {
+	conf := *config.Config
+	conf.Tenant = config.Tenant{Enable: true, IDs: []string{"tenant-a", "tenant-b"}}
+	router, err := NewRouter(&conf, logr.Discard())
 	if err != nil {
 		t.Fatal(err)
 	}
-	if resp.StatusCode >= 400 {
-		t.Fatal(fmt.Sprintf("error response code: %d", resp.StatusCode))
+	server := httptest.NewServer(router.engine)
+	defer func() {
+		server.Close()
+		router.Close()
+	}()
+
+	key := "app_id:tenant:" + id2.GenID()
+	tenant := func(id string) http.Header {
+		return http.Header{db.TenantHeader: []string{id}}
+	}
+	set := &persona.BatchSetValueReq{Keys: []persona.VersionKeyValue{{Version: "v1", Key: key, Value: "a"}}}
+	if r := requestTo(t, server.URL, "/api/v1/persona/batchSetValue", tenant("tenant-a"), set, nil); r.Code != error2.Success {
+		t.Fatalf("set: %d %s", r.Code, r.Msg)
+	}
+
+	get := &persona.BatchGetValueReq{Keys: []persona.VersionKey{{Version: "v1", Key: key}}}
+	for _, tt := range []struct {
+		tenant string
+		want   string
+	}{
+		{tenant: "tenant-a", want: "a"},
+		{tenant: "tenant-b", want: ""},
+	} {
+		var data persona.BatchGetValueResp
+		if r := requestTo(t, server.URL, "/api/v1/persona/batchGetValue", tenant(tt.tenant), get, &data); r.Code != error2.Success {
+			t.Fatalf("get: %d %s", r.Code, r.Msg)
+		}
+		if data.Result[key] != tt.want {
+			t.Fatalf("tenant %q: expect %q, got %q", tt.tenant, tt.want, data.Result[key])
+		}
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+
+	// 未携带、未登记或不合法的租户ID
+	for _, header := range []http.Header{nil, tenant("tenant-c"), tenant("../tenant-a")} {
+		if r := requestTo(t, server.URL, "/api/v1/persona/batchGetValue", header, get, nil); r.Code != code.InvalidTenant {
+			t.Fatalf("tenant %q: expect invalid tenant, got %d %s", header.Get(db.TenantHeader), r.Code, r.Msg)
+		}
+	}
+	// 未开启多租户时不接受租户ID
+	if r := request(t, "/api/v1/persona/batchGetValue", tenant("tenant-a"), get, nil); r.Code != code.InvalidTenant {
+		t.Fatalf("expect invalid tenant, got %d %s", r.Code, r.Msg)
+	}
+	// 探针不携带租户ID
+	res, err := httpClient.Get(server.URL + "/liveness")
 	if err != nil {
 		t.Fatal(err)
 	}
-	fmt.Printf("Response: %s", string(body))
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || len(body) != 0 {
+		t.Fatalf("expect liveness without tenant, got %d %s", res.StatusCode, body)
+	}
 }
 
-func TestMainOrder(t *testing.T) {
-	t.Run("TestCreateDataSet", TestCreateDataSet)
+// TestAuthorize 按路由组校验角色
+func TestAuthorize(t *testing.T) {
+	auth := authorizer(config.Auth{
+		Enable: true,
+		Groups: map[string][]string{GroupAppWrite: {"admin"}},
+	})
+	engine := gin.New()
+	ok := func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	}
+	engine.POST("/write", auth(GroupAppWrite), ok)
+	engine.POST("/user", auth(GroupUser), ok)
+
+	tests := []struct {
+		path string
+		role string
+		want int
+	}{
+		{path: "/write", role: "admin", want: http.StatusOK},
+		{path: "/write", role: "user, admin", want: http.StatusOK},
+		{path: "/write", role: "user", want: http.StatusForbidden},
+		{path: "/write", role: "", want: http.StatusForbidden},
+		// 未配置角色的路由组拒绝所有请求
+		{path: "/user", role: "", want: http.StatusForbidden},
+		{path: "/user", role: "admin", want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, tt.path, nil)
+		req.Header.Set("Role", tt.role)
+		engine.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Fatalf("%s with role %q: expect %d, got %d", tt.path, tt.role, tt.want, w.Code)
+		}
+		if w.Code != http.StatusForbidden {
+			continue
+		}
+		r := &resp.R{}
+		if err := json.Unmarshal(w.Body.Bytes(), r); err != nil {
+			t.Fatal(err)
+		}
+		if r.Code != code.Forbidden {
+			t.Fatalf("expect forbidden code, got %d", r.Code)
+		}
+	}
+}
+
+// TestCheckAuth 开启校验时路由组的角色配置不完整或有未知路由组时启动失败
+func TestCheckAuth(t *testing.T) {
+	complete := func() map[string][]string {
+		g := make(map[string][]string, len(groups))
+		for _, group := range groups {
+			g[group] = []string{"admin"}
+		}
+		return g
+	}
+	missing := complete()
+	missing[GroupAppRead] = nil
+	unknown := complete()
+	unknown["appread"] = []string{"admin"}
+
+	tests := []struct {
+		name    string
+		conf    config.Auth
+		wantErr bool
+	}{
+		{name: "disabled", conf: config.Auth{}},
+		{name: "complete", conf: config.Auth{Enable: true, Groups: complete()}},
+		{name: "missing", conf: config.Auth{Enable: true, Groups: missing}, wantErr: true},
+		{name: "unknown", conf: config.Auth{Enable: true, Groups: unknown}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := checkAuth(tt.conf); (err != nil) != tt.wantErr {
+			t.Fatalf("%s: expect error %v, got %v", tt.name, tt.wantErr, err)
+		}
+	}
+
+	conf := *config.Config
+	conf.Auth = config.Auth{Enable: true, Groups: missing}
+	if _, err := NewRouter(&conf, logr.Discard()); err == nil {
+		t.Fatal("expect router not created with incomplete auth config")
+	}
 }
@@ -0,0 +1,106 @@
+package restful
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"git.internal.yunify.com/qxp/persona/pkg/code"
+	"git.internal.yunify.com/qxp/persona/pkg/config"
+	"git.internal.yunify.com/qxp/persona/pkg/db"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/error2"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/resp"
+	"github.com/gin-gonic/gin"
+)
+
+// checkTenant 开启多租户时拒绝未携带或未登记租户ID的请求，关闭时拒绝携带租户ID的请求
+func checkTenant(conf config.Tenant) gin.HandlerFunc {
+	tenants := make(map[string]bool, len(conf.IDs))
+	if conf.Enable {
+		for _, id := range conf.IDs {
+			tenants[id] = true
+		}
+	} else {
+		tenants[""] = true
+	}
+	return func(c *gin.Context) {
+		if !tenants[c.GetHeader(db.TenantHeader)] {
+			resp.Format(nil, error2.NewError(code.InvalidTenant)).Context(c)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// roleHeader 请求中携带角色的header，与 logger.CTXTransfer 一致
+const roleHeader = "Role"
+
+// 路由组，config.Auth.Groups 中按组配置允许访问的角色
+const (
+	// GroupUser 当前用户的数据及用户端数据集
+	GroupUser = "user"
+	// GroupAppRead 读取应用级数据
+	GroupAppRead = "appRead"
+	// GroupAppWrite 修改应用级数据
+	GroupAppWrite = "appWrite"
+	// GroupApp 应用数据的导入、导出、复制及删除
+	GroupApp = "app"
+	// GroupSchema JSON Schema
+	GroupSchema = "schema"
+	// GroupDataSet 管理端数据集
+	GroupDataSet = "dataSet"
+	// GroupUserData 用户数据的导出及删除
+	GroupUserData = "userData"
+)
+
+// groups 所有路由组
+var groups = []string{GroupUser, GroupAppRead, GroupAppWrite, GroupApp, GroupSchema, GroupDataSet, GroupUserData}
+
+// checkAuth 开启校验时每个路由组都需配置允许的角色，且不能配置未知的路由组，启动时检查
+func checkAuth(conf config.Auth) error {
+	if !conf.Enable {
+		return nil
+	}
+	known := make(map[string]bool, len(groups))
+	for _, group := range groups {
+		known[group] = true
+		if len(conf.Groups[group]) == 0 {
+			return fmt.Errorf("auth: no roles for route group %q", group)
+		}
+	}
+	for group := range conf.Groups {
+		if !known[group] {
+			return fmt.Errorf("auth: unknown route group %q", group)
+		}
+	}
+	return nil
+}
+
+// authorizer 返回按路由组校验角色的中间件，没有权限时返回403，
+// 开启校验时未配置角色的路由组拒绝所有请求。
+// 请求头 Role 不做任何校验，只有网关删除客户端传入的 Role 并按认证结果重新设置时才可信
+func authorizer(conf config.Auth) func(group string) gin.HandlerFunc {
+	return func(group string) gin.HandlerFunc {
+		if !conf.Enable {
+			return func(c *gin.Context) {
+				c.Next()
+			}
+		}
+		roles := conf.Groups[group]
+		allowed := make(map[string]bool, len(roles))
+		for _, role := range roles {
+			allowed[role] = true
+		}
+		return func(c *gin.Context) {
+			for _, role := range strings.Split(c.GetHeader(roleHeader), ",") {
+				if allowed[strings.TrimSpace(role)] {
+					c.Next()
+					return
+				}
+			}
+			resp.Format(nil, error2.NewError(code.Forbidden)).Context(c, http.StatusForbidden)
+			c.Abort()
+		}
+	}
+}
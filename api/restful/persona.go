@@ -2,13 +2,26 @@ package restful
 
 import (
 	"context"
+	"encoding/json"
 	"git.internal.yunify.com/qxp/persona/internal/persona"
 	"git.internal.yunify.com/qxp/persona/internal/server/options"
 	"git.internal.yunify.com/qxp/persona/pkg/config"
+	"git.internal.yunify.com/qxp/persona/pkg/db"
 	"git.internal.yunify.com/qxp/persona/pkg/misc/logger"
 	"git.internal.yunify.com/qxp/persona/pkg/misc/resp"
 	"github.com/gin-gonic/gin"
+	"io"
 	"net/http"
+	"time"
+)
+
+const (
+	// exportFlushSize 流式导出时每写入多少条刷新一次
+	exportFlushSize = 100
+	// exportErrorTrailer 流式导出中途出错时的trailer
+	exportErrorTrailer = "X-Export-Error"
+	// watchHeartbeat 没有变更时发送心跳的间隔，避免连接被代理关闭
+	watchHeartbeat = 15 * time.Second
 )
 
 // Persona Persona
@@ -18,7 +31,7 @@ type Persona struct {
 
 // NewPersona new persona
 func NewPersona(ctx context.Context, c *config.Configs, opts ...options.Options) (*Persona, error) {
-	p, err := persona.NewPersona(c)
+	p, err := persona.NewPersona(ctx, c)
 	if err != nil {
 		return nil, err
 	}
@@ -65,6 +78,24 @@ func (p *Persona) getValue(c *gin.Context) {
 	resp.Format(p.persona.GetValue(logger.CTXTransfer(c), req)).Context(c)
 }
 
+func (p *Persona) userDeleteValue(c *gin.Context) {
+	req := &persona.BatchDeleteValueReq{}
+	if err := c.ShouldBind(req); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	resp.Format(p.persona.UserDeleteValue(logger.CTXTransfer(c), req)).Context(c)
+}
+
+func (p *Persona) deleteValue(c *gin.Context) {
+	req := &persona.BatchDeleteValueReq{}
+	if err := c.ShouldBind(req); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	resp.Format(p.persona.DeleteValue(logger.CTXTransfer(c), req)).Context(c)
+}
+
 func (p *Persona) cloneValue(c *gin.Context) {
 	req := &persona.CloneValueReq{}
 	if err := c.ShouldBind(req); err != nil {
@@ -74,13 +105,170 @@ func (p *Persona) cloneValue(c *gin.Context) {
 	resp.Format(p.persona.CloneValue(logger.CTXTransfer(c), req)).Context(c)
 }
 
+// batchCloneValue 批量复制或按版本发布
+func (p *Persona) batchCloneValue(c *gin.Context) {
+	req := &persona.BatchCloneValueReq{}
+	if err := c.ShouldBind(req); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	resp.Format(p.persona.BatchCloneValue(logger.CTXTransfer(c), req)).Context(c)
+}
+
+// exportData 按统一的返回值格式流式返回导出结果，appData 逐条写入，不在内存中堆积
+// 开始返回数据后出错时无法再修改状态码，错误信息放在 X-Export-Error trailer 中
 func (p *Persona) exportData(c *gin.Context) {
 	req := &persona.ExportDataReq{}
 	if err := c.ShouldBind(req); err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
-	resp.Format(p.persona.ExportData(logger.CTXTransfer(c), req)).Context(c)
+
+	var (
+		ctx     = logger.CTXTransfer(c)
+		enc     = json.NewEncoder(c.Writer)
+		count   int
+		started bool
+	)
+	// start appData 之外的字段在导出结束后写入
+	start := func() {
+		c.Header("Content-Type", "application/json; charset=utf-8")
+		c.Header("Trailer", exportErrorTrailer)
+		c.Status(http.StatusOK)
+		_, _ = c.Writer.WriteString(`{"code":0,"data":{"appData":[`)
+		started = true
+	}
+	envelope, err := p.persona.StreamExportData(ctx, req, func(data db.ImportReqData) error {
+		if !started {
+			start()
+		} else if _, err := c.Writer.WriteString(","); err != nil {
+			return err
+		}
+		if err := enc.Encode(&data); err != nil {
+			return err
+		}
+		count++
+		if count%exportFlushSize == 0 {
+			c.Writer.Flush()
+		}
+		return nil
+	})
+	if err == nil {
+		var tail []byte
+		if tail, err = json.Marshal(envelope); err == nil {
+			if !started {
+				start()
+			}
+			// 除 appData 外没有其他字段时 tail 为 {}
+			rest := "}"
+			if len(tail) > 2 {
+				rest = "," + string(tail[1:])
+			}
+			_, err = c.Writer.WriteString("]" + rest + "}")
+		}
+	}
+	switch {
+	case err != nil && !started:
+		resp.Format(nil, err).Context(c)
+	case err != nil:
+		logger.Logger.Errorw(err.Error(), logger.GINRequestID(c))
+		c.Writer.Header().Set(exportErrorTrailer, err.Error())
+	}
+}
+
+// exportDataStream 以NDJSON逐行返回导出的数据
+// 开始返回数据后出错时无法再修改状态码，错误信息放在 X-Export-Error trailer 中
+func (p *Persona) exportDataStream(c *gin.Context) {
+	req := &persona.ExportDataReq{}
+	if err := c.ShouldBind(req); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	var (
+		ctx   = logger.CTXTransfer(c)
+		enc   = json.NewEncoder(c.Writer)
+		count int
+	)
+	_, err := p.persona.StreamExportData(ctx, req, func(data db.ImportReqData) error {
+		if count == 0 {
+			c.Header("Content-Type", "application/x-ndjson")
+			c.Header("Trailer", exportErrorTrailer)
+			c.Status(http.StatusOK)
+		}
+		if err := enc.Encode(&data); err != nil {
+			return err
+		}
+		count++
+		if count%exportFlushSize == 0 {
+			c.Writer.Flush()
+		}
+		return nil
+	})
+	switch {
+	case err != nil && count == 0:
+		resp.Format(nil, err).Context(c)
+	case err != nil:
+		logger.Logger.Errorw(err.Error(), logger.GINRequestID(c))
+		c.Writer.Header().Set(exportErrorTrailer, err.Error())
+	case count == 0:
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Status(http.StatusOK)
+	}
+}
+
+// watch 以 Server-Sent Events 推送应用级key的变更
+func (p *Persona) watch(c *gin.Context) {
+	p.streamChanges(c, p.persona.Watch)
+}
+
+// userWatch 以 Server-Sent Events 推送用户key的变更
+func (p *Persona) userWatch(c *gin.Context) {
+	p.streamChanges(c, p.persona.UserWatch)
+}
+
+// streamChanges 每个变更为一个事件，事件名为变更类型，id 为事件在监听中的位置，data 为 persona.ChangeEvent，
+// 监听结束时断开连接，客户端(如 EventSource)自动重连并以 Last-Event-ID 从断开处恢复
+func (p *Persona) streamChanges(c *gin.Context,
+	watch func(ctx context.Context, req *persona.WatchReq) (<-chan *persona.ChangeEvent, error)) {
+	req := &persona.WatchReq{}
+	if err := c.ShouldBind(req); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if id := c.GetHeader("Last-Event-ID"); id != "" {
+		req.Revision = id
+	}
+	ctx, cancel := context.WithCancel(logger.CTXTransfer(c))
+	defer cancel()
+	changes, err := watch(ctx, req)
+	if err != nil {
+		resp.Format(nil, err).Context(c)
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+	heartbeat := time.NewTicker(watchHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case change, ok := <-changes:
+			if !ok {
+				return
+			}
+			io.WriteString(c.Writer, "id: "+change.ID+"\n")
+			c.SSEvent(change.Type, change)
+		case <-heartbeat.C:
+			io.WriteString(c.Writer, ": heartbeat\n\n")
+		case <-c.Request.Context().Done():
+			return
+		}
+		c.Writer.Flush()
+	}
 }
 
 func (p *Persona) importData(c *gin.Context) {
@@ -89,7 +277,47 @@ func (p *Persona) importData(c *gin.Context) {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
-	resp.Format(nil, p.persona.ImportData(logger.CTXTransfer(c), req)).Context(c)
+	resp.Format(p.persona.ImportData(logger.CTXTransfer(c), req)).Context(c)
+}
+
+// cloneApp 复制应用的所有数据到新的应用
+func (p *Persona) cloneApp(c *gin.Context) {
+	req := &persona.CloneAppReq{}
+	if err := c.ShouldBind(req); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	resp.Format(p.persona.CloneApp(logger.CTXTransfer(c), req)).Context(c)
+}
+
+// purgeApp 删除应用的所有数据
+func (p *Persona) purgeApp(c *gin.Context) {
+	req := &persona.PurgeAppReq{}
+	if err := c.ShouldBind(req); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	resp.Format(p.persona.PurgeApp(logger.CTXTransfer(c), req)).Context(c)
+}
+
+// exportUserData 导出用户的所有数据(管理端)
+func (p *Persona) exportUserData(c *gin.Context) {
+	req := &persona.ExportUserDataReq{}
+	if err := c.ShouldBind(req); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	resp.Format(p.persona.ExportUserData(logger.CTXTransfer(c), req)).Context(c)
+}
+
+// eraseUserData 删除用户的所有数据(管理端)
+func (p *Persona) eraseUserData(c *gin.Context) {
+	req := &persona.EraseUserDataReq{}
+	if err := c.ShouldBind(req); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	resp.Format(p.persona.EraseUserData(logger.CTXTransfer(c), req)).Context(c)
 }
 
 // createDataSet 创建数据集(管理端)
@@ -152,3 +380,99 @@ func (p *Persona) deleteDataSet(c *gin.Context) {
 	}
 	resp.Format(p.persona.DeleteDataSet(logger.CTXTransfer(c), req)).Context(c)
 }
+
+// listHistory 应用级key的修改记录
+func (p *Persona) listHistory(c *gin.Context) {
+	req := &persona.ListHistoryReq{}
+	if err := c.ShouldBind(req); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	resp.Format(p.persona.ListHistory(logger.CTXTransfer(c), req)).Context(c)
+}
+
+// userListHistory 用户key的修改记录
+func (p *Persona) userListHistory(c *gin.Context) {
+	req := &persona.ListHistoryReq{}
+	if err := c.ShouldBind(req); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	resp.Format(p.persona.UserListHistory(logger.CTXTransfer(c), req)).Context(c)
+}
+
+// rollback 应用级key回滚
+func (p *Persona) rollback(c *gin.Context) {
+	req := &persona.RollbackReq{}
+	if err := c.ShouldBind(req); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	resp.Format(p.persona.Rollback(logger.CTXTransfer(c), req)).Context(c)
+}
+
+// userRollback 用户key回滚
+func (p *Persona) userRollback(c *gin.Context) {
+	req := &persona.RollbackReq{}
+	if err := c.ShouldBind(req); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	resp.Format(p.persona.UserRollback(logger.CTXTransfer(c), req)).Context(c)
+}
+
+// listVersions 应用级key的所有版本
+func (p *Persona) listVersions(c *gin.Context) {
+	req := &persona.ListVersionsReq{}
+	if err := c.ShouldBind(req); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	resp.Format(p.persona.ListVersions(logger.CTXTransfer(c), req)).Context(c)
+}
+
+// userListVersions 用户key的所有版本
+func (p *Persona) userListVersions(c *gin.Context) {
+	req := &persona.ListVersionsReq{}
+	if err := c.ShouldBind(req); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	resp.Format(p.persona.UserListVersions(logger.CTXTransfer(c), req)).Context(c)
+}
+
+// diffVersions 比较两个版本的差异
+func (p *Persona) diffVersions(c *gin.Context) {
+	req := &persona.DiffVersionsReq{}
+	if err := c.ShouldBind(req); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	resp.Format(p.persona.DiffVersions(logger.CTXTransfer(c), req)).Context(c)
+}
+
+// setSchema 按key前缀或数据集类型注册 JSON Schema
+func (p *Persona) setSchema(c *gin.Context) {
+	req := &persona.SetSchemaReq{}
+	if err := c.ShouldBind(req); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	resp.Format(p.persona.SetSchema(logger.CTXTransfer(c), req)).Context(c)
+}
+
+// listSchemas 所有已注册的 JSON Schema
+func (p *Persona) listSchemas(c *gin.Context) {
+	req := &persona.ListSchemasReq{}
+	resp.Format(p.persona.ListSchemas(logger.CTXTransfer(c), req)).Context(c)
+}
+
+// deleteSchema 删除 JSON Schema
+func (p *Persona) deleteSchema(c *gin.Context) {
+	req := &persona.DeleteSchemaReq{}
+	if err := c.ShouldBind(req); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	resp.Format(p.persona.DeleteSchema(logger.CTXTransfer(c), req)).Context(c)
+}
@@ -29,6 +29,9 @@ type Router struct {
 
 // NewRouter 开启路由
 func NewRouter(c *config.Configs, log logr.Logger) (*Router, error) {
+	if err := checkAuth(c.Auth); err != nil {
+		return nil, err
+	}
 	engine, err := newRouter(c, log)
 	if err != nil {
 		return nil, err
@@ -39,24 +42,75 @@ func NewRouter(c *config.Configs, log logr.Logger) (*Router, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 	p, err := NewPersona(ctx, c)
 	if err != nil {
+		cancel()
 		return nil, err
 	}
-	v1 := engine.Group("/api/v1/persona")
+	auth := authorizer(c.Auth)
+	// 只有业务接口校验租户，探针不携带租户ID
+	v1 := engine.Group("/api/v1/persona", checkTenant(c.Tenant))
 	{
-		v1.POST("/userBatchSetValue", p.userSetValue)
-		v1.POST("/userBatchGetValue", p.userGetValue)
+		v1.POST("/userBatchSetValue", auth(GroupUser), p.userSetValue)
+		v1.POST("/userBatchGetValue", auth(GroupUser), p.userGetValue)
+		v1.POST("/userBatchDeleteValue", auth(GroupUser), p.userDeleteValue)
+
+		v1.POST("/batchSetValue", auth(GroupAppWrite), p.setValue)
+		v1.POST("/batchGetValue", auth(GroupAppRead), p.getValue)
+		v1.POST("/batchDeleteValue", auth(GroupAppWrite), p.deleteValue)
+
+		// 变更推送(Server-Sent Events)
+		v1.GET("/watch", auth(GroupAppRead), p.watch)
+		v1.GET("/userWatch", auth(GroupUser), p.userWatch)
+
+		v1.POST("/cloneValue", auth(GroupAppWrite), p.cloneValue)
+		v1.POST("/batchCloneValue", auth(GroupAppWrite), p.batchCloneValue)
+	}
 
-		v1.POST("/batchSetValue", p.setValue)
-		v1.POST("/batchGetValue", p.getValue)
+	// 应用数据
+	appAPI := v1.Group("/app", auth(GroupApp))
+	{
+		appAPI.POST("/import", p.importData)
+		appAPI.POST("/clone", p.cloneApp)
+		appAPI.POST("/export", p.exportData)
+		appAPI.POST("/exportStream", p.exportDataStream)
+		appAPI.POST("/purge", p.purgeApp)
+	}
 
-		v1.POST("/cloneValue", p.cloneValue)
+	// 修改记录
+	historyAPI := v1.Group("/history")
+	{
+		historyAPI.POST("/list", auth(GroupAppRead), p.listHistory)
+		historyAPI.POST("/rollback", auth(GroupAppWrite), p.rollback)
 
-		v1.POST("/app/import", p.importData)
-		v1.POST("/app/export", p.exportData)
+		historyAPI.POST("/userList", auth(GroupUser), p.userListHistory)
+		historyAPI.POST("/userRollback", auth(GroupUser), p.userRollback)
+	}
+
+	// 版本
+	versionAPI := v1.Group("/version")
+	{
+		versionAPI.POST("/list", auth(GroupAppRead), p.listVersions)
+		versionAPI.POST("/diff", auth(GroupAppRead), p.diffVersions)
+
+		versionAPI.POST("/userList", auth(GroupUser), p.userListVersions)
+	}
+
+	// JSON Schema
+	schemaAPI := v1.Group("/schema", auth(GroupSchema))
+	{
+		schemaAPI.POST("/set", p.setSchema)
+		schemaAPI.POST("/list", p.listSchemas)
+		schemaAPI.POST("/delete", p.deleteSchema)
+	}
+
+	// 用户数据的导出及删除(管理端)
+	userDataAPI := v1.Group("/admin/user", auth(GroupUserData))
+	{
+		userDataAPI.POST("/export", p.exportUserData)
+		userDataAPI.POST("/erase", p.eraseUserData)
 	}
 
 	// 数据集
-	smAPI := engine.Group("/api/v1/persona/dataset/m")
+	smAPI := v1.Group("/dataset/m", auth(GroupDataSet))
 	{
 		// 创建数据集
 		smAPI.POST("/create", p.createDataSet)
@@ -70,7 +124,7 @@ func NewRouter(c *config.Configs, log logr.Logger) (*Router, error) {
 		smAPI.POST("/delete", p.deleteDataSet)
 	}
 	// 用户端API
-	suAPI := engine.Group("/api/v1/persona/dataset/home")
+	suAPI := v1.Group("/dataset/home", auth(GroupUser))
 	{
 		// 根据ID获取数据集
 		suAPI.POST("/get", p.getDataSetByIDHome)
@@ -4,8 +4,8 @@ import (
 	"flag"
 	"fmt"
 	"git.internal.yunify.com/qxp/persona/api/restful"
+	"git.internal.yunify.com/qxp/persona/internal/model"
 	"git.internal.yunify.com/qxp/persona/pkg/config"
-	"git.internal.yunify.com/qxp/persona/pkg/db/elasticsearch"
 	"git.internal.yunify.com/qxp/persona/pkg/misc/logger"
 	"github.com/go-logr/logr"
 	"github.com/go-logr/zapr"
@@ -31,10 +31,10 @@ func main() {
 		panic(err)
 	}
 
-	// init es index
-	err = elasticsearch.InitEsIndex(config.Config)
+	// 初始化所选的后端存储，如es的索引
+	err = model.InitBackend(config.Config)
 	if err != nil {
-		panic(fmt.Sprintf("Create es index error: %s", err))
+		panic(fmt.Sprintf("Init backend storage error: %s", err))
 	}
 
 	// err = logger.New(&config.Config.Log)
@@ -1,30 +1,75 @@
 package model
 
 import (
+	"context"
+	"errors"
 	"fmt"
+
 	"git.internal.yunify.com/qxp/persona/pkg/config"
+	"git.internal.yunify.com/qxp/persona/pkg/db"
 	pes "git.internal.yunify.com/qxp/persona/pkg/db/elasticsearch"
 	petcd "git.internal.yunify.com/qxp/persona/pkg/db/etcd"
+	pmemory "git.internal.yunify.com/qxp/persona/pkg/db/memory"
+)
+
+const (
+	// BackendES elasticsearch
+	BackendES = "es"
+	// BackendEtcd etcd v3
+	BackendEtcd = "etcd"
+	// BackendMemory 内存，仅用于测试及本地开发
+	BackendMemory = "memory"
 )
 
-// DBFactory 根据配置不同返回不同的db对象
-func DBFactory(conf *config.Configs) (interface{}, error) {
+// InitBackend 执行所选后端存储的初始化工作，如es的索引创建
+func InitBackend(conf *config.Configs) error {
 	switch conf.BackendStorage {
-	case "es":
-		b, err := pes.NewEs(conf)
-		if err != nil {
-			return nil, err
-		}
-		return b, nil
-	case "etcd":
-		b, err := petcd.NewEtcd(conf)
-		if err != nil {
-			return nil, err
+	case BackendES:
+		return pes.InitEsIndex(conf)
+	case BackendEtcd, BackendMemory:
+		return nil
+	default:
+		return unsupportedBackend(conf.BackendStorage)
+	}
+}
+
+// DBFactory 根据配置不同返回不同的db对象，开启多租户时按请求的 Tenant-Id 隔离登记的各租户的数据。
+// 后端的后台任务(如清理过期数据)在ctx结束时退出
+func DBFactory(ctx context.Context, conf *config.Configs) (db.BackendStorage, error) {
+	var tenants []string
+	if conf.Tenant.Enable {
+		if len(conf.Tenant.IDs) == 0 {
+			return nil, errors.New("tenant enabled without any tenant ids")
 		}
-		return b, nil
+		tenants = conf.Tenant.IDs
+	}
+	var (
+		b   db.BackendStorage
+		err error
+	)
+	switch conf.BackendStorage {
+	case BackendES:
+		b, err = pes.NewEs(ctx, conf)
+	case BackendEtcd:
+		b, err = petcd.NewEtcd(conf)
+	case BackendMemory:
+		b, err = pmemory.NewMemory(ctx, conf)
 	default:
-		panic(fmt.Sprintf("Unsupported backend of: %s", conf.BackendStorage))
+		return nil, unsupportedBackend(conf.BackendStorage)
+	}
+	if err != nil {
+		return nil, err
 	}
+	t, ok := b.(db.Tenanted)
+	if !ok {
+		return nil, fmt.Errorf("backend storage %q does not support tenants", conf.BackendStorage)
+	}
+	return db.NewTenantStorage(ctx, t, tenants)
+}
+
+func unsupportedBackend(backend string) error {
+	return fmt.Errorf("unsupported backend storage: %q, expect one of %s, %s, %s",
+		backend, BackendES, BackendEtcd, BackendMemory)
 }
 
 // DataSet DataSet
@@ -37,3 +82,41 @@ type DataSet struct {
 	CreatedAt int64  `json:"created_at"`
 	DataType  string `json:"data_type"`
 }
+
+// History 值的修改记录，保存修改前的值
+type History struct {
+	ID      string `json:"id"`
+	Key     string `json:"key"`
+	Version string `json:"version"`
+	// UserID 用户级数据所属的用户，应用级数据为空
+	UserID string `json:"user_id"`
+	Value  string `json:"value"`
+	// Existed 修改前是否存在值
+	Existed      bool   `json:"existed"`
+	Operator     string `json:"operator"`
+	OperatorName string `json:"operator_name"`
+	CreatedAt    int64  `json:"created_at"`
+	// Seq 纳秒时间戳，同一毫秒内的多次修改按此排序
+	Seq int64 `json:"seq"`
+}
+
+// Schema 按key前缀或数据集类型注册的 JSON Schema，Prefix 与 DataSetType 二选一
+type Schema struct {
+	ID          string `json:"id"`
+	Prefix      string `json:"prefix"`
+	DataSetType *int64 `json:"dataset_type"`
+	Schema      string `json:"schema"`
+	CreatedAt   int64  `json:"created_at"`
+	DataType    string `json:"data_type"`
+}
+
+// Delivery 待投递的回调，保存在记录集合 db.CollectionDelivery 中，记录的 Seq 为下次投递的时间(纳秒)。
+// 投递成功或超过最大投递次数后删除
+type Delivery struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Payload 签名的请求体，重试时原样发送
+	Payload   string `json:"payload"`
+	Attempts  int    `json:"attempts"`
+	CreatedAt int64  `json:"created_at"`
+}
@@ -0,0 +1,246 @@
+package persona
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"git.internal.yunify.com/qxp/persona/pkg/code"
+	"git.internal.yunify.com/qxp/persona/pkg/db"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/error2"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/id2"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/json2"
+)
+
+// CloneApp 复制应用，源应用的所有数据(含版本)及引用的数据集写入目标应用，
+// 与 ImportData 一样全部写入或全部不生效
+func (p *persona) CloneApp(ctx context.Context, req *CloneAppReq) (*ImportDataResp, error) {
+	if req.SourceAppID == req.TargetAppID {
+		return nil, error2.NewError(code.InvalidParams)
+	}
+	datas, err := p.daoRepo.GetWithPrefix(ctx, appPrefix(req.SourceAppID))
+	if err != nil {
+		return nil, err
+	}
+	refs := newDataSetRefs()
+	for _, data := range datas {
+		refs.scan(data.Value)
+	}
+	dataSets, err := p.exportDataSets(ctx, refs)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.ImportData(ctx, &ImportDataReq{
+		SchemaVersion: ExportSchemaVersion,
+		AppID:         req.SourceAppID,
+		TargetAppID:   req.TargetAppID,
+		AppData:       datas,
+		DataSets:      dataSets,
+		DryRun:        req.DryRun,
+		Policy:        req.Policy,
+	})
+}
+
+// remapApp 将属于 req.AppID 的key改写到 req.TargetAppID 下，
+// 数据集复制为新的ID，并替换value中对原数据集的引用，req 本身不修改
+func remapApp(req *ImportDataReq) (*ImportDataReq, map[string]string) {
+	from, to := appPrefix(req.AppID), appPrefix(req.TargetAppID)
+
+	ids := make(map[string]string, len(req.DataSets))
+	dataSets := make([]*DataSetVo, 0, len(req.DataSets))
+	for _, dataSet := range req.DataSets {
+		clone := *dataSet
+		if dataSet.ID != "" {
+			clone.ID = id2.GenID()
+			ids[dataSet.ID] = clone.ID
+		}
+		dataSets = append(dataSets, &clone)
+	}
+
+	appData := make([]db.ImportReqData, 0, len(req.AppData))
+	for _, data := range req.AppData {
+		// 不属于源应用的key保持不变，之后按目标应用校验为不合法
+		if strings.HasPrefix(data.Key, from) {
+			data.Key = to + strings.TrimPrefix(data.Key, from)
+		}
+		// 只替换与原数据集ID完全相同的字符串值，与导出时识别引用的方式一致
+		data.Value = json2.ReplaceStrings(data.Value, func(s string) (string, bool) {
+			newID, ok := ids[s]
+			return newID, ok
+		})
+		appData = append(appData, data)
+	}
+
+	remapped := *req
+	remapped.AppID = req.TargetAppID
+	remapped.TargetAppID = ""
+	remapped.AppData = appData
+	remapped.DataSets = dataSets
+	return &remapped, ids
+}
+
+// BatchCloneValue 批量复制应用级key，Keys 与 Promote 二选一
+// Promote 将前缀下某个版本的所有key复制为另一个版本，如将draft发布为published
+func (p *persona) BatchCloneValue(ctx context.Context, req *BatchCloneValueReq) (*BatchCloneValueResp, error) {
+	policy := req.Policy
+	if policy == "" {
+		policy = PolicyOverwrite
+	}
+	if policy != PolicyOverwrite && policy != PolicySkip {
+		return nil, error2.NewError(code.InvalidParams)
+	}
+	if (len(req.Keys) == 0) == (req.Promote == nil) {
+		return nil, error2.NewError(code.InvalidParams)
+	}
+
+	pairs := req.Keys
+	if req.Promote != nil {
+		var err error
+		if pairs, err = p.promotePairs(ctx, req.Promote); err != nil {
+			return nil, err
+		}
+	}
+	return p.cloneValues(ctx, pairs, policy), nil
+}
+
+// promotePairs 遍历前缀下属于 From 版本的key，生成到 To 版本的复制
+func (p *persona) promotePairs(ctx context.Context, req *PromoteVersionReq) ([]CloneValueReq, error) {
+	if req.From == req.To {
+		return nil, error2.NewError(code.InvalidParams)
+	}
+	pairs := make([]CloneValueReq, 0)
+	err := p.daoRepo.WalkWithPrefix(ctx, req.Prefix, func(data db.ImportReqData) error {
+		if key, ok := trimVersion(data, req.From); ok {
+			pairs = append(pairs, CloneValueReq{
+				Key:    VersionKey{Version: req.From, Key: key},
+				NewKey: VersionKey{Version: req.To, Key: key},
+			})
+		}
+		return nil
+	})
+	return pairs, err
+}
+
+// trimVersion 存储中的key为 {key}_{version}，属于该版本时返回去掉版本的key
+// 存储中有版本信息时以其为准，避免版本号本身含有 "_" 时误判
+func trimVersion(data db.ImportReqData, version string) (string, bool) {
+	suffix := "_" + version
+	if !strings.HasSuffix(data.Key, suffix) || (data.Version != "" && data.Version != version) {
+		return "", false
+	}
+	return strings.TrimSuffix(data.Key, suffix), true
+}
+
+// cloneValues 读取源key后批量写入目标key，并记录每个目标key的结果
+// 源key不存在或策略为skip且目标key已存在时跳过
+func (p *persona) cloneValues(ctx context.Context, pairs []CloneValueReq, policy string) *BatchCloneValueResp {
+	resp := &BatchCloneValueResp{
+		Copied:  make([]string, 0),
+		Skipped: make([]string, 0),
+		Failed:  make([]string, 0),
+		Status:  make([]*KeyStatus, 0, len(pairs)),
+	}
+	keys := make([]db.VersionKV, 0, len(pairs))
+	for _, pair := range pairs {
+		keys = append(keys, db.VersionKV{
+			Version: pair.Key.Version,
+			Key:     pair.Key.Key,
+		})
+		resp.Status = append(resp.Status, &KeyStatus{
+			Key:     pair.NewKey.Key,
+			Version: pair.NewKey.Version,
+		})
+	}
+	if len(pairs) == 0 {
+		return resp
+	}
+
+	values, err := p.daoRepo.MultiGetWithVersion(ctx, keys)
+	writes := make([]db.VersionKV, 0, len(pairs))
+	owners := make([]*KeyStatus, 0, len(pairs))
+	for i, pair := range pairs {
+		status := resp.Status[i]
+		switch {
+		case err != nil:
+			status.withError(ctx, err)
+			resp.Failed = append(resp.Failed, status.Key)
+		case values[i].Err != nil:
+			status.withError(ctx, values[i].Err)
+			resp.Failed = append(resp.Failed, status.Key)
+		case !values[i].Found:
+			status.Status = StatusNotFound
+			resp.Skipped = append(resp.Skipped, status.Key)
+		default:
+			kv := db.VersionKV{
+				Version: pair.NewKey.Version,
+				Key:     pair.NewKey.Key,
+				Value:   values[i].Value,
+			}
+			// 只在目标key不存在时写入，已存在时写入失败即跳过
+			if policy == PolicySkip {
+				kv.Revision = db.RevisionNotExist
+			}
+			writes = append(writes, kv)
+			owners = append(owners, status)
+		}
+	}
+	if len(writes) == 0 {
+		return resp
+	}
+
+	results, err := p.writeValues(ctx, p.appScope(), writes)
+	for i, status := range owners {
+		switch {
+		case err != nil:
+			status.withError(ctx, err)
+			resp.Failed = append(resp.Failed, status.Key)
+		case policy == PolicySkip && errors.Is(results[i].Err, db.ErrRevisionConflict):
+			status.Status = StatusSkipped
+			resp.Skipped = append(resp.Skipped, status.Key)
+		case results[i].Err != nil:
+			status.withError(ctx, results[i].Err)
+			resp.Failed = append(resp.Failed, status.Key)
+		default:
+			status.Status = StatusSuccess
+			status.Revision = results[i].Revision
+			resp.Copied = append(resp.Copied, status.Key)
+		}
+	}
+	return resp
+}
+
+// BatchCloneValueReq req
+type BatchCloneValueReq struct {
+	Keys    []CloneValueReq    `json:"keys"`
+	Promote *PromoteVersionReq `json:"promote"`
+	// Policy 目标key已存在时的处理方式: overwrite(默认)、skip
+	Policy string `json:"policy"`
+}
+
+// PromoteVersionReq 将 Prefix 下 From 版本的所有key复制为 To 版本
+type PromoteVersionReq struct {
+	Prefix string `json:"prefix" binding:"required"`
+	From   string `json:"from" binding:"required"`
+	To     string `json:"to" binding:"required"`
+}
+
+// BatchCloneValueResp resp
+// Status 为目标key的结果，顺序与请求一致，Promote 时按遍历顺序
+type BatchCloneValueResp struct {
+	Copied  []string     `json:"copied"`
+	Skipped []string     `json:"skipped"`
+	Failed  []string     `json:"failed"`
+	Status  []*KeyStatus `json:"status"`
+}
+
+// CloneAppReq req
+type CloneAppReq struct {
+	// SourceAppID 复制范围与 ExportDataReq 一致
+	SourceAppID string `json:"sourceAppId" binding:"required"`
+	TargetAppID string `json:"targetAppId" binding:"required"`
+	// DryRun 只校验，不写入
+	DryRun bool `json:"dryRun"`
+	// Policy 目标应用中key已存在时的处理方式，同 ImportDataReq
+	Policy string `json:"policy"`
+}
@@ -0,0 +1,139 @@
+package persona
+
+import (
+	"context"
+	"encoding/json"
+
+	"git.internal.yunify.com/qxp/persona/pkg/db"
+	"git.internal.yunify.com/qxp/persona/pkg/db/elasticsearch"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/json2"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/time2"
+
+	"github.com/google/uuid"
+)
+
+// ExportSchemaVersion 导出数据格式的版本
+// 0: 只有appData，不含版本信息及数据集
+// 1: 增加schemaVersion、appId、exportedAt、dataSets，appData包含版本信息
+const ExportSchemaVersion = 1
+
+// ExportData 导出应用级数据，以及被这些数据引用或指定的数据集
+func (p *persona) ExportData(ctx context.Context, req *ExportDataReq) (*ExportDataResp, error) {
+	datas := make([]db.ImportReqData, 0)
+	resp, err := p.StreamExportData(ctx, req, func(data db.ImportReqData) error {
+		datas = append(datas, data)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp.AppData = datas
+	return resp, nil
+}
+
+// StreamExportData 逐条导出appData，数据不在内存中堆积，返回的结果不含appData，
+// 范围与 ExportData 一致
+func (p *persona) StreamExportData(ctx context.Context, req *ExportDataReq, fn db.WalkFunc) (*ExportDataResp, error) {
+	exportedAt := time2.NowUnix()
+	refs := newDataSetRefs(req.DataSetIDs...)
+	err := p.daoRepo.WalkWithPrefix(ctx, appPrefix(req.AppID), func(data db.ImportReqData) error {
+		refs.scan(data.Value)
+		return fn(data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	dataSets, err := p.exportDataSets(ctx, refs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ExportDataResp{
+		SchemaVersion: ExportSchemaVersion,
+		AppID:         req.AppID,
+		ExportedAt:    exportedAt,
+		DataSets:      dataSets,
+	}, nil
+}
+
+// appPrefix 应用级key的前缀 app_id:{appID}:，导出、导入、复制及删除应用均以此为范围。
+// 旧版本以 app_id:{appID} 为前缀，会包含 app_id:42_x、app_id:420:k 等不属于应用42的key，现在不再包含
+func appPrefix(appID string) string {
+	return "app_id:" + appID + ":"
+}
+
+// dataSetRefs 可能被引用的数据集ID，按首次出现的顺序保存
+type dataSetRefs struct {
+	seen map[string]bool
+	ids  []string
+}
+
+func newDataSetRefs(ids ...string) *dataSetRefs {
+	refs := &dataSetRefs{seen: make(map[string]bool)}
+	for _, id := range ids {
+		refs.add(id)
+	}
+	return refs
+}
+
+func (r *dataSetRefs) add(id string) {
+	if id == "" || r.seen[id] {
+		return
+	}
+	r.seen[id] = true
+	r.ids = append(r.ids, id)
+}
+
+// scan 数据集通过ID引用，value中与数据集ID格式一致的字符串值均视为可能的引用
+func (r *dataSetRefs) scan(value string) {
+	for _, s := range json2.Strings(value) {
+		if _, err := uuid.Parse(s); err == nil {
+			r.add(s)
+		}
+	}
+}
+
+// exportDataSets 数据集不属于某个应用，按ID逐个查询被引用或指定的数据集，不存在的ID忽略
+func (p *persona) exportDataSets(ctx context.Context, refs *dataSetRefs) ([]*DataSetVo, error) {
+	list := make([]*DataSetVo, 0)
+	for _, id := range refs.ids {
+		id := id
+		data, err := p.daoRepo.GetData(&ctx, &id)
+		if err != nil {
+			return nil, err
+		}
+		if data == nil {
+			continue
+		}
+		var dataSet struct {
+			DataSetVo
+			DataType string `json:"data_type"`
+		}
+		if err := json.Unmarshal(*data, &dataSet); err != nil {
+			return nil, err
+		}
+		if dataSet.DataType != elasticsearch.TypeOfDataSet {
+			continue
+		}
+		list = append(list, &dataSet.DataSetVo)
+	}
+	return list, nil
+}
+
+// ExportDataReq req
+type ExportDataReq struct {
+	// AppID 导出以 app_id:{AppID}: 开头的key，不包含 app_id:{AppID}_x 等只以应用ID开头的key
+	AppID string `json:"appId" binding:"required"`
+	// DataSetIDs 需要一并导出的数据集，被应用数据引用的数据集会自动导出
+	DataSetIDs []string `json:"dataSetIds"`
+}
+
+// ExportDataResp resp，可直接作为 ImportDataReq 导入
+type ExportDataResp struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	AppID         string `json:"appId"`
+	ExportedAt    int64  `json:"exportedAt"`
+	// AppData 流式导出时单独写入
+	AppData  []db.ImportReqData `json:"appData,omitempty"`
+	DataSets []*DataSetVo       `json:"dataSets"`
+}
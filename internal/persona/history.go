@@ -0,0 +1,358 @@
+package persona
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.internal.yunify.com/qxp/persona/internal/model"
+	"git.internal.yunify.com/qxp/persona/pkg/code"
+	"git.internal.yunify.com/qxp/persona/pkg/config"
+	"git.internal.yunify.com/qxp/persona/pkg/db"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/error2"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/id2"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/logger"
+)
+
+const (
+	// defaultHistoryLimit 未配置时每个key保留的修改记录条数
+	defaultHistoryLimit = 100
+	// defaultHistoryTrimInterval 未配置时清理修改记录的间隔
+	defaultHistoryTrimInterval = time.Minute
+	// defaultHistoryPageSize 未指定时每页返回的修改记录条数
+	defaultHistoryPageSize = 20
+	// maxHistoryPageSize 每页最多返回的修改记录条数
+	maxHistoryPageSize = 100
+)
+
+// recordHistory 以一次批量写入记录kvs的修改前的值，失败时只记录日志，不影响写入结果。
+// 超出 History.Limit 的记录由 historyTrimmer 在后台清理
+func (p *persona) recordHistory(ctx context.Context, s *scope, kvs []db.VersionKV, olds []db.GetResult) {
+	if len(kvs) == 0 {
+		return
+	}
+	header := logger.STDHeader(ctx)
+	records := make([]db.Record, 0, len(kvs))
+	groups := make([]string, 0, len(kvs))
+	for i, kv := range kvs {
+		now := time.Now()
+		history := model.History{
+			ID:           id2.GenID(),
+			Key:          kv.Key,
+			Version:      kv.Version,
+			UserID:       s.userID,
+			Value:        olds[i].Value,
+			Existed:      olds[i].Found,
+			Operator:     header["User-Id"],
+			OperatorName: header["User-Name"],
+			CreatedAt:    now.UnixNano() / int64(time.Millisecond),
+			Seq:          now.UnixNano(),
+		}
+		value, err := json.Marshal(history)
+		if err != nil {
+			logger.Logger.Errorw(err.Error(), logger.STDRequestID(ctx))
+			continue
+		}
+		group := historyGroup(s.userID, kv.Version, kv.Key)
+		records = append(records, db.Record{
+			Group: group,
+			ID:    history.ID,
+			Seq:   history.Seq,
+			Users: historyUsers(history),
+			Value: value,
+		})
+		groups = append(groups, group)
+	}
+	if err := p.daoRepo.PutRecords(ctx, db.CollectionHistory, records); err != nil {
+		logger.Logger.Errorw(err.Error(), logger.STDRequestID(ctx))
+		return
+	}
+	p.trimmer.mark(ctx, groups)
+}
+
+// historyTrimmer 登记写入过修改记录的分组，后台定期清理超出保留条数的记录，
+// 避免每次写入都逐个分组清理
+type historyTrimmer struct {
+	conf    *config.Configs
+	daoRepo db.BackendStorage
+	mu      sync.Mutex
+	// pending 租户 -> 待清理的分组
+	pending map[string]map[string]bool
+}
+
+func newHistoryTrimmer(conf *config.Configs, daoRepo db.BackendStorage) *historyTrimmer {
+	return &historyTrimmer{
+		conf:    conf,
+		daoRepo: daoRepo,
+		pending: make(map[string]map[string]bool),
+	}
+}
+
+// mark 登记ctx所属租户待清理的分组
+func (t *historyTrimmer) mark(ctx context.Context, groups []string) {
+	tenant := logger.STDHeader(ctx)[db.TenantHeader]
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pending[tenant] == nil {
+		t.pending[tenant] = make(map[string]bool)
+	}
+	for _, g := range groups {
+		t.pending[tenant][g] = true
+	}
+}
+
+// run 每隔 History.TrimInterval 秒清理一次，ctx结束时退出
+func (t *historyTrimmer) run(ctx context.Context) {
+	ticker := time.NewTicker(t.interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.trim(ctx)
+		}
+	}
+}
+
+// trim 清理登记的分组，每个分组只保留最近的 History.Limit 条记录，清理失败的分组重新登记
+func (t *historyTrimmer) trim(ctx context.Context) {
+	t.mu.Lock()
+	pending := t.pending
+	t.pending = make(map[string]map[string]bool)
+	t.mu.Unlock()
+
+	for tenant, groups := range pending {
+		tenantCtx := ctx
+		if tenant != "" {
+			tenantCtx = db.WithTenant(ctx, tenant)
+		}
+		failed := make([]string, 0)
+		for group := range groups {
+			if _, err := t.daoRepo.TrimRecords(tenantCtx, db.CollectionHistory, group, t.limit()); err != nil {
+				logger.Logger.Errorw("trim history: " + err.Error())
+				failed = append(failed, group)
+			}
+		}
+		t.mark(tenantCtx, failed)
+	}
+}
+
+// limit 每个key保留的修改记录条数
+func (t *historyTrimmer) limit() int {
+	if t.conf == nil || t.conf.History.Limit <= 0 {
+		return defaultHistoryLimit
+	}
+	return t.conf.History.Limit
+}
+
+// interval 清理的间隔
+func (t *historyTrimmer) interval() time.Duration {
+	if t.conf == nil || t.conf.History.TrimInterval <= 0 {
+		return defaultHistoryTrimInterval
+	}
+	return time.Duration(t.conf.History.TrimInterval) * time.Second
+}
+
+// historyGroup 修改记录按用户、版本及key分组，应用级数据的用户为空
+func historyGroup(userID string, version string, key string) string {
+	group, _ := json.Marshal([]string{userID, version, key})
+	return string(group)
+}
+
+// historyUsers 数据所属的用户及操作人，删除用户数据时按此查找
+func historyUsers(h model.History) []string {
+	users := make([]string, 0, 2)
+	if h.UserID != "" {
+		users = append(users, h.UserID)
+	}
+	if h.Operator != "" && h.Operator != h.UserID {
+		users = append(users, h.Operator)
+	}
+	return users
+}
+
+// ListHistory 应用级key的修改记录
+func (p *persona) ListHistory(ctx context.Context, req *ListHistoryReq) (*ListHistoryResp, error) {
+	return p.listHistory(ctx, req, p.appScope())
+}
+
+// UserListHistory 当前用户key的修改记录
+func (p *persona) UserListHistory(ctx context.Context, req *ListHistoryReq) (*ListHistoryResp, error) {
+	return p.listHistory(ctx, req, p.userScope(ctx))
+}
+
+// Rollback 将应用级key回滚到某条修改记录之前的值
+func (p *persona) Rollback(ctx context.Context, req *RollbackReq) (*RollbackResp, error) {
+	return p.rollback(ctx, req, p.appScope())
+}
+
+// UserRollback 将当前用户的key回滚到某条修改记录之前的值
+func (p *persona) UserRollback(ctx context.Context, req *RollbackReq) (*RollbackResp, error) {
+	return p.rollback(ctx, req, p.userScope(ctx))
+}
+
+// listHistory 按时间倒序分页返回修改记录
+func (p *persona) listHistory(ctx context.Context, req *ListHistoryReq, s *scope) (*ListHistoryResp, error) {
+	q := db.RecordQuery{
+		Group: historyGroup(s.userID, req.Version, req.Key),
+		Desc:  true,
+		Limit: historyPageSize(req.Limit),
+	}
+	if req.Cursor != "" {
+		after, err := parseHistoryCursor(req.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		q.After = after
+	}
+	records, err := p.daoRepo.ListRecords(ctx, db.CollectionHistory, q)
+	if err != nil {
+		return nil, err
+	}
+	resp := &ListHistoryResp{List: make([]*HistoryVo, 0, len(records))}
+	for _, r := range records {
+		var h model.History
+		if err := json.Unmarshal(r.Value, &h); err != nil {
+			return nil, err
+		}
+		resp.List = append(resp.List, historyVo(h))
+	}
+	if len(records) == q.Limit {
+		last := records[len(records)-1]
+		resp.Cursor = fmt.Sprintf("%d_%s", last.Seq, last.ID)
+	}
+	return resp, nil
+}
+
+func historyPageSize(limit int) int {
+	switch {
+	case limit <= 0:
+		return defaultHistoryPageSize
+	case limit > maxHistoryPageSize:
+		return maxHistoryPageSize
+	}
+	return limit
+}
+
+// parseHistoryCursor 游标格式为 {seq}_{id}
+func parseHistoryCursor(cursor string) (*db.Record, error) {
+	parts := strings.SplitN(cursor, "_", 2)
+	if len(parts) != 2 {
+		return nil, error2.NewError(code.InvalidParams)
+	}
+	seq, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, error2.NewError(code.InvalidParams)
+	}
+	return &db.Record{Seq: seq, ID: parts[1]}, nil
+}
+
+func historyVo(h model.History) *HistoryVo {
+	return &HistoryVo{
+		ID:           h.ID,
+		Key:          h.Key,
+		Version:      h.Version,
+		Value:        h.Value,
+		Existed:      h.Existed,
+		Operator:     h.Operator,
+		OperatorName: h.OperatorName,
+		CreatedAt:    h.CreatedAt,
+	}
+}
+
+// rollback 以修改记录中的值重新写入，修改前key不存在时删除key，回滚本身也会产生修改记录
+func (p *persona) rollback(ctx context.Context, req *RollbackReq, s *scope) (*RollbackResp, error) {
+	record, err := p.daoRepo.GetRecord(ctx, db.CollectionHistory, historyGroup(s.userID, req.Version, req.Key), req.ID)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, error2.NewError(code.Rollback)
+	}
+	var history model.History
+	if err := json.Unmarshal(record.Value, &history); err != nil {
+		return nil, err
+	}
+	if !history.Existed {
+		results, err := p.removeValues(ctx, s, []db.VersionKV{{
+			Version: history.Version,
+			Key:     history.Key,
+		}})
+		if err != nil {
+			return nil, err
+		}
+		if results[0].Err != nil {
+			return nil, results[0].Err
+		}
+		return &RollbackResp{
+			Revision: db.RevisionNotExist,
+			Deleted:  true,
+		}, nil
+	}
+
+	results, err := p.writeValues(ctx, s, []db.VersionKV{{
+		Version: history.Version,
+		Key:     history.Key,
+		Value:   history.Value,
+	}})
+	if err != nil {
+		return nil, err
+	}
+	if results[0].Err != nil {
+		return nil, results[0].Err
+	}
+	return &RollbackResp{
+		Value:    history.Value,
+		Revision: results[0].Revision,
+	}, nil
+}
+
+// ListHistoryReq req
+type ListHistoryReq struct {
+	Version string `json:"version" binding:"required"`
+	Key     string `json:"key" binding:"required"`
+	// Limit 每页条数，默认20，最大100
+	Limit int `json:"limit"`
+	// Cursor 上一页返回的游标，为空时从最新的记录开始
+	Cursor string `json:"cursor"`
+}
+
+// ListHistoryResp resp
+type ListHistoryResp struct {
+	// List 按时间倒序
+	List []*HistoryVo `json:"list"`
+	// Cursor 下一页的游标，为空时没有更多记录
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// HistoryVo 修改记录，Value为修改前的值
+type HistoryVo struct {
+	ID           string `json:"id"`
+	Key          string `json:"key"`
+	Version      string `json:"version"`
+	Value        string `json:"value"`
+	Existed      bool   `json:"existed"`
+	Operator     string `json:"operator"`
+	OperatorName string `json:"operatorName"`
+	CreatedAt    int64  `json:"createdAt"`
+}
+
+// RollbackReq req
+type RollbackReq struct {
+	Version string `json:"version" binding:"required"`
+	Key     string `json:"key" binding:"required"`
+	// ID 修改记录的ID，回滚到该次修改之前的值
+	ID string `json:"id" binding:"required"`
+}
+
+// RollbackResp resp，回滚到key不存在时 Deleted 为true
+type RollbackResp struct {
+	Value    string `json:"value"`
+	Revision string `json:"revision"`
+	Deleted  bool   `json:"deleted"`
+}
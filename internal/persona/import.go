@@ -0,0 +1,339 @@
+package persona
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"git.internal.yunify.com/qxp/persona/internal/model"
+	"git.internal.yunify.com/qxp/persona/pkg/code"
+	"git.internal.yunify.com/qxp/persona/pkg/db"
+	"git.internal.yunify.com/qxp/persona/pkg/db/elasticsearch"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/error2"
+)
+
+const (
+	// PolicyOverwrite key已存在时覆盖
+	PolicyOverwrite = "overwrite"
+	// PolicySkip key已存在时跳过
+	PolicySkip = "skip"
+	// PolicyFail key已存在时整体导入失败
+	PolicyFail = "fail"
+)
+
+const (
+	// StatusCreated 新建的key
+	StatusCreated = "created"
+	// StatusOverwritten 覆盖已存在的key
+	StatusOverwritten = "overwritten"
+	// StatusSkipped 已存在而跳过的key
+	StatusSkipped = "skipped"
+	// StatusConflict 已存在且冲突策略为fail
+	StatusConflict = "conflict"
+	// StatusInvalid 数据不合法
+	StatusInvalid = "invalid"
+)
+
+// ImportData 导入应用数据及数据集，先校验所有数据，全部合法且无冲突时写入，
+// 全部写入或全部不生效。DryRun 时只返回每个key将执行的操作。
+// 兼容 schemaVersion 为0(只有appData)的旧格式
+func (p *persona) ImportData(ctx context.Context, req *ImportDataReq) (*ImportDataResp, error) {
+	policy := req.Policy
+	if policy == "" {
+		policy = PolicyOverwrite
+	}
+	if policy != PolicyOverwrite && policy != PolicySkip && policy != PolicyFail {
+		return nil, error2.NewError(code.InvalidParams)
+	}
+	if req.SchemaVersion < 0 || req.SchemaVersion > ExportSchemaVersion {
+		return nil, error2.NewError(code.InvalidParams)
+	}
+
+	resp := &ImportDataResp{}
+	if req.TargetAppID != "" {
+		if req.AppID == "" || req.AppID == req.TargetAppID {
+			return nil, error2.NewError(code.InvalidParams)
+		}
+		req, resp.DataSetIDs = remapApp(req)
+	}
+	resp.Status = make([]*KeyStatus, 0, len(req.AppData))
+	resp.DataSetStatus = make([]*KeyStatus, 0, len(req.DataSets))
+	schemas, err := p.loadSchemas(ctx)
+	if err != nil {
+		return nil, err
+	}
+	writes, owners, olds, ok, err := p.checkAppData(ctx, req, policy, schemas, resp)
+	if err != nil {
+		return nil, err
+	}
+	dataSets, dataSetsOK := p.checkDataSets(ctx, req, policy, schemas, resp)
+	if !ok || !dataSetsOK || req.DryRun {
+		return resp, nil
+	}
+
+	// 数据集不支持事务，先写入数据集，kv写入失败时恢复
+	if err := p.putDataSets(ctx, dataSets); err != nil {
+		return nil, err
+	}
+	results, err := p.daoRepo.TxnPut(ctx, writes)
+	if err != nil {
+		if e := p.restoreDataSets(ctx, dataSets); e != nil {
+			return nil, e
+		}
+	}
+	if err == db.ErrAborted {
+		for i, r := range results {
+			owners[i].withError(ctx, r.Err)
+		}
+		return resp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i, r := range results {
+		owners[i].Revision = r.Revision
+	}
+	p.feed.publish(ctx, "", importEvents(writes, results))
+	p.webhook.notify(ctx, importHooks(writes, olds, dataSets))
+	resp.Committed = true
+	return resp, nil
+}
+
+// importHooks 导入的kv及数据集的回调事件
+func importHooks(writes []db.VersionKV, olds []db.GetResult, dataSets []*dataSetWrite) []*WebhookEvent {
+	events := make([]*WebhookEvent, 0, len(writes)+len(dataSets))
+	for i, w := range writes {
+		key := w.Key
+		if k, ok := trimVersion(db.ImportReqData{Key: w.Key, Version: w.Version}, w.Version); w.Version != "" && ok {
+			key = k
+		}
+		events = append(events, &WebhookEvent{
+			Operation: OpImport,
+			Key:       key,
+			Version:   w.Version,
+			OldHash:   valueHash(olds[i].Value, olds[i].Found),
+			NewHash:   valueHash(w.Value, true),
+		})
+	}
+	for _, w := range dataSets {
+		op := OpDataSetUpdate
+		if w.old == nil {
+			op = OpDataSetCreate
+		}
+		events = append(events, &WebhookEvent{
+			Operation: op,
+			Key:       w.dataSet.ID,
+			OldHash:   dataSetHash(w.old),
+			NewHash:   valueHash(w.dataSet.Content, true),
+		})
+	}
+	return events
+}
+
+// importEvents 导入的kv的变更，存储中的key为 {key}_{version}，没有版本信息的无法通知
+func importEvents(writes []db.VersionKV, results []db.PutResult) []db.WatchEvent {
+	kvs := make([]db.VersionKV, 0, len(writes))
+	puts := make([]db.PutResult, 0, len(writes))
+	for i, w := range writes {
+		key, ok := trimVersion(db.ImportReqData{Key: w.Key, Version: w.Version}, w.Version)
+		if w.Version == "" || !ok {
+			continue
+		}
+		kvs = append(kvs, db.VersionKV{Key: key, Version: w.Version, Value: w.Value})
+		puts = append(puts, results[i])
+	}
+	return putEvents(kvs, puts)
+}
+
+// checkAppData 校验kv数据并确定每个key的操作，返回需要写入的数据、其状态及写入前的值
+func (p *persona) checkAppData(ctx context.Context, req *ImportDataReq, policy string, schemas *schemas, resp *ImportDataResp) ([]db.VersionKV, []*KeyStatus, []db.GetResult, bool, error) {
+	prefix := appPrefix(req.AppID)
+	// valid 合法数据在AppData中的位置
+	valid := make([]int, 0, len(req.AppData))
+	keys := make([]string, 0, len(req.AppData))
+	seen := make(map[string]bool, len(req.AppData))
+	ok := true
+	for i, data := range req.AppData {
+		status := &KeyStatus{Key: data.Key, Version: data.Version}
+		resp.Status = append(resp.Status, status)
+		if data.Key == "" || seen[data.Key] || (req.AppID != "" && !strings.HasPrefix(data.Key, prefix)) {
+			status.withCode(StatusInvalid, code.InvalidParams)
+			ok = false
+			continue
+		}
+		if err := schemas.validateValue(data.Key, data.Value); err != nil {
+			status.invalid(ctx, err)
+			ok = false
+			continue
+		}
+		seen[data.Key] = true
+		valid = append(valid, i)
+		keys = append(keys, data.Key)
+	}
+
+	olds, err := p.daoRepo.MultiGet(ctx, keys)
+	if err != nil {
+		return nil, nil, nil, false, err
+	}
+	writes := make([]db.VersionKV, 0, len(valid))
+	owners := make([]*KeyStatus, 0, len(valid))
+	found := make([]db.GetResult, 0, len(valid))
+	for j, i := range valid {
+		data, status, old := req.AppData[i], resp.Status[i], olds[j]
+		if old.Err != nil {
+			status.withError(ctx, old.Err)
+			ok = false
+			continue
+		}
+		if !resp.apply(status, old.Found, policy) {
+			ok = ok && status.Status != StatusConflict
+			continue
+		}
+		// 校验之后被他人修改过的key导致整体失败
+		writes = append(writes, db.VersionKV{
+			Version:  data.Version,
+			Key:      data.Key,
+			Value:    data.Value,
+			Revision: old.Revision,
+		})
+		owners = append(owners, status)
+		found = append(found, old)
+	}
+	return writes, owners, found, ok, nil
+}
+
+// dataSetWrite 待写入的数据集及写入前的内容，用于恢复
+type dataSetWrite struct {
+	dataSet *DataSetVo
+	old     *json.RawMessage
+}
+
+// checkDataSets 校验数据集并确定每个数据集的操作，数据集保留原ID以保证kv中的引用有效
+func (p *persona) checkDataSets(ctx context.Context, req *ImportDataReq, policy string, schemas *schemas, resp *ImportDataResp) ([]*dataSetWrite, bool) {
+	writes := make([]*dataSetWrite, 0, len(req.DataSets))
+	seen := make(map[string]bool, len(req.DataSets))
+	ok := true
+	for _, dataSet := range req.DataSets {
+		status := &KeyStatus{Key: dataSet.ID}
+		resp.DataSetStatus = append(resp.DataSetStatus, status)
+		if dataSet.ID == "" || seen[dataSet.ID] {
+			status.withCode(StatusInvalid, code.InvalidParams)
+			ok = false
+			continue
+		}
+		if err := schemas.validateDataSet(dataSet.Type, dataSet.Content); err != nil {
+			status.invalid(ctx, err)
+			ok = false
+			continue
+		}
+		seen[dataSet.ID] = true
+
+		old, err := p.daoRepo.GetData(&ctx, &dataSet.ID)
+		if err != nil {
+			status.withError(ctx, err)
+			ok = false
+			continue
+		}
+		if !resp.apply(status, old != nil, policy) {
+			ok = ok && status.Status != StatusConflict
+			continue
+		}
+		writes = append(writes, &dataSetWrite{dataSet: dataSet, old: old})
+	}
+	return writes, ok
+}
+
+// putDataSets 写入数据集，失败时恢复已写入的数据集
+func (p *persona) putDataSets(ctx context.Context, writes []*dataSetWrite) error {
+	for i, w := range writes {
+		dataSet := model.DataSet{
+			ID:        w.dataSet.ID,
+			Name:      w.dataSet.Name,
+			Tag:       w.dataSet.Tag,
+			Type:      w.dataSet.Type,
+			Content:   w.dataSet.Content,
+			CreatedAt: w.dataSet.CreatedAt,
+			DataType:  elasticsearch.TypeOfDataSet,
+		}
+		if err := p.daoRepo.PutData(&ctx, &dataSet.ID, dataSet); err != nil {
+			if e := p.restoreDataSets(ctx, writes[:i]); e != nil {
+				return e
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreDataSets 将数据集恢复为写入前的内容，写入前不存在的删除
+func (p *persona) restoreDataSets(ctx context.Context, writes []*dataSetWrite) error {
+	for _, w := range writes {
+		var err error
+		if w.old == nil {
+			err = p.daoRepo.DeleteData(&ctx, &w.dataSet.ID)
+		} else {
+			err = p.daoRepo.PutData(&ctx, &w.dataSet.ID, w.old)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// invalid 记录不合法数据的错误
+func (s *KeyStatus) invalid(ctx context.Context, err error) {
+	s.withError(ctx, err)
+	s.Status = StatusInvalid
+}
+
+// apply 根据是否已存在及冲突策略设置状态并计数，返回是否需要写入
+func (r *ImportDataResp) apply(status *KeyStatus, found bool, policy string) bool {
+	switch {
+	case !found:
+		status.Status = StatusCreated
+		r.Created++
+	case policy == PolicySkip:
+		status.Status = StatusSkipped
+		r.Skipped++
+		return false
+	case policy == PolicyFail:
+		status.withCode(StatusConflict, code.ImportConflict)
+		return false
+	default:
+		status.Status = StatusOverwritten
+		r.Overwritten++
+	}
+	return true
+}
+
+// ImportDataReq req，与 ExportDataResp 格式一致
+type ImportDataReq struct {
+	// SchemaVersion 导出格式的版本，旧格式为0
+	SchemaVersion int `json:"schemaVersion"`
+	// AppID 不为空时所有key必须以 app_id:{AppID}: 开头
+	AppID string `json:"appId"`
+	// TargetAppID 不为空时将 AppID 的数据导入到该应用下，数据集复制为新的ID
+	TargetAppID string             `json:"targetAppId"`
+	ExportedAt  int64              `json:"exportedAt"`
+	AppData     []db.ImportReqData `json:"appData" binding:"required"`
+	DataSets    []*DataSetVo       `json:"dataSets"`
+	// DryRun 只校验，不写入
+	DryRun bool `json:"dryRun"`
+	// Policy key或数据集已存在时的处理方式: overwrite(默认)、skip、fail
+	Policy string `json:"policy"`
+}
+
+// ImportDataResp resp
+// Status 与 AppData 顺序一致，DataSetStatus 与 DataSets 顺序一致，DryRun 时表示将执行的操作
+type ImportDataResp struct {
+	// Committed 是否已写入，DryRun、校验失败或写入失败时为false
+	Committed     bool         `json:"committed"`
+	Created       int          `json:"created"`
+	Overwritten   int          `json:"overwritten"`
+	Skipped       int          `json:"skipped"`
+	Status        []*KeyStatus `json:"status"`
+	DataSetStatus []*KeyStatus `json:"dataSetStatus"`
+	// DataSetIDs 指定 TargetAppID 时原数据集ID到新ID的映射
+	DataSetIDs map[string]string `json:"dataSetIds,omitempty"`
+}
@@ -0,0 +1,162 @@
+package persona
+
+import (
+	"context"
+	"errors"
+
+	"git.internal.yunify.com/qxp/persona/pkg/code"
+	"git.internal.yunify.com/qxp/persona/pkg/db"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/error2"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/json2"
+)
+
+const (
+	// PatchMerge value 为 JSON Merge Patch(RFC 7396)
+	PatchMerge = "merge"
+	// PatchJSON value 为 JSON Patch(RFC 6902)
+	PatchJSON = "json"
+)
+
+// patchRetries 未指定修订号的补丁因并发修改冲突时的最大尝试次数
+const patchRetries = 3
+
+// putValues 批量写入，带补丁的key先读取当前值并应用补丁，以读取时的修订号写入，
+// 未指定修订号的补丁冲突时重新读取并重试，不会覆盖他人的修改；
+// 写入前按key前缀的 JSON Schema 校验最终的值
+func (p *persona) putValues(ctx context.Context, s *scope, values []VersionKeyValue, kvs []db.VersionKV) ([]db.PutResult, error) {
+	schemas, err := p.loadSchemas(ctx)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]db.PutResult, len(kvs))
+	pending := make([]int, 0, len(kvs))
+	for i := range kvs {
+		pending = append(pending, i)
+	}
+	for attempt := 1; len(pending) > 0; attempt++ {
+		if err := p.applyPatches(ctx, s, values, kvs, pending, results); err != nil {
+			return nil, err
+		}
+		for _, i := range pending {
+			if results[i].Err == nil {
+				results[i].Err = schemas.validateValue(kvs[i].Key, kvs[i].Value)
+			}
+		}
+		writes := make([]db.VersionKV, 0, len(pending))
+		owners := make([]int, 0, len(pending))
+		for _, i := range pending {
+			if results[i].Err == nil {
+				writes = append(writes, kvs[i])
+				owners = append(owners, i)
+			}
+		}
+		if len(writes) == 0 {
+			break
+		}
+		puts, err := p.writeValues(ctx, s, writes)
+		if err != nil {
+			return nil, err
+		}
+
+		retry := make([]int, 0)
+		for j, i := range owners {
+			results[i] = puts[j]
+			if values[i].PatchType != "" && values[i].Revision == "" &&
+				errors.Is(puts[j].Err, db.ErrRevisionConflict) && attempt < patchRetries {
+				retry = append(retry, i)
+			}
+		}
+		pending = retry
+	}
+	return results, nil
+}
+
+// applyPatches 读取 pending 中带补丁的key的当前值，将应用补丁后的值写入kvs，失败原因记录在results
+func (p *persona) applyPatches(ctx context.Context, s *scope, values []VersionKeyValue, kvs []db.VersionKV, pending []int, results []db.PutResult) error {
+	patches := make([]int, 0)
+	keys := make([]db.VersionKV, 0)
+	for _, i := range pending {
+		if values[i].PatchType != "" {
+			results[i] = db.PutResult{}
+			patches = append(patches, i)
+			keys = append(keys, kvs[i])
+		}
+	}
+	if len(patches) == 0 {
+		return nil
+	}
+	olds, err := s.get(ctx, keys)
+	if err != nil {
+		return err
+	}
+	for j, i := range patches {
+		if olds[j].Err != nil {
+			results[i].Err = olds[j].Err
+			continue
+		}
+		value, err := patchValue(values[i].PatchType, olds[j].Value, values[i].Value)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		kvs[i].Value = value
+		kvs[i].Revision = values[i].Revision
+		if kvs[i].Revision == "" {
+			kvs[i].Revision = olds[j].Revision
+		}
+	}
+	return nil
+}
+
+// patchValue 将补丁应用到当前值，当前值不存在时视为null
+func patchValue(patchType string, doc string, patch string) (string, error) {
+	var value string
+	var err error
+	switch patchType {
+	case PatchMerge:
+		value, err = json2.MergePatch(doc, patch)
+	case PatchJSON:
+		value, err = json2.Patch(doc, patch)
+	default:
+		return "", error2.NewError(code.InvalidParams)
+	}
+	switch {
+	case errors.Is(err, json2.ErrInvalidPatch):
+		return "", error2.NewError(code.InvalidPatch, err.Error())
+	case err != nil:
+		return "", error2.NewError(code.InvalidJSONValue)
+	}
+	return value, nil
+}
+
+// pointerValue 返回value中 JSON Pointer 指向的部分，指向的值不存在时返回false
+func pointerValue(value string, pointer string) (string, bool, error) {
+	v, err := json2.Pointer(value, pointer)
+	switch {
+	case errors.Is(err, json2.ErrNotFound):
+		return "", false, nil
+	case errors.Is(err, json2.ErrInvalidPointer):
+		return "", false, error2.NewError(code.InvalidParams)
+	case err != nil:
+		return "", false, error2.NewError(code.InvalidJSONValue)
+	}
+	return v, true, nil
+}
+
+// found 记录读取到的值，指定 pointer 时只返回其指向的部分，指向的值不存在时为 StatusNotFound
+func (r *BatchGetValueResp) found(ctx context.Context, status *KeyStatus, pointer string, value string) {
+	if pointer != "" {
+		v, ok, err := pointerValue(value, pointer)
+		if err != nil {
+			status.withError(ctx, err)
+			return
+		}
+		if !ok {
+			status.Status = StatusNotFound
+			return
+		}
+		value = v
+	}
+	status.Status = StatusFound
+	r.Result[status.Key] = value
+}
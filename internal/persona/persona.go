@@ -3,15 +3,18 @@ package persona
 import (
 	"context"
 	"encoding/json"
+	"errors"
 
 	"git.internal.yunify.com/qxp/persona/internal/model"
 	"git.internal.yunify.com/qxp/persona/internal/server/options"
+	"git.internal.yunify.com/qxp/persona/pkg/code"
 	"git.internal.yunify.com/qxp/persona/pkg/config"
 	"git.internal.yunify.com/qxp/persona/pkg/db"
 	"git.internal.yunify.com/qxp/persona/pkg/db/elasticsearch"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/error2"
 	"git.internal.yunify.com/qxp/persona/pkg/misc/id2"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/logger"
 	"git.internal.yunify.com/qxp/persona/pkg/misc/time2"
-	"git.internal.yunify.com/qxp/persona/pkg/utils"
 )
 
 // Persona inter
@@ -21,8 +24,33 @@ type Persona interface {
 	SetValue(ctx context.Context, req *BatchSetValueReq) (*BatchSetValueResp, error)
 	GetValue(ctx context.Context, req *BatchGetValueReq) (*BatchGetValueResp, error)
 	CloneValue(ctx context.Context, req *CloneValueReq) (string, error)
+	BatchCloneValue(ctx context.Context, req *BatchCloneValueReq) (*BatchCloneValueResp, error)
 	ExportData(ctx context.Context, req *ExportDataReq) (*ExportDataResp, error)
-	ImportData(ctx context.Context, req *ImportDataReq) error
+	StreamExportData(ctx context.Context, req *ExportDataReq, fn db.WalkFunc) (*ExportDataResp, error)
+	ImportData(ctx context.Context, req *ImportDataReq) (*ImportDataResp, error)
+	CloneApp(ctx context.Context, req *CloneAppReq) (*ImportDataResp, error)
+	UserDeleteValue(ctx context.Context, req *BatchDeleteValueReq) (*BatchDeleteValueResp, error)
+	DeleteValue(ctx context.Context, req *BatchDeleteValueReq) (*BatchDeleteValueResp, error)
+	PurgeApp(ctx context.Context, req *PurgeAppReq) (*PurgeAppResp, error)
+
+	ExportUserData(ctx context.Context, req *ExportUserDataReq) (*ExportUserDataResp, error)
+	EraseUserData(ctx context.Context, req *EraseUserDataReq) (*EraseUserDataResp, error)
+
+	ListHistory(ctx context.Context, req *ListHistoryReq) (*ListHistoryResp, error)
+	UserListHistory(ctx context.Context, req *ListHistoryReq) (*ListHistoryResp, error)
+	Rollback(ctx context.Context, req *RollbackReq) (*RollbackResp, error)
+	UserRollback(ctx context.Context, req *RollbackReq) (*RollbackResp, error)
+
+	ListVersions(ctx context.Context, req *ListVersionsReq) (*ListVersionsResp, error)
+	UserListVersions(ctx context.Context, req *ListVersionsReq) (*ListVersionsResp, error)
+	DiffVersions(ctx context.Context, req *DiffVersionsReq) (*DiffVersionsResp, error)
+
+	Watch(ctx context.Context, req *WatchReq) (<-chan *ChangeEvent, error)
+	UserWatch(ctx context.Context, req *WatchReq) (<-chan *ChangeEvent, error)
+
+	SetSchema(ctx context.Context, req *SetSchemaReq) (*SetSchemaResp, error)
+	ListSchemas(ctx context.Context, req *ListSchemasReq) (*ListSchemasResp, error)
+	DeleteSchema(ctx context.Context, req *DeleteSchemaReq) (*DeleteSchemaResp, error)
 
 	GetDataSetByID(ctx context.Context, req *GetDataSetReq) (*GetDataSetResp, error)
 	CreateDataset(ctx context.Context, req *CreateDataSetReq) (*CreateDataSetResp, error)
@@ -34,129 +62,396 @@ type Persona interface {
 type persona struct {
 	conf    *config.Configs
 	daoRepo db.BackendStorage
-}
-
-// NewPersona new
-func NewPersona(conf *config.Configs, opts ...options.Options) (Persona, error) {
-	dao, err := elasticsearch.NewEs(conf)
+	// feed 后端不支持监听时，本实例写入的变更通知
+	feed *feed
+	// webhook 变更回调，未配置回调地址时为nil
+	webhook *webhook
+	// trimmer 清理超出保留条数的修改记录
+	trimmer *historyTrimmer
+	// schemas 已注册的 JSON Schema 的缓存
+	schemas *schemaCache
+}
+
+// NewPersona new，后台任务(回调投递、清理修改记录、清理过期数据)在ctx结束时退出
+func NewPersona(ctx context.Context, conf *config.Configs, opts ...options.Options) (Persona, error) {
+	dao, err := model.DBFactory(ctx, conf)
 	if err != nil {
 		return nil, err
 	}
-	return &persona{
+	p := &persona{
 		conf:    conf,
 		daoRepo: dao,
-	}, nil
+		feed:    newFeed(),
+		webhook: newWebhook(conf, dao),
+		trimmer: newHistoryTrimmer(conf, dao),
+		schemas: newSchemaCache(),
+	}
+	if e, ok := dao.(db.Expirer); ok {
+		e.OnExpire(p.feed.expire)
+	}
+	if p.webhook != nil {
+		go p.webhook.run(ctx)
+	}
+	go p.trimmer.run(ctx)
+	return p, nil
 }
 
 func (p *persona) UserSetValue(ctx context.Context, req *BatchSetValueReq) (*BatchSetValueResp, error) {
-	successKeys := make([]string, 0)
-	failKeys := make([]string, 0)
-	for _, value := range req.Keys {
-		err := p.daoRepo.UserPutWithVersion(ctx, value.Version, value.Key, value.Value)
-		if err != nil {
-			failKeys = append(failKeys, value.Key)
-		} else {
-			successKeys = append(successKeys, value.Key)
-		}
+	return p.setValues(ctx, req, p.userScope(ctx)), nil
+}
+
+func (p *persona) UserGetValue(ctx context.Context, req *BatchGetValueReq) (*BatchGetValueResp, error) {
+	if len(req.Resolve) > 0 {
+		return p.resolveValues(ctx, req)
 	}
+	return p.getValues(ctx, req, p.daoRepo.UserMultiGetWithVersion), nil
+}
 
-	return &BatchSetValueResp{
-		SuccessKeys: successKeys,
-		FailKeys:    failKeys,
-	}, nil
+func (p *persona) SetValue(ctx context.Context, req *BatchSetValueReq) (*BatchSetValueResp, error) {
+	return p.setValues(ctx, req, p.appScope()), nil
 }
 
-func (p *persona) UserGetValue(ctx context.Context, req *BatchGetValueReq) (*BatchGetValueResp, error) {
-	result := make(map[string]string, 0)
-	for _, value := range req.Keys {
-		r, err := p.daoRepo.UserGetWithVersion(ctx, value.Version, value.Key)
-		if err == nil && len(r) > 0 {
-			result = utils.MergeMap2(result, r)
-		}
+func (p *persona) GetValue(ctx context.Context, req *BatchGetValueReq) (*BatchGetValueResp, error) {
+	if len(req.Resolve) > 0 {
+		return p.resolveValues(ctx, req)
 	}
+	return p.getValues(ctx, req, p.daoRepo.MultiGetWithVersion), nil
+}
 
-	return &BatchGetValueResp{
-		Result: result,
-	}, nil
+func (p *persona) UserDeleteValue(ctx context.Context, req *BatchDeleteValueReq) (*BatchDeleteValueResp, error) {
+	return p.deleteValues(ctx, req, p.userScope(ctx)), nil
 }
 
-func (p *persona) SetValue(ctx context.Context, req *BatchSetValueReq) (*BatchSetValueResp, error) {
-	successKeys := make([]string, 0)
-	failKeys := make([]string, 0)
-	for _, value := range req.Keys {
-		err := p.daoRepo.PutWithVersion(ctx, value.Version, value.Key, value.Value)
-		if err != nil {
-			failKeys = append(failKeys, value.Key)
-		} else {
-			successKeys = append(successKeys, value.Key)
+func (p *persona) DeleteValue(ctx context.Context, req *BatchDeleteValueReq) (*BatchDeleteValueResp, error) {
+	return p.deleteValues(ctx, req, p.appScope()), nil
+}
+
+type multiPutFunc func(ctx context.Context, kvs []db.VersionKV) ([]db.PutResult, error)
+
+type multiGetFunc func(ctx context.Context, keys []db.VersionKV) ([]db.GetResult, error)
+
+type multiDeleteFunc func(ctx context.Context, keys []db.VersionKV) ([]db.DeleteResult, error)
+
+// scope 应用级或用户级数据的读写方法
+type scope struct {
+	get multiGetFunc
+	put multiPutFunc
+	del multiDeleteFunc
+	// userID 用户级数据所属的用户，应用级数据为空
+	userID string
+}
+
+func (p *persona) appScope() *scope {
+	return &scope{
+		get: p.daoRepo.MultiGetWithVersion,
+		put: p.daoRepo.MultiPutWithVersion,
+		del: p.daoRepo.MultiDeleteWithVersion,
+	}
+}
+
+func (p *persona) userScope(ctx context.Context) *scope {
+	return &scope{
+		get:    p.daoRepo.UserMultiGetWithVersion,
+		put:    p.daoRepo.UserMultiPutWithVersion,
+		del:    p.daoRepo.UserMultiDeleteWithVersion,
+		userID: logger.STDHeader(ctx)["User-Id"],
+	}
+}
+
+// writeValues 批量写入，并为写入成功的key记录修改前的值、通知变更
+// 修改前的值读取失败的key不会写入，有重复的key时整批不写入
+func (p *persona) writeValues(ctx context.Context, s *scope, kvs []db.VersionKV) ([]db.PutResult, error) {
+	if duplicated(kvs) {
+		return nil, error2.NewError(code.InvalidParams)
+	}
+	olds, err := s.get(ctx, kvs)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]db.PutResult, len(kvs))
+	writes := make([]db.VersionKV, 0, len(kvs))
+	owners := make([]int, 0, len(kvs))
+	for i, kv := range kvs {
+		if olds[i].Err != nil {
+			results[i].Err = olds[i].Err
+			continue
+		}
+		writes = append(writes, kv)
+		owners = append(owners, i)
+	}
+	if len(writes) == 0 {
+		return results, nil
+	}
+	puts, err := s.put(ctx, writes)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]*WebhookEvent, 0, len(owners))
+	written := make([]db.VersionKV, 0, len(owners))
+	prevs := make([]db.GetResult, 0, len(owners))
+	for j, i := range owners {
+		results[i] = puts[j]
+		if puts[j].Err == nil {
+			written = append(written, kvs[i])
+			prevs = append(prevs, olds[i])
+			events = append(events, &WebhookEvent{
+				Operation: OpPut,
+				Key:       kvs[i].Key,
+				Version:   kvs[i].Version,
+				UserID:    s.userID,
+				OldHash:   valueHash(olds[i].Value, olds[i].Found),
+				NewHash:   valueHash(kvs[i].Value, true),
+			})
 		}
 	}
+	p.recordHistory(ctx, s, written, prevs)
+	p.feed.publish(ctx, s.userID, putEvents(writes, puts))
+	p.webhook.notify(ctx, events)
+	return results, nil
+}
 
-	return &BatchSetValueResp{
-		SuccessKeys: successKeys,
-		FailKeys:    failKeys,
-	}, nil
+// removeValues 批量删除，并为删除前存在的key记录修改前的值、通知变更
+// 修改前的值读取失败的key不会删除，有重复的key时整批不删除
+func (p *persona) removeValues(ctx context.Context, s *scope, keys []db.VersionKV) ([]db.DeleteResult, error) {
+	if duplicated(keys) {
+		return nil, error2.NewError(code.InvalidParams)
+	}
+	olds, err := s.get(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]db.DeleteResult, len(keys))
+	deletes := make([]db.VersionKV, 0, len(keys))
+	owners := make([]int, 0, len(keys))
+	for i, k := range keys {
+		if olds[i].Err != nil {
+			results[i].Err = olds[i].Err
+			continue
+		}
+		deletes = append(deletes, k)
+		owners = append(owners, i)
+	}
+	if len(deletes) == 0 {
+		return results, nil
+	}
+	dels, err := s.del(ctx, deletes)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]db.WatchEvent, 0, len(owners))
+	hooks := make([]*WebhookEvent, 0, len(owners))
+	removed := make([]db.VersionKV, 0, len(owners))
+	prevs := make([]db.GetResult, 0, len(owners))
+	for j, i := range owners {
+		results[i] = dels[j]
+		if dels[j].Err == nil && dels[j].Found {
+			removed = append(removed, keys[i])
+			prevs = append(prevs, olds[i])
+			events = append(events, db.WatchEvent{
+				Key:      keys[i].Key,
+				Version:  keys[i].Version,
+				Revision: db.RevisionNotExist,
+				Deleted:  true,
+			})
+			hooks = append(hooks, &WebhookEvent{
+				Operation: OpDelete,
+				Key:       keys[i].Key,
+				Version:   keys[i].Version,
+				UserID:    s.userID,
+				OldHash:   valueHash(olds[i].Value, olds[i].Found),
+			})
+		}
+	}
+	p.recordHistory(ctx, s, removed, prevs)
+	p.feed.publish(ctx, s.userID, events)
+	p.webhook.notify(ctx, hooks)
+	return results, nil
 }
 
-func (p *persona) GetValue(ctx context.Context, req *BatchGetValueReq) (*BatchGetValueResp, error) {
-	result := make(map[string]string, 0)
+// setValues 批量写入，并记录每个key的结果
+func (p *persona) setValues(ctx context.Context, req *BatchSetValueReq, s *scope) *BatchSetValueResp {
+	kvs := make([]db.VersionKV, 0, len(req.Keys))
 	for _, value := range req.Keys {
-		r, err := p.daoRepo.GetWithVersion(ctx, value.Version, value.Key)
-		if err == nil && len(r) > 0 {
-			result = utils.MergeMap2(result, r)
+		kvs = append(kvs, db.VersionKV{
+			Version:  value.Version,
+			Key:      value.Key,
+			Value:    value.Value,
+			Revision: value.Revision,
+			TTL:      value.TTL,
+		})
+	}
+	results, err := p.putValues(ctx, s, req.Keys, kvs)
+
+	resp := &BatchSetValueResp{
+		SuccessKeys: make([]string, 0),
+		FailKeys:    make([]string, 0),
+		Status:      make([]*KeyStatus, 0, len(req.Keys)),
+	}
+	for i, value := range req.Keys {
+		status := &KeyStatus{
+			Key:     value.Key,
+			Version: value.Version,
+			Status:  StatusSuccess,
 		}
+		switch {
+		case err != nil:
+			status.withError(ctx, err)
+			resp.FailKeys = append(resp.FailKeys, value.Key)
+		case results[i].Err != nil:
+			status.withError(ctx, results[i].Err)
+			resp.FailKeys = append(resp.FailKeys, value.Key)
+		default:
+			status.Revision = results[i].Revision
+			resp.SuccessKeys = append(resp.SuccessKeys, value.Key)
+		}
+		resp.Status = append(resp.Status, status)
 	}
+	return resp
+}
 
-	return &BatchGetValueResp{
-		Result: result,
-	}, nil
+// duplicated 同一个key及版本是否出现多次，etcd的单个事务中不能包含重复的key，
+// 且无法确定以哪一项为准，整批拒绝
+func duplicated(keys []db.VersionKV) bool {
+	seen := make(map[[2]string]bool, len(keys))
+	for _, k := range keys {
+		id := [2]string{k.Version, k.Key}
+		if seen[id] {
+			return true
+		}
+		seen[id] = true
+	}
+	return false
 }
 
-func (p *persona) CloneValue(ctx context.Context, req *CloneValueReq) (string, error) {
-	r, err := p.daoRepo.GetWithVersion(ctx, req.Key.Version, req.Key.Key)
-	if err != nil {
-		return "", err
+// deleteValues 批量删除，并记录每个key的结果
+// 不存在的key视为删除成功，状态为 StatusNotFound
+func (p *persona) deleteValues(ctx context.Context, req *BatchDeleteValueReq, s *scope) *BatchDeleteValueResp {
+	keys := make([]db.VersionKV, 0, len(req.Keys))
+	for _, value := range req.Keys {
+		keys = append(keys, db.VersionKV{
+			Version: value.Version,
+			Key:     value.Key,
+		})
 	}
-	if len(r) > 0 {
-		var value string
-		for _, v := range r {
-			value = v
-		}
+	results, err := p.removeValues(ctx, s, keys)
 
-		err := p.daoRepo.PutWithVersion(ctx, req.NewKey.Version, req.NewKey.Key, value)
-		if err != nil {
-			return "", err
+	resp := &BatchDeleteValueResp{
+		SuccessKeys: make([]string, 0),
+		FailKeys:    make([]string, 0),
+		Status:      make([]*KeyStatus, 0, len(req.Keys)),
+	}
+	for i, value := range req.Keys {
+		status := &KeyStatus{
+			Key:     value.Key,
+			Version: value.Version,
+			Status:  StatusSuccess,
+		}
+		switch {
+		case err != nil:
+			status.withError(ctx, err)
+			resp.FailKeys = append(resp.FailKeys, value.Key)
+		case results[i].Err != nil:
+			status.withError(ctx, results[i].Err)
+			resp.FailKeys = append(resp.FailKeys, value.Key)
+		default:
+			if !results[i].Found {
+				status.Status = StatusNotFound
+			}
+			resp.SuccessKeys = append(resp.SuccessKeys, value.Key)
 		}
+		resp.Status = append(resp.Status, status)
+	}
+	return resp
+}
 
-		return value, nil
+// getValues 批量读取，并记录每个key的结果
+func (p *persona) getValues(ctx context.Context, req *BatchGetValueReq, get multiGetFunc) *BatchGetValueResp {
+	keys := make([]db.VersionKV, 0, len(req.Keys))
+	for _, value := range req.Keys {
+		keys = append(keys, db.VersionKV{
+			Version: value.Version,
+			Key:     value.Key,
+		})
 	}
+	results, err := get(ctx, keys)
 
-	return "", nil
+	resp := &BatchGetValueResp{
+		Result: make(map[string]string, 0),
+		Status: make([]*KeyStatus, 0, len(req.Keys)),
+	}
+	for i, value := range req.Keys {
+		status := &KeyStatus{
+			Key:     value.Key,
+			Version: value.Version,
+		}
+		switch {
+		case err != nil:
+			status.withError(ctx, err)
+		case results[i].Err != nil:
+			status.withError(ctx, results[i].Err)
+		case !results[i].Found:
+			status.Status = StatusNotFound
+			status.Revision = results[i].Revision
+		default:
+			status.Revision = results[i].Revision
+			resp.found(ctx, status, value.Pointer, results[i].Value)
+		}
+		resp.Status = append(resp.Status, status)
+	}
+	return resp
 }
 
-func (p *persona) ExportData(ctx context.Context, req *ExportDataReq) (*ExportDataResp, error) {
-	datas, err := p.daoRepo.GetWithPrefix(ctx, "app_id:"+req.AppID)
+// CloneValue 复制单个key，源key不存在时返回空值
+func (p *persona) CloneValue(ctx context.Context, req *CloneValueReq) (string, error) {
+	values, err := p.daoRepo.MultiGetWithVersion(ctx, []db.VersionKV{{
+		Version: req.Key.Version,
+		Key:     req.Key.Key,
+	}})
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	if values[0].Err != nil {
+		return "", values[0].Err
+	}
+	if !values[0].Found {
+		return "", nil
 	}
 
-	return &ExportDataResp{
-		AppData: datas,
-	}, nil
+	results, err := p.writeValues(ctx, p.appScope(), []db.VersionKV{{
+		Version: req.NewKey.Version,
+		Key:     req.NewKey.Key,
+		Value:   values[0].Value,
+	}})
+	if err != nil {
+		return "", err
+	}
+	if results[0].Err != nil {
+		return "", results[0].Err
+	}
+	return values[0].Value, nil
 }
 
-func (p *persona) ImportData(ctx context.Context, req *ImportDataReq) error {
-	for _, data := range req.AppData {
-		err := p.daoRepo.Put(ctx, data.Key, data.Value)
-		if err != nil {
-			return err
-		}
+// PurgeApp 删除应用的所有应用级数据，与 ExportData 导出的范围一致
+// 前缀以 ":" 结尾，避免误删应用ID以该ID开头的其他应用。不记录修改记录
+func (p *persona) PurgeApp(ctx context.Context, req *PurgeAppReq) (*PurgeAppResp, error) {
+	prefix := appPrefix(req.AppID)
+	deleted, err := p.daoRepo.DeleteWithPrefix(ctx, prefix)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	if deleted > 0 {
+		p.webhook.notify(ctx, []*WebhookEvent{{Operation: OpPurge, Key: prefix}})
+	}
+	return &PurgeAppResp{
+		Total: deleted,
+	}, nil
 }
 
 // CreateDataset 创建数据集
 func (p *persona) CreateDataset(ctx context.Context, req *CreateDataSetReq) (*CreateDataSetResp, error) {
+	if err := p.validateDataSet(ctx, req.Type, req.Content); err != nil {
+		return nil, err
+	}
 	key := id2.GenID()
 	dataset := model.DataSet{
 		ID:        key,
@@ -170,6 +465,11 @@ func (p *persona) CreateDataset(ctx context.Context, req *CreateDataSetReq) (*Cr
 	if err := p.daoRepo.PutData(&ctx, &key, dataset); err != nil {
 		return nil, err
 	}
+	p.webhook.notify(ctx, []*WebhookEvent{{
+		Operation: OpDataSetCreate,
+		Key:       key,
+		NewHash:   valueHash(req.Content, true),
+	}})
 
 	return &CreateDataSetResp{ID: key}, nil
 }
@@ -193,9 +493,22 @@ func (p *persona) GetDataSetByID(ctx context.Context, req *GetDataSetReq) (*GetD
 
 // UpdateDataSet 更新数据集
 func (p *persona) UpdateDataSet(ctx context.Context, req *UpdateDataSetReq) (*UpdateDataSetResp, error) {
+	if err := p.validateDataSet(ctx, req.Type, req.Content); err != nil {
+		return nil, err
+	}
+	old, err := p.oldDataSet(ctx, req.ID)
+	if err != nil {
+		return nil, err
+	}
 	if err := p.daoRepo.UpdateData(&ctx, &req.ID, req); err != nil {
 		return nil, err
 	}
+	p.webhook.notify(ctx, []*WebhookEvent{{
+		Operation: OpDataSetUpdate,
+		Key:       req.ID,
+		OldHash:   dataSetHash(old),
+		NewHash:   valueHash(req.Content, true),
+	}})
 	return &UpdateDataSetResp{}, nil
 }
 
@@ -209,6 +522,8 @@ func (p *persona) GetByConditionSet(ctx context.Context, req *GetByConditionSetR
 	if err := json.Unmarshal(b, &FilterKVs); err != nil {
 		return nil, err
 	}
+	// 数据集与 JSON Schema 等共用存储，只返回数据集
+	FilterKVs["data_type"] = elasticsearch.TypeOfDataSet
 	dataList, err := p.daoRepo.GetDataByKVs(&ctx, &FilterKVs)
 	for _, d := range dataList {
 		var data DataSetVo
@@ -221,26 +536,41 @@ func (p *persona) GetByConditionSet(ctx context.Context, req *GetByConditionSetR
 }
 
 func (p *persona) DeleteDataSet(ctx context.Context, req *DeleteDataSetReq) (*DeleteDataSetResp, error) {
+	old, err := p.oldDataSet(ctx, req.ID)
+	if err != nil {
+		return nil, err
+	}
 	if err := p.daoRepo.DeleteData(&ctx, &req.ID); err != nil {
 		return nil, err
 	}
+	if old != nil {
+		p.webhook.notify(ctx, []*WebhookEvent{{
+			Operation: OpDataSetDelete,
+			Key:       req.ID,
+			OldHash:   dataSetHash(old),
+		}})
+	}
 	return &DeleteDataSetResp{}, nil
 }
 
-// ExportDataReq req
-type ExportDataReq struct {
-	AppID string `json:"appId" binding:"required"`
+// oldDataSet 修改前的数据集，只在需要回调时读取
+func (p *persona) oldDataSet(ctx context.Context, id string) (*json.RawMessage, error) {
+	if p.webhook == nil {
+		return nil, nil
+	}
+	return p.daoRepo.GetData(&ctx, &id)
 }
 
-// ExportDataResp resp
-type ExportDataResp struct {
-	AppData []db.ImportReqData `json:"appData"`
+// PurgeAppReq req
+type PurgeAppReq struct {
+	// AppID 删除范围与 ExportDataReq 一致
+	AppID string `json:"appId" binding:"required"`
 }
 
-// ImportDataReq req
-type ImportDataReq struct {
-	// AppID   string `json:"appId" binding:"required"`
-	AppData []db.ImportReqData `json:"appData" binding:"required"`
+// PurgeAppResp resp
+type PurgeAppResp struct {
+	// Total 删除的数据条数
+	Total int64 `json:"total"`
 }
 
 // CloneValueReq req
@@ -256,31 +586,111 @@ type BatchSetValueReq struct {
 
 // BatchSetValueResp resp
 type BatchSetValueResp struct {
-	SuccessKeys []string `json:"successKeys"`
-	FailKeys    []string `json:"failKeys"`
+	SuccessKeys []string     `json:"successKeys"`
+	FailKeys    []string     `json:"failKeys"`
+	Status      []*KeyStatus `json:"status"`
 }
 
 // BatchGetValueReq req
 type BatchGetValueReq struct {
 	Keys []VersionKey `json:"keys" binding:"required"`
+	// Resolve 可选，未找到时依次查找的层: user、app、previous，
+	// 如 ["user", "app", "previous"]，为空时只读取接口对应的用户或应用的值
+	Resolve []string `json:"resolve"`
 }
 
 // BatchGetValueResp resp
 type BatchGetValueResp struct {
 	Result map[string]string `json:"result"`
+	Status []*KeyStatus      `json:"status"`
+}
+
+// BatchDeleteValueReq req
+type BatchDeleteValueReq struct {
+	Keys []VersionKey `json:"keys" binding:"required"`
+}
+
+// BatchDeleteValueResp resp
+type BatchDeleteValueResp struct {
+	SuccessKeys []string     `json:"successKeys"`
+	FailKeys    []string     `json:"failKeys"`
+	Status      []*KeyStatus `json:"status"`
+}
+
+const (
+	// StatusSuccess 写入或删除成功
+	StatusSuccess = "success"
+	// StatusFound 读取到值
+	StatusFound = "found"
+	// StatusNotFound 未设置过值，删除时表示无需删除
+	StatusNotFound = "not_found"
+	// StatusError 存储异常，见Code及Message
+	StatusError = "error"
+)
+
+// KeyStatus 批量读写中单个key的结果，顺序与请求一致
+// Revision 为当前(读取)或写入后(写入)的修订号，写入时回传可避免覆盖他人的修改
+type KeyStatus struct {
+	Key      string `json:"key"`
+	Version  string `json:"version"`
+	Status   string `json:"status"`
+	Revision string `json:"revision,omitempty"`
+	Code     int64  `json:"code,omitempty"`
+	Message  string `json:"message,omitempty"`
+	// Layer、ResolvedVersion 指定 Resolve 时找到值的层及实际的版本
+	Layer           string `json:"layer,omitempty"`
+	ResolvedVersion string `json:"resolvedVersion,omitempty"`
+}
+
+// withError 记录错误，非error2.Error的错误统一为存储异常
+func (s *KeyStatus) withError(ctx context.Context, err error) {
+	e, ok := err.(error2.Error)
+	switch {
+	case ok:
+	case errors.Is(err, db.ErrRevisionConflict):
+		e = error2.NewError(code.RevisionConflict)
+	case errors.Is(err, db.ErrInvalidRevision):
+		e = error2.NewError(code.InvalidParams)
+	case errors.Is(err, db.ErrAborted):
+		e = error2.NewError(code.ImportAborted)
+	case errors.Is(err, db.ErrInvalidTenant):
+		e = error2.NewError(code.InvalidTenant)
+	default:
+		logger.Logger.Errorw(err.Error(), logger.STDRequestID(ctx))
+		e = error2.NewError(code.StorageUnavailable)
+	}
+	s.Status = StatusError
+	s.Code = e.Code
+	s.Message = e.Error()
+}
+
+// withCode 以指定的状态记录错误码
+func (s *KeyStatus) withCode(status string, c int64) {
+	e := error2.NewError(c)
+	s.Status = status
+	s.Code = e.Code
+	s.Message = e.Error()
 }
 
 // VersionKeyValue req
+// Revision 可选，传入读取时得到的修订号，数据已被修改时该key写入失败
+// PatchType 可选，merge 或 json，此时 Value 为补丁，应用到当前的JSON值后写入
+// TTL 可选，单位秒，大于0时key在TTL秒后过期，每次写入重新计算，不传时不过期
 type VersionKeyValue struct {
-	Version string `json:"version" binding:"required"`
-	Key     string `json:"key" binding:"required"`
-	Value   string `json:"value" binding:"required"`
+	Version   string `json:"version" binding:"required"`
+	Key       string `json:"key" binding:"required"`
+	Value     string `json:"value" binding:"required"`
+	Revision  string `json:"revision,omitempty"`
+	PatchType string `json:"patchType,omitempty"`
+	TTL       int64  `json:"ttl,omitempty"`
 }
 
 // VersionKey req
+// Pointer 可选，仅用于读取，只返回JSON值中 JSON Pointer(RFC 6901) 指向的部分
 type VersionKey struct {
 	Version string `json:"version" binding:"required"`
 	Key     string `json:"key" binding:"required"`
+	Pointer string `json:"pointer,omitempty"`
 }
 
 // GetDataSetReq 根据ID获取数据请求
@@ -0,0 +1,1666 @@
+package persona
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"git.internal.yunify.com/qxp/persona/pkg/code"
+	"git.internal.yunify.com/qxp/persona/pkg/config"
+	"git.internal.yunify.com/qxp/persona/pkg/db"
+	"git.internal.yunify.com/qxp/persona/pkg/db/memory"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/error2"
+)
+
+// faultyStorage 对包含fail的key返回错误，模拟存储异常
+// beforePut 不为空时在每次批量写入前调用，模拟并发修改
+type faultyStorage struct {
+	db.BackendStorage
+	beforePut func()
+}
+
+func (f *faultyStorage) MultiPutWithVersion(ctx context.Context, kvs []db.VersionKV) ([]db.PutResult, error) {
+	if f.beforePut != nil {
+		f.beforePut()
+	}
+	results, err := f.BackendStorage.MultiPutWithVersion(ctx, kvs)
+	if err != nil {
+		return nil, err
+	}
+	for i, kv := range kvs {
+		if strings.Contains(kv.Key, "fail") {
+			results[i] = db.PutResult{Err: errors.New("storage down")}
+		}
+	}
+	return results, nil
+}
+
+func (f *faultyStorage) DeleteUserData(ctx context.Context, userID string) (int64, error) {
+	if strings.Contains(userID, "fail") {
+		return 0, errors.New("storage down")
+	}
+	return f.BackendStorage.DeleteUserData(ctx, userID)
+}
+
+func (f *faultyStorage) MultiGetWithVersion(ctx context.Context, keys []db.VersionKV) ([]db.GetResult, error) {
+	results, err := f.BackendStorage.MultiGetWithVersion(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	for i, k := range keys {
+		if strings.Contains(k.Key, "fail") {
+			results[i] = db.GetResult{Err: errors.New("storage down")}
+		}
+	}
+	return results, nil
+}
+
+func newTestPersona(t *testing.T) *persona {
+	conf := &config.Configs{HostName: "persona", BackendStorage: "memory"}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	m, err := memory.NewMemory(ctx, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dao := &faultyStorage{BackendStorage: m}
+	return &persona{
+		conf:    conf,
+		daoRepo: dao,
+		trimmer: newHistoryTrimmer(conf, dao),
+		schemas: newSchemaCache(),
+		feed:    newFeed(),
+	}
+}
+
+func TestBatchValueStatus(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPersona(t)
+
+	setResp, err := p.SetValue(ctx, &BatchSetValueReq{
+		Keys: []VersionKeyValue{
+			{Version: "v1", Key: "app_id:1:a", Value: "a"},
+			{Version: "v1", Key: "app_id:1:fail", Value: "b"},
+			// 失败的key之后的key不受影响
+			{Version: "v1", Key: "app_id:1:c", Value: "c"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(setResp.SuccessKeys) != 2 || len(setResp.FailKeys) != 1 {
+		t.Fatalf("unexpected keys: %+v", setResp)
+	}
+	wantSet := []string{StatusSuccess, StatusError, StatusSuccess}
+	for i, s := range setResp.Status {
+		if s.Status != wantSet[i] {
+			t.Fatalf("key %s: expect %s, got %s", s.Key, wantSet[i], s.Status)
+		}
+	}
+	if setResp.Status[1].Code != code.StorageUnavailable || setResp.Status[1].Message == "" {
+		t.Fatalf("unexpected error status: %+v", setResp.Status[1])
+	}
+
+	getResp, err := p.GetValue(ctx, &BatchGetValueReq{
+		Keys: []VersionKey{
+			{Version: "v1", Key: "app_id:1:a"},
+			{Version: "v1", Key: "app_id:1:b"},
+			{Version: "v1", Key: "app_id:1:fail"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(getResp.Result) != 1 || getResp.Result["app_id:1:a"] != "a" {
+		t.Fatalf("unexpected result: %v", getResp.Result)
+	}
+	wantGet := []string{StatusFound, StatusNotFound, StatusError}
+	for i, s := range getResp.Status {
+		if s.Status != wantGet[i] {
+			t.Fatalf("key %s: expect %s, got %s", s.Key, wantGet[i], s.Status)
+		}
+	}
+}
+
+func TestBatchDuplicateKeys(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPersona(t)
+
+	setResp, err := p.SetValue(ctx, &BatchSetValueReq{
+		Keys: []VersionKeyValue{
+			{Version: "v1", Key: "app_id:1:a", Value: "a"},
+			{Version: "v2", Key: "app_id:1:a", Value: "other version"},
+			{Version: "v1", Key: "app_id:1:a", Value: "b"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(setResp.SuccessKeys) != 0 {
+		t.Fatalf("expect the whole batch rejected: %+v", setResp)
+	}
+	for _, s := range setResp.Status {
+		if s.Code != code.InvalidParams {
+			t.Fatalf("key %s: expect invalid params, got %+v", s.Key, s)
+		}
+	}
+	getResp, err := p.GetValue(ctx, &BatchGetValueReq{
+		Keys: []VersionKey{{Version: "v1", Key: "app_id:1:a"}, {Version: "v2", Key: "app_id:1:a"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(getResp.Result) != 0 {
+		t.Fatalf("expect nothing written, got %v", getResp.Result)
+	}
+
+	delResp, err := p.DeleteValue(ctx, &BatchDeleteValueReq{
+		Keys: []VersionKey{{Version: "v1", Key: "app_id:1:a"}, {Version: "v1", Key: "app_id:1:a"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delResp.FailKeys) != 2 || delResp.Status[0].Code != code.InvalidParams {
+		t.Fatalf("expect the whole batch rejected: %+v", delResp)
+	}
+}
+
+func TestSetValueWithRevision(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPersona(t)
+	key := VersionKey{Version: "v1", Key: "app_id:1:a"}
+
+	getResp, err := p.GetValue(ctx, &BatchGetValueReq{Keys: []VersionKey{key}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	revision := getResp.Status[0].Revision
+
+	// 两个管理员基于同一次读取修改
+	for i, want := range []string{StatusSuccess, StatusError} {
+		setResp, err := p.SetValue(ctx, &BatchSetValueReq{
+			Keys: []VersionKeyValue{{Version: key.Version, Key: key.Key, Value: fmt.Sprintf("admin_%d", i), Revision: revision}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if setResp.Status[0].Status != want {
+			t.Fatalf("admin_%d: expect %s, got %+v", i, want, setResp.Status[0])
+		}
+	}
+
+	getResp, err = p.GetValue(ctx, &BatchGetValueReq{Keys: []VersionKey{key}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getResp.Result[key.Key] != "admin_0" {
+		t.Fatalf("unexpected value: %v", getResp.Result)
+	}
+	setResp, err := p.SetValue(ctx, &BatchSetValueReq{
+		Keys: []VersionKeyValue{{Version: key.Version, Key: key.Key, Value: "admin_1", Revision: revision}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if setResp.Status[0].Code != code.RevisionConflict {
+		t.Fatalf("expect conflict code, got %+v", setResp.Status[0])
+	}
+}
+
+func TestHistoryAndRollback(t *testing.T) {
+	p := newTestPersona(t)
+	ctx := context.WithValue(context.Background(), "User-Id", "user_1")
+	key := VersionKey{Version: "v1", Key: "app_id:1:a"}
+
+	for _, value := range []string{"a", "b", "c"} {
+		if _, err := p.SetValue(ctx, &BatchSetValueReq{
+			Keys: []VersionKeyValue{{Version: key.Version, Key: key.Key, Value: value}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 用户级的修改记录互不影响
+	if _, err := p.UserSetValue(ctx, &BatchSetValueReq{
+		Keys: []VersionKeyValue{{Version: key.Version, Key: key.Key, Value: "user"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	listResp, err := p.ListHistory(ctx, &ListHistoryReq{Version: key.Version, Key: key.Key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listResp.List) != 3 {
+		t.Fatalf("expect 3 histories, got %d", len(listResp.List))
+	}
+	first := listResp.List[2]
+	if first.Existed || first.Operator != "user_1" {
+		t.Fatalf("unexpected history: %+v", first)
+	}
+
+	// 回滚到写入c之前的值
+	latest := listResp.List[0]
+	if latest.Value != "b" {
+		t.Fatalf("unexpected history: %+v", latest)
+	}
+	if _, err := p.UserRollback(ctx, &RollbackReq{Version: key.Version, Key: key.Key, ID: latest.ID}); err == nil {
+		t.Fatal("expect error when rollback app history by user")
+	}
+	if _, err := p.Rollback(ctx, &RollbackReq{Version: key.Version, Key: key.Key, ID: latest.ID}); err != nil {
+		t.Fatal(err)
+	}
+	getResp, err := p.GetValue(ctx, &BatchGetValueReq{Keys: []VersionKey{key}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getResp.Result[key.Key] != "b" {
+		t.Fatalf("unexpected value: %v", getResp.Result)
+	}
+
+	listResp, err = p.ListHistory(ctx, &ListHistoryReq{Version: key.Version, Key: key.Key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listResp.List) != 4 || listResp.List[0].Value != "c" {
+		t.Fatalf("rollback should be recorded: %+v", listResp.List)
+	}
+
+	userResp, err := p.UserListHistory(ctx, &ListHistoryReq{Version: key.Version, Key: key.Key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(userResp.List) != 1 {
+		t.Fatalf("expect 1 user history, got %d", len(userResp.List))
+	}
+
+	// 最早一次写入之前key不存在，回滚时删除key
+	rollbackResp, err := p.Rollback(ctx, &RollbackReq{Version: key.Version, Key: key.Key, ID: first.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rollbackResp.Deleted || rollbackResp.Revision != db.RevisionNotExist {
+		t.Fatalf("unexpected rollback: %+v", rollbackResp)
+	}
+	getResp, err = p.GetValue(ctx, &BatchGetValueReq{Keys: []VersionKey{key}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := getResp.Result[key.Key]; ok {
+		t.Fatalf("key should be deleted: %v", getResp.Result)
+	}
+	listResp, err = p.ListHistory(ctx, &ListHistoryReq{Version: key.Version, Key: key.Key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listResp.List) != 5 || listResp.List[0].Value != "b" || !listResp.List[0].Existed {
+		t.Fatalf("rollback by delete should be recorded: %+v", listResp.List)
+	}
+}
+
+func TestHistoryRetentionAndPaging(t *testing.T) {
+	p := newTestPersona(t)
+	p.conf.History.Limit = 5
+	ctx := context.WithValue(context.Background(), "User-Id", "user_1")
+	key := VersionKey{Version: "v1", Key: "app_id:1:a"}
+
+	for i := 0; i < 8; i++ {
+		if _, err := p.SetValue(ctx, &BatchSetValueReq{
+			Keys: []VersionKeyValue{{Version: key.Version, Key: key.Key, Value: strconv.Itoa(i)}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 清理前保留所有记录，清理后只保留最近的5条，分页按时间倒序返回
+	all, err := p.ListHistory(ctx, &ListHistoryReq{Version: key.Version, Key: key.Key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all.List) != 8 {
+		t.Fatalf("expect 8 histories before trim, got %d", len(all.List))
+	}
+	p.trimmer.trim(ctx)
+	values := make([]string, 0)
+	req := &ListHistoryReq{Version: key.Version, Key: key.Key, Limit: 2}
+	for {
+		resp, err := p.ListHistory(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, h := range resp.List {
+			values = append(values, h.Value)
+		}
+		if resp.Cursor == "" {
+			break
+		}
+		req.Cursor = resp.Cursor
+	}
+	if strings.Join(values, ",") != "6,5,4,3,2" {
+		t.Fatalf("unexpected histories: %v", values)
+	}
+
+	if _, err := p.ListHistory(ctx, &ListHistoryReq{Version: key.Version, Key: key.Key, Cursor: "bad"}); err == nil {
+		t.Fatal("expect error with invalid cursor")
+	}
+}
+
+func TestDeleteValue(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPersona(t)
+	if _, err := p.SetValue(ctx, &BatchSetValueReq{
+		Keys: []VersionKeyValue{
+			{Version: "v1", Key: "app_id:1:a", Value: "a"},
+			{Version: "v2", Key: "app_id:1:a", Value: "a_v2"},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	delResp, err := p.DeleteValue(ctx, &BatchDeleteValueReq{
+		Keys: []VersionKey{
+			{Version: "v1", Key: "app_id:1:a"},
+			{Version: "v1", Key: "app_id:1:b"},
+			{Version: "v1", Key: "app_id:1:fail"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delResp.SuccessKeys) != 2 || len(delResp.FailKeys) != 1 {
+		t.Fatalf("unexpected keys: %+v", delResp)
+	}
+	want := []string{StatusSuccess, StatusNotFound, StatusError}
+	for i, s := range delResp.Status {
+		if s.Status != want[i] {
+			t.Fatalf("key %s: expect %s, got %s", s.Key, want[i], s.Status)
+		}
+	}
+
+	getResp, err := p.GetValue(ctx, &BatchGetValueReq{
+		Keys: []VersionKey{{Version: "v1", Key: "app_id:1:a"}, {Version: "v2", Key: "app_id:1:a"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getResp.Status[0].Status != StatusNotFound || getResp.Status[1].Status != StatusFound {
+		t.Fatalf("unexpected status: %+v %+v", getResp.Status[0], getResp.Status[1])
+	}
+
+	// 删除可以通过修改记录回滚
+	listResp, err := p.ListHistory(ctx, &ListHistoryReq{Version: "v1", Key: "app_id:1:a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listResp.List) != 2 || listResp.List[0].Value != "a" {
+		t.Fatalf("delete should be recorded: %+v", listResp.List)
+	}
+	if _, err := p.Rollback(ctx, &RollbackReq{Version: "v1", Key: "app_id:1:a", ID: listResp.List[0].ID}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPurgeApp(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPersona(t)
+	keys := []VersionKeyValue{
+		{Version: "v1", Key: "app_id:1:a", Value: "a"},
+		{Version: "v2", Key: "app_id:1:b", Value: "b"},
+		{Version: "v1", Key: "app_id:10:a", Value: "a"},
+	}
+	if _, err := p.SetValue(ctx, &BatchSetValueReq{Keys: keys}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.UserSetValue(ctx, &BatchSetValueReq{Keys: keys[:1]}); err != nil {
+		t.Fatal(err)
+	}
+
+	purgeResp, err := p.PurgeApp(ctx, &PurgeAppReq{AppID: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purgeResp.Total != 2 {
+		t.Fatalf("expect 2 deleted, got %d", purgeResp.Total)
+	}
+	exportResp, err := p.ExportData(ctx, &ExportDataReq{AppID: "10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exportResp.AppData) != 1 {
+		t.Fatalf("data of other app deleted: %+v", exportResp.AppData)
+	}
+}
+
+func TestImportData(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPersona(t)
+	if err := p.daoRepo.Put(ctx, "app_id:1:a_v1", "old"); err != nil {
+		t.Fatal(err)
+	}
+	appData := []db.ImportReqData{
+		{Key: "app_id:1:a_v1", Value: "new_a"},
+		{Key: "app_id:1:b_v1", Value: "new_b"},
+	}
+	value := func(key string) string {
+		res, err := p.daoRepo.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res["value"]
+	}
+
+	tests := []struct {
+		name      string
+		req       ImportDataReq
+		committed bool
+		status    []string
+		a, b      string
+	}{
+		{
+			name:   "dry run",
+			req:    ImportDataReq{AppData: appData, DryRun: true},
+			status: []string{StatusOverwritten, StatusCreated},
+			a:      "old",
+		},
+		{
+			name:   "fail",
+			req:    ImportDataReq{AppData: appData, Policy: PolicyFail},
+			status: []string{StatusConflict, StatusCreated},
+			a:      "old",
+		},
+		{
+			name:   "invalid",
+			req:    ImportDataReq{AppData: append(appData, appData[0])},
+			status: []string{StatusOverwritten, StatusCreated, StatusInvalid},
+			a:      "old",
+		},
+		{
+			name:      "skip",
+			req:       ImportDataReq{AppData: appData, Policy: PolicySkip},
+			committed: true,
+			status:    []string{StatusSkipped, StatusCreated},
+			a:         "old",
+			b:         "new_b",
+		},
+		{
+			name:      "overwrite",
+			req:       ImportDataReq{AppData: appData},
+			committed: true,
+			status:    []string{StatusOverwritten, StatusOverwritten},
+			a:         "new_a",
+			b:         "new_b",
+		},
+	}
+	for _, tt := range tests {
+		resp, err := p.ImportData(ctx, &tt.req)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if resp.Committed != tt.committed {
+			t.Fatalf("%s: expect committed %v, got %+v", tt.name, tt.committed, resp)
+		}
+		for i, s := range resp.Status {
+			if s.Status != tt.status[i] {
+				t.Fatalf("%s: key %s expect %s, got %+v", tt.name, s.Key, tt.status[i], s)
+			}
+		}
+		if a, b := value(appData[0].Key), value(appData[1].Key); a != tt.a || b != tt.b {
+			t.Fatalf("%s: expect (%s, %s), got (%s, %s)", tt.name, tt.a, tt.b, a, b)
+		}
+	}
+
+	if _, err := p.ImportData(ctx, &ImportDataReq{AppData: appData, Policy: "merge"}); err == nil {
+		t.Fatal("expect error with unknown policy")
+	}
+}
+
+func TestExportImportEnvelope(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPersona(t)
+	dataSet, err := p.CreateDataset(ctx, &CreateDataSetReq{Name: "ds", Content: "[]"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.CreateDataset(ctx, &CreateDataSetReq{Name: "other"}); err != nil {
+		t.Fatal(err)
+	}
+	keys := []VersionKeyValue{
+		{Version: "v1", Key: "app_id:1:a", Value: `{"dataSet":"` + dataSet.ID + `"}`},
+		{Version: "v2", Key: "app_id:1:b", Value: "b"},
+	}
+	if _, err := p.SetValue(ctx, &BatchSetValueReq{Keys: keys}); err != nil {
+		t.Fatal(err)
+	}
+
+	exportResp, err := p.ExportData(ctx, &ExportDataReq{AppID: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exportResp.SchemaVersion != ExportSchemaVersion || exportResp.AppID != "1" || exportResp.ExportedAt == 0 {
+		t.Fatalf("unexpected envelope: %+v", exportResp)
+	}
+	if len(exportResp.AppData) != 2 || exportResp.AppData[0].Version != "v1" || exportResp.AppData[1].Version != "v2" {
+		t.Fatalf("expect versions in appData, got %+v", exportResp.AppData)
+	}
+	if len(exportResp.DataSets) != 1 || exportResp.DataSets[0].ID != dataSet.ID {
+		t.Fatalf("expect only referenced data set, got %+v", exportResp.DataSets)
+	}
+
+	// 导入到新的存储
+	q := newTestPersona(t)
+	importReq := ImportDataReq{
+		SchemaVersion: exportResp.SchemaVersion,
+		AppID:         exportResp.AppID,
+		ExportedAt:    exportResp.ExportedAt,
+		AppData:       exportResp.AppData,
+		DataSets:      exportResp.DataSets,
+	}
+	importResp, err := q.ImportData(ctx, &importReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !importResp.Committed || importResp.Created != 3 || len(importResp.DataSetStatus) != 1 {
+		t.Fatalf("unexpected import result: %+v", importResp)
+	}
+	getResp, err := q.GetValue(ctx, &BatchGetValueReq{Keys: []VersionKey{{Version: "v2", Key: "app_id:1:b"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getResp.Result["app_id:1:b"] != "b" {
+		t.Fatalf("expect imported value with version, got %+v", getResp.Result)
+	}
+	dataSetResp, err := q.GetDataSetByID(ctx, &GetDataSetReq{ID: dataSet.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dataSetResp.Name != "ds" {
+		t.Fatalf("expect imported data set, got %+v", dataSetResp)
+	}
+
+	// 不属于该应用的key
+	importReq.AppData = append(importReq.AppData, db.ImportReqData{Key: "app_id:2:c_v1", Value: "c"})
+	importResp, err = q.ImportData(ctx, &importReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if importResp.Committed || importResp.Status[2].Status != StatusInvalid {
+		t.Fatalf("expect key of other app invalid, got %+v", importResp)
+	}
+
+	// 旧格式
+	importResp, err = q.ImportData(ctx, &ImportDataReq{AppData: []db.ImportReqData{{Key: "app_id:1:c_v1", Value: "c"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !importResp.Committed || importResp.Created != 1 {
+		t.Fatalf("unexpected import result of old format: %+v", importResp)
+	}
+
+	if _, err := q.ImportData(ctx, &ImportDataReq{SchemaVersion: ExportSchemaVersion + 1}); err == nil {
+		t.Fatal("expect error with unknown schema version")
+	}
+}
+
+// 应用ID互为前缀时，导出、导入及清空只作用于指定的应用
+func TestExportAppScope(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPersona(t)
+	dataSet, err := p.CreateDataset(ctx, &CreateDataSetReq{Name: "ds"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []VersionKeyValue{
+		{Version: "v1", Key: "app_id:1:a", Value: `{"note":"prefix-` + dataSet.ID + `"}`},
+		{Version: "v1", Key: "app_id:12:a", Value: `{"dataSet":"` + dataSet.ID + `"}`},
+	}
+	if _, err := p.SetValue(ctx, &BatchSetValueReq{Keys: keys}); err != nil {
+		t.Fatal(err)
+	}
+
+	exportResp, err := p.ExportData(ctx, &ExportDataReq{AppID: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exportResp.AppData) != 1 || exportResp.AppData[0].Key != "app_id:1:a_v1" {
+		t.Fatalf("expect only app 1, got %+v", exportResp.AppData)
+	}
+	// 只有完整的字符串值才视为引用
+	if len(exportResp.DataSets) != 0 {
+		t.Fatalf("expect no data set, got %+v", exportResp.DataSets)
+	}
+	exportResp, err = p.ExportData(ctx, &ExportDataReq{AppID: "12"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exportResp.DataSets) != 1 || exportResp.DataSets[0].ID != dataSet.ID {
+		t.Fatalf("expect referenced data set, got %+v", exportResp.DataSets)
+	}
+
+	importResp, err := p.ImportData(ctx, &ImportDataReq{
+		AppID:   "1",
+		AppData: []db.ImportReqData{{Key: "app_id:12:b", Version: "v1", Value: "b"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if importResp.Committed || importResp.Status[0].Status != StatusInvalid {
+		t.Fatalf("expect key of app 12 invalid for app 1, got %+v", importResp.Status[0])
+	}
+
+	purgeResp, err := p.PurgeApp(ctx, &PurgeAppReq{AppID: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purgeResp.Total != 1 {
+		t.Fatalf("expect 1 deleted, got %d", purgeResp.Total)
+	}
+	getResp, err := p.GetValue(ctx, &BatchGetValueReq{Keys: []VersionKey{{Version: "v1", Key: "app_id:12:a"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(getResp.Result) != 1 {
+		t.Fatalf("expect app 12 untouched, got %+v", getResp.Result)
+	}
+}
+
+func TestCloneApp(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPersona(t)
+	dataSet, err := p.CreateDataset(ctx, &CreateDataSetReq{Name: "ds"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []VersionKeyValue{
+		{Version: "v1", Key: "app_id:1:a", Value: dataSet.ID},
+		{Version: "v2", Key: "app_id:1:b", Value: "b"},
+		{Version: "v1", Key: "app_id:10:a", Value: "other"},
+	}
+	if _, err := p.SetValue(ctx, &BatchSetValueReq{Keys: keys}); err != nil {
+		t.Fatal(err)
+	}
+
+	cloneResp, err := p.CloneApp(ctx, &CloneAppReq{SourceAppID: "1", TargetAppID: "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cloneResp.Committed || len(cloneResp.Status) != 2 || len(cloneResp.DataSetStatus) != 1 {
+		t.Fatalf("unexpected clone result: %+v", cloneResp)
+	}
+	newID := cloneResp.DataSetIDs[dataSet.ID]
+	if newID == "" || newID == dataSet.ID {
+		t.Fatalf("expect data set copied with new id, got %+v", cloneResp.DataSetIDs)
+	}
+
+	getResp, err := p.GetValue(ctx, &BatchGetValueReq{Keys: []VersionKey{
+		{Version: "v1", Key: "app_id:2:a"},
+		{Version: "v2", Key: "app_id:2:b"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getResp.Result["app_id:2:a"] != newID || getResp.Result["app_id:2:b"] != "b" {
+		t.Fatalf("unexpected cloned values: %+v", getResp.Result)
+	}
+	dataSetResp, err := p.GetDataSetByID(ctx, &GetDataSetReq{ID: newID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dataSetResp.Name != "ds" {
+		t.Fatalf("expect copied data set, got %+v", dataSetResp)
+	}
+
+	// 目标应用已有数据
+	cloneResp, err = p.CloneApp(ctx, &CloneAppReq{SourceAppID: "1", TargetAppID: "2", Policy: PolicyFail})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cloneResp.Committed || cloneResp.Status[0].Status != StatusConflict {
+		t.Fatalf("expect conflict, got %+v", cloneResp)
+	}
+
+	if _, err := p.CloneApp(ctx, &CloneAppReq{SourceAppID: "1", TargetAppID: "1"}); err == nil {
+		t.Fatal("expect error when cloning to the same app")
+	}
+}
+
+// 只替换与原数据集ID完全相同的字符串值
+func TestRemapApp(t *testing.T) {
+	req := &ImportDataReq{
+		AppID:       "1",
+		TargetAppID: "2",
+		DataSets:    []*DataSetVo{{ID: "ds"}, {ID: "ds2"}},
+		AppData: []db.ImportReqData{
+			{Key: "app_id:1:a_v1", Version: "v1", Value: `{"ds": "ds", "list": ["ds2", "ds-ds2"]}`},
+			{Key: "app_id:1:b_v1", Version: "v1", Value: "ds2"},
+		},
+	}
+	remapped, ids := remapApp(req)
+	if len(ids) != 2 || ids["ds"] == "" || ids["ds2"] == "" {
+		t.Fatalf("unexpected ids: %v", ids)
+	}
+	want := []string{
+		`{"ds": "` + ids["ds"] + `", "list": ["` + ids["ds2"] + `", "ds-ds2"]}`,
+		ids["ds2"],
+	}
+	for i, data := range remapped.AppData {
+		if data.Value != want[i] {
+			t.Fatalf("expect %s, got %s", want[i], data.Value)
+		}
+	}
+	if remapped.AppData[0].Key != "app_id:2:a_v1" || req.AppData[1].Value != "ds2" {
+		t.Fatalf("unexpected remap: %+v", remapped.AppData)
+	}
+}
+
+func TestBatchCloneValue(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPersona(t)
+	keys := []VersionKeyValue{
+		{Version: "draft", Key: "app_id:1:a", Value: "a"},
+		{Version: "draft", Key: "app_id:1:b", Value: "b"},
+		{Version: "published", Key: "app_id:1:b", Value: "old"},
+		{Version: "v1", Key: "app_id:1:c", Value: "c"},
+	}
+	if _, err := p.SetValue(ctx, &BatchSetValueReq{Keys: keys}); err != nil {
+		t.Fatal(err)
+	}
+	published := func(key string) string {
+		resp, err := p.GetValue(ctx, &BatchGetValueReq{Keys: []VersionKey{{Version: "published", Key: key}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Result[key]
+	}
+
+	promote := &PromoteVersionReq{Prefix: "app_id:1:", From: "draft", To: "published"}
+	resp, err := p.BatchCloneValue(ctx, &BatchCloneValueReq{Promote: promote, Policy: PolicySkip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(resp.Copied, resp.Skipped, resp.Failed) != "[app_id:1:a] [app_id:1:b] []" {
+		t.Fatalf("unexpected promote result: %+v", resp)
+	}
+	if a, b := published("app_id:1:a"), published("app_id:1:b"); a != "a" || b != "old" {
+		t.Fatalf("expect (a, old), got (%s, %s)", a, b)
+	}
+
+	resp, err = p.BatchCloneValue(ctx, &BatchCloneValueReq{Promote: promote})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Copied) != 2 || published("app_id:1:b") != "b" {
+		t.Fatalf("expect overwritten, got %+v", resp)
+	}
+
+	resp, err = p.BatchCloneValue(ctx, &BatchCloneValueReq{Keys: []CloneValueReq{
+		{Key: VersionKey{Version: "v1", Key: "app_id:1:c"}, NewKey: VersionKey{Version: "published", Key: "app_id:1:c"}},
+		{Key: VersionKey{Version: "v1", Key: "app_id:1:d"}, NewKey: VersionKey{Version: "published", Key: "app_id:1:d"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status[0].Status != StatusSuccess || resp.Status[1].Status != StatusNotFound || published("app_id:1:c") != "c" {
+		t.Fatalf("unexpected batch clone result: %+v", resp)
+	}
+
+	if _, err := p.BatchCloneValue(ctx, &BatchCloneValueReq{}); err == nil {
+		t.Fatal("expect error without keys or promote")
+	}
+}
+
+func TestVersions(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPersona(t)
+	keys := []VersionKeyValue{
+		{Version: "v1", Key: "app_id:1:a", Value: "a"},
+		{Version: "v1", Key: "app_id:1:b", Value: "b"},
+		{Version: "v1", Key: "app_id:1:c", Value: "c"},
+		{Version: "v2", Key: "app_id:1:a", Value: "a"},
+		{Version: "v2", Key: "app_id:1:b", Value: "b2"},
+		{Version: "v2", Key: "app_id:1:d", Value: "d"},
+	}
+	if _, err := p.SetValue(ctx, &BatchSetValueReq{Keys: keys}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.UserSetValue(ctx, &BatchSetValueReq{Keys: keys[:1]}); err != nil {
+		t.Fatal(err)
+	}
+
+	listResp, err := p.ListVersions(ctx, &ListVersionsReq{Key: "app_id:1:b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listResp.Versions) != 2 || listResp.Versions[0].Version != "v1" || listResp.Versions[1].Value != "b2" {
+		t.Fatalf("unexpected versions: %+v", listResp.Versions)
+	}
+	listResp, err = p.UserListVersions(ctx, &ListVersionsReq{Key: "app_id:1:a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listResp.Versions) != 1 {
+		t.Fatalf("unexpected user versions: %+v", listResp.Versions)
+	}
+
+	// 语义化版本号按版本先后排序，其他版本号排在之后
+	if _, err := p.SetValue(ctx, &BatchSetValueReq{Keys: []VersionKeyValue{
+		{Version: "v10", Key: "app_id:1:e", Value: "e"},
+		{Version: "latest", Key: "app_id:1:e", Value: "e"},
+		{Version: "v9", Key: "app_id:1:e", Value: "e"},
+		{Version: "v9.1", Key: "app_id:1:e", Value: "e"},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	listResp, err = p.ListVersions(ctx, &ListVersionsReq{Key: "app_id:1:e"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := make([]string, 0, len(listResp.Versions))
+	for _, v := range listResp.Versions {
+		order = append(order, v.Version)
+	}
+	if fmt.Sprint(order) != "[v9 v9.1 v10 latest]" {
+		t.Fatalf("unexpected version order: %v", order)
+	}
+
+	diffResp, err := p.DiffVersions(ctx, &DiffVersionsReq{Prefix: "app_id:1:", From: "v1", To: "v2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0, len(diffResp.Diff))
+	for _, d := range diffResp.Diff {
+		got = append(got, d.Key+":"+d.Status)
+	}
+	if fmt.Sprint(got) != "[app_id:1:b:changed app_id:1:c:removed app_id:1:d:added]" || diffResp.Unchanged != 1 {
+		t.Fatalf("unexpected prefix diff: %+v", diffResp)
+	}
+
+	diffResp, err = p.DiffVersions(ctx, &DiffVersionsReq{Key: "app_id:1:b", From: "v1", To: "v2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffResp.Changed != 1 || diffResp.Diff[0].From != "b" || diffResp.Diff[0].To != "b2" {
+		t.Fatalf("unexpected key diff: %+v", diffResp)
+	}
+
+	if _, err := p.DiffVersions(ctx, &DiffVersionsReq{From: "v1", To: "v2"}); err == nil {
+		t.Fatal("expect error without key or prefix")
+	}
+}
+
+func TestSemverLess(t *testing.T) {
+	tests := []struct {
+		a, b string
+		less bool
+	}{
+		{a: "v1.9.0", b: "v1.10.0", less: true},
+		{a: "v1", b: "1.0.1", less: true},
+		{a: "1.0.0-rc.1", b: "1.0.0", less: true},
+		{a: "1.0.0", b: "1.0.0-rc.1", less: false},
+		// 数字标识按数值比较
+		{a: "1.0.0-rc.9", b: "1.0.0-rc.10", less: true},
+		{a: "1.0.0-rc.10", b: "1.0.0-rc.9", less: false},
+		// 数字标识小于非数字标识
+		{a: "1.0.0-alpha.1", b: "1.0.0-alpha.beta", less: true},
+		{a: "1.0.0-1", b: "1.0.0-alpha", less: true},
+		// 前面的标识相同时标识少的较小
+		{a: "1.0.0-alpha", b: "1.0.0-alpha.1", less: true},
+		{a: "1.0.0-beta.11", b: "1.0.0-rc.1", less: true},
+		// 构建信息不参与比较
+		{a: "1.0.0-rc.1+build.2", b: "1.0.0-rc.1+build.1", less: false},
+		{a: "1.0.0-rc.1", b: "1.0.0-rc.1", less: false},
+	}
+	for _, tt := range tests {
+		a, aok := parseSemver(tt.a)
+		b, bok := parseSemver(tt.b)
+		if !aok || !bok {
+			t.Fatalf("%s, %s: expect semver", tt.a, tt.b)
+		}
+		if got := a.less(b); got != tt.less {
+			t.Fatalf("%s < %s: expect %v, got %v", tt.a, tt.b, tt.less, got)
+		}
+	}
+	if _, ok := parseSemver("1.0.0-rc..1"); ok {
+		t.Fatal("expect empty prerelease identifier rejected")
+	}
+}
+
+func TestResolveValue(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "User-Id", "u1")
+	p := newTestPersona(t)
+	appKeys := []VersionKeyValue{
+		{Version: "v1.2.0", Key: "a", Value: "app_a"},
+		{Version: "v1.9.0", Key: "b", Value: "app_b_1.9"},
+		{Version: "v1.10.0", Key: "b", Value: "app_b_1.10"},
+		{Version: "v2.1.0", Key: "b", Value: "app_b_2.1"},
+		{Version: "v1.0.0", Key: "c", Value: "app_c"},
+	}
+	if _, err := p.SetValue(ctx, &BatchSetValueReq{Keys: appKeys}); err != nil {
+		t.Fatal(err)
+	}
+	userKeys := []VersionKeyValue{
+		{Version: "v2.0.0", Key: "a", Value: "user_a"},
+		{Version: "v1.0.0", Key: "c", Value: "user_c"},
+	}
+	if _, err := p.UserSetValue(ctx, &BatchSetValueReq{Keys: userKeys}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := &BatchGetValueReq{
+		Keys: []VersionKey{
+			{Version: "v2.0.0", Key: "a"},
+			{Version: "v1.2.0", Key: "a"},
+			{Version: "v2.0.0", Key: "b"},
+			{Version: "v2.0.0", Key: "c"},
+			{Version: "v2.0.0", Key: "d"},
+		},
+		Resolve: []string{LayerUser, LayerApp, LayerPrevious},
+	}
+	want := []struct {
+		layer, version, value string
+	}{
+		{LayerUser, "v2.0.0", "user_a"},
+		{LayerApp, "v1.2.0", "app_a"},
+		{LayerPrevious, "v1.10.0", "app_b_1.10"},
+		{LayerPrevious, "v1.0.0", "user_c"},
+		{"", "", ""},
+	}
+	for i := range req.Keys {
+		resp, err := p.UserGetValue(ctx, &BatchGetValueReq{Keys: req.Keys[i : i+1], Resolve: req.Resolve})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := resp.Status[0]
+		if s.Layer != want[i].layer || s.ResolvedVersion != want[i].version || resp.Result[s.Key] != want[i].value {
+			t.Fatalf("key %s@%s: expect %+v, got %+v %v", s.Key, s.Version, want[i], s, resp.Result)
+		}
+	}
+	resp, err := p.GetValue(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status[4].Status != StatusNotFound {
+		t.Fatalf("expect not found, got %+v", resp.Status[4])
+	}
+
+	// 只查找应用时不使用用户的值
+	resp, err = p.GetValue(ctx, &BatchGetValueReq{Keys: req.Keys[3:4], Resolve: []string{LayerApp, LayerPrevious}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Result["c"] != "app_c" {
+		t.Fatalf("expect app value, got %v", resp.Result)
+	}
+
+	if _, err := p.GetValue(ctx, &BatchGetValueReq{Keys: req.Keys, Resolve: []string{LayerApp, "other"}}); err == nil {
+		t.Fatal("expect error with unknown layer")
+	}
+}
+
+func TestPatchValue(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPersona(t)
+	set := func(value VersionKeyValue) *KeyStatus {
+		resp, err := p.SetValue(ctx, &BatchSetValueReq{Keys: []VersionKeyValue{value}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Status[0]
+	}
+	get := func(key VersionKey) (*KeyStatus, string) {
+		resp, err := p.GetValue(ctx, &BatchGetValueReq{Keys: []VersionKey{key}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Status[0], resp.Result[key.Key]
+	}
+
+	if s := set(VersionKeyValue{Version: "v1", Key: "a", Value: `{"theme":"dark","size":1}`, PatchType: PatchMerge}); s.Status != StatusSuccess {
+		t.Fatalf("merge patch on missing value: %+v", s)
+	}
+	if s := set(VersionKeyValue{Version: "v1", Key: "a", Value: `{"size":null,"lang":"zh"}`, PatchType: PatchMerge}); s.Status != StatusSuccess {
+		t.Fatalf("merge patch: %+v", s)
+	}
+	patch := `[{"op":"test","path":"/theme","value":"dark"},{"op":"add","path":"/tabs","value":["x"]}]`
+	if s := set(VersionKeyValue{Version: "v1", Key: "a", Value: patch, PatchType: PatchJSON}); s.Status != StatusSuccess {
+		t.Fatalf("json patch: %+v", s)
+	}
+	if _, v := get(VersionKey{Version: "v1", Key: "a"}); v != `{"lang":"zh","tabs":["x"],"theme":"dark"}` {
+		t.Fatalf("unexpected patched value: %s", v)
+	}
+
+	// 并发修改时重新读取并应用补丁，不覆盖他人的修改
+	storage := p.daoRepo.(*faultyStorage)
+	storage.beforePut = func() {
+		storage.beforePut = nil
+		if err := storage.PutWithVersion(ctx, "v1", "a", `{"theme":"light"}`); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := set(VersionKeyValue{Version: "v1", Key: "a", Value: `{"lang":"en"}`, PatchType: PatchMerge}); s.Status != StatusSuccess {
+		t.Fatalf("merge patch with concurrent write: %+v", s)
+	}
+	if _, v := get(VersionKey{Version: "v1", Key: "a"}); v != `{"lang":"en","theme":"light"}` {
+		t.Fatalf("concurrent write lost: %s", v)
+	}
+
+	if s := set(VersionKeyValue{Version: "v1", Key: "a", Value: `[{"op":"remove","path":"/missing"}]`, PatchType: PatchJSON}); s.Code != code.InvalidPatch {
+		t.Fatalf("expect invalid patch, got %+v", s)
+	}
+	set(VersionKeyValue{Version: "v1", Key: "text", Value: "plain"})
+	if s := set(VersionKeyValue{Version: "v1", Key: "text", Value: `{}`, PatchType: PatchMerge}); s.Code != code.InvalidJSONValue {
+		t.Fatalf("expect invalid json value, got %+v", s)
+	}
+
+	if s, v := get(VersionKey{Version: "v1", Key: "a", Pointer: "/theme"}); s.Status != StatusFound || v != `"light"` {
+		t.Fatalf("unexpected pointer read: %+v %s", s, v)
+	}
+	if s, _ := get(VersionKey{Version: "v1", Key: "a", Pointer: "/missing"}); s.Status != StatusNotFound {
+		t.Fatalf("expect not found, got %+v", s)
+	}
+	if s, _ := get(VersionKey{Version: "v1", Key: "text", Pointer: "/a"}); s.Code != code.InvalidJSONValue {
+		t.Fatalf("expect invalid json value, got %+v", s)
+	}
+}
+
+func TestSchemaValidation(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPersona(t)
+
+	if _, err := p.SetSchema(ctx, &SetSchemaReq{Prefix: "app_id:a:", Schema: `{"type":`}); !isCode(err, code.InvalidSchema) {
+		t.Fatalf("expect invalid schema, got %v", err)
+	}
+	dataSetType := int64(2)
+	if _, err := p.SetSchema(ctx, &SetSchemaReq{Prefix: "app_id:a:", DataSetType: &dataSetType, Schema: `{}`}); !isCode(err, code.InvalidParams) {
+		t.Fatalf("expect invalid params, got %v", err)
+	}
+	schemas := []*SetSchemaReq{
+		{Prefix: "app_id:a:", Schema: `{"type":"object","required":["theme"]}`},
+		{Prefix: "app_id:a:page:", Schema: `{"type":"object","properties":{"size":{"type":"integer","minimum":1}}}`},
+		{DataSetType: &dataSetType, Schema: `{"type":"array","items":{"type":"string"}}`},
+	}
+	for _, req := range schemas {
+		if _, err := p.SetSchema(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err := p.ListSchemas(ctx, &ListSchemasReq{})
+	if err != nil || len(list.List) != 3 {
+		t.Fatalf("unexpected schemas: %+v %v", list, err)
+	}
+
+	resp, err := p.SetValue(ctx, &BatchSetValueReq{Keys: []VersionKeyValue{
+		{Version: "v1", Key: "app_id:a:theme", Value: `{"theme":"dark"}`},
+		{Version: "v1", Key: "app_id:a:other", Value: `{}`},
+		{Version: "v1", Key: "app_id:a:page:1", Value: `{"size":0}`},
+		{Version: "v1", Key: "app_id:b:free", Value: `plain`},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expects := []struct {
+		code    int64
+		message string
+	}{
+		{error2.Success, ""},
+		{code.SchemaViolation, "/theme"},
+		{code.SchemaViolation, "/size"},
+		{error2.Success, ""},
+	}
+	for i, e := range expects {
+		s := resp.Status[i]
+		if s.Code != e.code || !strings.Contains(s.Message, e.message) {
+			t.Fatalf("key %s: expect code %d with %q, got %+v", s.Key, e.code, e.message, s)
+		}
+	}
+
+	// 补丁应用后的值也需要符合
+	resp, err = p.SetValue(ctx, &BatchSetValueReq{Keys: []VersionKeyValue{
+		{Version: "v1", Key: "app_id:a:theme", Value: `{"theme":null}`, PatchType: PatchMerge},
+	}})
+	if err != nil || resp.Status[0].Code != code.SchemaViolation {
+		t.Fatalf("expect schema violation after patch, got %+v %v", resp, err)
+	}
+
+	if _, err := p.CreateDataset(ctx, &CreateDataSetReq{Type: dataSetType, Content: `["a",1]`}); !isCode(err, code.SchemaViolation) {
+		t.Fatalf("expect schema violation, got %v", err)
+	}
+	created, err := p.CreateDataset(ctx, &CreateDataSetReq{Type: dataSetType, Content: `["a"]`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.UpdateDataSet(ctx, &UpdateDataSetReq{ID: created.ID, Type: dataSetType, Content: `{}`}); !isCode(err, code.SchemaViolation) {
+		t.Fatalf("expect schema violation, got %v", err)
+	}
+	if _, err := p.DeleteSchema(ctx, &DeleteSchemaReq{ID: created.ID}); !isCode(err, code.InvalidParams) {
+		t.Fatalf("expect invalid params when deleting a dataset as schema, got %v", err)
+	}
+	if _, err := p.DeleteSchema(ctx, &DeleteSchemaReq{ID: "schema_key_missing"}); !isCode(err, code.InvalidParams) {
+		t.Fatalf("expect invalid params when deleting a missing schema, got %v", err)
+	}
+	dataSets, err := p.GetByConditionSet(ctx, &GetByConditionSetReq{})
+	if err != nil || len(dataSets.List) != 1 || dataSets.List[0].ID != created.ID {
+		t.Fatalf("expect only the dataset, got %+v %v", dataSets, err)
+	}
+	if _, err := p.SetSchema(ctx, &SetSchemaReq{Prefix: "app_id:b:", Schema: `{"format":"email"}`}); !isCode(err, code.InvalidSchema) {
+		t.Fatalf("expect unsupported keyword rejected, got %v", err)
+	}
+
+	imported, err := p.ImportData(ctx, &ImportDataReq{
+		AppData: []db.ImportReqData{
+			{Version: "v1", Key: "app_id:a:new", Value: `{"theme":"light"}`},
+			{Version: "v1", Key: "app_id:a:bad", Value: `[]`},
+		},
+		DataSets: []*DataSetVo{{ID: "ds1", Type: dataSetType, Content: `[1]`}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.Committed || imported.Status[0].Status != StatusCreated ||
+		imported.Status[1].Status != StatusInvalid || imported.Status[1].Code != code.SchemaViolation ||
+		imported.DataSetStatus[0].Status != StatusInvalid {
+		t.Fatalf("unexpected import result: %+v %+v %+v", imported, imported.Status[1], imported.DataSetStatus[0])
+	}
+
+	if _, err := p.DeleteSchema(ctx, &DeleteSchemaReq{ID: "schema_key_app_id:a:"}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = p.SetValue(ctx, &BatchSetValueReq{Keys: []VersionKeyValue{
+		{Version: "v1", Key: "app_id:a:other", Value: `{}`},
+	}})
+	if err != nil || resp.Status[0].Code != error2.Success {
+		t.Fatalf("expect success after schema deleted, got %+v %v", resp, err)
+	}
+}
+
+func isCode(err error, c int64) bool {
+	e, ok := err.(error2.Error)
+	return ok && e.Code == c
+}
+
+func TestValueTTL(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPersona(t)
+	resp, err := p.SetValue(ctx, &BatchSetValueReq{Keys: []VersionKeyValue{
+		{Version: "v1", Key: "draft", Value: "temp", TTL: 1},
+		{Version: "v1", Key: "flag", Value: "kept"},
+	}})
+	if err != nil || len(resp.FailKeys) != 0 {
+		t.Fatalf("unexpected set result: %+v %v", resp, err)
+	}
+	get := func() *BatchGetValueResp {
+		resp, err := p.GetValue(ctx, &BatchGetValueReq{Keys: []VersionKey{
+			{Version: "v1", Key: "draft"},
+			{Version: "v1", Key: "flag"},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	if got := get(); got.Result["draft"] != "temp" || got.Result["flag"] != "kept" {
+		t.Fatalf("unexpected values before expiry: %v", got.Result)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	got := get()
+	if _, ok := got.Result["draft"]; ok || got.Status[0].Status != StatusNotFound || got.Result["flag"] != "kept" {
+		t.Fatalf("unexpected values after expiry: %v %+v", got.Result, got.Status[0])
+	}
+}
+
+func TestWatchExpiry(t *testing.T) {
+	p := newTestPersona(t)
+	expirer := p.daoRepo.(*faultyStorage).BackendStorage.(db.Expirer)
+	expirer.OnExpire(p.feed.expire)
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), "User-Id", "u1"))
+	defer cancel()
+	req := &WatchReq{Version: "v1", Keys: []string{"draft"}}
+	appChanges, err := p.Watch(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userChanges, err := p.UserWatch(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := &BatchSetValueReq{Keys: []VersionKeyValue{{Version: "v1", Key: "draft", Value: "temp", TTL: 1}}}
+	if _, err := p.SetValue(ctx, set); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.UserSetValue(ctx, set); err != nil {
+		t.Fatal(err)
+	}
+	for _, changes := range []<-chan *ChangeEvent{appChanges, userChanges} {
+		if e := <-changes; e.Type != EventPut {
+			t.Fatalf("expect put, got %+v", e)
+		}
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if n, err := expirer.Sweep(context.Background()); err != nil || n != 2 {
+		t.Fatalf("expect 2 swept, got %d %v", n, err)
+	}
+	for _, changes := range []<-chan *ChangeEvent{appChanges, userChanges} {
+		select {
+		case e := <-changes:
+			if e.Type != EventDelete || e.Key != "draft" || e.Revision != db.RevisionNotExist {
+				t.Fatalf("expect expiry delete, got %+v", e)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for expiry")
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := newTestPersona(t)
+	if _, err := p.Watch(ctx, &WatchReq{Version: "v1"}); !isCode(err, code.InvalidParams) {
+		t.Fatalf("expect invalid params, got %v", err)
+	}
+	changes, err := p.Watch(ctx, &WatchReq{Version: "v1", Prefix: "app_id:a:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	userCtx := context.WithValue(ctx, "User-Id", "u1")
+	userChanges, err := p.UserWatch(userCtx, &WatchReq{Version: "v1", Keys: []string{"theme"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.SetValue(ctx, &BatchSetValueReq{Keys: []VersionKeyValue{
+		{Version: "v2", Key: "app_id:a:k", Value: "other version"},
+		{Version: "v1", Key: "app_id:b:k", Value: "other prefix"},
+		{Version: "v1", Key: "app_id:a:k", Value: "1"},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.DeleteValue(ctx, &BatchDeleteValueReq{Keys: []VersionKey{{Version: "v1", Key: "app_id:a:k"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.ImportData(ctx, &ImportDataReq{AppData: []db.ImportReqData{
+		{Version: "v1", Key: "app_id:a:imported_v1", Value: "2"},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.UserSetValue(userCtx, &BatchSetValueReq{Keys: []VersionKeyValue{
+		{Version: "v1", Key: "theme", Value: "dark"},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	next := func(ch <-chan *ChangeEvent) *ChangeEvent {
+		select {
+		case e := <-ch:
+			return e
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for change")
+		}
+		return nil
+	}
+	expects := []ChangeEvent{
+		{Type: EventPut, Key: "app_id:a:k", Version: "v1", Value: "1"},
+		{Type: EventDelete, Key: "app_id:a:k", Version: "v1"},
+		{Type: EventPut, Key: "app_id:a:imported", Version: "v1", Value: "2"},
+	}
+	for _, want := range expects {
+		got := next(changes)
+		if got.Type != want.Type || got.Key != want.Key || got.Version != want.Version || got.Value != want.Value {
+			t.Fatalf("expect %+v, got %+v", want, got)
+		}
+	}
+	if got := next(userChanges); got.Key != "theme" || got.Value != "dark" {
+		t.Fatalf("unexpected user change: %+v", got)
+	}
+	select {
+	case e := <-changes:
+		t.Fatalf("unexpected change: %+v", e)
+	default:
+	}
+
+	cancel()
+	for range changes {
+	}
+	for range userChanges {
+	}
+	subs := func() int {
+		p.feed.mu.Lock()
+		defer p.feed.mu.Unlock()
+		return len(p.feed.subs)
+	}
+	for i := 0; subs() != 0; i++ {
+		if i == 100 {
+			t.Fatalf("expect subscribers removed, got %d", subs())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatchResync(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := newTestPersona(t)
+	// 进程内的变更无法从断开处恢复，先通知 resync
+	changes, err := p.Watch(ctx, &WatchReq{Version: "v1", Keys: []string{"k"}, Revision: "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := <-changes; e.Type != EventResync || e.ID == "" {
+		t.Fatalf("expect resync, got %+v", e)
+	}
+	set := func(value string) {
+		if _, err := p.SetValue(ctx, &BatchSetValueReq{Keys: []VersionKeyValue{
+			{Version: "v1", Key: "k", Value: value},
+		}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	set("1")
+	first := <-changes
+	set("2")
+	second := <-changes
+	firstID, _ := strconv.Atoi(first.ID)
+	secondID, _ := strconv.Atoi(second.ID)
+	if first.Value != "1" || second.Value != "2" || firstID >= secondID {
+		t.Fatalf("expect increasing ids, got %+v %+v", first, second)
+	}
+
+	// 读取过慢时丢弃未读取的变更，通知 resync 后继续通知
+	filter := db.WatchFilter{Version: "v1", Keys: []string{"k"}}
+	events := p.feed.subscribe(ctx, "", filter, false)
+	for i := 0; i <= feedBuffer; i++ {
+		p.feed.publish(ctx, "", []db.WatchEvent{{Key: "k", Version: "v1", Value: strconv.Itoa(i)}})
+	}
+	if e := <-events; !e.Resync || len(events) != 0 {
+		t.Fatalf("expect only resync after overflow, got %+v and %d more", e, len(events))
+	}
+	p.feed.publish(ctx, "", []db.WatchEvent{{Key: "k", Version: "v1", Value: "after"}})
+	if e := <-events; e.Resync || e.Value != "after" {
+		t.Fatalf("expect change after resync, got %+v", e)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	ctx := context.Background()
+	secret := []byte("secret")
+
+	var fail bool
+	var received []WebhookEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if got := r.Header.Get(SignatureHeader); got != Sign(secret, body) {
+			t.Errorf("unexpected signature: %s", got)
+		}
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var e WebhookEvent
+		if err := json.Unmarshal(body, &e); err != nil {
+			t.Error(err)
+		}
+		received = append(received, e)
+		w.Write([]byte(`{"code":0,"data":null}`))
+	}))
+	defer srv.Close()
+
+	p := newTestPersona(t)
+	p.conf.CallbackURL = srv.URL
+	p.conf.InternalNet.Timeout = 5
+	p.conf.Webhook.Secret = string(secret)
+	p.webhook = newWebhook(p.conf, p.daoRepo)
+	// 失败后立即重试
+	p.webhook.backoff = 0
+	pending := func() int {
+		return pendingDeliveries(t, p.daoRepo)
+	}
+
+	for _, value := range []string{"1", "2"} {
+		if _, err := p.SetValue(ctx, &BatchSetValueReq{Keys: []VersionKeyValue{
+			{Version: "v1", Key: "app_id:a:k", Value: value},
+		}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := p.DeleteValue(ctx, &BatchDeleteValueReq{Keys: []VersionKey{{Version: "v1", Key: "app_id:a:k"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if n := pending(); n != 3 {
+		t.Fatalf("expect 3 pending deliveries, got %d", n)
+	}
+
+	// 投递失败的事件保留在队列中，之后重试
+	fail = true
+	p.webhook.deliverPending(ctx)
+	if n := pending(); n != 3 || len(received) != 0 {
+		t.Fatalf("expect deliveries kept, got %d pending, %d received", n, len(received))
+	}
+	fail = false
+	p.webhook.deliverPending(ctx)
+	if n := pending(); n != 0 {
+		t.Fatalf("expect queue drained, got %d", n)
+	}
+
+	expects := []WebhookEvent{
+		{Operation: OpPut, Key: "app_id:a:k", Version: "v1", NewHash: valueHash("1", true)},
+		{Operation: OpPut, Key: "app_id:a:k", Version: "v1", OldHash: valueHash("1", true), NewHash: valueHash("2", true)},
+		{Operation: OpDelete, Key: "app_id:a:k", Version: "v1", OldHash: valueHash("2", true)},
+	}
+	if len(received) != len(expects) {
+		t.Fatalf("expect %d events, got %+v", len(expects), received)
+	}
+	for i, want := range expects {
+		got := received[i]
+		if got.ID == "" || got.Operation != want.Operation || got.Key != want.Key || got.Version != want.Version ||
+			got.OldHash != want.OldHash || got.NewHash != want.NewHash {
+			t.Fatalf("expect %+v, got %+v", want, got)
+		}
+	}
+
+	// 超过最大投递次数后丢弃
+	p.webhook.maxAttempts = 2
+	fail = true
+	created, err := p.CreateDataset(ctx, &CreateDataSetReq{Name: "d", Content: "[]"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.webhook.deliverPending(ctx)
+	if n := pending(); n != 1 {
+		t.Fatalf("expect delivery %s kept after first failure, got %d", created.ID, n)
+	}
+	p.webhook.deliverPending(ctx)
+	if n := pending(); n != 0 {
+		t.Fatalf("expect delivery dropped, got %d", n)
+	}
+}
+
+// pendingDeliveries 待投递队列中的回调数，包括未到期的
+func pendingDeliveries(t *testing.T, dao db.BackendStorage) int {
+	records, err := dao.ListRecords(context.Background(), db.CollectionDelivery, db.RecordQuery{Group: deliveryGroup})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(records)
+}
+
+// TestWebhookReplicas 多个实例共享队列时每个回调只投递一次，ctx结束时投递退出
+func TestWebhookReplicas(t *testing.T) {
+	var mu sync.Mutex
+	received := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e WebhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		received[e.Key]++
+		mu.Unlock()
+		w.Write([]byte(`{"code":0,"data":null}`))
+	}))
+	defer srv.Close()
+
+	p := newTestPersona(t)
+	p.conf.CallbackURL = srv.URL
+	p.conf.InternalNet.Timeout = 5
+	replicas := []*webhook{newWebhook(p.conf, p.daoRepo), newWebhook(p.conf, p.daoRepo), newWebhook(p.conf, p.daoRepo)}
+	p.webhook = replicas[0]
+	const n = 50
+	for i := 0; i < n; i++ {
+		if _, err := p.SetValue(context.Background(), &BatchSetValueReq{Keys: []VersionKeyValue{
+			{Version: "v1", Key: fmt.Sprintf("app_id:a:%d", i), Value: "v"},
+		}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for _, w := range replicas {
+		w := w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.run(ctx)
+		}()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for pendingDeliveries(t, p.daoRepo) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for deliveries")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	wg.Wait()
+
+	if len(received) != n {
+		t.Fatalf("expect %d events, got %d", n, len(received))
+	}
+	for key, count := range received {
+		if count != 1 {
+			t.Fatalf("event of %s delivered %d times", key, count)
+		}
+	}
+}
+
+func TestUserData(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPersona(t)
+	p.conf.CallbackURL = "http://127.0.0.1:0"
+	p.webhook = newWebhook(p.conf, p.daoRepo)
+	set := func(userID string, kvs ...VersionKeyValue) {
+		resp, err := p.UserSetValue(context.WithValue(ctx, "User-Id", userID), &BatchSetValueReq{Keys: kvs})
+		if err != nil || len(resp.FailKeys) != 0 {
+			t.Fatalf("set: %+v %v", resp, err)
+		}
+	}
+	set("u1",
+		VersionKeyValue{Version: "v1", Key: "app_id:a:theme", Value: "light"},
+		VersionKeyValue{Version: "v1", Key: "app_id:b:lang", Value: "en"},
+	)
+	set("u1", VersionKeyValue{Version: "v1", Key: "app_id:a:theme", Value: "dark"})
+	set("u2", VersionKeyValue{Version: "v1", Key: "app_id:a:theme", Value: "u2"})
+	// u1 修改应用级数据，记录中的操作人在删除用户数据时清除
+	operator := context.WithValue(context.WithValue(ctx, "User-Id", "u1"), "User-Name", "User One")
+	if _, err := p.SetValue(operator, &BatchSetValueReq{Keys: []VersionKeyValue{
+		{Version: "v1", Key: "app_id:a:theme", Value: "app"},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	exported, err := p.ExportUserData(ctx, &ExportUserDataReq{UserID: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []UserValueVo{
+		{Version: "v1", Key: "app_id:a:theme", Value: "dark"},
+		{Version: "v1", Key: "app_id:b:lang", Value: "en"},
+	}
+	if len(exported.Values) != len(want) {
+		t.Fatalf("expect %d values, got %+v", len(want), exported.Values)
+	}
+	for i, v := range exported.Values {
+		if *v != want[i] {
+			t.Fatalf("expect %+v, got %+v", want[i], v)
+		}
+	}
+	if len(exported.History) != 3 || exported.History[0].Value != "light" {
+		t.Fatalf("unexpected history: %+v", exported.History)
+	}
+
+	erased, err := p.EraseUserData(ctx, &EraseUserDataReq{UserID: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if erased.Values != 2 || erased.History != 3 || erased.Redacted != 1 || erased.Deliveries != 3 {
+		t.Fatalf("unexpected erase result: %+v", erased)
+	}
+	appHistory, err := p.ListHistory(ctx, &ListHistoryReq{Version: "v1", Key: "app_id:a:theme"})
+	if err != nil || len(appHistory.List) != 1 || appHistory.List[0].Operator != "" || appHistory.List[0].OperatorName != "" {
+		t.Fatalf("expect operator redacted, got %+v %v", appHistory, err)
+	}
+	// 只删除该用户的回调，应用级数据及其他用户的回调保留，删除后产生一个 erase 回调
+	if n := pendingDeliveries(t, p.daoRepo); n != 3 {
+		t.Fatalf("expect 3 deliveries left, got %d", n)
+	}
+	// erase 回调不关联该用户，再次删除时不会被删除
+	if again, err := p.EraseUserData(ctx, &EraseUserDataReq{UserID: "u1"}); err != nil || again.Deliveries != 0 {
+		t.Fatalf("expect erase delivery kept, got %+v %v", again, err)
+	}
+	if exported, err = p.ExportUserData(ctx, &ExportUserDataReq{UserID: "u1"}); err != nil ||
+		len(exported.Values) != 0 || len(exported.History) != 0 {
+		t.Fatalf("expect nothing left, got %+v %v", exported, err)
+	}
+	if exported, err = p.ExportUserData(ctx, &ExportUserDataReq{UserID: "u2"}); err != nil || len(exported.Values) != 1 {
+		t.Fatalf("other user affected: %+v %v", exported, err)
+	}
+	got, err := p.GetValue(ctx, &BatchGetValueReq{Keys: []VersionKey{{Version: "v1", Key: "app_id:a:theme"}}})
+	if err != nil || got.Result["app_id:a:theme"] != "app" {
+		t.Fatalf("app value affected: %+v %v", got, err)
+	}
+
+	// 部分步骤失败时其他步骤照常执行，并明确返回未完成
+	set("fail_u", VersionKeyValue{Version: "v1", Key: "app_id:a:theme", Value: "x"})
+	erased, err = p.EraseUserData(ctx, &EraseUserDataReq{UserID: "fail_u"})
+	var e error2.Error
+	if !errors.As(err, &e) || e.Code != code.EraseIncomplete || !strings.Contains(e.Message, "values") {
+		t.Fatalf("expect erase incomplete, got %v", err)
+	}
+	if erased.History != 1 || erased.Deliveries != 1 {
+		t.Fatalf("expect other steps done, got %+v", erased)
+	}
+}
+
+func TestWatchTenant(t *testing.T) {
+	p := newTestPersona(t)
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), db.TenantHeader, "tenant-a"))
+	defer cancel()
+	changes, err := p.Watch(ctx, &WatchReq{Version: "v1", Prefix: "app_id:a:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tenant := range []string{"tenant-b", "tenant-a"} {
+		if _, err := p.SetValue(context.WithValue(context.Background(), db.TenantHeader, tenant), &BatchSetValueReq{Keys: []VersionKeyValue{
+			{Version: "v1", Key: "app_id:a:k", Value: tenant},
+		}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case e := <-changes:
+		if e.Value != "tenant-a" {
+			t.Fatalf("change of other tenant leaked: %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for change")
+	}
+}
@@ -0,0 +1,135 @@
+package persona
+
+import (
+	"context"
+
+	"git.internal.yunify.com/qxp/persona/pkg/code"
+	"git.internal.yunify.com/qxp/persona/pkg/db"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/error2"
+)
+
+const (
+	// LayerUser 当前用户在请求版本的值
+	LayerUser = "user"
+	// LayerApp 应用在请求版本的值，即应用默认值
+	LayerApp = "app"
+	// LayerPrevious 按语义化版本号早于请求版本的最新值，
+	// 依次查找在其之前列出的用户、应用，都未列出时只查找应用
+	LayerPrevious = "previous"
+)
+
+// versionLister 列出key的所有版本
+type versionLister func(ctx context.Context, key string) ([]db.VersionKV, error)
+
+// resolveValues 按 req.Resolve 的顺序逐层查找，未找到的key继续在下一层查找
+func (p *persona) resolveValues(ctx context.Context, req *BatchGetValueReq) (*BatchGetValueResp, error) {
+	seen := make(map[string]bool, len(req.Resolve))
+	for _, layer := range req.Resolve {
+		if seen[layer] || (layer != LayerUser && layer != LayerApp && layer != LayerPrevious) {
+			return nil, error2.NewError(code.InvalidParams)
+		}
+		seen[layer] = true
+	}
+
+	resp := &BatchGetValueResp{
+		Result: make(map[string]string, 0),
+		Status: make([]*KeyStatus, 0, len(req.Keys)),
+	}
+	for _, value := range req.Keys {
+		resp.Status = append(resp.Status, &KeyStatus{
+			Key:     value.Key,
+			Version: value.Version,
+			Status:  StatusNotFound,
+		})
+	}
+
+	// pending 还未找到的key在请求中的位置
+	pending := make([]int, 0, len(req.Keys))
+	for i := range req.Keys {
+		pending = append(pending, i)
+	}
+	listers := make([]versionLister, 0, 2)
+	for _, layer := range req.Resolve {
+		switch layer {
+		case LayerUser:
+			pending = p.resolveLayer(ctx, req, resp, pending, layer, p.daoRepo.UserMultiGetWithVersion)
+			listers = append(listers, p.daoRepo.UserListVersions)
+		case LayerApp:
+			pending = p.resolveLayer(ctx, req, resp, pending, layer, p.daoRepo.MultiGetWithVersion)
+			listers = append(listers, p.daoRepo.ListVersions)
+		case LayerPrevious:
+			if len(listers) == 0 {
+				listers = append(listers, p.daoRepo.ListVersions)
+			}
+			pending = p.resolvePrevious(ctx, req, resp, pending, listers)
+		}
+	}
+	return resp, nil
+}
+
+// resolveLayer 读取请求版本的值，返回仍未找到的key，读取失败的key不再继续查找
+func (p *persona) resolveLayer(ctx context.Context, req *BatchGetValueReq, resp *BatchGetValueResp,
+	pending []int, layer string, get multiGetFunc) []int {
+	if len(pending) == 0 {
+		return pending
+	}
+	keys := make([]db.VersionKV, 0, len(pending))
+	for _, i := range pending {
+		keys = append(keys, db.VersionKV{
+			Version: req.Keys[i].Version,
+			Key:     req.Keys[i].Key,
+		})
+	}
+	results, err := get(ctx, keys)
+
+	rest := make([]int, 0, len(pending))
+	for j, i := range pending {
+		status := resp.Status[i]
+		switch {
+		case err != nil:
+			status.withError(ctx, err)
+		case results[j].Err != nil:
+			status.withError(ctx, results[j].Err)
+		case !results[j].Found:
+			rest = append(rest, i)
+		default:
+			resp.resolved(ctx, status, req.Keys[i].Pointer, layer, req.Keys[i].Version, results[j])
+		}
+	}
+	return rest
+}
+
+// resolvePrevious 依次在各层查找早于请求版本的最新值，返回仍未找到的key
+func (p *persona) resolvePrevious(ctx context.Context, req *BatchGetValueReq, resp *BatchGetValueResp,
+	pending []int, listers []versionLister) []int {
+	rest := make([]int, 0, len(pending))
+	for _, i := range pending {
+		status := resp.Status[i]
+		found, failed := false, false
+		for _, list := range listers {
+			versions, err := list(ctx, req.Keys[i].Key)
+			if err != nil {
+				status.withError(ctx, err)
+				failed = true
+				break
+			}
+			if prev, ok := previousVersion(versions, req.Keys[i].Version); ok {
+				resp.resolved(ctx, status, req.Keys[i].Pointer, LayerPrevious, prev.Version, db.GetResult{Value: prev.Value, Found: true})
+				found = true
+				break
+			}
+		}
+		if !found && !failed {
+			rest = append(rest, i)
+		}
+	}
+	return rest
+}
+
+// resolved 记录某一层找到的值
+func (r *BatchGetValueResp) resolved(ctx context.Context, status *KeyStatus, pointer string, layer string, version string, result db.GetResult) {
+	status.Layer = layer
+	status.ResolvedVersion = version
+	status.Revision = result.Revision
+	r.found(ctx, status, pointer, result.Value)
+}
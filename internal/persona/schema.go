@@ -0,0 +1,284 @@
+package persona
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.internal.yunify.com/qxp/persona/internal/model"
+	"git.internal.yunify.com/qxp/persona/pkg/code"
+	"git.internal.yunify.com/qxp/persona/pkg/db"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/error2"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/json2"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/logger"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/time2"
+)
+
+// typeOfSchema JSON Schema 在存储中的数据类型
+const typeOfSchema = "schema"
+
+// SetSchema 注册 JSON Schema，同一前缀或数据集类型重复注册时覆盖
+func (p *persona) SetSchema(ctx context.Context, req *SetSchemaReq) (*SetSchemaResp, error) {
+	if (req.Prefix == "") == (req.DataSetType == nil) {
+		return nil, error2.NewError(code.InvalidParams)
+	}
+	if _, err := json2.CompileSchema(req.Schema); err != nil {
+		return nil, error2.NewError(code.InvalidSchema, err.Error())
+	}
+	id := "schema_key_" + req.Prefix
+	if req.DataSetType != nil {
+		id = "schema_dataSet_" + strconv.FormatInt(*req.DataSetType, 10)
+	}
+	schema := model.Schema{
+		ID:          id,
+		Prefix:      req.Prefix,
+		DataSetType: req.DataSetType,
+		Schema:      req.Schema,
+		CreatedAt:   time2.NowUnix(),
+		DataType:    typeOfSchema,
+	}
+	if err := p.daoRepo.PutData(&ctx, &id, schema); err != nil {
+		return nil, err
+	}
+	p.schemas.invalidate(ctx)
+	return &SetSchemaResp{ID: id}, nil
+}
+
+// ListSchemas 所有已注册的 JSON Schema
+func (p *persona) ListSchemas(ctx context.Context, req *ListSchemasReq) (*ListSchemasResp, error) {
+	list, err := p.listSchemas(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return &ListSchemasResp{List: list}, nil
+}
+
+// DeleteSchema 删除 JSON Schema，id 不是已注册的 JSON Schema 时返回参数错误，不会删除数据集
+func (p *persona) DeleteSchema(ctx context.Context, req *DeleteSchemaReq) (*DeleteSchemaResp, error) {
+	d, err := p.daoRepo.GetData(&ctx, &req.ID)
+	if err != nil {
+		return nil, err
+	}
+	var stored struct {
+		DataType string `json:"data_type"`
+	}
+	if d == nil || json.Unmarshal(*d, &stored) != nil || stored.DataType != typeOfSchema {
+		return nil, error2.NewError(code.InvalidParams)
+	}
+	if err := p.daoRepo.DeleteData(&ctx, &req.ID); err != nil {
+		return nil, err
+	}
+	p.schemas.invalidate(ctx)
+	return &DeleteSchemaResp{}, nil
+}
+
+func (p *persona) listSchemas(ctx context.Context) ([]*SchemaVo, error) {
+	kvs := map[string]interface{}{
+		"data_type": typeOfSchema,
+	}
+	dataList, err := p.daoRepo.GetDataByKVs(&ctx, &kvs)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*SchemaVo, 0, len(dataList))
+	for _, d := range dataList {
+		var schema SchemaVo
+		if err := json.Unmarshal(*d, &schema); err != nil {
+			return nil, err
+		}
+		list = append(list, &schema)
+	}
+	return list, nil
+}
+
+// schemaCacheTTL 缓存的有效期，其他实例注册或删除的 JSON Schema 最迟在该时间后生效
+const schemaCacheTTL = 30 * time.Second
+
+// schemaCache 按租户缓存已解析的 JSON Schema，本实例注册、删除时失效
+type schemaCache struct {
+	mu      sync.Mutex
+	entries map[string]schemaEntry
+	// gen 每次失效时递增，加载期间发生失效的结果不再缓存
+	gen int64
+}
+
+type schemaEntry struct {
+	schemas  *schemas
+	loadedAt time.Time
+}
+
+func newSchemaCache() *schemaCache {
+	return &schemaCache{
+		entries: make(map[string]schemaEntry),
+	}
+}
+
+// get 租户未过期的缓存及当前的gen
+func (c *schemaCache) get(tenant string) (*schemas, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[tenant]
+	if !ok || time.Since(e.loadedAt) > schemaCacheTTL {
+		return nil, c.gen
+	}
+	return e.schemas, c.gen
+}
+
+// set 加载开始后没有失效时缓存
+func (c *schemaCache) set(tenant string, gen int64, s *schemas, loadedAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen == c.gen {
+		c.entries[tenant] = schemaEntry{schemas: s, loadedAt: loadedAt}
+	}
+}
+
+func (c *schemaCache) invalidate(ctx context.Context) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, logger.STDHeader(ctx)[db.TenantHeader])
+	c.gen++
+}
+
+// schemas 已注册的 JSON Schema，加载后只读，可在请求间共享
+type schemas struct {
+	// keys 按前缀长度倒序，key匹配最长的前缀
+	keys     []keySchema
+	dataSets map[int64]*json2.Schema
+}
+
+type keySchema struct {
+	prefix string
+	schema *json2.Schema
+}
+
+// loadSchemas 当前租户的所有 JSON Schema，优先使用缓存
+func (p *persona) loadSchemas(ctx context.Context) (*schemas, error) {
+	tenant := logger.STDHeader(ctx)[db.TenantHeader]
+	s, gen := p.schemas.get(tenant)
+	if s != nil {
+		return s, nil
+	}
+	loadedAt := time.Now()
+	s, err := p.readSchemas(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.schemas.set(tenant, gen, s, loadedAt)
+	return s, nil
+}
+
+// readSchemas 从存储加载所有 JSON Schema，无法解析的记录日志后忽略
+func (p *persona) readSchemas(ctx context.Context) (*schemas, error) {
+	list, err := p.listSchemas(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s := &schemas{
+		dataSets: make(map[int64]*json2.Schema),
+	}
+	for _, vo := range list {
+		schema, err := json2.CompileSchema(vo.Schema)
+		if err != nil {
+			logger.Logger.Errorw(vo.ID+": "+err.Error(), logger.STDRequestID(ctx))
+			continue
+		}
+		switch {
+		case vo.DataSetType != nil:
+			s.dataSets[*vo.DataSetType] = schema
+		case vo.Prefix != "":
+			s.keys = append(s.keys, keySchema{prefix: vo.Prefix, schema: schema})
+		}
+	}
+	sort.Slice(s.keys, func(i, j int) bool {
+		return len(s.keys[i].prefix) > len(s.keys[j].prefix)
+	})
+	return s, nil
+}
+
+// validateValue 按key匹配的最长前缀的 JSON Schema 校验，没有匹配的不校验
+func (s *schemas) validateValue(key string, value string) error {
+	for _, k := range s.keys {
+		if strings.HasPrefix(key, k.prefix) {
+			return schemaError(k.schema.Validate(value))
+		}
+	}
+	return nil
+}
+
+// validateDataSet 按数据集类型的 JSON Schema 校验数据集内容
+func (s *schemas) validateDataSet(dataSetType int64, content string) error {
+	if schema, ok := s.dataSets[dataSetType]; ok {
+		return schemaError(schema.Validate(content))
+	}
+	return nil
+}
+
+// schemaError 校验失败时返回带有不符合的JSON路径的错误
+func schemaError(err error) error {
+	var e *json2.ValidationError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &e):
+		return error2.NewError(code.SchemaViolation, e.Error())
+	default:
+		return error2.NewError(code.InvalidJSONValue)
+	}
+}
+
+// validateDataSet 数据集内容的校验，用于单个数据集的创建及修改
+func (p *persona) validateDataSet(ctx context.Context, dataSetType int64, content string) error {
+	s, err := p.loadSchemas(ctx)
+	if err != nil {
+		return err
+	}
+	return s.validateDataSet(dataSetType, content)
+}
+
+// SetSchemaReq req
+type SetSchemaReq struct {
+	// Prefix 以该前缀开头的key，匹配多个前缀时使用最长的
+	Prefix string `json:"prefix"`
+	// DataSetType 该类型的数据集内容
+	DataSetType *int64 `json:"dataSetType"`
+	Schema      string `json:"schema" binding:"required"`
+}
+
+// SetSchemaResp resp
+type SetSchemaResp struct {
+	ID string `json:"id"`
+}
+
+// ListSchemasReq req
+type ListSchemasReq struct{}
+
+// ListSchemasResp resp
+type ListSchemasResp struct {
+	List []*SchemaVo `json:"list"`
+}
+
+// SchemaVo JSON Schema
+type SchemaVo struct {
+	ID          string `json:"id"`
+	Prefix      string `json:"prefix,omitempty"`
+	DataSetType *int64 `json:"dataset_type,omitempty"`
+	Schema      string `json:"schema"`
+	CreatedAt   int64  `json:"created_at"`
+}
+
+// DeleteSchemaReq req
+type DeleteSchemaReq struct {
+	ID string `json:"id" binding:"required"`
+}
+
+// DeleteSchemaResp resp
+type DeleteSchemaResp struct{}
@@ -0,0 +1,203 @@
+package persona
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"git.internal.yunify.com/qxp/persona/internal/model"
+	"git.internal.yunify.com/qxp/persona/pkg/code"
+	"git.internal.yunify.com/qxp/persona/pkg/db"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/error2"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/logger"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/time2"
+)
+
+// ExportUserData 导出用户在所有应用、所有版本下的用户级数据及其修改记录
+func (p *persona) ExportUserData(ctx context.Context, req *ExportUserDataReq) (*ExportUserDataResp, error) {
+	kvs, err := p.daoRepo.ListUserData(ctx, req.UserID)
+	if err != nil {
+		return nil, err
+	}
+	histories, err := p.userHistory(ctx, req.UserID)
+	if err != nil {
+		return nil, err
+	}
+	resp := &ExportUserDataResp{
+		UserID:     req.UserID,
+		ExportedAt: time2.NowUnix(),
+		Values:     make([]*UserValueVo, 0, len(kvs)),
+		History:    make([]*HistoryVo, 0, len(histories)),
+	}
+	for _, kv := range kvs {
+		resp.Values = append(resp.Values, &UserValueVo{
+			Version: kv.Version,
+			Key:     kv.Key,
+			Value:   kv.Value,
+		})
+	}
+	for _, h := range histories {
+		resp.History = append(resp.History, historyVo(h))
+	}
+	return resp, nil
+}
+
+// EraseUserData 删除用户在所有应用、所有版本下的用户级数据及其修改记录和待投递的回调，
+// 并清除应用级数据的修改记录中该用户的操作人信息。
+// 各步骤互不影响，任一步骤失败时返回 EraseIncomplete 并列出失败的步骤，重试即可
+func (p *persona) EraseUserData(ctx context.Context, req *EraseUserDataReq) (*EraseUserDataResp, error) {
+	resp := &EraseUserDataResp{}
+	failed := make([]string, 0)
+	fail := func(step string, err error) {
+		logger.Logger.Errorw("erase "+step+" of user "+req.UserID+": "+err.Error(), logger.STDRequestID(ctx))
+		failed = append(failed, step)
+	}
+
+	deleted, err := p.daoRepo.DeleteUserData(ctx, req.UserID)
+	if err != nil {
+		fail("values", err)
+	}
+	resp.Values = deleted
+	if err := p.eraseHistory(ctx, req.UserID, resp); err != nil {
+		fail("history", err)
+	}
+	if err := p.eraseDeliveries(ctx, req.UserID, resp); err != nil {
+		fail("deliveries", err)
+	}
+	if len(failed) != 0 {
+		return resp, error2.NewError(code.EraseIncomplete, strings.Join(failed, ","))
+	}
+	p.webhook.notify(ctx, []*WebhookEvent{{Operation: OpErase, UserID: req.UserID}})
+	return resp, nil
+}
+
+// eraseHistory 删除用户级数据的修改记录，清除用户修改应用级数据的记录中的操作人
+func (p *persona) eraseHistory(ctx context.Context, userID string, resp *EraseUserDataResp) error {
+	records, err := p.walkRecords(ctx, db.CollectionHistory, userID)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, r := range records {
+		var h model.History
+		if err := json.Unmarshal(r.Value, &h); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if h.UserID == userID {
+			if err := p.daoRepo.DeleteRecord(ctx, db.CollectionHistory, r); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			resp.History++
+			continue
+		}
+		h.Operator, h.OperatorName = "", ""
+		redacted := r
+		redacted.Users = historyUsers(h)
+		if redacted.Value, err = json.Marshal(h); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if _, err := p.daoRepo.UpdateRecord(ctx, db.CollectionHistory, r, redacted); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		resp.Redacted++
+	}
+	return firstError(errs)
+}
+
+// eraseDeliveries 删除用户相关的待投递回调
+func (p *persona) eraseDeliveries(ctx context.Context, userID string, resp *EraseUserDataResp) error {
+	records, err := p.walkRecords(ctx, db.CollectionDelivery, userID)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, r := range records {
+		// 投递中的回调已被占用，修订号变化，重试时删除
+		if err := p.daoRepo.DeleteRecord(ctx, db.CollectionDelivery, r); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		resp.Deliveries++
+	}
+	return firstError(errs)
+}
+
+// walkRecords 集合中与用户相关的所有记录，遍历结束后再修改，避免遍历期间修改影响遍历
+func (p *persona) walkRecords(ctx context.Context, collection string, userID string) ([]db.Record, error) {
+	records := make([]db.Record, 0)
+	err := p.daoRepo.WalkRecords(ctx, collection, userID, func(r db.Record) error {
+		records = append(records, r)
+		return nil
+	})
+	return records, err
+}
+
+func firstError(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs[0]
+}
+
+// userHistory 用户级数据的修改记录，按时间倒序
+func (p *persona) userHistory(ctx context.Context, userID string) ([]model.History, error) {
+	records, err := p.walkRecords(ctx, db.CollectionHistory, userID)
+	if err != nil {
+		return nil, err
+	}
+	db.SortRecords(records, true)
+	histories := make([]model.History, 0, len(records))
+	for _, r := range records {
+		var h model.History
+		if err := json.Unmarshal(r.Value, &h); err != nil {
+			return nil, err
+		}
+		// 用户修改应用级数据的记录只有操作人是该用户
+		if h.UserID == userID {
+			histories = append(histories, h)
+		}
+	}
+	return histories, nil
+}
+
+// ExportUserDataReq req
+type ExportUserDataReq struct {
+	UserID string `json:"userId" binding:"required"`
+}
+
+// ExportUserDataResp resp
+type ExportUserDataResp struct {
+	UserID     string         `json:"userId"`
+	ExportedAt int64          `json:"exportedAt"`
+	Values     []*UserValueVo `json:"values"`
+	// History 按时间倒序
+	History []*HistoryVo `json:"history"`
+}
+
+// UserValueVo 用户级数据
+type UserValueVo struct {
+	Version string `json:"version"`
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+}
+
+// EraseUserDataReq req
+type EraseUserDataReq struct {
+	UserID string `json:"userId" binding:"required"`
+}
+
+// EraseUserDataResp resp
+type EraseUserDataResp struct {
+	// Values 删除的数据条数
+	Values int64 `json:"values"`
+	// History 删除的修改记录条数
+	History int `json:"history"`
+	// Redacted 清除了操作人信息的应用级数据修改记录条数
+	Redacted int `json:"redacted"`
+	// Deliveries 删除的待投递回调数
+	Deliveries int `json:"deliveries"`
+}
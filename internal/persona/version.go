@@ -0,0 +1,299 @@
+package persona
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+
+	"git.internal.yunify.com/qxp/persona/pkg/code"
+	"git.internal.yunify.com/qxp/persona/pkg/db"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/error2"
+)
+
+const (
+	// StatusAdded 只存在于目标版本的key
+	StatusAdded = "added"
+	// StatusRemoved 只存在于源版本的key
+	StatusRemoved = "removed"
+	// StatusChanged 两个版本的值不同
+	StatusChanged = "changed"
+)
+
+// ListVersions 应用级key已存储的所有版本
+func (p *persona) ListVersions(ctx context.Context, req *ListVersionsReq) (*ListVersionsResp, error) {
+	return listVersions(ctx, req, p.daoRepo.ListVersions)
+}
+
+// UserListVersions 当前用户key已存储的所有版本
+func (p *persona) UserListVersions(ctx context.Context, req *ListVersionsReq) (*ListVersionsResp, error) {
+	return listVersions(ctx, req, p.daoRepo.UserListVersions)
+}
+
+func listVersions(ctx context.Context, req *ListVersionsReq,
+	list func(ctx context.Context, key string) ([]db.VersionKV, error)) (*ListVersionsResp, error) {
+	kvs, err := list(ctx, req.Key)
+	if err != nil {
+		return nil, err
+	}
+	sortVersions(kvs)
+	versions := make([]*VersionVo, 0, len(kvs))
+	for _, kv := range kvs {
+		versions = append(versions, &VersionVo{
+			Version: kv.Version,
+			Value:   kv.Value,
+		})
+	}
+	return &ListVersionsResp{
+		Key:      req.Key,
+		Versions: versions,
+	}, nil
+}
+
+// DiffVersions 比较应用级key或前缀下所有key在两个版本间的差异，Key 与 Prefix 二选一
+func (p *persona) DiffVersions(ctx context.Context, req *DiffVersionsReq) (*DiffVersionsResp, error) {
+	if (req.Key == "") == (req.Prefix == "") || req.From == req.To {
+		return nil, error2.NewError(code.InvalidParams)
+	}
+
+	var from, to map[string]string
+	var err error
+	if req.Key != "" {
+		from, to, err = p.keyVersions(ctx, req)
+	} else {
+		from, to, err = p.prefixVersions(ctx, req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return diffVersions(from, to), nil
+}
+
+// keyVersions 读取单个key的两个版本
+func (p *persona) keyVersions(ctx context.Context, req *DiffVersionsReq) (map[string]string, map[string]string, error) {
+	results, err := p.daoRepo.MultiGetWithVersion(ctx, []db.VersionKV{
+		{Version: req.From, Key: req.Key},
+		{Version: req.To, Key: req.Key},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	values := make([]map[string]string, 0, len(results))
+	for _, r := range results {
+		if r.Err != nil {
+			return nil, nil, r.Err
+		}
+		m := make(map[string]string, 1)
+		if r.Found {
+			m[req.Key] = r.Value
+		}
+		values = append(values, m)
+	}
+	return values[0], values[1], nil
+}
+
+// prefixVersions 遍历前缀，收集两个版本下的所有key
+func (p *persona) prefixVersions(ctx context.Context, req *DiffVersionsReq) (map[string]string, map[string]string, error) {
+	from, to := make(map[string]string), make(map[string]string)
+	err := p.daoRepo.WalkWithPrefix(ctx, req.Prefix, func(data db.ImportReqData) error {
+		if key, ok := trimVersion(data, req.From); ok {
+			from[key] = data.Value
+		}
+		if key, ok := trimVersion(data, req.To); ok {
+			to[key] = data.Value
+		}
+		return nil
+	})
+	return from, to, err
+}
+
+// diffVersions 只返回有差异的key，按key排序
+func diffVersions(from, to map[string]string) *DiffVersionsResp {
+	resp := &DiffVersionsResp{
+		Diff: make([]*VersionDiff, 0),
+	}
+	for key, value := range from {
+		newValue, ok := to[key]
+		switch {
+		case !ok:
+			resp.Removed++
+			resp.Diff = append(resp.Diff, &VersionDiff{Key: key, Status: StatusRemoved, From: value})
+		case newValue != value:
+			resp.Changed++
+			resp.Diff = append(resp.Diff, &VersionDiff{Key: key, Status: StatusChanged, From: value, To: newValue})
+		default:
+			resp.Unchanged++
+		}
+	}
+	for key, value := range to {
+		if _, ok := from[key]; !ok {
+			resp.Added++
+			resp.Diff = append(resp.Diff, &VersionDiff{Key: key, Status: StatusAdded, To: value})
+		}
+	}
+	sort.Slice(resp.Diff, func(i, j int) bool {
+		return resp.Diff[i].Key < resp.Diff[j].Key
+	})
+	return resp
+}
+
+// semver 语义化版本号，允许 v 前缀及省略 minor、patch，如 v1、1.2、v1.2.3-beta
+type semver struct {
+	nums [3]int
+	// pre 预发布版本的各个标识，如 rc.10 为 [rc 10]
+	pre []string
+}
+
+// parseSemver 不是语义化版本号时返回false
+func parseSemver(version string) (semver, bool) {
+	var v semver
+	s := strings.TrimPrefix(version, "v")
+	if i := strings.IndexAny(s, "-+"); i >= 0 {
+		if s[i] == '-' {
+			pre := strings.SplitN(s[i+1:], "+", 2)[0]
+			v.pre = strings.Split(pre, ".")
+			for _, id := range v.pre {
+				if id == "" {
+					return v, false
+				}
+			}
+		}
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) > len(v.nums) {
+		return v, false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, false
+		}
+		v.nums[i] = n
+	}
+	return v, true
+}
+
+// less 先比较数字部分，相同时预发布版本小于正式版本，
+// 预发布版本按 SemVer 第11条逐个比较标识：数字标识按数值比较且小于非数字标识，
+// 非数字标识按字典序比较，前面的标识都相同时标识少的版本较小
+func (v semver) less(o semver) bool {
+	for i := range v.nums {
+		if v.nums[i] != o.nums[i] {
+			return v.nums[i] < o.nums[i]
+		}
+	}
+	switch {
+	case len(v.pre) == 0:
+		return false
+	case len(o.pre) == 0:
+		return true
+	}
+	for i := 0; i < len(v.pre) && i < len(o.pre); i++ {
+		if c := comparePrerelease(v.pre[i], o.pre[i]); c != 0 {
+			return c < 0
+		}
+	}
+	return len(v.pre) < len(o.pre)
+}
+
+// comparePrerelease 比较预发布版本的单个标识
+func comparePrerelease(a, b string) int {
+	an, aerr := strconv.ParseUint(a, 10, 64)
+	bn, berr := strconv.ParseUint(b, 10, 64)
+	switch {
+	case aerr == nil && berr == nil:
+		if an != bn {
+			if an < bn {
+				return -1
+			}
+			return 1
+		}
+		return 0
+	case aerr == nil:
+		return -1
+	case berr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// sortVersions 语义化版本号按版本先后排序，排在其他版本号之前，其他版本号及相同的语义化版本号按字符串排序
+func sortVersions(kvs []db.VersionKV) {
+	sort.SliceStable(kvs, func(i, j int) bool {
+		a, aok := parseSemver(kvs[i].Version)
+		b, bok := parseSemver(kvs[j].Version)
+		switch {
+		case aok && bok && a.less(b):
+			return true
+		case aok && bok && b.less(a):
+			return false
+		case aok != bok:
+			return aok
+		}
+		return kvs[i].Version < kvs[j].Version
+	})
+}
+
+// previousVersion 返回 versions 中早于 version 的最新版本，不是语义化版本号的忽略
+func previousVersion(versions []db.VersionKV, version string) (db.VersionKV, bool) {
+	target, ok := parseSemver(version)
+	if !ok {
+		return db.VersionKV{}, false
+	}
+	var prev db.VersionKV
+	var prevVer semver
+	found := false
+	for _, kv := range versions {
+		v, ok := parseSemver(kv.Version)
+		if !ok || !v.less(target) {
+			continue
+		}
+		if !found || prevVer.less(v) {
+			prev, prevVer, found = kv, v, true
+		}
+	}
+	return prev, found
+}
+
+// ListVersionsReq req
+type ListVersionsReq struct {
+	Key string `json:"key" binding:"required"`
+}
+
+// ListVersionsResp resp
+type ListVersionsResp struct {
+	Key      string       `json:"key"`
+	Versions []*VersionVo `json:"versions"`
+}
+
+// VersionVo key的某个版本及其值
+type VersionVo struct {
+	Version string `json:"version"`
+	Value   string `json:"value"`
+}
+
+// DiffVersionsReq req
+type DiffVersionsReq struct {
+	Key    string `json:"key"`
+	Prefix string `json:"prefix"`
+	From   string `json:"from" binding:"required"`
+	To     string `json:"to" binding:"required"`
+}
+
+// DiffVersionsResp resp
+type DiffVersionsResp struct {
+	Added     int            `json:"added"`
+	Removed   int            `json:"removed"`
+	Changed   int            `json:"changed"`
+	Unchanged int            `json:"unchanged"`
+	Diff      []*VersionDiff `json:"diff"`
+}
+
+// VersionDiff 单个key的差异，From、To 为两个版本的值
+type VersionDiff struct {
+	Key    string `json:"key"`
+	Status string `json:"status"`
+	From   string `json:"from,omitempty"`
+	To     string `json:"to,omitempty"`
+}
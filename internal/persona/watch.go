@@ -0,0 +1,237 @@
+package persona
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	"git.internal.yunify.com/qxp/persona/pkg/code"
+	"git.internal.yunify.com/qxp/persona/pkg/db"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/error2"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/logger"
+)
+
+const (
+	// EventPut key被写入
+	EventPut = "put"
+	// EventDelete key被删除或过期
+	EventDelete = "delete"
+	// EventResync 之前的变更可能已遗漏，客户端需重新读取监听的key
+	EventResync = "resync"
+)
+
+// feedBuffer 每个监听者未读取的变更数上限，超过时丢弃未读取的变更并通知 resync
+const feedBuffer = 256
+
+// Watch 监听应用级key的变更，Keys 与 Prefix 二选一，ctx结束时关闭返回的channel
+func (p *persona) Watch(ctx context.Context, req *WatchReq) (<-chan *ChangeEvent, error) {
+	return p.watch(ctx, req, "", func(w db.Watcher) watchFunc {
+		return w.Watch
+	})
+}
+
+// UserWatch 监听当前用户key的变更
+func (p *persona) UserWatch(ctx context.Context, req *WatchReq) (<-chan *ChangeEvent, error) {
+	return p.watch(ctx, req, logger.STDHeader(ctx)["User-Id"], func(w db.Watcher) watchFunc {
+		return w.UserWatch
+	})
+}
+
+type watchFunc func(ctx context.Context, filter db.WatchFilter) (<-chan db.WatchEvent, error)
+
+// watch 后端支持监听时使用后端的监听，能收到所有实例的写入及租约到期；
+// 否则使用进程内的变更通知，只能收到本实例的写入及本实例清理的过期数据，过期通知最多延迟一个清理间隔
+func (p *persona) watch(ctx context.Context, req *WatchReq, userID string, backend func(w db.Watcher) watchFunc) (<-chan *ChangeEvent, error) {
+	if (len(req.Keys) == 0) == (req.Prefix == "") {
+		return nil, error2.NewError(code.InvalidParams)
+	}
+	filter := db.WatchFilter{
+		Version: req.Version,
+		Keys:    req.Keys,
+		Prefix:  req.Prefix,
+	}
+	var events <-chan db.WatchEvent
+	if w, ok := p.daoRepo.(db.Watcher); ok {
+		if req.Revision != "" {
+			rev, err := strconv.ParseInt(req.Revision, 10, 64)
+			if err != nil || rev < 0 {
+				return nil, error2.NewError(code.InvalidParams)
+			}
+			filter.Revision = rev
+		}
+		var err error
+		if events, err = backend(w)(ctx, filter); err != nil {
+			return nil, err
+		}
+	} else {
+		// 进程内的变更没有历史，恢复监听时先通知 resync
+		events = p.feed.subscribe(ctx, userID, filter, req.Revision != "")
+	}
+
+	changes := make(chan *ChangeEvent)
+	go func() {
+		defer close(changes)
+		for e := range events {
+			change := &ChangeEvent{
+				ID:       strconv.FormatInt(e.WatchRevision, 10),
+				Type:     EventPut,
+				Key:      e.Key,
+				Version:  e.Version,
+				Value:    e.Value,
+				Revision: e.Revision,
+			}
+			switch {
+			case e.Resync:
+				change.Type = EventResync
+			case e.Deleted:
+				change.Type = EventDelete
+			}
+			select {
+			case changes <- change:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return changes, nil
+}
+
+// feed 进程内的变更通知，用于不支持监听的后端
+type feed struct {
+	mu   sync.Mutex
+	subs map[*subscriber]struct{}
+	// seq 已通知的变更数，作为事件的 WatchRevision，只在本进程内有意义
+	seq int64
+}
+
+// subscriber 一个监听，只接收同一租户的变更，userID 为空时监听应用级数据
+type subscriber struct {
+	tenant string
+	userID string
+	filter db.WatchFilter
+	ch     chan db.WatchEvent
+}
+
+func newFeed() *feed {
+	return &feed{
+		subs: make(map[*subscriber]struct{}),
+	}
+}
+
+// subscribe 添加监听，ctx结束时移除，resync 为true时第一个事件为 Resync
+func (f *feed) subscribe(ctx context.Context, userID string, filter db.WatchFilter, resync bool) <-chan db.WatchEvent {
+	s := &subscriber{
+		tenant: logger.STDHeader(ctx)[db.TenantHeader],
+		userID: userID,
+		filter: filter,
+		// 多一个位置保证溢出时 Resync 能写入
+		ch: make(chan db.WatchEvent, feedBuffer+1),
+	}
+	f.mu.Lock()
+	if resync {
+		s.ch <- db.WatchEvent{Resync: true, WatchRevision: f.seq}
+	}
+	f.subs[s] = struct{}{}
+	f.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.remove(s)
+	}()
+	return s.ch
+}
+
+// publish 通知ctx所属租户中匹配的监听，不阻塞写入。
+// 读取过慢的监听丢弃未读取的变更，改为通知 Resync，之后继续通知新的变更
+func (f *feed) publish(ctx context.Context, userID string, events []db.WatchEvent) {
+	if len(events) == 0 {
+		return
+	}
+	tenant := logger.STDHeader(ctx)[db.TenantHeader]
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range events {
+		f.seq++
+		events[i].WatchRevision = f.seq
+	}
+	for s := range f.subs {
+		if s.tenant != tenant || s.userID != userID {
+			continue
+		}
+		for _, e := range events {
+			if !s.filter.Match(e.Key, e.Version) {
+				continue
+			}
+			// 只有持有锁时写入，未满时写入不会阻塞
+			if len(s.ch) < feedBuffer {
+				s.ch <- e
+				continue
+			}
+			s.overflow(e.WatchRevision)
+		}
+	}
+}
+
+// overflow 丢弃未读取的变更并写入 Resync，调用方需持有锁
+func (s *subscriber) overflow(rev int64) {
+	for {
+		select {
+		case <-s.ch:
+			continue
+		default:
+		}
+		break
+	}
+	s.ch <- db.WatchEvent{Resync: true, WatchRevision: rev}
+}
+
+// expire 后端清理过期数据时通知ctx所属租户中匹配的监听
+func (f *feed) expire(ctx context.Context, userID string, e db.WatchEvent) {
+	f.publish(ctx, userID, []db.WatchEvent{e})
+}
+
+// remove 移除监听并关闭channel，调用方需持有锁
+func (f *feed) remove(s *subscriber) {
+	if _, ok := f.subs[s]; ok {
+		delete(f.subs, s)
+		close(s.ch)
+	}
+}
+
+// putEvents 写入成功的key的变更
+func putEvents(kvs []db.VersionKV, results []db.PutResult) []db.WatchEvent {
+	events := make([]db.WatchEvent, 0, len(kvs))
+	for i, kv := range kvs {
+		if results[i].Err == nil {
+			events = append(events, db.WatchEvent{
+				Key:      kv.Key,
+				Version:  kv.Version,
+				Value:    kv.Value,
+				Revision: results[i].Revision,
+			})
+		}
+	}
+	return events
+}
+
+// WatchReq req，Keys 与 Prefix 二选一
+type WatchReq struct {
+	Version string   `json:"version" form:"version" binding:"required"`
+	Keys    []string `json:"keys" form:"key"`
+	Prefix  string   `json:"prefix" form:"prefix"`
+	// Revision 断线前最后收到的事件的 ID，从该事件之后恢复监听；无法恢复时先通知 EventResync
+	Revision string `json:"revision" form:"revision"`
+}
+
+// ChangeEvent key的一次变更，Type 为 EventPut、EventDelete 或 EventResync，
+// EventResync 时只有 ID，客户端需重新读取监听的key
+type ChangeEvent struct {
+	// ID 事件在监听中的位置，作为 WatchReq.Revision 恢复监听
+	ID       string `json:"-"`
+	Type     string `json:"type"`
+	Key      string `json:"key"`
+	Version  string `json:"version"`
+	Value    string `json:"value,omitempty"`
+	Revision string `json:"revision"`
+}
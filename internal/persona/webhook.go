@@ -0,0 +1,339 @@
+package persona
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"git.internal.yunify.com/qxp/persona/internal/model"
+	"git.internal.yunify.com/qxp/persona/pkg/config"
+	"git.internal.yunify.com/qxp/persona/pkg/db"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/client"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/id2"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/logger"
+)
+
+// deliveryGroup 待投递队列在记录集合中的分组
+const deliveryGroup = "pending"
+
+// SignatureHeader 回调请求的签名头，值为 sha256=hex(hmac-sha256(secret, body))
+const SignatureHeader = "X-Persona-Signature"
+
+const (
+	defaultMaxAttempts = 10
+	defaultBackoff     = time.Second
+	defaultInterval    = 5 * time.Second
+	// maxBackoff 重试间隔的上限
+	maxBackoff = time.Hour
+	// deliveryBatch 每次从队列取出的到期回调数
+	deliveryBatch = 100
+	// claimLease 取出的回调在租期内不会被其他实例取出，超过租期仍未完成(如实例退出)时重新投递
+	claimLease = time.Minute
+)
+
+const (
+	// OpPut 写入值
+	OpPut = "put"
+	// OpDelete 删除值
+	OpDelete = "delete"
+	// OpImport 导入值
+	OpImport = "import"
+	// OpPurge 删除应用的所有数据，Key 为应用的key前缀
+	OpPurge = "purge"
+	// OpErase 删除用户的所有数据，Key 为空
+	OpErase = "erase"
+	// OpDataSetCreate 创建数据集，Key 为数据集ID
+	OpDataSetCreate = "dataset_create"
+	// OpDataSetUpdate 更新数据集
+	OpDataSetUpdate = "dataset_update"
+	// OpDataSetDelete 删除数据集
+	OpDataSetDelete = "dataset_delete"
+)
+
+// WebhookEvent 回调的变更事件，至少投递一次，接收方按 ID 去重
+type WebhookEvent struct {
+	ID        string `json:"id"`
+	Operation string `json:"operation"`
+	Key       string `json:"key"`
+	Version   string `json:"version,omitempty"`
+	// TenantID 数据所属的租户，默认租户为空
+	TenantID string `json:"tenantId,omitempty"`
+	// UserID 用户级数据所属的用户，应用级数据为空
+	UserID string `json:"userId,omitempty"`
+	// OldHash 修改前的值的sha256，修改前不存在时为空
+	OldHash string `json:"oldHash,omitempty"`
+	// NewHash 修改后的值的sha256，删除时为空
+	NewHash    string `json:"newHash,omitempty"`
+	OccurredAt int64  `json:"occurredAt"`
+}
+
+// webhook 变更回调，事件先持久化到所属租户的待投递队列，由后台按退避间隔投递。
+// 多个实例共享队列，每次投递前先占用，同一时间只有一个实例投递同一回调
+type webhook struct {
+	urls        []string
+	secret      []byte
+	maxAttempts int
+	backoff     time.Duration
+	interval    time.Duration
+	client      http.Client
+	daoRepo     db.BackendStorage
+	// tenants 需要投递的租户
+	tenants []string
+	wake    chan struct{}
+}
+
+// newWebhook 没有配置回调地址时返回nil，nil不通知
+func newWebhook(conf *config.Configs, dao db.BackendStorage) *webhook {
+	urls := make([]string, 0, len(conf.Webhook.URLs)+1)
+	if conf.CallbackURL != "" {
+		urls = append(urls, conf.CallbackURL)
+	}
+	for _, url := range conf.Webhook.URLs {
+		if url != "" {
+			urls = append(urls, url)
+		}
+	}
+	if len(urls) == 0 {
+		return nil
+	}
+	w := &webhook{
+		urls:        urls,
+		secret:      []byte(conf.Webhook.Secret),
+		maxAttempts: conf.Webhook.MaxAttempts,
+		backoff:     time.Duration(conf.Webhook.Backoff) * time.Second,
+		interval:    time.Duration(conf.Webhook.Interval) * time.Second,
+		client:      client.New(conf.InternalNet),
+		daoRepo:     dao,
+		tenants:     []string{""},
+		wake:        make(chan struct{}, 1),
+	}
+	if conf.Tenant.Enable {
+		w.tenants = conf.Tenant.IDs
+	}
+	if w.maxAttempts <= 0 {
+		w.maxAttempts = defaultMaxAttempts
+	}
+	if w.backoff <= 0 {
+		w.backoff = defaultBackoff
+	}
+	if w.interval <= 0 {
+		w.interval = defaultInterval
+	}
+	return w
+}
+
+// run 每隔interval或有新事件时投递到期的回调，ctx结束时返回
+func (w *webhook) run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		// 还有到期的回调时继续投递
+		if w.deliverPending(ctx) {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-w.wake:
+		}
+	}
+}
+
+// notify 为每个回调地址持久化事件，失败时只记录日志，不影响写入结果。
+// 事件保存在ctx所属租户的待投递队列中，由后台统一投递
+func (w *webhook) notify(ctx context.Context, events []*WebhookEvent) {
+	if w == nil || len(events) == 0 {
+		return
+	}
+	tenant := logger.STDHeader(ctx)[db.TenantHeader]
+	now := time.Now()
+	records := make([]db.Record, 0, len(events)*len(w.urls))
+	for _, e := range events {
+		e.ID = id2.GenID()
+		e.TenantID = tenant
+		e.OccurredAt = now.UnixNano() / int64(time.Millisecond)
+		payload, err := json.Marshal(e)
+		if err != nil {
+			logger.Logger.Errorw(err.Error(), logger.STDRequestID(ctx))
+			continue
+		}
+		// 删除用户数据的事件需要投递，不关联该用户，不会被导出或再次删除时清理
+		var users []string
+		if e.UserID != "" && e.Operation != OpErase {
+			users = []string{e.UserID}
+		}
+		for _, url := range w.urls {
+			delivery := model.Delivery{
+				ID:        id2.GenID(),
+				URL:       url,
+				Payload:   string(payload),
+				CreatedAt: e.OccurredAt,
+			}
+			value, err := json.Marshal(delivery)
+			if err != nil {
+				logger.Logger.Errorw(err.Error(), logger.STDRequestID(ctx))
+				continue
+			}
+			records = append(records, db.Record{
+				Group: deliveryGroup,
+				ID:    delivery.ID,
+				Seq:   time.Now().UnixNano(),
+				Users: users,
+				Value: value,
+			})
+		}
+	}
+	if err := w.daoRepo.PutRecords(ctx, db.CollectionDelivery, records); err != nil {
+		logger.Logger.Errorw(err.Error(), logger.STDRequestID(ctx))
+		return
+	}
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliverPending 投递各租户到期的回调，每个租户最多 deliveryBatch 条，还有到期的回调时返回true
+func (w *webhook) deliverPending(ctx context.Context) bool {
+	more := false
+	for _, tenant := range w.tenants {
+		if ctx.Err() != nil {
+			return false
+		}
+		tenantCtx := ctx
+		if tenant != "" {
+			tenantCtx = db.WithTenant(ctx, tenant)
+		}
+		if w.deliverTenant(tenantCtx) {
+			more = true
+		}
+	}
+	return more
+}
+
+// deliverTenant 按到期时间投递ctx所属租户的回调
+func (w *webhook) deliverTenant(ctx context.Context) bool {
+	records, err := w.daoRepo.ListRecords(ctx, db.CollectionDelivery, db.RecordQuery{
+		Group:  deliveryGroup,
+		MaxSeq: time.Now().UnixNano(),
+		Limit:  deliveryBatch,
+	})
+	if err != nil {
+		logger.Logger.Errorw("list deliveries: " + err.Error())
+		return false
+	}
+	for _, r := range records {
+		if ctx.Err() != nil {
+			return false
+		}
+		w.deliver(ctx, r)
+	}
+	return len(records) == deliveryBatch
+}
+
+// deliver 占用后投递一次，成功或超过最大投递次数时移出队列，否则按退避间隔延后。
+// 已被其他实例占用的回调跳过
+func (w *webhook) deliver(ctx context.Context, r db.Record) {
+	var d model.Delivery
+	if err := json.Unmarshal(r.Value, &d); err != nil {
+		logger.Logger.Errorw("decode delivery " + r.ID + ": " + err.Error())
+		w.remove(ctx, r)
+		return
+	}
+	claimed := r
+	claimed.Seq = time.Now().Add(claimLease).UnixNano()
+	rev, err := w.daoRepo.UpdateRecord(ctx, db.CollectionDelivery, r, claimed)
+	if err != nil {
+		if !errors.Is(err, db.ErrRevisionConflict) {
+			logger.Logger.Errorw("claim delivery " + d.ID + ": " + err.Error())
+		}
+		return
+	}
+	claimed.Revision = rev
+
+	err = client.POSTWithHeader(ctx, &w.client, d.URL, w.header(d.Payload), json.RawMessage(d.Payload), nil)
+	if err == nil {
+		w.remove(ctx, claimed)
+		return
+	}
+	// 服务退出，租期过后重新投递
+	if ctx.Err() != nil {
+		return
+	}
+	d.Attempts++
+	if d.Attempts >= w.maxAttempts {
+		logger.Logger.Errorw("drop delivery " + d.ID + " to " + d.URL + ": " + err.Error())
+		w.remove(ctx, claimed)
+		return
+	}
+	retry := claimed
+	retry.Seq = time.Now().Add(w.retryAfter(d.Attempts)).UnixNano()
+	if retry.Value, err = json.Marshal(d); err != nil {
+		logger.Logger.Errorw(err.Error())
+		return
+	}
+	if _, err := w.daoRepo.UpdateRecord(ctx, db.CollectionDelivery, claimed, retry); err != nil {
+		logger.Logger.Errorw("retry delivery " + d.ID + ": " + err.Error())
+	}
+}
+
+// remove 移出队列，租期已过且被其他实例占用时不删除
+func (w *webhook) remove(ctx context.Context, r db.Record) {
+	if err := w.daoRepo.DeleteRecord(ctx, db.CollectionDelivery, r); err != nil && !errors.Is(err, db.ErrRevisionConflict) {
+		logger.Logger.Errorw(err.Error())
+	}
+}
+
+// retryAfter 第attempts次失败后的重试间隔
+func (w *webhook) retryAfter(attempts int) time.Duration {
+	backoff := w.backoff
+	for i := 1; i < attempts && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff
+}
+
+func (w *webhook) header(payload string) http.Header {
+	header := http.Header{}
+	if len(w.secret) != 0 {
+		header.Set(SignatureHeader, Sign(w.secret, []byte(payload)))
+	}
+	return header
+}
+
+// Sign 回调请求体的签名
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// valueHash 值的sha256，不存在时为空
+func valueHash(value string, found bool) string {
+	if !found {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// dataSetHash 数据集内容的sha256，不存在时为空
+func dataSetHash(data *json.RawMessage) string {
+	if data == nil {
+		return ""
+	}
+	var dataSet DataSetVo
+	if err := json.Unmarshal(*data, &dataSet); err != nil {
+		return ""
+	}
+	return valueHash(dataSet.Content, true)
+}
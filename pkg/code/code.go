@@ -17,19 +17,52 @@ const (
 	NameExist = 160014000003
 	// TimeOut 超时
 	TimeOut = 160014000004
-	// Rollback 回滚
+	// Rollback 回滚失败
 	Rollback = 160014000005
 	// LockExpire 锁过期
 	LockExpire = 160014000006
+	// StorageUnavailable 存储服务异常
+	StorageUnavailable = 160014000007
+	// RevisionConflict 修订号冲突
+	RevisionConflict = 160014000008
+	// ImportConflict 导入的数据已存在
+	ImportConflict = 160014000009
+	// ImportAborted 导入未生效
+	ImportAborted = 160014000010
+	// InvalidJSONValue 值不是合法的JSON
+	InvalidJSONValue = 160014000011
+	// InvalidPatch 补丁不合法或无法应用
+	InvalidPatch = 160014000012
+	// SchemaViolation 值不符合 JSON Schema
+	SchemaViolation = 160014000013
+	// InvalidSchema JSON Schema 不合法
+	InvalidSchema = 160014000014
+	// EraseIncomplete 用户数据未完全删除
+	EraseIncomplete = 160014000015
+	// InvalidTenant 租户ID不合法或未登记
+	InvalidTenant = 160014000016
+	// Forbidden 没有权限
+	Forbidden = 160014030001
 )
 
 // CodeTable 码表
 var CodeTable = map[int64]string{
-	InvalidURI:       "无效的URI.",
-	InvalidParams:    "无效的参数.",
-	InvalidTimestamp: "无效的时间格式.",
-	NameExist:        "名称已被使用！请检查后重试！",
-	TimeOut:          "超时",
-	Rollback:         "回滚",
-	LockExpire:       "锁已过期",
+	InvalidURI:         "无效的URI.",
+	InvalidParams:      "无效的参数.",
+	InvalidTimestamp:   "无效的时间格式.",
+	NameExist:          "名称已被使用！请检查后重试！",
+	TimeOut:            "超时",
+	Rollback:           "回滚失败，修改记录不存在或不可回滚",
+	LockExpire:         "锁已过期",
+	StorageUnavailable: "存储服务异常，请稍后重试",
+	RevisionConflict:   "数据已被他人修改，请刷新后重试",
+	ImportConflict:     "数据已存在",
+	ImportAborted:      "其他数据导入失败，本次导入未生效",
+	InvalidJSONValue:   "值不是合法的JSON",
+	InvalidPatch:       "补丁不合法或无法应用到当前值: %s",
+	SchemaViolation:    "值不符合JSON Schema: %s",
+	InvalidSchema:      "JSON Schema不合法: %s",
+	EraseIncomplete:    "用户数据未完全删除，请重试: %s",
+	InvalidTenant:      "租户ID不合法或未登记",
+	Forbidden:          "没有权限访问",
 }
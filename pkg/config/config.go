@@ -24,6 +24,10 @@ type Configs struct {
 	ES             ESConf        `yaml:"elasticsearch"`
 	ProcessorNum   int           `yaml:"processorNum"`
 	BackendStorage string        `yaml:"backendStorage"`
+	Webhook        Webhook       `yaml:"webhook"`
+	Auth           Auth          `yaml:"auth"`
+	History        History       `yaml:"history"`
+	Tenant         Tenant        `yaml:"tenant"`
 }
 
 // HTTPServer http服务配置
@@ -58,6 +62,46 @@ type ESConf struct {
 	Username     string
 	Password     string
 	DefaultIndex string
+	// SweepInterval 清理过期数据的间隔(秒)
+	SweepInterval int
+}
+
+// Webhook 变更回调配置，CallbackURL 与 URLs 均会收到变更事件
+type Webhook struct {
+	URLs []string `yaml:"urls"`
+	// Secret 签名密钥，为空时不签名
+	Secret string `yaml:"secret"`
+	// MaxAttempts 最大投递次数
+	MaxAttempts int `yaml:"maxAttempts"`
+	// Backoff 首次重试的间隔(秒)，之后每次翻倍
+	Backoff int `yaml:"backoff"`
+	// Interval 检查待投递队列的间隔(秒)
+	Interval int `yaml:"interval"`
+}
+
+// History 修改记录配置
+type History struct {
+	// Limit 每个key(按版本、用户区分)保留的修改记录条数
+	Limit int `yaml:"limit"`
+	// TrimInterval 清理超出条数的修改记录的间隔(秒)
+	TrimInterval int `yaml:"trimInterval"`
+}
+
+// Tenant 多租户配置
+type Tenant struct {
+	// Enable 为true时请求必须携带 Tenant-Id 且在 IDs 中，为false时请求不能携带 Tenant-Id
+	Enable bool `yaml:"enable"`
+	// IDs 登记的租户，服务启动时创建各租户的存储
+	IDs []string `yaml:"ids"`
+}
+
+// Auth 接口权限，请求头 Role 中的任一角色在路由组允许的角色中即可访问。
+// Role 由客户端传入，服务需部署在删除并重新设置 Role 的网关之后
+type Auth struct {
+	// Enable 为false(默认)时不校验
+	Enable bool `yaml:"enable"`
+	// Groups 路由组允许访问的角色，开启校验时每个路由组都需配置，否则启动失败
+	Groups map[string][]string `yaml:"groups"`
 }
 
 // Init 初始化
@@ -3,22 +3,126 @@ package db
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+
+	"git.internal.yunify.com/qxp/persona/pkg/misc/time2"
+)
+
+// RevisionNotExist 数据不存在时的修订号，写入时携带表示仅在数据不存在时写入
+const RevisionNotExist = "0"
+
+var (
+	// ErrRevisionConflict 写入时携带的修订号与当前存储的不一致
+	ErrRevisionConflict = errors.New("revision conflict")
+	// ErrInvalidRevision 无法识别的修订号
+	ErrInvalidRevision = errors.New("invalid revision")
+	// ErrAborted TxnPut 中其他项失败，该项未写入或已回滚
+	ErrAborted = errors.New("transaction aborted")
 )
 
 // BackendStorage 抽象接口
+// 读取不存在的数据时不返回错误：Get* 返回空map，GetData 返回nil，
+// 返回错误仅表示存储本身异常
+//
+// MultiGet 及 TxnPut 与 Get/Put 使用相同的key，TxnPut 中的 VersionKV.Key 即存储的key，
+// Version 仅作为数据的版本信息写入。TxnPut 全部写入或全部不生效，
+// 任一项失败时返回 ErrAborted，失败项的 Err 为具体原因，其余项为 ErrAborted
+//
+// ListVersions 及 UserListVersions 返回key已存储的所有版本及其值，按版本号字符串排序，
+// Revision 为空。不包含旧格式({version}_{key})存储的数据
+//
+// Multi*PutWithVersion 及 TxnPut 支持 VersionKV.TTL，过期的数据视为不存在，
+// 读取时不返回，携带 RevisionNotExist 写入时视为不存在。不带TTL写入时取消原有的过期时间
+//
+// ListUserData 返回用户在所有应用、所有版本下的用户级数据，按key、版本号排序，Revision 为空；
+// DeleteUserData 删除这些数据并返回删除的条数。userID 不能为空
+//
+// *Record 读写集合中的记录，见 Record。PutRecords 批量写入新的记录；GetRecord 不存在时返回nil；
+// ListRecords 按 RecordQuery 分页查询一个分组；WalkRecords 遍历集合中与用户相关的记录，顺序不定；
+// UpdateRecord 以 record 替换 old(Group 及 ID 不变，Seq 及 Value 可修改)，DeleteRecord 在 Revision 不为空时删除前比较，
+// 二者在记录已被修改或删除时返回 ErrRevisionConflict；TrimRecords 每个分组只保留最后 keep 条，
+// 返回删除的条数，keep 不大于0时不清理
 type BackendStorage interface {
 	Put(ctx context.Context, key string, value string) error
 	Get(ctx context.Context, key string) (map[string]string, error)
+	MultiGet(ctx context.Context, keys []string) ([]GetResult, error)
+	TxnPut(ctx context.Context, kvs []VersionKV) ([]PutResult, error)
 	GetWithPrefix(ctx context.Context, key string) ([]ImportReqData, error)
+	WalkWithPrefix(ctx context.Context, key string, fn WalkFunc) error
 	PutWithVersion(ctx context.Context, version string, key string, value string) error
 	GetWithVersion(ctx context.Context, version string, key string) (map[string]string, error)
 	UserPutWithVersion(ctx context.Context, version string, key string, value string) error
 	UserGetWithVersion(ctx context.Context, version string, key string) (map[string]string, error)
+	MultiPutWithVersion(ctx context.Context, kvs []VersionKV) ([]PutResult, error)
+	MultiGetWithVersion(ctx context.Context, keys []VersionKV) ([]GetResult, error)
+	UserMultiPutWithVersion(ctx context.Context, kvs []VersionKV) ([]PutResult, error)
+	UserMultiGetWithVersion(ctx context.Context, keys []VersionKV) ([]GetResult, error)
+	MultiDeleteWithVersion(ctx context.Context, keys []VersionKV) ([]DeleteResult, error)
+	UserMultiDeleteWithVersion(ctx context.Context, keys []VersionKV) ([]DeleteResult, error)
+	ListVersions(ctx context.Context, key string) ([]VersionKV, error)
+	UserListVersions(ctx context.Context, key string) ([]VersionKV, error)
+	DeleteWithPrefix(ctx context.Context, key string) (int64, error)
+	ListUserData(ctx context.Context, userID string) ([]VersionKV, error)
+	DeleteUserData(ctx context.Context, userID string) (int64, error)
 	PutData(ctx *context.Context, key *string, value interface{}) error
 	GetData(ctx *context.Context, key *string) (*json.RawMessage, error)
 	UpdateData(ctx *context.Context, key *string, value interface{}) error
 	GetDataByKVs(ctx *context.Context, kvs *map[string]interface{}) ([]*json.RawMessage, error)
 	DeleteData(ctx *context.Context, key *string) error
+	PutRecords(ctx context.Context, collection string, records []Record) error
+	GetRecord(ctx context.Context, collection string, group string, id string) (*Record, error)
+	ListRecords(ctx context.Context, collection string, q RecordQuery) ([]Record, error)
+	WalkRecords(ctx context.Context, collection string, userID string, fn func(record Record) error) error
+	UpdateRecord(ctx context.Context, collection string, old Record, record Record) (string, error)
+	DeleteRecord(ctx context.Context, collection string, record Record) error
+	TrimRecords(ctx context.Context, collection string, group string, keep int) (int64, error)
+}
+
+// Watcher 可选接口，后端能够监听所有实例的写入时实现
+// Watch 及 UserWatch 监听 filter 匹配的key的变更，ctx结束或监听出错时关闭返回的channel
+type Watcher interface {
+	Watch(ctx context.Context, filter WatchFilter) (<-chan WatchEvent, error)
+	UserWatch(ctx context.Context, filter WatchFilter) (<-chan WatchEvent, error)
+}
+
+// WatchFilter 监听条件，Version 下的 Keys 或以 Prefix 开头的key，Keys 不为空时忽略 Prefix
+type WatchFilter struct {
+	Version string
+	Keys    []string
+	Prefix  string
+	// Revision 大于0时从该位置(之前收到的事件的 WatchRevision)之后开始监听，用于断线后恢复
+	Revision int64
+}
+
+// Match key是否满足监听条件
+func (f *WatchFilter) Match(key string, version string) bool {
+	if version != f.Version {
+		return false
+	}
+	if len(f.Keys) == 0 {
+		return strings.HasPrefix(key, f.Prefix)
+	}
+	for _, k := range f.Keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// WatchEvent key的一次变更，Deleted 时 Value 为空，Revision 为 RevisionNotExist。
+// Resync 时只有 WatchRevision，表示之前的变更可能已遗漏，需重新读取监听的key
+type WatchEvent struct {
+	Key      string
+	Version  string
+	Value    string
+	Revision string
+	Deleted  bool
+	Resync   bool
+	// WatchRevision 事件在监听中的位置，按事件顺序递增，可作为 WatchFilter.Revision 恢复监听
+	WatchRevision int64
 }
 
 // Kv Kv
@@ -28,10 +132,75 @@ type Kv struct {
 	Version  string `json:"version"` // 使用方维护
 	UserID   string `json:"user_id"`
 	DataType string `json:"data_type"` // 内部使用
+	// ExpiresAt 过期时间(毫秒时间戳)，为0时不过期
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+}
+
+// Expired 是否已过期
+func (kv *Kv) Expired() bool {
+	return kv.ExpiresAt > 0 && kv.ExpiresAt <= time2.NowUnixMill()
+}
+
+// ExpiresAt ttl(秒)对应的过期时间，ttl 不大于0时不过期，返回0
+func ExpiresAt(ttl int64) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return time2.NowUnixMill() + ttl*1000
 }
 
 // ImportReqData 导入数据请求
+// Version 为数据的版本信息，后端未保存版本信息时为空
 type ImportReqData struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Version string `json:"version,omitempty"`
+}
+
+// WalkFunc 遍历时对每条数据的回调，返回错误时停止遍历并返回该错误
+type WalkFunc func(data ImportReqData) error
+
+// VersionKV 批量读写中的单项，读取及删除时忽略Value及Revision
+type VersionKV struct {
+	Version string
+	Key     string
+	Value   string
+	// Revision 不为空时仅在存储的修订号与其一致时写入(compare-and-set)，
+	// 否则该项返回 ErrRevisionConflict
+	Revision string
+	// TTL 大于0时数据在TTL秒后过期，仅用于写入
+	TTL int64
+}
+
+// GetResult 批量读取中单项的结果
+// 批量接口返回的结果与请求顺序一致，单项失败不影响其他项
+type GetResult struct {
+	Value string
+	Found bool
+	// Revision 当前修订号，由后端生成(es _seq_no/_primary_term，etcd mod_revision)，
+	// 调用方应视为不透明的字符串。不存在时为 RevisionNotExist
+	Revision string
+	Err      error
+}
+
+// PutResult 批量写入中单项的结果，Revision为写入后的修订号
+type PutResult struct {
+	Revision string
+	Err      error
+}
+
+// DeleteResult 批量删除中单项的结果，Found表示删除前是否存在
+type DeleteResult struct {
+	Found bool
+	Err   error
+}
+
+// SortVersionKVs 按key、版本号排序
+func SortVersionKVs(kvs []VersionKV) {
+	sort.Slice(kvs, func(i, j int) bool {
+		if kvs[i].Key != kvs[j].Key {
+			return kvs[i].Key < kvs[j].Key
+		}
+		return kvs[i].Version < kvs[j].Version
+	})
 }
@@ -0,0 +1,1352 @@
+// Package dbtest 提供 db.BackendStorage 的一致性测试，
+// 各后端在自己的测试中调用 Run 即可验证行为与其他后端一致。
+package dbtest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"git.internal.yunify.com/qxp/persona/pkg/db"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/id2"
+)
+
+// Harness 一致性测试上下文
+type Harness struct {
+	Storage db.BackendStorage
+	// Prefix 本次测试使用的key前缀，避免与已有数据冲突
+	Prefix string
+
+	settle func()
+}
+
+// Settle 等待写入对查询可见，es等近实时的后端需要
+func (h *Harness) Settle() {
+	if h.settle != nil {
+		h.settle()
+	}
+}
+
+// Key 返回带本次测试前缀的key
+func (h *Harness) Key(name string) string {
+	return h.Prefix + name
+}
+
+// UserContext 返回携带User-Id的context，与 logger.CTXTransfer 一致
+func UserContext(userID string) context.Context {
+	return context.WithValue(context.Background(), "User-Id", userID)
+}
+
+// TenantContext 返回携带Tenant-Id的context
+func TenantContext(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, db.TenantHeader, tenant)
+}
+
+// Case 一致性测试用例
+type Case struct {
+	Name string
+	Run  func(t *testing.T, h *Harness)
+}
+
+// Cases 所有后端都需要满足的用例
+var Cases = []Case{
+	{Name: "VersionedPutGet", Run: testVersionedPutGet},
+	{Name: "VersionedNotFound", Run: testVersionedNotFound},
+	{Name: "UserIsolation", Run: testUserIsolation},
+	{Name: "UserNotFound", Run: testUserNotFound},
+	{Name: "MultiPutGet", Run: testMultiPutGet},
+	{Name: "UserMultiPutGet", Run: testUserMultiPutGet},
+	{Name: "CompareAndSet", Run: testCompareAndSet},
+	{Name: "UserCompareAndSet", Run: testUserCompareAndSet},
+	{Name: "TxnPut", Run: testTxnPut},
+	{Name: "TxnPutAbort", Run: testTxnPutAbort},
+	{Name: "MultiDelete", Run: testMultiDelete},
+	{Name: "UserMultiDelete", Run: testUserMultiDelete},
+	{Name: "ListVersions", Run: testListVersions},
+	{Name: "UserListVersions", Run: testUserListVersions},
+	{Name: "PrefixExport", Run: testPrefixExport},
+	{Name: "PrefixDelete", Run: testPrefixDelete},
+	{Name: "PrefixWalk", Run: testPrefixWalk},
+	{Name: "Expiry", Run: testExpiry},
+	{Name: "ExpiryEvents", Run: testExpiryEvents},
+	{Name: "UserData", Run: testUserData},
+	{Name: "UserDataScope", Run: testUserDataScope},
+	{Name: "TenantIsolation", Run: testTenantIsolation},
+	{Name: "DataCRUD", Run: testDataCRUD},
+	{Name: "DataNotFound", Run: testDataNotFound},
+	{Name: "DataFilterByKVs", Run: testDataFilterByKVs},
+	{Name: "Records", Run: testRecords},
+}
+
+// Run 对storage执行所有一致性用例
+// settle 为nil时表示写入立即可见
+func Run(t *testing.T, storage db.BackendStorage, settle func()) {
+	for _, c := range Cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			h := &Harness{
+				Storage: storage,
+				Prefix:  "dbtest_" + id2.GenUpperID() + "_",
+				settle:  settle,
+			}
+			c.Run(t, h)
+		})
+	}
+}
+
+func testVersionedPutGet(t *testing.T, h *Harness) {
+	ctx := context.Background()
+	key := h.Key("key")
+	tests := []struct {
+		version string
+		value   string
+	}{
+		{version: "v1", value: "value_v1"},
+		{version: "v2", value: "value_v2"},
+	}
+	for _, tt := range tests {
+		if err := h.Storage.PutWithVersion(ctx, tt.version, key, tt.value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 覆盖写
+	if err := h.Storage.PutWithVersion(ctx, "v1", key, "value_v1_new"); err != nil {
+		t.Fatal(err)
+	}
+	tests[0].value = "value_v1_new"
+
+	for _, tt := range tests {
+		res, err := h.Storage.GetWithVersion(ctx, tt.version, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != 1 || res[key] != tt.value {
+			t.Fatalf("version %s: expect {%s: %s}, got %v", tt.version, key, tt.value, res)
+		}
+	}
+}
+
+func testVersionedNotFound(t *testing.T, h *Harness) {
+	ctx := context.Background()
+	key := h.Key("key")
+	if err := h.Storage.PutWithVersion(ctx, "v1", key, "value"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		version string
+		key     string
+	}{
+		{name: "missing key", version: "v1", key: h.Key("missing")},
+		{name: "missing version", version: "v2", key: key},
+	}
+	for _, tt := range tests {
+		res, err := h.Storage.GetWithVersion(ctx, tt.version, tt.key)
+		if err != nil {
+			t.Fatalf("%s: expect no error, got %s", tt.name, err)
+		}
+		if len(res) != 0 {
+			t.Fatalf("%s: expect empty result, got %v", tt.name, res)
+		}
+	}
+}
+
+func testUserIsolation(t *testing.T, h *Harness) {
+	key := h.Key("key")
+	users := []struct {
+		userID string
+		value  string
+	}{
+		{userID: h.Key("user_a"), value: "value_a"},
+		{userID: h.Key("user_b"), value: "value_b"},
+	}
+	for _, u := range users {
+		if err := h.Storage.UserPutWithVersion(UserContext(u.userID), "v1", key, u.value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, u := range users {
+		res, err := h.Storage.UserGetWithVersion(UserContext(u.userID), "v1", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != 1 || res[key] != u.value {
+			t.Fatalf("user %s: expect {%s: %s}, got %v", u.userID, key, u.value, res)
+		}
+	}
+
+	// 用户的值对应用级读取不可见
+	res, err := h.Storage.GetWithVersion(context.Background(), "v1", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 0 {
+		t.Fatalf("user value leaked to app value: %v", res)
+	}
+}
+
+func testUserNotFound(t *testing.T, h *Harness) {
+	key := h.Key("key")
+	if err := h.Storage.UserPutWithVersion(UserContext(h.Key("user_a")), "v1", key, "value"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := h.Storage.UserGetWithVersion(UserContext(h.Key("user_b")), "v1", key)
+	if err != nil {
+		t.Fatalf("expect no error, got %s", err)
+	}
+	if len(res) != 0 {
+		t.Fatalf("expect empty result, got %v", res)
+	}
+}
+
+func testMultiPutGet(t *testing.T, h *Harness) {
+	ctx := context.Background()
+	kvs := make([]db.VersionKV, 0)
+	for i := 0; i < 150; i++ {
+		kvs = append(kvs, db.VersionKV{Version: "v1", Key: h.Key(fmt.Sprintf("key_%d", i)), Value: fmt.Sprintf("value_%d", i)})
+	}
+	puts, err := h.Storage.MultiPutWithVersion(ctx, kvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range puts {
+		if r.Err != nil {
+			t.Fatalf("put %s: %s", kvs[i].Key, r.Err)
+		}
+	}
+
+	// 与单个读取结果一致，包含不存在的key
+	keys := append(kvs, db.VersionKV{Version: "v1", Key: h.Key("missing")}, db.VersionKV{Version: "v2", Key: kvs[0].Key})
+	results, err := h.Storage.MultiGetWithVersion(ctx, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(keys) {
+		t.Fatalf("expect %d results, got %d", len(keys), len(results))
+	}
+	for i, k := range keys {
+		single, err := h.Storage.GetWithVersion(ctx, k.Version, k.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, found := single[k.Key]
+		if results[i].Err != nil || results[i].Found != found || results[i].Value != want {
+			t.Fatalf("key %s: expect (%s, %v), got %+v", k.Key, want, found, results[i])
+		}
+	}
+}
+
+func testUserMultiPutGet(t *testing.T, h *Harness) {
+	userA, userB := UserContext(h.Key("user_a")), UserContext(h.Key("user_b"))
+	kvs := []db.VersionKV{
+		{Version: "v1", Key: h.Key("key_1"), Value: "value_1"},
+		{Version: "v1", Key: h.Key("key_2"), Value: "value_2"},
+	}
+	puts, err := h.Storage.UserMultiPutWithVersion(userA, kvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range puts {
+		if r.Err != nil {
+			t.Fatalf("put %s: %s", kvs[i].Key, r.Err)
+		}
+	}
+
+	results, err := h.Storage.UserMultiGetWithVersion(userA, kvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, kv := range kvs {
+		if !results[i].Found || results[i].Value != kv.Value {
+			t.Fatalf("key %s: expect %s, got %+v", kv.Key, kv.Value, results[i])
+		}
+		single, err := h.Storage.UserGetWithVersion(userA, kv.Version, kv.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if single[kv.Key] != kv.Value {
+			t.Fatalf("key %s: expect %s, got %v", kv.Key, kv.Value, single)
+		}
+	}
+
+	results, err = h.Storage.UserMultiGetWithVersion(userB, kvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, kv := range kvs {
+		if results[i].Found || results[i].Err != nil {
+			t.Fatalf("key %s: expect not found for other user, got %+v", kv.Key, results[i])
+		}
+	}
+}
+
+func testCompareAndSet(t *testing.T, h *Harness) {
+	compareAndSet(t, context.Background(), h.Storage.MultiGetWithVersion, h.Storage.MultiPutWithVersion, h.Key("key"))
+}
+
+func testUserCompareAndSet(t *testing.T, h *Harness) {
+	ctx := UserContext(h.Key("user_a"))
+	compareAndSet(t, ctx, h.Storage.UserMultiGetWithVersion, h.Storage.UserMultiPutWithVersion, h.Key("key"))
+}
+
+func compareAndSet(t *testing.T, ctx context.Context,
+	get func(context.Context, []db.VersionKV) ([]db.GetResult, error),
+	put func(context.Context, []db.VersionKV) ([]db.PutResult, error),
+	key string) {
+	mustGet := func() db.GetResult {
+		res, err := get(ctx, []db.VersionKV{{Version: "v1", Key: key}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res[0].Err != nil {
+			t.Fatal(res[0].Err)
+		}
+		return res[0]
+	}
+	mustPut := func(value string, revision string) db.PutResult {
+		res, err := put(ctx, []db.VersionKV{{Version: "v1", Key: key, Value: value, Revision: revision}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res[0]
+	}
+
+	missing := mustGet()
+	if missing.Found || missing.Revision != db.RevisionNotExist {
+		t.Fatalf("expect not found with revision %s, got %+v", db.RevisionNotExist, missing)
+	}
+
+	// 两个请求基于同一个修订号写入，后写入的冲突
+	created := mustPut("value_1", missing.Revision)
+	if created.Err != nil {
+		t.Fatal(created.Err)
+	}
+	if r := mustPut("value_2", missing.Revision); r.Err != db.ErrRevisionConflict {
+		t.Fatalf("expect conflict, got %+v", r)
+	}
+
+	current := mustGet()
+	if current.Value != "value_1" || current.Revision != created.Revision {
+		t.Fatalf("expect (value_1, %s), got %+v", created.Revision, current)
+	}
+	updated := mustPut("value_3", current.Revision)
+	if updated.Err != nil {
+		t.Fatal(updated.Err)
+	}
+	if r := mustPut("value_4", current.Revision); r.Err != db.ErrRevisionConflict {
+		t.Fatalf("expect conflict, got %+v", r)
+	}
+	if r := mustPut("value_5", "not a revision"); r.Err != db.ErrInvalidRevision {
+		t.Fatalf("expect invalid revision, got %+v", r)
+	}
+
+	// 不带修订号时直接覆盖
+	if r := mustPut("value_6", ""); r.Err != nil {
+		t.Fatal(r.Err)
+	}
+	if current := mustGet(); current.Value != "value_6" {
+		t.Fatalf("expect value_6, got %+v", current)
+	}
+}
+
+func testTxnPut(t *testing.T, h *Harness) {
+	ctx := context.Background()
+	keys := []string{h.Key("a"), h.Key("b")}
+	if err := h.Storage.Put(ctx, keys[0], "old"); err != nil {
+		t.Fatal(err)
+	}
+	olds, err := h.Storage.MultiGet(ctx, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !olds[0].Found || olds[0].Value != "old" || olds[1].Found || olds[1].Revision != db.RevisionNotExist {
+		t.Fatalf("unexpected results: %+v", olds)
+	}
+
+	results, err := h.Storage.TxnPut(ctx, []db.VersionKV{
+		{Key: keys[0], Value: "new_a", Revision: olds[0].Revision},
+		{Key: keys[1], Value: "new_b", Revision: olds[1].Revision, Version: "v1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gets, err := h.Storage.MultiGet(ctx, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"new_a", "new_b"} {
+		if gets[i].Value != want || gets[i].Revision != results[i].Revision {
+			t.Fatalf("key %s: expect (%s, %s), got %+v", keys[i], want, results[i].Revision, gets[i])
+		}
+	}
+	// 与 Get 一致
+	res, err := h.Storage.Get(ctx, keys[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) == 0 {
+		t.Fatalf("key %s not found by Get", keys[1])
+	}
+}
+
+func testTxnPutAbort(t *testing.T, h *Harness) {
+	ctx := context.Background()
+	// 超过etcd单个事务的操作数，冲突在最后一批
+	kvs := make([]db.VersionKV, 0)
+	for i := 0; i < 300; i++ {
+		kvs = append(kvs, db.VersionKV{Key: h.Key(fmt.Sprintf("key_%d", i)), Value: "new"})
+	}
+	keys := make([]string, 0, len(kvs))
+	for _, kv := range kvs {
+		keys = append(keys, kv.Key)
+	}
+	for _, i := range []int{0, 150} {
+		if err := h.Storage.Put(ctx, keys[i], "old"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	last := len(kvs) - 1
+	if err := h.Storage.Put(ctx, keys[last], "other"); err != nil {
+		t.Fatal(err)
+	}
+	kvs[last].Revision = db.RevisionNotExist
+
+	results, err := h.Storage.TxnPut(ctx, kvs)
+	if err != db.ErrAborted {
+		t.Fatalf("expect aborted, got %v", err)
+	}
+	for i, r := range results {
+		want := db.ErrAborted
+		if i == last {
+			want = db.ErrRevisionConflict
+		}
+		if r.Err != want {
+			t.Fatalf("key %s: expect %v, got %+v", kvs[i].Key, want, r)
+		}
+	}
+
+	// 全部恢复为写入前的状态
+	gets, err := h.Storage.MultiGet(ctx, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, g := range gets {
+		switch i {
+		case 0, 150:
+			if g.Value != "old" {
+				t.Fatalf("key %s: expect restored, got %+v", keys[i], g)
+			}
+		case last:
+			if g.Value != "other" {
+				t.Fatalf("key %s: expect unchanged, got %+v", keys[i], g)
+			}
+		default:
+			if g.Found {
+				t.Fatalf("key %s: expect not found, got %+v", keys[i], g)
+			}
+		}
+	}
+
+	kvs[0].Revision = "not a revision"
+	if _, err := h.Storage.TxnPut(ctx, kvs[:1]); err != db.ErrAborted {
+		t.Fatalf("expect aborted, got %v", err)
+	}
+}
+
+func testMultiDelete(t *testing.T, h *Harness) {
+	ctx := context.Background()
+	multiDelete(t, ctx, h.Storage.MultiGetWithVersion, h.Storage.MultiPutWithVersion, h.Storage.MultiDeleteWithVersion, h)
+}
+
+func testUserMultiDelete(t *testing.T, h *Harness) {
+	userA, userB := UserContext(h.Key("user_a")), UserContext(h.Key("user_b"))
+	key := db.VersionKV{Version: "v1", Key: h.Key("key"), Value: "value"}
+	if _, err := h.Storage.UserMultiPutWithVersion(userB, []db.VersionKV{key}); err != nil {
+		t.Fatal(err)
+	}
+	multiDelete(t, userA, h.Storage.UserMultiGetWithVersion, h.Storage.UserMultiPutWithVersion, h.Storage.UserMultiDeleteWithVersion, h)
+
+	// 不影响其他用户
+	results, err := h.Storage.UserMultiGetWithVersion(userB, []db.VersionKV{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !results[0].Found || results[0].Value != key.Value {
+		t.Fatalf("value of other user deleted: %+v", results[0])
+	}
+}
+
+func multiDelete(t *testing.T, ctx context.Context,
+	get func(context.Context, []db.VersionKV) ([]db.GetResult, error),
+	put func(context.Context, []db.VersionKV) ([]db.PutResult, error),
+	del func(context.Context, []db.VersionKV) ([]db.DeleteResult, error),
+	h *Harness) {
+	kvs := make([]db.VersionKV, 0)
+	for i := 0; i < 150; i++ {
+		kvs = append(kvs, db.VersionKV{Version: "v1", Key: h.Key(fmt.Sprintf("key_%d", i)), Value: fmt.Sprintf("value_%d", i)})
+	}
+	puts, err := put(ctx, kvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range puts {
+		if r.Err != nil {
+			t.Fatalf("put %s: %s", kvs[i].Key, r.Err)
+		}
+	}
+
+	// 其他版本不受影响
+	other := db.VersionKV{Version: "v2", Key: kvs[0].Key, Value: "value_v2"}
+	if _, err := put(ctx, []db.VersionKV{other}); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := append(kvs[:100:100], db.VersionKV{Version: "v1", Key: h.Key("missing")})
+	results, err := del(ctx, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(keys) {
+		t.Fatalf("expect %d results, got %d", len(keys), len(results))
+	}
+	for i, k := range keys {
+		want := i < 100
+		if results[i].Err != nil || results[i].Found != want {
+			t.Fatalf("key %s: expect found %v, got %+v", k.Key, want, results[i])
+		}
+	}
+
+	gets, err := get(ctx, append(kvs, other))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range gets {
+		want := i >= 100
+		if r.Err != nil || r.Found != want {
+			t.Fatalf("key %d: expect found %v after delete, got %+v", i, want, r)
+		}
+	}
+}
+
+func testListVersions(t *testing.T, h *Harness) {
+	ctx := context.Background()
+	key := h.Key("key")
+	listVersions(t, h, ctx, key, h.Storage.PutWithVersion, h.Storage.ListVersions)
+
+	// 用户的值不属于应用级key的版本
+	if err := h.Storage.UserPutWithVersion(UserContext(h.Key("user")), "v3", key, "user"); err != nil {
+		t.Fatal(err)
+	}
+	h.Settle()
+	res, err := h.Storage.ListVersions(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 3 {
+		t.Fatalf("user value leaked to app versions: %+v", res)
+	}
+}
+
+func testUserListVersions(t *testing.T, h *Harness) {
+	ctx := UserContext(h.Key("user_a"))
+	key := h.Key("key")
+	listVersions(t, h, ctx, key, h.Storage.UserPutWithVersion, h.Storage.UserListVersions)
+
+	res, err := h.Storage.UserListVersions(UserContext(h.Key("user_b")), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 0 {
+		t.Fatalf("versions of other user leaked: %+v", res)
+	}
+}
+
+// listVersions 写入同一个key的三个版本及其他key，列出的版本按版本号排序。
+// 版本号可以包含 _，以 {key}_ 开头的其他key的版本不属于该key
+func listVersions(t *testing.T, h *Harness, ctx context.Context, key string,
+	put func(ctx context.Context, version string, key string, value string) error,
+	list func(ctx context.Context, key string) ([]db.VersionKV, error)) {
+	writes := []db.VersionKV{
+		{Version: "v2", Key: key, Value: "value_2"},
+		{Version: "v1", Key: key, Value: "value_1"},
+		{Version: "x_y", Key: key, Value: "value_x_y"},
+		{Version: "v1", Key: h.Key("other"), Value: "other"},
+		{Version: "v1", Key: key + "_a", Value: "suffix"},
+	}
+	for _, kv := range writes {
+		if err := put(ctx, kv.Version, kv.Key, kv.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.Settle()
+
+	res, err := list(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []db.VersionKV{writes[1], writes[0], writes[2]}
+	if fmt.Sprint(res) != fmt.Sprint(want) {
+		t.Fatalf("expect %+v, got %+v", want, res)
+	}
+
+	res, err = list(ctx, h.Key("missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 0 {
+		t.Fatalf("expect no versions, got %+v", res)
+	}
+}
+
+func testPrefixExport(t *testing.T, h *Harness) {
+	ctx := context.Background()
+	app := h.Key("app_id:1")
+	want := map[string]string{
+		app + ":a": "value_a",
+		app + ":b": "value_b",
+	}
+	for k, v := range want {
+		if err := h.Storage.Put(ctx, k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.Storage.Put(ctx, h.Key("app_id:2:a"), "other"); err != nil {
+		t.Fatal(err)
+	}
+	h.Settle()
+
+	res, err := h.Storage.GetWithPrefix(ctx, app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string, len(res))
+	for _, r := range res {
+		got[r.Key] = r.Value
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expect %v, got %v", want, got)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Fatalf("key %s: expect %s, got %s", k, v, got[k])
+		}
+	}
+
+	res, err = h.Storage.GetWithPrefix(ctx, h.Key("app_id:3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 0 {
+		t.Fatalf("expect empty result, got %v", res)
+	}
+}
+
+func testPrefixDelete(t *testing.T, h *Harness) {
+	ctx := context.Background()
+	app := h.Key("app_id:1")
+	for _, k := range []string{app + ":a", app + ":b"} {
+		if err := h.Storage.PutWithVersion(ctx, "v1", k, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := h.Key("app_id:2:a")
+	if err := h.Storage.PutWithVersion(ctx, "v1", other, "other"); err != nil {
+		t.Fatal(err)
+	}
+	h.Settle()
+
+	deleted, err := h.Storage.DeleteWithPrefix(ctx, app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 2 {
+		t.Fatalf("expect 2 deleted, got %d", deleted)
+	}
+	h.Settle()
+
+	res, err := h.Storage.GetWithPrefix(ctx, app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 0 {
+		t.Fatalf("expect empty result, got %v", res)
+	}
+	got, err := h.Storage.GetWithVersion(ctx, "v1", other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[other] != "other" {
+		t.Fatalf("value of other app deleted: %v", got)
+	}
+
+	deleted, err = h.Storage.DeleteWithPrefix(ctx, app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 0 {
+		t.Fatalf("expect 0 deleted, got %d", deleted)
+	}
+}
+
+func testPrefixWalk(t *testing.T, h *Harness) {
+	ctx := context.Background()
+	app := h.Key("app_id:1:")
+	// 超过一页
+	kvs := make([]db.VersionKV, 0)
+	for i := 0; i < 1050; i++ {
+		kvs = append(kvs, db.VersionKV{Version: "v1", Key: app + fmt.Sprintf("key_%d", i), Value: fmt.Sprintf("value_%d", i)})
+	}
+	puts, err := h.Storage.MultiPutWithVersion(ctx, kvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range puts {
+		if r.Err != nil {
+			t.Fatalf("put %s: %s", kvs[i].Key, r.Err)
+		}
+	}
+	h.Settle()
+
+	got := make(map[string]string, len(kvs))
+	err = h.Storage.WalkWithPrefix(ctx, app, func(data db.ImportReqData) error {
+		if _, ok := got[data.Key]; ok {
+			return fmt.Errorf("duplicate key %s", data.Key)
+		}
+		got[data.Key] = data.Value
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(kvs) {
+		t.Fatalf("expect %d keys, got %d", len(kvs), len(got))
+	}
+
+	// 回调返回错误时停止遍历
+	stop := errors.New("stop")
+	var count int
+	err = h.Storage.WalkWithPrefix(ctx, app, func(data db.ImportReqData) error {
+		count++
+		return stop
+	})
+	if err != stop || count != 1 {
+		t.Fatalf("expect stop after first key, got (%v, %d)", err, count)
+	}
+}
+
+func testExpiry(t *testing.T, h *Harness) {
+	ctx := context.Background()
+	userCtx := UserContext(h.Key("user"))
+	temp, kept, renewed := h.Key("temp"), h.Key("kept"), h.Key("renewed")
+	puts, err := h.Storage.MultiPutWithVersion(ctx, []db.VersionKV{
+		{Version: "v1", Key: temp, Value: "temp", TTL: 1},
+		{Version: "v1", Key: kept, Value: "kept"},
+		{Version: "v1", Key: renewed, Value: "renewed", TTL: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range puts {
+		if r.Err != nil {
+			t.Fatal(r.Err)
+		}
+	}
+	// 不带TTL覆盖写后不再过期
+	if puts, err = h.Storage.MultiPutWithVersion(ctx, []db.VersionKV{{Version: "v1", Key: renewed, Value: "renewed"}}); err != nil || puts[0].Err != nil {
+		t.Fatalf("renew: %v %+v", err, puts)
+	}
+	if puts, err = h.Storage.UserMultiPutWithVersion(userCtx, []db.VersionKV{{Version: "v1", Key: temp, Value: "user", TTL: 1}}); err != nil || puts[0].Err != nil {
+		t.Fatalf("user put: %v %+v", err, puts)
+	}
+	txnKey := h.Key("txn")
+	if puts, err = h.Storage.TxnPut(ctx, []db.VersionKV{{Version: "v1", Key: txnKey, Value: "txn", TTL: 1}}); err != nil {
+		t.Fatalf("txn put: %v %+v", err, puts)
+	}
+
+	keys := []db.VersionKV{{Version: "v1", Key: temp}, {Version: "v1", Key: kept}, {Version: "v1", Key: renewed}}
+	results, err := h.Storage.MultiGetWithVersion(ctx, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range results {
+		if !r.Found {
+			t.Fatalf("key %s: expect found before expiry", keys[i].Key)
+		}
+	}
+
+	// 等待过期，etcd的租约有最小TTL且由leader定期检查，各次写入的租约到期时间略有先后
+	var userResults, txnResults []db.GetResult
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		results, err = h.Storage.MultiGetWithVersion(ctx, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if userResults, err = h.Storage.UserMultiGetWithVersion(userCtx, []db.VersionKV{{Version: "v1", Key: temp}}); err != nil {
+			t.Fatal(err)
+		}
+		if txnResults, err = h.Storage.MultiGet(ctx, []string{txnKey}); err != nil {
+			t.Fatal(err)
+		}
+		if !results[0].Found && !userResults[0].Found && !txnResults[0].Found {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("keys not expired: %+v %+v %+v", results[0], userResults[0], txnResults[0])
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	if results[0].Revision != db.RevisionNotExist || !results[1].Found || !results[2].Found {
+		t.Fatalf("unexpected results after expiry: %+v", results)
+	}
+	if res, err := h.Storage.GetWithVersion(ctx, "v1", temp); err != nil || len(res) != 0 {
+		t.Fatalf("expect expired key missing, got %v %v", res, err)
+	}
+	versions, err := h.Storage.ListVersions(ctx, temp)
+	if err != nil || len(versions) != 0 {
+		t.Fatalf("expect no versions, got %+v %v", versions, err)
+	}
+	h.Settle()
+	datas, err := h.Storage.GetWithPrefix(ctx, h.Key(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range datas {
+		if data.Value == "temp" || data.Value == "txn" {
+			t.Fatalf("expired key %s exported", data.Key)
+		}
+	}
+
+	// 过期的key视为不存在
+	puts, err = h.Storage.MultiPutWithVersion(ctx, []db.VersionKV{{Version: "v1", Key: temp, Value: "again", Revision: db.RevisionNotExist}})
+	if err != nil || puts[0].Err != nil {
+		t.Fatalf("expect create over expired key, got %+v %v", puts, err)
+	}
+}
+
+// expiry 一次过期通知
+type expiry struct {
+	userID string
+	event  db.WatchEvent
+}
+
+// testExpiryEvents 过期的key产生删除事件：Watcher 后端由监听收到，Expirer 后端由清理时通知
+func testExpiryEvents(t *testing.T, h *Harness) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	user := h.Key("user")
+	appKey, userKey := h.Key("app"), h.Key("user_key")
+	events := make(chan expiry, 16)
+	var sweep func() error
+
+	switch s := h.Storage.(type) {
+	case db.Watcher:
+		forward := func(userID string, ch <-chan db.WatchEvent) {
+			for e := range ch {
+				if e.Deleted {
+					events <- expiry{userID: userID, event: e}
+				}
+			}
+		}
+		appEvents, err := s.Watch(ctx, db.WatchFilter{Version: "v1", Keys: []string{appKey}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		userEvents, err := s.UserWatch(context.WithValue(ctx, "User-Id", user), db.WatchFilter{Version: "v1", Keys: []string{userKey}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go forward("", appEvents)
+		go forward(user, userEvents)
+	case db.Expirer:
+		s.OnExpire(func(ctx context.Context, userID string, e db.WatchEvent) {
+			if e.Key != appKey && e.Key != userKey {
+				return
+			}
+			select {
+			case events <- expiry{userID: userID, event: e}:
+			default:
+			}
+		})
+		defer s.OnExpire(nil)
+		sweep = func() error {
+			h.Settle()
+			_, err := s.Sweep(context.Background())
+			return err
+		}
+	default:
+		t.Skip("backend does not notify expiry")
+	}
+
+	if puts, err := h.Storage.MultiPutWithVersion(context.Background(), []db.VersionKV{{Version: "v1", Key: appKey, Value: "app", TTL: 1}}); err != nil || puts[0].Err != nil {
+		t.Fatalf("put: %v %+v", err, puts)
+	}
+	if puts, err := h.Storage.UserMultiPutWithVersion(UserContext(user), []db.VersionKV{{Version: "v1", Key: userKey, Value: "user", TTL: 1}}); err != nil || puts[0].Err != nil {
+		t.Fatalf("user put: %v %+v", err, puts)
+	}
+
+	// etcd的租约有最小TTL且由leader定期检查，其他后端等待过期后主动清理
+	got := make(map[string]expiry)
+	deadline := time.Now().Add(10 * time.Second)
+	for len(got) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expect expiry events for both keys, got %+v", got)
+		}
+		if sweep != nil {
+			if err := sweep(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		select {
+		case e := <-events:
+			got[e.event.Key] = e
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+	if e := got[appKey]; e.userID != "" || e.event.Version != "v1" || e.event.Revision != db.RevisionNotExist {
+		t.Fatalf("unexpected app expiry: %+v", e)
+	}
+	if e := got[userKey]; e.userID != user || e.event.Version != "v1" || e.event.Revision != db.RevisionNotExist {
+		t.Fatalf("unexpected user expiry: %+v", e)
+	}
+}
+
+func testDataCRUD(t *testing.T, h *Harness) {
+	ctx := context.Background()
+	key := h.Key("dataset")
+	data := map[string]interface{}{
+		"id":      key,
+		"name":    "persona_test",
+		"tag":     "tag_1111",
+		"type":    1,
+		"content": "content",
+	}
+	if err := h.Storage.PutData(&ctx, &key, data); err != nil {
+		t.Fatal(err)
+	}
+	got := getData(t, h, key)
+	if got["name"] != "persona_test" || got["type"] != float64(1) {
+		t.Fatalf("unexpected document: %v", got)
+	}
+
+	// 只覆盖出现的字段
+	update := map[string]interface{}{
+		"tag":     "tag_2222",
+		"content": "content_new",
+	}
+	if err := h.Storage.UpdateData(&ctx, &key, update); err != nil {
+		t.Fatal(err)
+	}
+	got = getData(t, h, key)
+	want := map[string]interface{}{
+		"id":      key,
+		"name":    "persona_test",
+		"tag":     "tag_2222",
+		"type":    float64(1),
+		"content": "content_new",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Fatalf("field %s: expect %v, got %v", k, v, got[k])
+		}
+	}
+
+	if err := h.Storage.DeleteData(&ctx, &key); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := h.Storage.GetData(&ctx, &key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw != nil {
+		t.Fatalf("expect nil after delete, got %s", string(*raw))
+	}
+}
+
+func testDataNotFound(t *testing.T, h *Harness) {
+	ctx := context.Background()
+	key := h.Key("missing")
+	raw, err := h.Storage.GetData(&ctx, &key)
+	if err != nil {
+		t.Fatalf("expect no error, got %s", err)
+	}
+	if raw != nil {
+		t.Fatalf("expect nil, got %s", string(*raw))
+	}
+	if err := h.Storage.UpdateData(&ctx, &key, map[string]interface{}{"name": "x"}); err == nil {
+		t.Fatal("expect error when update missing document")
+	}
+}
+
+func testDataFilterByKVs(t *testing.T, h *Harness) {
+	ctx := context.Background()
+	tag := h.Key("tag")
+	docs := []map[string]interface{}{
+		{"id": h.Key("d1"), "name": "n1", "tag": tag, "type": 1},
+		{"id": h.Key("d2"), "name": "n2", "tag": tag, "type": 2},
+		{"id": h.Key("d3"), "name": "n1", "tag": tag, "type": 2},
+	}
+	for _, doc := range docs {
+		key := doc["id"].(string)
+		if err := h.Storage.PutData(&ctx, &key, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.Settle()
+
+	tests := []struct {
+		name string
+		kvs  map[string]interface{}
+		want []string
+	}{
+		{name: "one condition", kvs: map[string]interface{}{"tag": tag}, want: []string{h.Key("d1"), h.Key("d2"), h.Key("d3")}},
+		{name: "string and number", kvs: map[string]interface{}{"tag": tag, "name": "n1", "type": int64(2)}, want: []string{h.Key("d3")}},
+		{name: "no match", kvs: map[string]interface{}{"tag": tag, "name": "n3"}, want: []string{}},
+	}
+	for _, tt := range tests {
+		list, err := h.Storage.GetDataByKVs(&ctx, &tt.kvs)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		got := make(map[string]bool, len(list))
+		for _, raw := range list {
+			var doc map[string]interface{}
+			if err := json.Unmarshal(*raw, &doc); err != nil {
+				t.Fatal(err)
+			}
+			got[doc["id"].(string)] = true
+		}
+		if len(got) != len(tt.want) {
+			t.Fatalf("%s: expect %v, got %v", tt.name, tt.want, got)
+		}
+		for _, id := range tt.want {
+			if !got[id] {
+				t.Fatalf("%s: missing %s", tt.name, id)
+			}
+		}
+	}
+
+	if _, err := h.Storage.GetDataByKVs(&ctx, nil); err == nil {
+		t.Fatal("expect error without conditions")
+	}
+}
+
+func getData(t *testing.T, h *Harness, key string) map[string]interface{} {
+	ctx := context.Background()
+	raw, err := h.Storage.GetData(&ctx, &key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw == nil {
+		t.Fatalf("document %s not found", key)
+	}
+	doc := make(map[string]interface{})
+	if err := json.Unmarshal(*raw, &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func testUserData(t *testing.T, h *Harness) {
+	ctx := context.Background()
+	userA, userB := h.Key("userA"), h.Key("userB")
+	key, other := h.Key("key"), h.Key("other")
+	writes := []db.VersionKV{
+		{Version: "v2", Key: key, Value: "a_2"},
+		{Version: "v1", Key: key, Value: "a_1"},
+		{Version: "v1", Key: other, Value: "a_other"},
+	}
+	if _, err := h.Storage.UserMultiPutWithVersion(UserContext(userA), writes); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Storage.UserPutWithVersion(UserContext(userB), "v1", key, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Storage.PutWithVersion(ctx, "v1", key, "app"); err != nil {
+		t.Fatal(err)
+	}
+	h.Settle()
+
+	res, err := h.Storage.ListUserData(ctx, userA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []db.VersionKV{writes[1], writes[0], writes[2]}
+	if len(res) != len(want) {
+		t.Fatalf("expect %d values, got %+v", len(want), res)
+	}
+	for i := range want {
+		if res[i].Key != want[i].Key || res[i].Version != want[i].Version || res[i].Value != want[i].Value {
+			t.Fatalf("expect %+v, got %+v", want[i], res[i])
+		}
+	}
+
+	deleted, err := h.Storage.DeleteUserData(ctx, userA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != int64(len(want)) {
+		t.Fatalf("expect %d deleted, got %d", len(want), deleted)
+	}
+	h.Settle()
+	if res, err = h.Storage.ListUserData(ctx, userA); err != nil || len(res) != 0 {
+		t.Fatalf("expect erased, got %+v %v", res, err)
+	}
+	// 其他用户及应用级数据不受影响
+	if res, err = h.Storage.ListUserData(ctx, userB); err != nil || len(res) != 1 || res[0].Value != "b" {
+		t.Fatalf("other user affected: %+v %v", res, err)
+	}
+	if got, err := h.Storage.GetWithVersion(ctx, "v1", key); err != nil || got[key] != "app" {
+		t.Fatalf("app value affected: %+v %v", got, err)
+	}
+}
+
+// testUserDataScope 用户ID是其他用户ID或应用级key的前缀时，列出及删除只影响该用户
+func testUserDataScope(t *testing.T, h *Harness) {
+	ctx := context.Background()
+	// 用户 {prefix}a 与 {prefix}a_b，用户 {prefix}app 与应用级key {prefix}app_id:1:k
+	userA, userAB, userApp := h.Key("a"), h.Key("a_b"), h.Key("app")
+	appKey := h.Key("app_id:1:k")
+	for _, user := range []string{userA, userAB, userApp} {
+		puts, err := h.Storage.UserMultiPutWithVersion(UserContext(user), []db.VersionKV{{Version: "v1", Key: "k", Value: user}})
+		if err != nil || puts[0].Err != nil {
+			t.Fatalf("user put: %v %+v", err, puts)
+		}
+	}
+	if puts, err := h.Storage.MultiPutWithVersion(ctx, []db.VersionKV{{Version: "v1", Key: appKey, Value: "app"}}); err != nil || puts[0].Err != nil {
+		t.Fatalf("put: %v %+v", err, puts)
+	}
+	h.Settle()
+
+	for _, user := range []string{userA, userAB, userApp} {
+		res, err := h.Storage.ListUserData(ctx, user)
+		if err != nil || len(res) != 1 || res[0].Value != user {
+			t.Fatalf("user %s: expect own data only, got %+v %v", user, res, err)
+		}
+	}
+	for _, user := range []string{userA, userApp} {
+		if deleted, err := h.Storage.DeleteUserData(ctx, user); err != nil || deleted != 1 {
+			t.Fatalf("user %s: expect 1 deleted, got %d %v", user, deleted, err)
+		}
+	}
+	h.Settle()
+	if res, err := h.Storage.ListUserData(ctx, userAB); err != nil || len(res) != 1 {
+		t.Fatalf("other user affected: %+v %v", res, err)
+	}
+	if got, err := h.Storage.GetWithVersion(ctx, "v1", appKey); err != nil || got[appKey] != "app" {
+		t.Fatalf("app value affected: %+v %v", got, err)
+	}
+	if _, err := h.Storage.DeleteUserData(ctx, userAB); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testTenantIsolation(t *testing.T, h *Harness) {
+	base, ok := h.Storage.(db.Tenanted)
+	if !ok {
+		t.Skip("backend does not support tenants")
+	}
+	ctx := context.Background()
+	s, err := db.NewTenantStorage(ctx, base, []string{"dbtest-a", "dbtest-b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctxA := TenantContext(ctx, "dbtest-a")
+	ctxB := TenantContext(ctx, "dbtest-b")
+	key, data := h.Key("key"), h.Key("data")
+
+	if err := s.PutWithVersion(ctxA, "v1", key, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutData(&ctxA, &data, map[string]interface{}{"id": data, "name": "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UserPutWithVersion(TenantContext(UserContext(h.Key("user")), "dbtest-a"), "v1", key, "user"); err != nil {
+		t.Fatal(err)
+	}
+	h.Settle()
+
+	if got, err := s.GetWithVersion(ctxA, "v1", key); err != nil || got[key] != "a" {
+		t.Fatalf("expect own value, got %+v %v", got, err)
+	}
+	// 其他租户及默认租户均不可见
+	for _, c := range []struct {
+		ctx     context.Context
+		storage db.BackendStorage
+	}{{ctxB, s}, {ctx, h.Storage}} {
+		if got, err := c.storage.GetWithVersion(c.ctx, "v1", key); err != nil || len(got) != 0 {
+			t.Fatalf("value leaked to other tenant: %+v %v", got, err)
+		}
+		if got, err := c.storage.GetData(&c.ctx, &data); err != nil || got != nil {
+			t.Fatalf("data leaked to other tenant: %v %v", got, err)
+		}
+		if res, err := c.storage.GetWithPrefix(c.ctx, h.Prefix); err != nil || len(res) != 0 {
+			t.Fatalf("prefix leaked to other tenant: %+v %v", res, err)
+		}
+		if res, err := c.storage.ListUserData(c.ctx, h.Key("user")); err != nil || len(res) != 0 {
+			t.Fatalf("user data leaked to other tenant: %+v %v", res, err)
+		}
+	}
+
+	// 其他租户按前缀删除不影响本租户
+	if _, err := s.DeleteWithPrefix(ctxB, h.Prefix); err != nil {
+		t.Fatal(err)
+	}
+	h.Settle()
+	if got, err := s.GetWithVersion(ctxA, "v1", key); err != nil || got[key] != "a" {
+		t.Fatalf("value deleted by other tenant: %+v %v", got, err)
+	}
+
+	// 登记了租户时必须携带已登记的租户ID
+	for _, c := range []context.Context{ctx, TenantContext(ctx, "dbtest-c"), TenantContext(ctx, "Bad_Tenant")} {
+		if _, err := s.GetWithVersion(c, "v1", key); !errors.Is(err, db.ErrInvalidTenant) {
+			t.Fatalf("expect ErrInvalidTenant, got %v", err)
+		}
+	}
+	// 未登记租户时不能携带租户ID
+	single, err := db.NewTenantStorage(ctx, base, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := single.GetWithVersion(ctxA, "v1", key); !errors.Is(err, db.ErrInvalidTenant) {
+		t.Fatalf("expect ErrInvalidTenant, got %v", err)
+	}
+	if _, err := db.NewTenantStorage(ctx, base, []string{"Bad_Tenant"}); !errors.Is(err, db.ErrInvalidTenant) {
+		t.Fatalf("expect ErrInvalidTenant, got %v", err)
+	}
+}
+
+func testRecords(t *testing.T, h *Harness) {
+	ctx := context.Background()
+	collection := db.CollectionHistory
+	group, other := h.Key("group"), h.Key("other")
+	user := h.Key("user")
+	records := make([]db.Record, 0, 5)
+	for i := 1; i <= 5; i++ {
+		r := db.Record{
+			Group: group,
+			ID:    h.Key(fmt.Sprintf("r%d", i)),
+			Seq:   int64(i * 10),
+			Value: json.RawMessage(fmt.Sprintf(`{"n":%d}`, i)),
+		}
+		if i%2 == 1 {
+			r.Users = []string{user}
+		}
+		records = append(records, r)
+	}
+	if err := h.Storage.PutRecords(ctx, collection, records); err != nil {
+		t.Fatal(err)
+	}
+	err := h.Storage.PutRecords(ctx, collection, []db.Record{{
+		Group: other, ID: h.Key("o1"), Seq: 1, Users: []string{user}, Value: json.RawMessage(`{}`),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Settle()
+
+	ids := func(list []db.Record) string {
+		s := ""
+		for _, r := range list {
+			s += strings.TrimPrefix(r.ID, h.Prefix) + ","
+		}
+		return s
+	}
+	list := func(q db.RecordQuery) []db.Record {
+		res, err := h.Storage.ListRecords(ctx, collection, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	tests := []struct {
+		name string
+		q    db.RecordQuery
+		want string
+	}{
+		{"all", db.RecordQuery{Group: group}, "r1,r2,r3,r4,r5,"},
+		{"desc limit", db.RecordQuery{Group: group, Desc: true, Limit: 2}, "r5,r4,"},
+		{"max seq", db.RecordQuery{Group: group, MaxSeq: 30}, "r1,r2,r3,"},
+		{"after", db.RecordQuery{Group: group, After: &db.Record{Seq: 20, ID: h.Key("r2")}, Limit: 2}, "r3,r4,"},
+		{"desc after", db.RecordQuery{Group: group, Desc: true, After: &db.Record{Seq: 20, ID: h.Key("r2")}}, "r1,"},
+		{"missing group", db.RecordQuery{Group: h.Key("missing")}, ""},
+	}
+	for _, tt := range tests {
+		if got := ids(list(tt.q)); got != tt.want {
+			t.Fatalf("%s: expect %s, got %s", tt.name, tt.want, got)
+		}
+	}
+
+	// 按ID获取，分组不一致时视为不存在
+	r, err := h.Storage.GetRecord(ctx, collection, group, h.Key("r3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r == nil || r.Seq != 30 || string(r.Value) != `{"n":3}` || !r.HasUser(user) || r.Revision == "" {
+		t.Fatalf("unexpected record: %+v", r)
+	}
+	if r, err := h.Storage.GetRecord(ctx, collection, other, h.Key("r3")); err != nil || r != nil {
+		t.Fatalf("expect nil for other group, got (%+v, %v)", r, err)
+	}
+
+	// 修改 Seq 后排序随之变化，旧的修订号不能再次使用
+	updated := *r
+	updated.Seq = 60
+	updated.Value = json.RawMessage(`{"n":33}`)
+	if _, err := h.Storage.UpdateRecord(ctx, collection, *r, updated); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Storage.UpdateRecord(ctx, collection, *r, updated); !errors.Is(err, db.ErrRevisionConflict) {
+		t.Fatalf("expect revision conflict, got %v", err)
+	}
+	if err := h.Storage.DeleteRecord(ctx, collection, *r); !errors.Is(err, db.ErrRevisionConflict) {
+		t.Fatalf("expect revision conflict, got %v", err)
+	}
+	h.Settle()
+	if got := ids(list(db.RecordQuery{Group: group})); got != "r1,r2,r4,r5,r3," {
+		t.Fatalf("expect r3 moved to the end, got %s", got)
+	}
+
+	walked := make([]string, 0)
+	err = h.Storage.WalkRecords(ctx, collection, user, func(r db.Record) error {
+		walked = append(walked, strings.TrimPrefix(r.ID, h.Prefix))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(walked)
+	if strings.Join(walked, ",") != "o1,r1,r3,r5" {
+		t.Fatalf("unexpected records of user: %v", walked)
+	}
+
+	deleted, err := h.Storage.TrimRecords(ctx, collection, group, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Settle()
+	if got := ids(list(db.RecordQuery{Group: group})); deleted != 3 || got != "r5,r3," {
+		t.Fatalf("expect 3 trimmed and r5,r3 kept, got %d and %s", deleted, got)
+	}
+	if got := ids(list(db.RecordQuery{Group: other})); got != "o1," {
+		t.Fatalf("expect other group untouched, got %s", got)
+	}
+
+	for _, g := range []string{group, other} {
+		for _, r := range list(db.RecordQuery{Group: g}) {
+			r.Revision = ""
+			if err := h.Storage.DeleteRecord(ctx, collection, r); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	h.Settle()
+	if got := ids(list(db.RecordQuery{Group: group})); got != "" {
+		t.Fatalf("expect empty group, got %s", got)
+	}
+}
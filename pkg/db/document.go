@@ -0,0 +1,86 @@
+package db
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// 以下方法供不具备文档能力的后端(etcd、memory)模拟es的文档语义
+
+// MergeDocument 将value中出现的字段覆盖到doc上，语义同es Update().Doc()
+// value 可传map或struct
+func MergeDocument(doc []byte, value interface{}) ([]byte, error) {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	patch := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(b, &patch); err != nil {
+		return nil, err
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(doc, &fields); err != nil {
+		return nil, err
+	}
+	for k, v := range patch {
+		fields[k] = v
+	}
+	return json.Marshal(fields)
+}
+
+// TermConditions 将过滤条件统一为json解码后的类型，供MatchDocument使用
+func TermConditions(kvs map[string]interface{}) (map[string]interface{}, error) {
+	conditions := make(map[string]interface{}, len(kvs))
+	for k, v := range kvs {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		var normalized interface{}
+		if err := json.Unmarshal(b, &normalized); err != nil {
+			return nil, err
+		}
+		conditions[k] = normalized
+	}
+	return conditions, nil
+}
+
+// MatchDocument term匹配，doc满足所有条件时返回true
+// conditions 需经过TermConditions处理
+func MatchDocument(doc []byte, conditions map[string]interface{}) bool {
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal(doc, &fields); err != nil {
+		return false
+	}
+	for k, v := range conditions {
+		if !reflect.DeepEqual(fields[k], v) {
+			return false
+		}
+	}
+	return true
+}
+
+// DecodeKv 将 db.Kv 文档解码为字符串map，非字符串字段保留JSON原文，
+// 已过期时返回空map
+func DecodeKv(doc []byte) (map[string]string, error) {
+	var kv Kv
+	if err := json.Unmarshal(doc, &kv); err != nil {
+		return nil, err
+	}
+	resp := make(map[string]string)
+	if kv.Expired() {
+		return resp, nil
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(doc, &fields); err != nil {
+		return nil, err
+	}
+	for k, v := range fields {
+		var s string
+		if err := json.Unmarshal(v, &s); err != nil {
+			s = string(v)
+		}
+		resp[k] = s
+	}
+	return resp, nil
+}
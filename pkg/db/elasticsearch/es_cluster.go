@@ -9,7 +9,13 @@ import (
 	"git.internal.yunify.com/qxp/persona/pkg/db"
 	"git.internal.yunify.com/qxp/persona/pkg/misc/elastic2"
 	"git.internal.yunify.com/qxp/persona/pkg/misc/logger"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/time2"
 	"github.com/olivere/elastic/v7"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 var (
@@ -21,6 +27,10 @@ var (
 	TypeOfDataSet = "dataSet"
 	// TypeOfDefault es中的默认数据类型
 	TypeOfDefault = "default"
+	// PitKeepAlive 遍历时 point in time 在两次请求之间的保留时间
+	PitKeepAlive = "1m"
+	// DefaultSweepInterval 未配置时清理过期数据的间隔
+	DefaultSweepInterval = time.Minute
 )
 
 // NewClient new elasticsearch client
@@ -68,17 +78,163 @@ type Elasticsearch struct {
 	client   *elastic.Client
 	esConfig *config.ESConf
 	prefix   string
+	// sweeper 默认租户及各租户共用
+	sweeper *sweeper
 }
 
-// NewEs new es
-func NewEs(conf *config.Configs) (db.BackendStorage, error) {
+// sweeper 记录需要清理过期数据的索引，所有索引由同一个后台任务清理
+type sweeper struct {
+	mu      sync.Mutex
+	targets []sweepTarget
+	expire  db.ExpireFunc
+}
+
+// sweepTarget 租户的索引，默认租户为空
+type sweepTarget struct {
+	index  string
+	tenant string
+}
+
+func newSweeper(index string) *sweeper {
+	return &sweeper{targets: []sweepTarget{{index: index}}}
+}
+
+func (s *sweeper) add(index string, tenant string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.targets = append(s.targets, sweepTarget{index: index, tenant: tenant})
+}
+
+func (s *sweeper) list() ([]sweepTarget, db.ExpireFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]sweepTarget(nil), s.targets...), s.expire
+}
+
+// NewEs new es，并在后台定期清理默认租户及各租户的过期数据，ctx结束时停止清理
+func NewEs(ctx context.Context, conf *config.Configs) (db.BackendStorage, error) {
 	cli, err := NewEsClient(&conf.ES)
 
-	return &Elasticsearch{
+	es := &Elasticsearch{
 		client:   cli,
 		esConfig: &conf.ES,
 		prefix:   conf.HostName,
-	}, err
+		sweeper:  newSweeper(conf.ES.DefaultIndex),
+	}
+	if err == nil {
+		go es.sweepLoop(ctx, sweepInterval(&conf.ES))
+	}
+	return es, err
+}
+
+// ForTenant 租户的数据存储在独立的索引 {DefaultIndex}_tenant_{tenant} 及其记录索引中，不存在时创建，
+// 过期数据由默认租户的后台任务一并清理
+func (d *Elasticsearch) ForTenant(ctx context.Context, tenant string) (db.BackendStorage, error) {
+	conf := *d.esConfig
+	conf.DefaultIndex = d.esConfig.DefaultIndex + "_tenant_" + tenant
+	if err := createIndices(ctx, d.client, conf.DefaultIndex); err != nil {
+		return nil, err
+	}
+	d.sweeper.add(conf.DefaultIndex, tenant)
+	return &Elasticsearch{
+		client:   d.client,
+		esConfig: &conf,
+		prefix:   d.prefix,
+		sweeper:  d.sweeper,
+	}, nil
+}
+
+func sweepInterval(conf *config.ESConf) time.Duration {
+	interval := time.Duration(conf.SweepInterval) * time.Second
+	if interval <= 0 {
+		interval = DefaultSweepInterval
+	}
+	return interval
+}
+
+// sweepLoop 每隔interval清理一次过期数据，直到ctx结束
+func (d *Elasticsearch) sweepLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := d.Sweep(ctx); err != nil && ctx.Err() == nil {
+			logger.Logger.Errorw("sweep expired values: " + err.Error())
+		}
+	}
+}
+
+// OnExpire 设置过期通知，默认租户及各租户共用
+func (d *Elasticsearch) OnExpire(fn db.ExpireFunc) {
+	d.sweeper.mu.Lock()
+	defer d.sweeper.mu.Unlock()
+	d.sweeper.expire = fn
+}
+
+// Sweep 删除所有索引中已过期的数据并通知，返回删除的条数。清理前已过期的数据在读取时即被忽略
+func (d *Elasticsearch) Sweep(ctx context.Context) (int64, error) {
+	targets, expire := d.sweeper.list()
+	var deleted int64
+	for _, target := range targets {
+		n, err := d.sweepIndex(ctx, target, expire)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// sweepIndex 按修订号分批删除索引中已过期的文档，期间被重新写入或已被其他实例删除的文档不通知
+func (d *Elasticsearch) sweepIndex(ctx context.Context, target sweepTarget, expire db.ExpireFunc) (int64, error) {
+	var deleted int64
+	hits := make([]*elastic.SearchHit, 0, MaxPageSize)
+	flush := func() error {
+		if len(hits) == 0 {
+			return nil
+		}
+		bulk := d.client.Bulk().Index(target.index)
+		for _, hit := range hits {
+			bulk.Add(elastic.NewBulkDeleteRequest().Id(hit.Id).IfSeqNo(*hit.SeqNo).IfPrimaryTerm(*hit.PrimaryTerm))
+		}
+		res, err := bulk.Do(ctx)
+		if err != nil {
+			return err
+		}
+		tenantCtx := db.WithTenant(ctx, target.tenant)
+		for i, item := range res.Items {
+			for _, r := range item {
+				if r.Status != http.StatusOK || r.Result != "deleted" {
+					continue
+				}
+				deleted++
+				var kv db.Kv
+				if expire == nil || json.Unmarshal(hits[i].Source, &kv) != nil {
+					continue
+				}
+				userID, e := db.ExpiredEvent(kv)
+				expire(tenantCtx, userID, e)
+			}
+		}
+		hits = hits[:0]
+		return nil
+	}
+	q := elastic.NewRangeQuery("expires_at").Lte(time2.NowUnixMill())
+	err := d.walkHits(ctx, target.index, q, func(hit *elastic.SearchHit) error {
+		hits = append(hits, hit)
+		if len(hits) < MaxPageSize {
+			return nil
+		}
+		return flush()
+	})
+	if err != nil {
+		return deleted, err
+	}
+	return deleted, flush()
 }
 
 // Put 存储v到key
@@ -92,21 +248,16 @@ func (d *Elasticsearch) Put(ctx context.Context, key string, value string) error
 }
 
 // Get 获取key的值
-// 最终返回json
+// 最终返回json，已过期时返回空map
 func (d *Elasticsearch) Get(ctx context.Context, key string) (map[string]string, error) {
 	res, err := d.GetData(&ctx, &key)
-	var resp = make(map[string]string)
 	if err != nil {
 		return nil, err
 	}
 	if res == nil {
-		return resp, nil
+		return make(map[string]string), nil
 	}
-	if err := json.Unmarshal(*res, &resp); err != nil {
-		return nil, err
-	}
-
-	return resp, err
+	return db.DecodeKv(*res)
 }
 
 // PutWithVersion 带版本的数据
@@ -121,48 +272,251 @@ func (d *Elasticsearch) PutWithVersion(ctx context.Context, version string, key
 	return d.PutData(&ctx, &k, &data)
 }
 
+// MultiGet 使用MultiGet批量获取key的值
+func (d *Elasticsearch) MultiGet(ctx context.Context, keys []string) ([]db.GetResult, error) {
+	return d.multiGet(ctx, keys)
+}
+
+// TxnPut 使用Bulk批量写入，部分失败时将写入成功的文档恢复为写入前的内容(补偿回滚)，
+// 写入后被他人修改过的文档不回滚
+func (d *Elasticsearch) TxnPut(ctx context.Context, kvs []db.VersionKV) ([]db.PutResult, error) {
+	results := make([]db.PutResult, len(kvs))
+	if len(kvs) == 0 {
+		return results, nil
+	}
+	ids := make([]string, 0, len(kvs))
+	docs := make([]db.Kv, 0, len(kvs))
+	for _, kv := range kvs {
+		ids = append(ids, kv.Key)
+		docs = append(docs, db.Kv{
+			Key:       kv.Key,
+			Value:     kv.Value,
+			Version:   kv.Version,
+			DataType:  TypeOfDefault,
+			ExpiresAt: db.ExpiresAt(kv.TTL),
+		})
+	}
+	// 写入前的文档，用于回滚
+	olds, err := d.mget(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for i, old := range olds {
+		if old.Error != nil {
+			results[i].Err = fmt.Errorf("%s: %s", old.Error.Type, old.Error.Reason)
+			return abort(results), db.ErrAborted
+		}
+	}
+
+	bulk := d.client.Bulk().Index(d.esConfig.DefaultIndex)
+	for i := range docs {
+		req := elastic.NewBulkIndexRequest().Id(docs[i].Key).Doc(&docs[i])
+		if err := withRevision(req, createRevision(olds[i], kvs[i].Revision)); err != nil {
+			results[i].Err = err
+			return abort(results), db.ErrAborted
+		}
+		bulk.Add(req)
+	}
+	res, err := bulk.Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	aborted := false
+	written := make([]*elastic.BulkResponseItem, len(kvs))
+	for i, item := range res.Items {
+		for _, r := range item {
+			results[i].Err = bulkItemError(r)
+			if results[i].Err != nil {
+				aborted = true
+				continue
+			}
+			written[i] = r
+			results[i].Revision = formatRevision(r.SeqNo, r.PrimaryTerm)
+		}
+	}
+	if !aborted {
+		return results, nil
+	}
+
+	if err := d.rollback(ctx, olds, written); err != nil {
+		return nil, err
+	}
+	return abort(results), db.ErrAborted
+}
+
+// rollback 将 TxnPut 写入成功的文档恢复为写入前的内容，写入前不存在的删除
+func (d *Elasticsearch) rollback(ctx context.Context, olds []*elastic.GetResult, written []*elastic.BulkResponseItem) error {
+	bulk := d.client.Bulk().Index(d.esConfig.DefaultIndex)
+	for i, w := range written {
+		if w == nil {
+			continue
+		}
+		if olds[i].Found {
+			bulk.Add(elastic.NewBulkIndexRequest().Id(w.Id).Doc(olds[i].Source).IfSeqNo(w.SeqNo).IfPrimaryTerm(w.PrimaryTerm))
+			continue
+		}
+		bulk.Add(elastic.NewBulkDeleteRequest().Id(w.Id).IfSeqNo(w.SeqNo).IfPrimaryTerm(w.PrimaryTerm))
+	}
+	if bulk.NumberOfActions() == 0 {
+		return nil
+	}
+	res, err := bulk.Do(ctx)
+	if err != nil {
+		return err
+	}
+	for _, item := range res.Items {
+		for _, r := range item {
+			// 已被他人修改或删除，保留他人的修改
+			if r.Status == http.StatusConflict || r.Status == http.StatusNotFound {
+				continue
+			}
+			if err := bulkItemError(r); err != nil {
+				return fmt.Errorf("rollback %s: %w", r.Id, err)
+			}
+		}
+	}
+	return nil
+}
+
 // GetWithPrefix 返回匹配前缀的数据
-// 默认情况下只返回1000条。如果大于这个数，则循环去es取
 func (d *Elasticsearch) GetWithPrefix(ctx context.Context, key string) ([]db.ImportReqData, error) {
+	var result = make([]db.ImportReqData, 0)
+	err := d.WalkWithPrefix(ctx, key, func(data db.ImportReqData) error {
+		result = append(result, data)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// WalkWithPrefix 使用 point in time + search_after 遍历匹配前缀的数据，
+// 每次取MaxPageSize条，不受 max_result_window 限制，遍历期间的写入不可见
+func (d *Elasticsearch) WalkWithPrefix(ctx context.Context, key string, fn db.WalkFunc) error {
 	var q = map[string]string{
 		"key": key,
 	}
-	var Offset = 0
-	var FoundTotal = 0
-	var result = make([]db.ImportReqData, 0)
-SEARCH:
-	search := d.client.Search().Index(d.esConfig.DefaultIndex)
-	d.PrefixQuery(search, &q)
-	ret, err := search.From(Offset).Size(MaxPageSize).Do(ctx)
+	return d.walk(ctx, prefixQuery(q), func(kv db.Kv) error {
+		return fn(db.ImportReqData{
+			Key:     kv.Key,
+			Value:   kv.Value,
+			Version: kv.Version,
+		})
+	})
+}
+
+// ListVersions 列出应用级key的所有版本
+func (d *Elasticsearch) ListVersions(ctx context.Context, key string) ([]db.VersionKV, error) {
+	q := prefixQuery(map[string]string{
+		"key": key + "_",
+	})
+	return d.listVersions(ctx, q, key, "", func(version string) string {
+		return d.genIDAndVersion(&key, &version)
+	})
+}
+
+// UserListVersions 列出当前用户key的所有版本
+func (d *Elasticsearch) UserListVersions(ctx context.Context, key string) ([]db.VersionKV, error) {
+	userID := logger.STDHeader(ctx)["User-Id"]
+	return d.listVersions(ctx, userQuery(userID), key, userID, func(version string) string {
+		return d.genIDVersionAndUserID(&key, &version, &userID)
+	})
+}
+
+// listVersions 以文档中的version字段还原ID，与ID一致的即为该key的某个版本，
+// 避免前缀同时匹配到以该key开头的其他key
+func (d *Elasticsearch) listVersions(ctx context.Context, q elastic.Query, key string, userID string, genID func(version string) string) ([]db.VersionKV, error) {
+	result := make([]db.VersionKV, 0)
+	err := d.walk(ctx, q, func(kv db.Kv) error {
+		if kv.UserID == userID && kv.Key == genID(kv.Version) {
+			result = append(result, db.VersionKV{
+				Version: kv.Version,
+				Key:     key,
+				Value:   kv.Value,
+			})
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	for _, r := range ret.Hits.Hits {
-		var res db.ImportReqData
-		err := json.Unmarshal(r.Source, &res)
-		if err != nil {
-			return nil, err
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Version < result[j].Version
+	})
+	return result, nil
+}
+
+// walk 遍历匹配查询条件且未过期的kv
+func (d *Elasticsearch) walk(ctx context.Context, q elastic.Query, fn func(kv db.Kv) error) error {
+	return d.walkSource(ctx, q, func(source json.RawMessage) error {
+		var kv db.Kv
+		if err := json.Unmarshal(source, &kv); err != nil {
+			return err
 		}
-		result = append(result, res)
-	}
-	FoundTotal += MaxPageSize
-	if (ret.Hits.TotalHits.Value - int64(FoundTotal)) > 0 {
-		Offset += MaxPageSize
-		goto SEARCH
+		// 已过期但还未清理
+		if kv.Expired() {
+			return nil
+		}
+		return fn(kv)
+	})
+}
+
+// walkSource 遍历默认索引中匹配查询条件的文档
+func (d *Elasticsearch) walkSource(ctx context.Context, q elastic.Query, fn func(source json.RawMessage) error) error {
+	return d.walkHits(ctx, d.esConfig.DefaultIndex, q, func(hit *elastic.SearchHit) error {
+		return fn(hit.Source)
+	})
+}
+
+// walkHits 使用 point in time + search_after 遍历匹配查询条件的文档，不受 from + size 的条数限制
+func (d *Elasticsearch) walkHits(ctx context.Context, index string, q elastic.Query, fn func(hit *elastic.SearchHit) error) error {
+	pit, err := d.client.OpenPointInTime(index).KeepAlive(PitKeepAlive).Do(ctx)
+	if err != nil {
+		return err
 	}
+	pitID := pit.Id
+	defer func() {
+		if _, err := d.client.ClosePointInTime(pitID).Do(context.Background()); err != nil {
+			logger.Logger.Errorw(err.Error(), logger.STDRequestID(ctx))
+		}
+	}()
 
-	return result, nil
+	var after []interface{}
+	for {
+		search := d.client.Search().
+			Query(q).
+			PointInTime(elastic.NewPointInTimeWithKeepAlive(pitID, PitKeepAlive)).
+			SortBy(elastic.NewFieldSort("_shard_doc")).
+			SeqNoAndPrimaryTerm(true).
+			TrackTotalHits(false).
+			Size(MaxPageSize)
+		if after != nil {
+			search = search.SearchAfter(after...)
+		}
+		ret, err := search.Do(ctx)
+		if err != nil {
+			return err
+		}
+		if ret.PitId != "" {
+			pitID = ret.PitId
+		}
+		for _, r := range ret.Hits.Hits {
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+		if len(ret.Hits.Hits) < MaxPageSize {
+			return nil
+		}
+		after = ret.Hits.Hits[len(ret.Hits.Hits)-1].Sort
+	}
 }
 
 // GetWithVersion 获取带版本数据
+// 不存在时返回空map
 func (d *Elasticsearch) GetWithVersion(ctx context.Context, version string, key string) (map[string]string, error) {
-	id := d.genIDAndVersion(&key, &version)
-	resp := make(map[string]string)
-	r, err := d.Get(ctx, id)
-	if r != nil {
-		resp[key] = r["value"]
-	}
-	return resp, err
+	return d.getValue(ctx, d.genIDAndVersion(&key, &version), key)
 }
 
 // UserPutWithVersion 设置用户带版本的值
@@ -180,16 +534,343 @@ func (d *Elasticsearch) UserPutWithVersion(ctx context.Context, version string,
 }
 
 // UserGetWithVersion 获取用户带版本的值
+// 不存在时返回空map
 func (d *Elasticsearch) UserGetWithVersion(ctx context.Context, version string, key string) (map[string]string, error) {
 	userID := logger.STDHeader(ctx)["User-Id"]
-	k := d.genIDVersionAndUserID(&key, &version, &userID)
-	r, err := d.Get(ctx, k)
+	return d.getValue(ctx, d.genIDVersionAndUserID(&key, &version, &userID), key)
+}
+
+// getValue 读取id对应文档中的value字段，并以key返回
+// 文档的value字段由 db.Kv 写入
+func (d *Elasticsearch) getValue(ctx context.Context, id string, key string) (map[string]string, error) {
+	r, err := d.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
 	resp := make(map[string]string)
 	if len(r) > 0 {
-		resp[key] = r[k]
+		resp[key] = r["value"]
+	}
+	return resp, nil
+}
+
+// MultiPutWithVersion 使用Bulk批量写入带版本的数据
+func (d *Elasticsearch) MultiPutWithVersion(ctx context.Context, kvs []db.VersionKV) ([]db.PutResult, error) {
+	docs := make([]db.Kv, 0, len(kvs))
+	for _, kv := range kvs {
+		docs = append(docs, db.Kv{
+			Key:       d.genIDAndVersion(&kv.Key, &kv.Version),
+			Value:     kv.Value,
+			Version:   kv.Version,
+			DataType:  TypeOfDefault,
+			ExpiresAt: db.ExpiresAt(kv.TTL),
+		})
+	}
+	return d.bulkPut(ctx, docs, kvs)
+}
+
+// MultiGetWithVersion 使用MultiGet批量获取带版本数据
+func (d *Elasticsearch) MultiGetWithVersion(ctx context.Context, keys []db.VersionKV) ([]db.GetResult, error) {
+	ids := make([]string, 0, len(keys))
+	for _, k := range keys {
+		ids = append(ids, d.genIDAndVersion(&k.Key, &k.Version))
+	}
+	return d.multiGet(ctx, ids)
+}
+
+// UserMultiPutWithVersion 使用Bulk批量写入用户带版本的数据
+func (d *Elasticsearch) UserMultiPutWithVersion(ctx context.Context, kvs []db.VersionKV) ([]db.PutResult, error) {
+	userID := logger.STDHeader(ctx)["User-Id"]
+	docs := make([]db.Kv, 0, len(kvs))
+	for _, kv := range kvs {
+		docs = append(docs, db.Kv{
+			Key:       d.genIDVersionAndUserID(&kv.Key, &kv.Version, &userID),
+			Value:     kv.Value,
+			Version:   kv.Version,
+			UserID:    userID,
+			DataType:  TypeOfDefault,
+			ExpiresAt: db.ExpiresAt(kv.TTL),
+		})
+	}
+	return d.bulkPut(ctx, docs, kvs)
+}
+
+// UserMultiGetWithVersion 使用MultiGet批量获取用户带版本数据
+func (d *Elasticsearch) UserMultiGetWithVersion(ctx context.Context, keys []db.VersionKV) ([]db.GetResult, error) {
+	userID := logger.STDHeader(ctx)["User-Id"]
+	ids := make([]string, 0, len(keys))
+	for _, k := range keys {
+		ids = append(ids, d.genIDVersionAndUserID(&k.Key, &k.Version, &userID))
+	}
+	return d.multiGet(ctx, ids)
+}
+
+// MultiDeleteWithVersion 使用Bulk批量删除带版本的数据
+func (d *Elasticsearch) MultiDeleteWithVersion(ctx context.Context, keys []db.VersionKV) ([]db.DeleteResult, error) {
+	ids := make([]string, 0, len(keys))
+	for _, k := range keys {
+		ids = append(ids, d.genIDAndVersion(&k.Key, &k.Version))
+	}
+	return d.bulkDelete(ctx, ids)
+}
+
+// UserMultiDeleteWithVersion 使用Bulk批量删除用户带版本的数据
+func (d *Elasticsearch) UserMultiDeleteWithVersion(ctx context.Context, keys []db.VersionKV) ([]db.DeleteResult, error) {
+	userID := logger.STDHeader(ctx)["User-Id"]
+	ids := make([]string, 0, len(keys))
+	for _, k := range keys {
+		ids = append(ids, d.genIDVersionAndUserID(&k.Key, &k.Version, &userID))
+	}
+	return d.bulkDelete(ctx, ids)
+}
+
+// DeleteWithPrefix 删除 GetWithPrefix 返回的所有数据，返回删除的条数
+func (d *Elasticsearch) DeleteWithPrefix(ctx context.Context, key string) (int64, error) {
+	res, err := d.client.DeleteByQuery(d.esConfig.DefaultIndex).
+		Query(prefixQuery(map[string]string{"key": key})).
+		Refresh("true").
+		Do(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return res.Deleted, nil
+}
+
+// ListUserData 按 user_id 列出用户的所有用户级数据
+func (d *Elasticsearch) ListUserData(ctx context.Context, userID string) ([]db.VersionKV, error) {
+	result := make([]db.VersionKV, 0)
+	empty := ""
+	err := d.walk(ctx, userQuery(userID), func(kv db.Kv) error {
+		pre := d.genIDVersionAndUserID(&empty, &kv.Version, &userID)
+		if strings.HasPrefix(kv.Key, pre) {
+			result = append(result, db.VersionKV{
+				Version: kv.Version,
+				Key:     kv.Key[len(pre):],
+				Value:   kv.Value,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	db.SortVersionKVs(result)
+	return result, nil
+}
+
+// DeleteUserData 按 user_id 删除用户的所有用户级数据，返回删除的条数
+func (d *Elasticsearch) DeleteUserData(ctx context.Context, userID string) (int64, error) {
+	res, err := d.client.DeleteByQuery(d.esConfig.DefaultIndex).
+		Query(userQuery(userID)).
+		Refresh("true").
+		Do(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return res.Deleted, nil
+}
+
+// bulkPut 以文档的Key为ID批量写入，返回的结果与docs顺序一致
+// kvs中携带修订号的项使用 if_seq_no/if_primary_term 或 create 做并发控制
+func (d *Elasticsearch) bulkPut(ctx context.Context, docs []db.Kv, kvs []db.VersionKV) ([]db.PutResult, error) {
+	results := make([]db.PutResult, len(docs))
+	if len(docs) == 0 {
+		return results, nil
+	}
+	revisions, err := d.createRevisions(ctx, docs, kvs)
+	if err != nil {
+		return nil, err
+	}
+	bulk := d.client.Bulk().Index(d.esConfig.DefaultIndex)
+	// 请求中的位置 -> docs中的位置，修订号无效的项不发送
+	owners := make([]int, 0, len(docs))
+	for i := range docs {
+		req := elastic.NewBulkIndexRequest().Id(docs[i].Key).Doc(&docs[i])
+		if err := withRevision(req, revisions[i]); err != nil {
+			results[i].Err = err
+			continue
+		}
+		bulk.Add(req)
+		owners = append(owners, i)
+	}
+	if len(owners) == 0 {
+		return results, nil
+	}
+	res, err := bulk.Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i, item := range res.Items {
+		for _, r := range item {
+			result := &results[owners[i]]
+			result.Err = bulkItemError(r)
+			if result.Err == nil {
+				result.Revision = formatRevision(r.SeqNo, r.PrimaryTerm)
+			}
+		}
+	}
+	return results, nil
+}
+
+// createRevisions 返回每项写入时使用的修订号，携带 RevisionNotExist 的项需读取当前文档，
+// 见 createRevision
+func (d *Elasticsearch) createRevisions(ctx context.Context, docs []db.Kv, kvs []db.VersionKV) ([]string, error) {
+	revisions := make([]string, len(kvs))
+	creates := make([]int, 0)
+	ids := make([]string, 0)
+	for i, kv := range kvs {
+		revisions[i] = kv.Revision
+		if kv.Revision == db.RevisionNotExist {
+			creates = append(creates, i)
+			ids = append(ids, docs[i].Key)
+		}
+	}
+	if len(creates) == 0 {
+		return revisions, nil
+	}
+	olds, err := d.mget(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for j, i := range creates {
+		revisions[i] = createRevision(olds[j], revisions[i])
+	}
+	return revisions, nil
+}
+
+// createRevision 文档已过期但还未清理时视为不存在，携带 RevisionNotExist 的写入
+// 改为比较过期文档的修订号，避免 create 因文档存在而失败
+func createRevision(old *elastic.GetResult, revision string) string {
+	if revision != db.RevisionNotExist || old == nil || !old.Found || old.SeqNo == nil || old.PrimaryTerm == nil {
+		return revision
+	}
+	var kv db.Kv
+	if err := json.Unmarshal(old.Source, &kv); err != nil || !kv.Expired() {
+		return revision
+	}
+	return formatRevision(*old.SeqNo, *old.PrimaryTerm)
+}
+
+// bulkDelete 批量删除，返回的结果与ids顺序一致，不存在的文档不视为失败
+func (d *Elasticsearch) bulkDelete(ctx context.Context, ids []string) ([]db.DeleteResult, error) {
+	results := make([]db.DeleteResult, len(ids))
+	if len(ids) == 0 {
+		return results, nil
+	}
+	bulk := d.client.Bulk().Index(d.esConfig.DefaultIndex)
+	for _, id := range ids {
+		bulk.Add(elastic.NewBulkDeleteRequest().Id(id))
+	}
+	res, err := bulk.Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i, item := range res.Items {
+		for _, r := range item {
+			if r.Status == http.StatusNotFound {
+				continue
+			}
+			results[i].Err = bulkItemError(r)
+			results[i].Found = results[i].Err == nil
+		}
+	}
+	return results, nil
+}
+
+// multiGet 批量读取文档的value字段，返回的结果与ids顺序一致
+func (d *Elasticsearch) multiGet(ctx context.Context, ids []string) ([]db.GetResult, error) {
+	results := make([]db.GetResult, len(ids))
+	docs, err := d.mget(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for i, doc := range docs {
+		if doc.Error != nil {
+			results[i].Err = fmt.Errorf("%s: %s", doc.Error.Type, doc.Error.Reason)
+			continue
+		}
+		if !doc.Found {
+			results[i].Revision = db.RevisionNotExist
+			continue
+		}
+		if doc.SeqNo != nil && doc.PrimaryTerm != nil {
+			results[i].Revision = formatRevision(*doc.SeqNo, *doc.PrimaryTerm)
+		}
+		var kv db.Kv
+		if err := json.Unmarshal(doc.Source, &kv); err != nil {
+			results[i].Err = err
+			continue
+		}
+		if kv.Expired() {
+			results[i].Revision = db.RevisionNotExist
+			continue
+		}
+		results[i].Value = kv.Value
+		results[i].Found = true
+	}
+	return results, nil
+}
+
+// mget 批量读取文档，返回的结果与ids顺序一致
+func (d *Elasticsearch) mget(ctx context.Context, ids []string) ([]*elastic.GetResult, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	mget := d.client.MultiGet()
+	for _, id := range ids {
+		mget.Add(elastic.NewMultiGetItem().Index(d.esConfig.DefaultIndex).Id(id))
+	}
+	res, err := mget.Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return res.Docs, nil
+}
+
+// bulkItemError 将Bulk中单项的失败转换为error
+func bulkItemError(item *elastic.BulkResponseItem) error {
+	if item.Status >= 200 && item.Status <= 299 {
+		return nil
+	}
+	if item.Status == http.StatusConflict {
+		return db.ErrRevisionConflict
 	}
+	if item.Error != nil {
+		return fmt.Errorf("%s: %s", item.Error.Type, item.Error.Reason)
+	}
+	return fmt.Errorf("bulk item %s failed with status %d", item.Id, item.Status)
+}
+
+// abort 未失败的项标记为 ErrAborted
+func abort(results []db.PutResult) []db.PutResult {
+	for i := range results {
+		if results[i].Err == nil {
+			results[i] = db.PutResult{Err: db.ErrAborted}
+		}
+	}
+	return results
+}
 
-	return resp, err
+// formatRevision 修订号格式: {seq_no}:{primary_term}
+func formatRevision(seqNo int64, primaryTerm int64) string {
+	return fmt.Sprintf("%d:%d", seqNo, primaryTerm)
+}
+
+// withRevision 根据修订号设置写入条件
+func withRevision(req *elastic.BulkIndexRequest, revision string) error {
+	switch revision {
+	case "":
+		return nil
+	case db.RevisionNotExist:
+		req.OpType("create")
+		return nil
+	}
+	var seqNo, primaryTerm int64
+	if _, err := fmt.Sscanf(revision, "%d:%d", &seqNo, &primaryTerm); err != nil {
+		return db.ErrInvalidRevision
+	}
+	req.IfSeqNo(seqNo).IfPrimaryTerm(primaryTerm)
+	return nil
 }
 
 // genIDAndVersion 生成es中需要的ID
@@ -250,11 +931,23 @@ func (d *Elasticsearch) AndQueryCondition(Query *elastic.SearchService, conditio
 // PrefixQuery 前缀查询
 // 返回所有前缀匹配的value
 func (d *Elasticsearch) PrefixQuery(Query *elastic.SearchService, conditions *map[string]string) *elastic.SearchService {
-	var q *elastic.PrefixQuery
-	for k, v := range *conditions {
-		q = elastic.NewPrefixQuery(k, v)
+	return Query.Query(prefixQuery(*conditions))
+}
+
+// userQuery 用户的用户级数据
+func userQuery(userID string) *elastic.BoolQuery {
+	return prefixQuery(map[string]string{
+		"key": userID + "_",
+	}).Filter(elastic.NewTermQuery("user_id", userID))
+}
+
+// prefixQuery 前缀匹配
+func prefixQuery(conditions map[string]string) *elastic.BoolQuery {
+	q := elastic.NewBoolQuery()
+	for k, v := range conditions {
+		q = q.Must(elastic.NewPrefixQuery(k, v))
 	}
-	return Query.Query(q)
+	return q
 }
 
 // InitEsIndex 初始化index
@@ -263,18 +956,41 @@ func InitEsIndex(conf *config.Configs) error {
 	if err != nil {
 		return err
 	}
-	ctx := context.Background()
-	exists, err := client.IndexExists(conf.ES.DefaultIndex).Do(ctx)
-	// 没有默认index则创建
-	if !exists {
-		_, err := client.CreateIndex(conf.ES.DefaultIndex).BodyString(IndexMappingLatest).Do(ctx)
-		if err != nil {
+	return createIndices(context.Background(), client, conf.ES.DefaultIndex)
+}
+
+// createIndices 创建数据索引及各集合的记录索引，已存在的旧版本数据索引更新到最新的映射
+func createIndices(ctx context.Context, client *elastic.Client, index string) error {
+	if err := createIndex(ctx, client, index, IndexMappingLatest); err != nil {
+		return err
+	}
+	if _, err := client.PutMapping().Index(index).BodyString(IndexMappingV3Update).Do(ctx); err != nil {
+		return err
+	}
+	for _, collection := range db.Collections {
+		if err := createIndex(ctx, client, recordIndex(index, collection), RecordIndexMapping); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// createIndex 索引不存在时以指定的映射创建，并发创建导致的失败以索引已存在为准
+func createIndex(ctx context.Context, client *elastic.Client, index string, mapping string) error {
+	exists, err := client.IndexExists(index).Do(ctx)
+	if err == nil && exists {
+		return nil
+	}
+	_, err = client.CreateIndex(index).BodyString(mapping).Do(ctx)
+	if err != nil {
+		if exists, e := client.IndexExists(index).Do(ctx); e == nil && exists {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
 // PutData 存储v到key
 func (d *Elasticsearch) PutData(ctx *context.Context, key *string, value interface{}) error {
 	_, err := d.client.
@@ -289,18 +1005,21 @@ func (d *Elasticsearch) PutData(ctx *context.Context, key *string, value interfa
 	return nil
 }
 
-// GetData 获取key的值
+// GetData 获取key的值，不存在时返回nil
 func (d *Elasticsearch) GetData(ctx *context.Context, key *string) (*json.RawMessage, error) {
 	res, err := d.client.
 		Get().
 		Index(d.esConfig.DefaultIndex).
 		Id(*key).
 		Do(*ctx)
+	if elastic.IsNotFound(err) {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	if res.Found == false {
-		return &res.Source, nil
+	if !res.Found {
+		return nil, nil
 	}
 	return &res.Source, nil
 }
@@ -339,24 +1058,236 @@ func (d *Elasticsearch) GetDataByKVs(ctx *context.Context, kvs *map[string]inter
 	if kvs == nil {
 		return nil, errors.New("GetDataByKVs: need one or more condition(s)")
 	}
-	var Offset = 0
-	var FoundTotal = 0
-	var Resp = make([]*json.RawMessage, 0)
-SEARCH:
-	search := d.client.Search().Index(d.esConfig.DefaultIndex)
-	search = d.AndQueryCondition(search, kvs)
-	ret, err := search.From(Offset).Size(MaxPageSize).Do(*ctx)
+	q := elastic.NewBoolQuery()
+	for k, v := range *kvs {
+		q = q.Filter(elastic.NewTermQuery(k, v))
+	}
+	resp := make([]*json.RawMessage, 0)
+	err := d.walkSource(*ctx, q, func(source json.RawMessage) error {
+		resp = append(resp, &source)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// recordDoc 记录在es中的文档，_id 为记录的ID
+type recordDoc struct {
+	Group string          `json:"group"`
+	ID    string          `json:"id"`
+	Seq   int64           `json:"seq"`
+	Users []string        `json:"users,omitempty"`
+	Value json.RawMessage `json:"value"`
+}
+
+// PutRecords 以一次Bulk写入新的记录，任一条失败时返回第一个错误
+func (d *Elasticsearch) PutRecords(ctx context.Context, collection string, records []db.Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+	bulk := d.client.Bulk().Index(d.recordIndex(collection))
+	for _, r := range records {
+		bulk.Add(elastic.NewBulkIndexRequest().Id(r.ID).Doc(newRecordDoc(r)))
+	}
+	res, err := bulk.Do(ctx)
+	if err != nil {
+		return err
+	}
+	for _, item := range res.Items {
+		for _, r := range item {
+			if err := bulkItemError(r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// GetRecord 获取记录，不存在或不属于该分组时返回nil
+func (d *Elasticsearch) GetRecord(ctx context.Context, collection string, group string, id string) (*db.Record, error) {
+	res, err := d.client.Get().
+		Index(d.recordIndex(collection)).
+		Id(id).
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !res.Found {
+		return nil, nil
+	}
+	r, err := parseRecord(res.Source, res.SeqNo, res.PrimaryTerm)
+	if err != nil {
+		return nil, err
+	}
+	if r.Group != group {
+		return nil, nil
+	}
+	return &r, nil
+}
+
+// ListRecords 按 seq、id 排序，以 search_after 分页
+func (d *Elasticsearch) ListRecords(ctx context.Context, collection string, q db.RecordQuery) ([]db.Record, error) {
+	query := elastic.NewBoolQuery().Filter(elastic.NewTermQuery("group", q.Group))
+	if q.MaxSeq > 0 {
+		query = query.Filter(elastic.NewRangeQuery("seq").Lte(q.MaxSeq))
+	}
+	search := d.client.Search().
+		Index(d.recordIndex(collection)).
+		Query(query).
+		SortBy(elastic.NewFieldSort("seq").Order(!q.Desc), elastic.NewFieldSort("id").Order(!q.Desc)).
+		SeqNoAndPrimaryTerm(true).
+		TrackTotalHits(false).
+		Size(q.Size())
+	if q.After != nil {
+		search = search.SearchAfter(q.After.Seq, q.After.ID)
+	}
+	ret, err := search.Do(ctx)
 	if err != nil {
 		return nil, err
 	}
-	for _, r := range ret.Hits.Hits {
-		Resp = append(Resp, &(r.Source))
+	list := make([]db.Record, 0, len(ret.Hits.Hits))
+	for _, hit := range ret.Hits.Hits {
+		r, err := parseRecord(hit.Source, hit.SeqNo, hit.PrimaryTerm)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, r)
+	}
+	return list, nil
+}
+
+// WalkRecords 遍历与用户相关的记录
+func (d *Elasticsearch) WalkRecords(ctx context.Context, collection string, userID string, fn func(record db.Record) error) error {
+	q := elastic.NewBoolQuery().Filter(elastic.NewTermQuery("users", userID))
+	return d.walkHits(ctx, d.recordIndex(collection), q, func(hit *elastic.SearchHit) error {
+		r, err := parseRecord(hit.Source, hit.SeqNo, hit.PrimaryTerm)
+		if err != nil {
+			return err
+		}
+		return fn(r)
+	})
+}
+
+// UpdateRecord 以 if_seq_no/if_primary_term 覆盖原文档
+func (d *Elasticsearch) UpdateRecord(ctx context.Context, collection string, old db.Record, record db.Record) (string, error) {
+	var seqNo, primaryTerm int64
+	if _, err := fmt.Sscanf(old.Revision, "%d:%d", &seqNo, &primaryTerm); err != nil {
+		return "", db.ErrInvalidRevision
+	}
+	record.Group, record.ID = old.Group, old.ID
+	res, err := d.client.Index().
+		Index(d.recordIndex(collection)).
+		Id(record.ID).
+		IfSeqNo(seqNo).
+		IfPrimaryTerm(primaryTerm).
+		BodyJson(newRecordDoc(record)).
+		Do(ctx)
+	if elastic.IsConflict(err) || elastic.IsNotFound(err) {
+		return "", db.ErrRevisionConflict
+	}
+	if err != nil {
+		return "", err
+	}
+	return formatRevision(res.SeqNo, res.PrimaryTerm), nil
+}
+
+// DeleteRecord 删除记录，Revision 不为空时比较修订号
+func (d *Elasticsearch) DeleteRecord(ctx context.Context, collection string, record db.Record) error {
+	del := d.client.Delete().
+		Index(d.recordIndex(collection)).
+		Id(record.ID)
+	if record.Revision != "" {
+		var seqNo, primaryTerm int64
+		if _, err := fmt.Sscanf(record.Revision, "%d:%d", &seqNo, &primaryTerm); err != nil {
+			return db.ErrInvalidRevision
+		}
+		del = del.IfSeqNo(seqNo).IfPrimaryTerm(primaryTerm)
+	}
+	_, err := del.Do(ctx)
+	switch {
+	case elastic.IsConflict(err), elastic.IsNotFound(err) && record.Revision != "":
+		return db.ErrRevisionConflict
+	case elastic.IsNotFound(err):
+		return nil
+	}
+	return err
+}
+
+// TrimRecords 找到倒数第keep+1条记录，删除分组内 seq 不大于该记录的文档。
+// 只对已刷新的文档生效
+func (d *Elasticsearch) TrimRecords(ctx context.Context, collection string, group string, keep int) (int64, error) {
+	if keep <= 0 {
+		return 0, nil
+	}
+	index := d.recordIndex(collection)
+	q := elastic.NewBoolQuery().Filter(elastic.NewTermQuery("group", group))
+	ret, err := d.client.Search().
+		Index(index).
+		Query(q).
+		SortBy(elastic.NewFieldSort("seq").Desc(), elastic.NewFieldSort("id").Desc()).
+		TrackTotalHits(false).
+		From(keep).
+		Size(1).
+		Do(ctx)
+	if err != nil {
+		return 0, err
 	}
-	FoundTotal += MaxPageSize
-	if (ret.Hits.TotalHits.Value - int64(FoundTotal)) > 0 {
-		Offset += MaxPageSize
-		goto SEARCH
+	if len(ret.Hits.Hits) == 0 {
+		return 0, nil
 	}
+	last, err := parseRecord(ret.Hits.Hits[0].Source, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	res, err := d.client.DeleteByQuery(index).
+		Query(q.Filter(elastic.NewRangeQuery("seq").Lte(last.Seq))).
+		Conflicts("proceed").
+		Do(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return res.Deleted, nil
+}
 
-	return Resp, nil
+// recordIndex 每个集合使用独立的索引
+// format is: {DefaultIndex}_{collection}
+func (d *Elasticsearch) recordIndex(collection string) string {
+	return recordIndex(d.esConfig.DefaultIndex, collection)
+}
+
+func recordIndex(index string, collection string) string {
+	return index + "_" + collection
+}
+
+func newRecordDoc(r db.Record) *recordDoc {
+	return &recordDoc{
+		Group: r.Group,
+		ID:    r.ID,
+		Seq:   r.Seq,
+		Users: r.Users,
+		Value: r.Value,
+	}
+}
+
+func parseRecord(source json.RawMessage, seqNo *int64, primaryTerm *int64) (db.Record, error) {
+	var doc recordDoc
+	if err := json.Unmarshal(source, &doc); err != nil {
+		return db.Record{}, err
+	}
+	r := db.Record{
+		Group: doc.Group,
+		ID:    doc.ID,
+		Seq:   doc.Seq,
+		Users: doc.Users,
+		Value: doc.Value,
+	}
+	if seqNo != nil && primaryTerm != nil {
+		r.Revision = formatRevision(*seqNo, *primaryTerm)
+	}
+	return r, nil
 }
@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"git.internal.yunify.com/qxp/persona/pkg/config"
 	"git.internal.yunify.com/qxp/persona/pkg/db"
+	"git.internal.yunify.com/qxp/persona/pkg/db/dbtest"
+	"os"
 	"testing"
 	"time"
 )
@@ -19,6 +21,8 @@ var (
 	TestVersion = "v1.0.1_persona"
 	// 完成测试后需要清理的key
 	CleanupKeys = make([]string, 0)
+	// esErr 连接es失败的原因，不为空时跳过所有测试
+	esErr error
 )
 
 func TestMain(m *testing.M) {
@@ -30,23 +34,42 @@ func TestMain(m *testing.M) {
 	flag.Parse()
 	err := config.Init(*configPath)
 	if err != nil {
-		panic(err)
+		esErr = err
+		os.Exit(m.Run())
 	}
 	client, err := NewEsClient(&config.Config.ES)
 	if err != nil {
-		panic(err)
+		esErr = err
+		os.Exit(m.Run())
 	}
-	TestEsAPI = &Elasticsearch{client: client, esConfig: &config.Config.ES}
-	m.Run()
+	if err := createIndices(ctx, client, config.Config.ES.DefaultIndex); err != nil {
+		esErr = err
+		os.Exit(m.Run())
+	}
+	TestEsAPI = &Elasticsearch{
+		client:   client,
+		esConfig: &config.Config.ES,
+		sweeper:  newSweeper(config.Config.ES.DefaultIndex),
+	}
+	code := m.Run()
 	// 清理测试数据
 	fmt.Printf("Delete keys: %s", CleanupKeys)
 	for _, i := range CleanupKeys {
 		_ = TestEsAPI.DeleteData(&ctx, &i)
 	}
 	fmt.Println("Data cleanup success")
+	os.Exit(code)
+}
+
+// requireES 没有可用的es时跳过测试，本地及CI可使用 memory 后端
+func requireES(t *testing.T) {
+	if esErr != nil {
+		t.Skipf("elasticsearch unavailable: %s", esErr)
+	}
 }
 
 func TestPutValue(t *testing.T) {
+	requireES(t)
 	ctx := context.Background()
 	fmt.Printf("Put key: [%s] value: [%s]\n", TestKey, TestUserID)
 	err := TestEsAPI.Put(ctx, TestKey, TestUserID)
@@ -56,6 +79,7 @@ func TestPutValue(t *testing.T) {
 }
 
 func TestGetValue(t *testing.T) {
+	requireES(t)
 	ctx := context.Background()
 	res, err := TestEsAPI.Get(ctx, TestKey)
 	fmt.Printf("Got value: %v\n", res)
@@ -68,6 +92,7 @@ func TestGetValue(t *testing.T) {
 }
 
 func TestPutWithVersion(t *testing.T) {
+	requireES(t)
 	ctx := context.Background()
 	key := fmt.Sprintf("%s_%s", TestKey, TestVersion)
 	fmt.Printf("Put Version: [%s] Key: [%s] Value: [%s]", TestVersion, key, TestValue)
@@ -79,6 +104,7 @@ func TestPutWithVersion(t *testing.T) {
 }
 
 func TestGetWithVersion(t *testing.T) {
+	requireES(t)
 	ctx := context.Background()
 	key := fmt.Sprintf("%s_%s", TestKey, TestVersion)
 	res, err := TestEsAPI.GetWithVersion(ctx, TestVersion, key)
@@ -90,6 +116,7 @@ func TestGetWithVersion(t *testing.T) {
 
 // 设置用户带版本的值
 func TestUserPutWithVersion(t *testing.T) {
+	requireES(t)
 	ctx := context.Background()
 	key := fmt.Sprintf("%s_%s_%s", TestKey, TestVersion, TestUserID)
 	err := TestEsAPI.UserPutWithVersion(ctx, TestVersion, key, TestValue)
@@ -100,6 +127,7 @@ func TestUserPutWithVersion(t *testing.T) {
 }
 
 func TestUserGetWithVersion(t *testing.T) {
+	requireES(t)
 	ctx := context.Background()
 	key := fmt.Sprintf("%s_%s_%s", TestKey, TestVersion, TestUserID)
 	res, err := TestEsAPI.UserGetWithVersion(ctx, TestVersion, key)
@@ -107,10 +135,42 @@ func TestUserGetWithVersion(t *testing.T) {
 		t.Fatal(err)
 	}
 	fmt.Printf("Got value: %v\n", res)
+	if res[key] != TestValue {
+		t.Fatal(fmt.Sprintf("%s != %s", TestValue, res[key]))
+	}
+}
+
+// 用户值读写需区分不存在与错误
+func TestUserGetWithVersionRoundTrip(t *testing.T) {
+	requireES(t)
+	ctx := dbtest.UserContext(TestUserID)
+	key := fmt.Sprintf("%s_round_trip", TestKey)
+	err := TestEsAPI.UserPutWithVersion(ctx, TestVersion, key, TestValue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	CleanupKeys = append(CleanupKeys, fmt.Sprintf("%s_%s_%s", TestUserID, TestVersion, key))
+
+	res, err := TestEsAPI.UserGetWithVersion(ctx, TestVersion, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[key] != TestValue {
+		t.Fatal(fmt.Sprintf("%s != %s", TestValue, res[key]))
+	}
+
+	res, err = TestEsAPI.UserGetWithVersion(dbtest.UserContext("not_exists"), TestVersion, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 0 {
+		t.Fatal(fmt.Sprintf("expect empty result, got %v", res))
+	}
 }
 
 // 根据key更新数据
 func TestUpdateData(t *testing.T) {
+	requireES(t)
 	ctx := context.Background()
 
 	updateValue := map[string]interface{}{
@@ -143,6 +203,7 @@ func TestUpdateData(t *testing.T) {
 
 // 根据条件获取数据
 func TestGetDataByKVs(t *testing.T) {
+	requireES(t)
 	ctx := context.Background()
 	KVCondition := map[string]interface{}{
 		"key": TestKey,
@@ -159,6 +220,7 @@ func TestGetDataByKVs(t *testing.T) {
 
 // 根据key删除数据
 func TestDeleteData(t *testing.T) {
+	requireES(t)
 	ctx := context.Background()
 	_ = TestEsAPI.DeleteData(&ctx, &TestKey)
 	time.Sleep(time.Second * 5)
@@ -170,14 +232,54 @@ func TestDeleteData(t *testing.T) {
 	fmt.Printf("Got TestDeleteData data: %v", data)
 }
 
+func TestConformance(t *testing.T) {
+	requireES(t)
+	dbtest.Run(t, TestEsAPI, func() {
+		_, err := EsClient.Refresh(config.Config.ES.DefaultIndex + "*").Do(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
 func TestMainOrder(t *testing.T) {
+	requireES(t)
 	t.Run("TestPutValue", TestPutValue)
 	t.Run("TestGetValue", TestGetValue)
 	t.Run("TestPutWithVersion", TestPutWithVersion)
 	t.Run("TestGetWithVersion", TestGetWithVersion)
 	t.Run("TestUserPutWithVersion", TestUserPutWithVersion)
 	t.Run("TestUserGetWithVersion", TestUserGetWithVersion)
+	t.Run("TestUserGetWithVersionRoundTrip", TestUserGetWithVersionRoundTrip)
 	t.Run("TestUpdateData", TestUpdateData)
 	t.Run("TestGetDataByKVs", TestGetDataByKVs)
 	t.Run("TestDeleteData", TestDeleteData)
 }
+
+// TestMappingUpdate v2的映射经过更新后与最新版本一致，不需要es
+func TestMappingUpdate(t *testing.T) {
+	properties := func(mapping string) map[string]interface{} {
+		var m struct {
+			Mappings struct {
+				Properties map[string]interface{} `json:"properties"`
+			} `json:"mappings"`
+			Properties map[string]interface{} `json:"properties"`
+		}
+		if err := json.Unmarshal([]byte(mapping), &m); err != nil {
+			t.Fatal(err)
+		}
+		if m.Properties != nil {
+			return m.Properties
+		}
+		return m.Mappings.Properties
+	}
+	updated := properties(IndexMappingV2)
+	for k, v := range properties(IndexMappingV3Update) {
+		updated[k] = v
+	}
+	got, _ := json.Marshal(updated)
+	want, _ := json.Marshal(properties(IndexMappingLatest))
+	if string(got) != string(want) {
+		t.Fatalf("expect %s, got %s", want, got)
+	}
+}
@@ -18,6 +18,50 @@ var (
 				}
 			}`
 
+	// IndexMappingV2 索引映射v2历史版本
+	IndexMappingV2 = `{
+				"mappings":{
+					"properties":{
+						"key":{
+							"type":"keyword"
+						},
+						"version":{
+							"type":"keyword"
+						},
+						"user_id":{
+							"type":"keyword"
+						},
+						"data_type":{
+							"type":"keyword"
+						},
+						"name":{
+							"type":"keyword"
+						},
+						"id":{
+							"type":"keyword"
+						},
+						"tag":{
+							"type":"keyword"
+						},
+						"content":{
+							"type":"keyword"
+						},
+						"created_at":{
+							"type":"float"
+						}
+					}
+				}
+			}`
+
+	// IndexMappingV3Update v2升级到最新版本新增的字段，已存在的索引启动时通过 PutMapping 更新
+	IndexMappingV3Update = `{
+				"properties":{
+					"expires_at":{
+						"type":"long"
+					}
+				}
+			}`
+
 	// IndexMappingLatest 索引最新版本
 	IndexMappingLatest = `{
 				"mappings":{
@@ -48,6 +92,33 @@ var (
 						},
 						"created_at":{
 							"type":"float"
+						},
+						"expires_at":{
+							"type":"long"
+						}
+					}
+				}
+			}`
+
+	// RecordIndexMapping 记录集合的索引映射，value 只保存不索引
+	RecordIndexMapping = `{
+				"mappings":{
+					"properties":{
+						"group":{
+							"type":"keyword"
+						},
+						"id":{
+							"type":"keyword"
+						},
+						"seq":{
+							"type":"long"
+						},
+						"users":{
+							"type":"keyword"
+						},
+						"value":{
+							"type":"object",
+							"enabled":false
 						}
 					}
 				}
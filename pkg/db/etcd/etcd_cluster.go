@@ -3,15 +3,29 @@ package db
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"git.internal.yunify.com/qxp/persona/pkg/config"
 	"git.internal.yunify.com/qxp/persona/pkg/db"
 	"git.internal.yunify.com/qxp/persona/pkg/misc/logger"
 
+	"github.com/coreos/etcd/mvcc/mvccpb"
 	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
+const (
+	// maxTxnOps 单个事务最多包含的操作数，与etcd默认的 --max-txn-ops 一致
+	maxTxnOps = 128
+	// walkPageSize 遍历时单次读取的条数
+	walkPageSize = 1000
+)
+
 // Etcd etcd
 type Etcd struct {
 	client     *clientv3.Client
@@ -19,29 +33,87 @@ type Etcd struct {
 	prefix     string
 }
 
-// DeleteData not need implement
+// DeleteData 根据key删除数据集
 func (d *Etcd) DeleteData(ctx *context.Context, key *string) error {
-	return nil
+	_, err := d.client.Delete(*ctx, d.addDataPrefix(*key))
+	return err
 }
 
-// UpdateData not need implement
+// UpdateData 更新数据集，只覆盖value中出现的字段，语义同es Update().Doc()
+// value 可传map或struct
 func (d *Etcd) UpdateData(ctx *context.Context, key *string, value interface{}) error {
-	return nil
+	k := d.addDataPrefix(*key)
+	for {
+		res, err := d.client.Get(*ctx, k)
+		if err != nil {
+			return err
+		}
+		if len(res.Kvs) == 0 {
+			return fmt.Errorf("document %s missing", *key)
+		}
+		doc, err := db.MergeDocument(res.Kvs[0].Value, value)
+		if err != nil {
+			return err
+		}
+		// 读取后被其他请求修改过则重试
+		txn, err := d.client.Txn(*ctx).
+			If(clientv3.Compare(clientv3.ModRevision(k), "=", res.Kvs[0].ModRevision)).
+			Then(clientv3.OpPut(k, string(doc))).
+			Commit()
+		if err != nil {
+			return err
+		}
+		if txn.Succeeded {
+			return nil
+		}
+	}
 }
 
-// GetDataByKVs not need implement
+// GetDataByKVs 根据k v过滤数据集。一次返回所有数据
 func (d *Etcd) GetDataByKVs(ctx *context.Context, kvs *map[string]interface{}) ([]*json.RawMessage, error) {
-	return nil, nil
+	if kvs == nil {
+		return nil, errors.New("GetDataByKVs: need one or more condition(s)")
+	}
+	conditions, err := db.TermConditions(*kvs)
+	if err != nil {
+		return nil, err
+	}
+	res, err := d.client.Get(*ctx, d.addDataPrefix(""), clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	resp := make([]*json.RawMessage, 0)
+	for _, ev := range res.Kvs {
+		if !db.MatchDocument(ev.Value, conditions) {
+			continue
+		}
+		doc := json.RawMessage(ev.Value)
+		resp = append(resp, &doc)
+	}
+	return resp, nil
 }
 
-// PutData not need implement
+// PutData 以json格式存储数据集
 func (d *Etcd) PutData(ctx *context.Context, key *string, value interface{}) error {
-	return nil
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = d.client.Put(*ctx, d.addDataPrefix(*key), string(b))
+	return err
 }
 
-// GetData not need implement
+// GetData 获取数据集，不存在时返回nil
 func (d *Etcd) GetData(ctx *context.Context, key *string) (*json.RawMessage, error) {
-	return nil, nil
+	res, err := d.client.Get(*ctx, d.addDataPrefix(*key))
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Kvs) == 0 {
+		return nil, nil
+	}
+	doc := json.RawMessage(res.Kvs[0].Value)
+	return &doc, nil
 }
 
 // NewEtcdClient new etcd client
@@ -68,6 +140,16 @@ func NewEtcd(conf *config.Configs) (db.BackendStorage, error) {
 	}, err
 }
 
+// ForTenant 租户的数据存储在前缀 {HostName}#{tenant} 下，与默认租户共用连接。
+// 租户ID不包含 _ 及 /，各租户的前缀互不包含
+func (d *Etcd) ForTenant(ctx context.Context, tenant string) (db.BackendStorage, error) {
+	return &Etcd{
+		client:     d.client,
+		etcdConfig: d.etcdConfig,
+		prefix:     d.prefix + "#" + tenant,
+	}, nil
+}
+
 // Put 存数据
 func (d *Etcd) Put(ctx context.Context, key string, value string) error {
 	_, err := d.client.Put(ctx, d.addPrefix(key), value)
@@ -87,25 +169,441 @@ func (d *Etcd) Get(ctx context.Context, key string) (map[string]string, error) {
 	return result, nil
 }
 
+// MultiGet 使用事务批量取数据
+func (d *Etcd) MultiGet(ctx context.Context, keys []string) ([]db.GetResult, error) {
+	candidates := make([][]string, 0, len(keys))
+	for _, k := range keys {
+		candidates = append(candidates, []string{d.addPrefix(k)})
+	}
+	return d.multiGet(ctx, candidates)
+}
+
+// TxnPut 按maxTxnOps分批提交事务，每个事务比较该批内所有带修订号的key。
+// 某一批失败时，将已提交批次中的key回滚为写入前的值，之后被他人修改过的key不回滚
+func (d *Etcd) TxnPut(ctx context.Context, kvs []db.VersionKV) ([]db.PutResult, error) {
+	results := make([]db.PutResult, len(kvs))
+	for i, kv := range kvs {
+		if kv.Revision == "" {
+			continue
+		}
+		if rev, err := strconv.ParseInt(kv.Revision, 10, 64); err != nil || rev < 0 {
+			results[i].Err = db.ErrInvalidRevision
+			return abort(results), db.ErrAborted
+		}
+	}
+
+	leases, err := d.grantLeases(ctx, kvs)
+	if err != nil {
+		return nil, err
+	}
+	// prevs 已提交的key写入前的值，不存在时为nil
+	prevs := make([]*prevKV, len(kvs))
+	// 每项写入数据及版本信息两个操作
+	size := maxTxnOps / 2
+	for start := 0; start < len(kvs); start += size {
+		end := start + size
+		if end > len(kvs) {
+			end = len(kvs)
+		}
+		cmps := make([]clientv3.Cmp, 0)
+		puts := make([]clientv3.Op, 0, end-start)
+		gets := make([]clientv3.Op, 0)
+		compared := make([]int, 0)
+		for i := start; i < end; i++ {
+			key := d.addPrefix(kvs[i].Key)
+			if kvs[i].Revision != "" {
+				rev, _ := strconv.ParseInt(kvs[i].Revision, 10, 64)
+				cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(key), "=", rev))
+				gets = append(gets, clientv3.OpGet(key))
+				compared = append(compared, i)
+			}
+			puts = append(puts, clientv3.OpPut(key, kvs[i].Value, leases.options(kvs[i].TTL, clientv3.WithPrevKV())...))
+		}
+		// 版本信息在数据之后，不影响按位置读取数据的响应
+		for i := start; i < end; i++ {
+			if index := d.txnVersionPrefix(kvs[i]); index != "" {
+				puts = append(puts, clientv3.OpPut(index, "", leases.options(kvs[i].TTL)...))
+			}
+		}
+		res, err := d.client.Txn(ctx).If(cmps...).Then(puts...).Else(gets...).Commit()
+		if err != nil || !res.Succeeded {
+			for i := start; i < end; i++ {
+				results[i].Err = err
+			}
+			if err == nil {
+				// 找出修订号不一致的key
+				for j, r := range res.Responses {
+					i := compared[j]
+					var current int64
+					if got := r.GetResponseRange().Kvs; len(got) > 0 {
+						current = got[0].ModRevision
+					}
+					if strconv.FormatInt(current, 10) != kvs[i].Revision {
+						results[i].Err = db.ErrRevisionConflict
+					}
+				}
+			}
+			if err := d.rollback(ctx, kvs[:start], results[:start], prevs[:start]); err != nil {
+				return nil, err
+			}
+			for i := 0; i < start; i++ {
+				results[i] = db.PutResult{}
+			}
+			return abort(results), db.ErrAborted
+		}
+		rev := strconv.FormatInt(res.Header.Revision, 10)
+		for j, r := range res.Responses[:end-start] {
+			if prev := r.GetResponsePut().PrevKv; prev != nil {
+				prevs[start+j] = &prevKV{value: string(prev.Value), lease: clientv3.LeaseID(prev.Lease)}
+			}
+			results[start+j].Revision = rev
+		}
+	}
+	return results, nil
+}
+
+// prevKV TxnPut 写入前的值及其租约
+type prevKV struct {
+	value string
+	lease clientv3.LeaseID
+}
+
+// rollback 将 TxnPut 已提交的key恢复为写入前的值，仅当key的修订号仍为写入后的修订号时恢复。
+// 写入前的租约已过期时，该key本应已过期，直接删除
+func (d *Etcd) rollback(ctx context.Context, kvs []db.VersionKV, results []db.PutResult, prevs []*prevKV) error {
+	for i, kv := range kvs {
+		key := d.addPrefix(kv.Key)
+		rev, err := strconv.ParseInt(results[i].Revision, 10, 64)
+		if err != nil {
+			return err
+		}
+		restore := func(op clientv3.Op) error {
+			_, err := d.client.Txn(ctx).
+				If(clientv3.Compare(clientv3.ModRevision(key), "=", rev)).
+				Then(op).
+				Commit()
+			return err
+		}
+		if prevs[i] == nil {
+			err = restore(clientv3.OpDelete(key))
+			if index := d.txnVersionPrefix(kv); err == nil && index != "" {
+				_, err = d.client.Delete(ctx, index)
+			}
+		} else {
+			opts := make([]clientv3.OpOption, 0, 1)
+			if prevs[i].lease != clientv3.NoLease {
+				opts = append(opts, clientv3.WithLease(prevs[i].lease))
+			}
+			err = restore(clientv3.OpPut(key, prevs[i].value, opts...))
+			if err == rpctypes.ErrLeaseNotFound {
+				err = restore(clientv3.OpDelete(key))
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("rollback %s: %w", kv.Key, err)
+		}
+	}
+	return nil
+}
+
+// ttlLeases TTL -> 租约，同一次写入中TTL相同的key共用一个租约
+type ttlLeases map[int64]clientv3.LeaseID
+
+// grantLeases 为kvs中每个不同的TTL申请租约，租约到期时etcd删除其上的key
+func (d *Etcd) grantLeases(ctx context.Context, kvs []db.VersionKV) (ttlLeases, error) {
+	l := make(ttlLeases)
+	for _, kv := range kvs {
+		if kv.TTL <= 0 {
+			continue
+		}
+		if _, ok := l[kv.TTL]; ok {
+			continue
+		}
+		res, err := d.client.Grant(ctx, kv.TTL)
+		if err != nil {
+			return nil, err
+		}
+		l[kv.TTL] = res.ID
+	}
+	return l, nil
+}
+
+// options 写入ttl对应的租约，没有TTL时不绑定租约，覆盖原有的租约
+func (l ttlLeases) options(ttl int64, opts ...clientv3.OpOption) []clientv3.OpOption {
+	if id, ok := l[ttl]; ok {
+		opts = append(opts, clientv3.WithLease(id))
+	}
+	return opts
+}
+
 // GetWithPrefix 获取前缀列表
 func (d *Etcd) GetWithPrefix(ctx context.Context, key string) ([]db.ImportReqData, error) {
-	res, err := d.client.Get(ctx, d.addPrefix(key), clientv3.WithPrefix())
+	result := make([]db.ImportReqData, 0)
+	err := d.WalkWithPrefix(ctx, key, func(data db.ImportReqData) error {
+		result = append(result, data)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	result := make([]db.ImportReqData, 0)
-	for _, ev := range res.Kvs {
-		result = append(result, db.ImportReqData{
-			Key:   d.removePrefix(string(ev.Key)),
-			Value: string(ev.Value),
+	return result, nil
+}
+
+// WalkWithPrefix 分页遍历前缀列表，所有分页读取同一个revision，遍历期间的写入不可见
+func (d *Etcd) WalkWithPrefix(ctx context.Context, key string, fn db.WalkFunc) error {
+	return d.walkRange(ctx, d.addPrefix(key), func(kv *mvccpb.KeyValue) error {
+		return fn(db.ImportReqData{
+			Key:   d.removePrefix(string(kv.Key)),
+			Value: string(kv.Value),
 		})
+	})
+}
+
+// walkRange 在同一修订号下分页遍历存储前缀下的所有key
+func (d *Etcd) walkRange(ctx context.Context, prefix string, fn func(kv *mvccpb.KeyValue) error) error {
+	end := clientv3.GetPrefixRangeEnd(prefix)
+	from := prefix
+	var rev int64
+	for {
+		opts := []clientv3.OpOption{
+			clientv3.WithRange(end),
+			clientv3.WithLimit(walkPageSize),
+			clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend),
+		}
+		if rev > 0 {
+			opts = append(opts, clientv3.WithRev(rev))
+		}
+		res, err := d.client.Get(ctx, from, opts...)
+		if err != nil {
+			return err
+		}
+		rev = res.Header.Revision
+		for _, kv := range res.Kvs {
+			if err := fn(kv); err != nil {
+				return err
+			}
+		}
+		if !res.More || len(res.Kvs) == 0 {
+			return nil
+		}
+		from = string(res.Kvs[len(res.Kvs)-1].Key) + "\x00"
 	}
+}
+
+// ListVersions 按版本信息列出应用级key的所有版本，版本信息存在但数据已不存在的不列出。
+// 写入版本信息之前存储的数据没有版本信息，{key}_ 之后不包含 _ 的部分视为其版本号
+func (d *Etcd) ListVersions(ctx context.Context, key string) ([]db.VersionKV, error) {
+	versions := make([]string, 0)
+	indexed := make(map[string]bool)
+	err := d.walkRange(ctx, d.versionKeyPrefix(key)+"/", func(kv *mvccpb.KeyValue) error {
+		if k, v, ok := d.parseVersionPrefix(string(kv.Key)); ok && k == key {
+			versions = append(versions, v)
+			indexed[v] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Compatible with data stored before version metadata
+	pre := key + "_"
+	err = d.WalkWithPrefix(ctx, pre, func(data db.ImportReqData) error {
+		v := strings.TrimPrefix(data.Key, pre)
+		if v != "" && !strings.Contains(v, "_") && !indexed[v] {
+			versions = append(versions, v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]db.VersionKV, 0, len(versions))
+	for _, v := range versions {
+		keys = append(keys, db.VersionKV{Version: v, Key: key})
+	}
+	values, err := d.MultiGetWithVersion(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]db.VersionKV, 0, len(keys))
+	for i, v := range values {
+		if v.Err != nil {
+			return nil, v.Err
+		}
+		if v.Found {
+			keys[i].Value = v.Value
+			result = append(result, keys[i])
+		}
+	}
+	db.SortVersionKVs(result)
+	return result, nil
+}
+
+// UserListVersions 列出当前用户key的所有版本
+func (d *Etcd) UserListVersions(ctx context.Context, key string) ([]db.VersionKV, error) {
+	result := make([]db.VersionKV, 0)
+	err := d.walkUserData(ctx, logger.STDHeader(ctx)["User-Id"], func(_ string, kv db.VersionKV) error {
+		if kv.Key == key {
+			result = append(result, kv)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Version < result[j].Version
+	})
 	return result, nil
 }
 
-// PutWithVersion 存储带前缀的key
+// Watch 监听应用级key的变更，租约到期删除的key同样产生删除事件。
+// 监听前缀时监听版本信息，与数据在同一事务中写入及删除，写入时按修订号读取数据
+func (d *Etcd) Watch(ctx context.Context, filter db.WatchFilter) (<-chan db.WatchEvent, error) {
+	if len(filter.Keys) == 0 {
+		targets := []string{d.versionKeyPrefix(filter.Prefix)}
+		return d.watch(ctx, filter, targets, d.parseVersionPrefix, func(ctx context.Context, key string, version string, rev int64) (string, error) {
+			res, err := d.client.Get(ctx, d.addPrefix2New(version, key), clientv3.WithRev(rev))
+			if err != nil {
+				return "", err
+			}
+			if len(res.Kvs) == 0 {
+				return "", fmt.Errorf("value of %s_%s missing at revision %d", key, version, rev)
+			}
+			return string(res.Kvs[0].Value), nil
+		})
+	}
+	targets := make([]string, 0, len(filter.Keys))
+	keys := make(map[string]string, len(filter.Keys))
+	for _, key := range filter.Keys {
+		target := d.addPrefix2New(filter.Version, key)
+		targets = append(targets, target)
+		keys[target] = key
+	}
+	return d.watch(ctx, filter, targets, func(k string) (string, string, bool) {
+		key, ok := keys[k]
+		return key, filter.Version, ok
+	}, nil)
+}
+
+// UserWatch 监听当前用户key的变更
+func (d *Etcd) UserWatch(ctx context.Context, filter db.WatchFilter) (<-chan db.WatchEvent, error) {
+	userID := logger.STDHeader(ctx)["User-Id"]
+	targets := []string{d.addPrefix3New(userID, filter.Version, filter.Prefix)}
+	if len(filter.Keys) > 0 {
+		targets = targets[:0]
+		for _, key := range filter.Keys {
+			targets = append(targets, d.addPrefix3New(userID, filter.Version, key))
+		}
+	}
+	pre := d.addPrefix3New(userID, filter.Version, "")
+	return d.watch(ctx, filter, targets, func(k string) (string, string, bool) {
+		if !strings.HasPrefix(k, pre) {
+			return "", "", false
+		}
+		return strings.TrimPrefix(k, pre), filter.Version, true
+	}, nil)
+}
+
+// watch 以一个监听覆盖filter中的所有key(按范围)或前缀，事件按修订号顺序通知，由 parse 从存储的key解析出key及版本号，
+// load 不为nil时写入事件的值由 load 按修订号读取。
+// 监听建立后返回，之后的写入都会通知；恢复的修订号已被压缩时通知 Resync 后结束，监听结束时关闭返回的channel
+func (d *Etcd) watch(ctx context.Context, filter db.WatchFilter, targets []string,
+	parse func(k string) (string, string, bool),
+	load func(ctx context.Context, key string, version string, rev int64) (string, error)) (<-chan db.WatchEvent, error) {
+	ctx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+	opts := []clientv3.OpOption{clientv3.WithCreatedNotify()}
+	switch {
+	case len(filter.Keys) == 0:
+		opts = append(opts, clientv3.WithPrefix())
+	case len(targets) > 1:
+		// 多个key的监听之间不保证顺序，使用覆盖所有key的范围，范围内的其他key由 parse 排除
+		sort.Strings(targets)
+		opts = append(opts, clientv3.WithRange(targets[len(targets)-1]+"\x00"))
+	}
+	if filter.Revision > 0 {
+		opts = append(opts, clientv3.WithRev(filter.Revision+1))
+	}
+	wch := d.client.Watch(ctx, targets[0], opts...)
+	// WithCreatedNotify 时第一个响应表示监听已建立
+	first, ok := <-wch
+	if !ok {
+		cancel()
+		return nil, fmt.Errorf("watch %s closed", targets[0])
+	}
+	if err := first.Err(); err != nil && first.CompactRevision == 0 {
+		cancel()
+		return nil, err
+	}
+
+	events := make(chan db.WatchEvent)
+	go func() {
+		defer close(events)
+		defer cancel()
+		send := func(e db.WatchEvent) bool {
+			select {
+			case events <- e:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		res := first
+		for {
+			if res.CompactRevision != 0 {
+				// 恢复的位置之后的变更已被压缩，从压缩的修订号恢复监听并重新读取
+				send(db.WatchEvent{Resync: true, WatchRevision: res.CompactRevision})
+				return
+			}
+			if err := res.Err(); err != nil {
+				logger.Logger.Errorw(err.Error(), logger.STDRequestID(ctx))
+				return
+			}
+			for i, ev := range res.Events {
+				key, version, ok := parse(string(ev.Kv.Key))
+				if !ok || !filter.Match(key, version) {
+					continue
+				}
+				e := db.WatchEvent{
+					Key:           key,
+					Version:       version,
+					Value:         string(ev.Kv.Value),
+					Revision:      strconv.FormatInt(ev.Kv.ModRevision, 10),
+					WatchRevision: ev.Kv.ModRevision,
+				}
+				// 同一事务的变更有相同的修订号且在同一响应中，未通知完时从上一修订号恢复
+				if i+1 < len(res.Events) && res.Events[i+1].Kv.ModRevision == ev.Kv.ModRevision {
+					e.WatchRevision--
+				}
+				if ev.Type == clientv3.EventTypeDelete {
+					e.Value, e.Revision, e.Deleted = "", db.RevisionNotExist, true
+				} else if load != nil {
+					value, err := load(ctx, key, version, ev.Kv.ModRevision)
+					if err != nil {
+						logger.Logger.Errorw(err.Error(), logger.STDRequestID(ctx))
+						return
+					}
+					e.Value = value
+				}
+				if !send(e) {
+					return
+				}
+			}
+			if res, ok = <-wch; !ok {
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// PutWithVersion 存储带前缀的key，并在同一事务中写入版本信息
 func (d *Etcd) PutWithVersion(ctx context.Context, version string, key string, value string) error {
-	_, err := d.client.Put(ctx, d.addPrefix2New(version, key), value)
+	_, err := d.client.Txn(ctx).Then(
+		clientv3.OpPut(d.addPrefix2New(version, key), value),
+		clientv3.OpPut(d.addVersionPrefix(key, version), ""),
+	).Commit()
 	return err
 }
 
@@ -140,26 +638,450 @@ func (d *Etcd) GetWithVersion(ctx context.Context, version string, key string) (
 // UserPutWithVersion 存储用户版本
 func (d *Etcd) UserPutWithVersion(ctx context.Context, version string, key string, value string) error {
 	userID := logger.STDHeader(ctx)["User-Id"]
-	k := d.addPrefix3(userID, version, key)
+	k := d.addPrefix3New(userID, version, key)
 	_, err := d.client.Put(ctx, k, value)
 	return err
 }
 
-// UserGetWithVersion 获取用户版本
+// UserGetWithVersion 获取用户版本，新格式不存在时读取旧格式
 func (d *Etcd) UserGetWithVersion(ctx context.Context, version string, key string) (map[string]string, error) {
-	userID := logger.STDHeader(ctx)["User-Id"]
-	k := d.addPrefix3(userID, version, key)
-	res, err := d.client.Get(ctx, k)
+	res, err := d.UserMultiGetWithVersion(ctx, []db.VersionKV{{Version: version, Key: key}})
 	if err != nil {
 		return nil, err
 	}
 	result := make(map[string]string, 0)
-	for _, ev := range res.Kvs {
-		result[d.removePrefix3(userID, version, string(ev.Key))] = string(ev.Value)
+	if res[0].Found {
+		result[key] = res[0].Value
 	}
 	return result, nil
 }
 
+// MultiPutWithVersion 使用事务批量存储带版本的数据
+func (d *Etcd) MultiPutWithVersion(ctx context.Context, kvs []db.VersionKV) ([]db.PutResult, error) {
+	keys := make([]string, 0, len(kvs))
+	indexes := make([]string, 0, len(kvs))
+	for _, kv := range kvs {
+		keys = append(keys, d.addPrefix2New(kv.Version, kv.Key))
+		indexes = append(indexes, d.addVersionPrefix(kv.Key, kv.Version))
+	}
+	return d.multiPut(ctx, keys, indexes, kvs)
+}
+
+// MultiGetWithVersion 使用事务批量获取带版本的value
+func (d *Etcd) MultiGetWithVersion(ctx context.Context, keys []db.VersionKV) ([]db.GetResult, error) {
+	ops := make([][]string, 0, len(keys))
+	for _, k := range keys {
+		// Compatible with old formats
+		ops = append(ops, []string{d.addPrefix2New(k.Version, k.Key), d.addPrefix2(k.Version, k.Key)})
+	}
+	return d.multiGet(ctx, ops)
+}
+
+// UserMultiPutWithVersion 使用事务批量存储用户版本
+func (d *Etcd) UserMultiPutWithVersion(ctx context.Context, kvs []db.VersionKV) ([]db.PutResult, error) {
+	userID := logger.STDHeader(ctx)["User-Id"]
+	keys := make([]string, 0, len(kvs))
+	for _, kv := range kvs {
+		keys = append(keys, d.addPrefix3New(userID, kv.Version, kv.Key))
+	}
+	return d.multiPut(ctx, keys, nil, kvs)
+}
+
+// UserMultiGetWithVersion 使用事务批量获取用户版本
+func (d *Etcd) UserMultiGetWithVersion(ctx context.Context, keys []db.VersionKV) ([]db.GetResult, error) {
+	userID := logger.STDHeader(ctx)["User-Id"]
+	ops := make([][]string, 0, len(keys))
+	for _, k := range keys {
+		// Compatible with old formats
+		ops = append(ops, []string{d.addPrefix3New(userID, k.Version, k.Key), d.addPrefix3(userID, k.Version, k.Key)})
+	}
+	return d.multiGet(ctx, ops)
+}
+
+// MultiDeleteWithVersion 使用事务批量删除带版本的数据，旧格式的key及版本信息一并删除
+func (d *Etcd) MultiDeleteWithVersion(ctx context.Context, keys []db.VersionKV) ([]db.DeleteResult, error) {
+	candidates := make([][]string, 0, len(keys))
+	indexes := make([]string, 0, len(keys))
+	for _, k := range keys {
+		// Compatible with old formats
+		candidates = append(candidates, []string{d.addPrefix2New(k.Version, k.Key), d.addPrefix2(k.Version, k.Key)})
+		indexes = append(indexes, d.addVersionPrefix(k.Key, k.Version))
+	}
+	return d.multiDelete(ctx, candidates, indexes)
+}
+
+// UserMultiDeleteWithVersion 使用事务批量删除用户版本，旧格式的key一并删除
+func (d *Etcd) UserMultiDeleteWithVersion(ctx context.Context, keys []db.VersionKV) ([]db.DeleteResult, error) {
+	userID := logger.STDHeader(ctx)["User-Id"]
+	candidates := make([][]string, 0, len(keys))
+	for _, k := range keys {
+		// Compatible with old formats
+		candidates = append(candidates, []string{d.addPrefix3New(userID, k.Version, k.Key), d.addPrefix3(userID, k.Version, k.Key)})
+	}
+	return d.multiDelete(ctx, candidates, nil)
+}
+
+// DeleteWithPrefix 删除 GetWithPrefix 返回的所有数据及以key开头的版本信息，返回删除的数据条数
+func (d *Etcd) DeleteWithPrefix(ctx context.Context, key string) (int64, error) {
+	res, err := d.client.Txn(ctx).Then(
+		clientv3.OpDelete(d.addPrefix(key), clientv3.WithPrefix()),
+		clientv3.OpDelete(d.versionKeyPrefix(key), clientv3.WithPrefix()),
+	).Commit()
+	if err != nil {
+		return 0, err
+	}
+	return res.Responses[0].GetResponseDeleteRange().Deleted, nil
+}
+
+// ListUserData 列出用户的所有用户级数据，包括旧格式的数据
+func (d *Etcd) ListUserData(ctx context.Context, userID string) ([]db.VersionKV, error) {
+	result := make([]db.VersionKV, 0)
+	err := d.walkUserData(ctx, userID, func(_ string, kv db.VersionKV) error {
+		result = append(result, kv)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	db.SortVersionKVs(result)
+	return result, nil
+}
+
+// DeleteUserData 删除用户前缀下的所有数据及 ListUserData 列出的旧格式的数据，返回删除的条数
+func (d *Etcd) DeleteUserData(ctx context.Context, userID string) (int64, error) {
+	legacy := make([]string, 0)
+	err := d.walkLegacyUserData(ctx, userID, func(k string, _ db.VersionKV) error {
+		legacy = append(legacy, k)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	var deleted int64
+	for start := 0; start < len(legacy); start += maxTxnOps {
+		end := start + maxTxnOps
+		if end > len(legacy) {
+			end = len(legacy)
+		}
+		ops := make([]clientv3.Op, 0, end-start)
+		for _, k := range legacy[start:end] {
+			ops = append(ops, clientv3.OpDelete(k))
+		}
+		res, err := d.client.Txn(ctx).Then(ops...).Commit()
+		if err != nil {
+			return deleted, err
+		}
+		for _, r := range res.Responses {
+			deleted += r.GetResponseDeleteRange().Deleted
+		}
+	}
+	res, err := d.client.Delete(ctx, d.userPrefix(userID), clientv3.WithPrefix())
+	if err != nil {
+		return deleted, err
+	}
+	return deleted + res.Deleted, nil
+}
+
+// walkUserData 遍历用户的所有用户级数据，k 为存储中的key，新格式与旧格式都存在时只遍历新格式
+func (d *Etcd) walkUserData(ctx context.Context, userID string, fn func(k string, kv db.VersionKV) error) error {
+	pre := d.userPrefix(userID)
+	seen := make(map[db.VersionKV]bool)
+	err := d.walkRange(ctx, pre, func(kv *mvccpb.KeyValue) error {
+		parts := strings.SplitN(strings.TrimPrefix(string(kv.Key), pre), "/", 2)
+		if len(parts) != 2 {
+			return nil
+		}
+		version, err := url.QueryUnescape(parts[0])
+		if err != nil || version == "" || parts[1] == "" {
+			return nil
+		}
+		seen[db.VersionKV{Version: version, Key: parts[1]}] = true
+		return fn(string(kv.Key), db.VersionKV{
+			Version: version,
+			Key:     parts[1],
+			Value:   string(kv.Value),
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return d.walkLegacyUserData(ctx, userID, func(k string, kv db.VersionKV) error {
+		if seen[db.VersionKV{Version: kv.Version, Key: kv.Key}] {
+			return nil
+		}
+		return fn(k, kv)
+	})
+}
+
+// walkLegacyUserData 遍历旧格式 {prefix}_{userID}_{version}_{key} 的用户级数据，版本号为第一个 _ 之前的部分。
+// 以 {userID}_ 开头的应用级key {prefix}_{key}_{version} 按版本信息排除；
+// 没有版本信息的应用级数据、ID以 {userID}_ 开头的用户的旧格式数据无法区分，用户ID不包含 _ 时准确
+func (d *Etcd) walkLegacyUserData(ctx context.Context, userID string, fn func(k string, kv db.VersionKV) error) error {
+	pre := d.addPrefix(userID + "_")
+	keys := make([]string, 0)
+	kvs := make([]db.VersionKV, 0)
+	err := d.walkRange(ctx, pre, func(kv *mvccpb.KeyValue) error {
+		parts := strings.SplitN(strings.TrimPrefix(string(kv.Key), pre), "_", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil
+		}
+		keys = append(keys, string(kv.Key))
+		kvs = append(kvs, db.VersionKV{
+			Version: parts[0],
+			Key:     parts[1],
+			Value:   string(kv.Value),
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	appData, err := d.indexedKeys(ctx, keys)
+	if err != nil {
+		return err
+	}
+	for i, k := range keys {
+		if appData[k] {
+			continue
+		}
+		if err := fn(k, kvs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexedKeys 存储的key中有版本信息的应用级数据，按每个 _ 拆分为key及版本号查找版本信息
+func (d *Etcd) indexedKeys(ctx context.Context, keys []string) (map[string]bool, error) {
+	result := make(map[string]bool)
+	ops := make([]clientv3.Op, 0, maxTxnOps)
+	owners := make([]string, 0, maxTxnOps)
+	flush := func() error {
+		if len(ops) == 0 {
+			return nil
+		}
+		res, err := d.client.Txn(ctx).Then(ops...).Commit()
+		if err != nil {
+			return err
+		}
+		for i, r := range res.Responses {
+			if r.GetResponseRange().Count > 0 {
+				result[owners[i]] = true
+			}
+		}
+		ops, owners = ops[:0], owners[:0]
+		return nil
+	}
+	for _, k := range keys {
+		rest := d.removePrefix(k)
+		for i := strings.Index(rest, "_"); i >= 0; {
+			if len(ops) == maxTxnOps {
+				if err := flush(); err != nil {
+					return nil, err
+				}
+			}
+			ops = append(ops, clientv3.OpGet(d.addVersionPrefix(rest[:i], rest[i+1:]), clientv3.WithCountOnly()))
+			owners = append(owners, k)
+			next := strings.Index(rest[i+1:], "_")
+			if next < 0 {
+				break
+			}
+			i += next + 1
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// multiPut 不带修订号的项按maxTxnOps分批提交事务，同一批次内全部成功或全部失败；
+// 带修订号的项各自使用一个事务比较 mod_revision，互不影响。
+// indexes 不为nil时为每项在同一事务中写入版本信息，见 addVersionPrefix
+func (d *Etcd) multiPut(ctx context.Context, keys []string, indexes []string, kvs []db.VersionKV) ([]db.PutResult, error) {
+	leases, err := d.grantLeases(ctx, kvs)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]db.PutResult, len(kvs))
+	size := maxTxnOps
+	if indexes != nil {
+		size = maxTxnOps / 2
+	}
+	batch := make([]int, 0, size)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ops := make([]clientv3.Op, 0, 2*len(batch))
+		for _, i := range batch {
+			ops = append(ops, clientv3.OpPut(keys[i], kvs[i].Value, leases.options(kvs[i].TTL)...))
+			if indexes != nil {
+				ops = append(ops, clientv3.OpPut(indexes[i], "", leases.options(kvs[i].TTL)...))
+			}
+		}
+		res, err := d.client.Txn(ctx).Then(ops...).Commit()
+		for _, i := range batch {
+			if err != nil {
+				results[i].Err = err
+				continue
+			}
+			results[i].Revision = strconv.FormatInt(res.Header.Revision, 10)
+		}
+		batch = batch[:0]
+	}
+	for i, kv := range kvs {
+		if kv.Revision == "" {
+			batch = append(batch, i)
+			if len(batch) == size {
+				flush()
+			}
+			continue
+		}
+		index := ""
+		if indexes != nil {
+			index = indexes[i]
+		}
+		results[i] = d.compareAndPut(ctx, keys[i], index, kv, leases)
+	}
+	flush()
+	return results, nil
+}
+
+// compareAndPut 仅当key的 mod_revision 与kv.Revision一致时写入，index 不为空时一并写入版本信息
+func (d *Etcd) compareAndPut(ctx context.Context, key string, index string, kv db.VersionKV, leases ttlLeases) db.PutResult {
+	rev, err := strconv.ParseInt(kv.Revision, 10, 64)
+	if err != nil || rev < 0 {
+		return db.PutResult{Err: db.ErrInvalidRevision}
+	}
+	ops := []clientv3.Op{clientv3.OpPut(key, kv.Value, leases.options(kv.TTL)...)}
+	if index != "" {
+		ops = append(ops, clientv3.OpPut(index, "", leases.options(kv.TTL)...))
+	}
+	res, err := d.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", rev)).
+		Then(ops...).
+		Commit()
+	if err != nil {
+		return db.PutResult{Err: err}
+	}
+	if !res.Succeeded {
+		return db.PutResult{Err: db.ErrRevisionConflict}
+	}
+	return db.PutResult{Revision: strconv.FormatInt(res.Header.Revision, 10)}
+}
+
+// multiGet 批量读取，每项按顺序尝试多个候选key，返回第一个存在的值。
+// 修订号取第一个候选key的 mod_revision，与写入时比较的key一致
+func (d *Etcd) multiGet(ctx context.Context, candidates [][]string) ([]db.GetResult, error) {
+	results := make([]db.GetResult, len(candidates))
+	for i := range results {
+		results[i].Revision = db.RevisionNotExist
+	}
+	ops := make([]clientv3.Op, 0, maxTxnOps)
+	owners := make([]int, 0, maxTxnOps)
+	primary := make([]bool, 0, maxTxnOps)
+	flush := func() error {
+		if len(ops) == 0 {
+			return nil
+		}
+		res, err := d.client.Txn(ctx).Then(ops...).Commit()
+		if err != nil {
+			return err
+		}
+		for i, r := range res.Responses {
+			result := &results[owners[i]]
+			kvs := r.GetResponseRange().Kvs
+			if len(kvs) == 0 {
+				continue
+			}
+			if primary[i] {
+				result.Revision = strconv.FormatInt(kvs[0].ModRevision, 10)
+			}
+			if result.Found {
+				continue
+			}
+			result.Value = string(kvs[0].Value)
+			result.Found = true
+		}
+		ops, owners, primary = ops[:0], owners[:0], primary[:0]
+		return nil
+	}
+	for i, keys := range candidates {
+		if len(ops)+len(keys) > maxTxnOps {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+		for j, k := range keys {
+			ops = append(ops, clientv3.OpGet(k))
+			owners = append(owners, i)
+			primary = append(primary, j == 0)
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// multiDelete 批量删除，每项删除所有候选key，任一候选key存在即视为存在。
+// indexes 不为nil时一并删除每项的版本信息，版本信息不影响是否存在。
+// 按maxTxnOps分批提交事务，同一批次内全部成功或全部失败
+func (d *Etcd) multiDelete(ctx context.Context, candidates [][]string, indexes []string) ([]db.DeleteResult, error) {
+	results := make([]db.DeleteResult, len(candidates))
+	ops := make([]clientv3.Op, 0, maxTxnOps)
+	owners := make([]int, 0, maxTxnOps)
+	counted := make([]bool, 0, maxTxnOps)
+	flush := func() {
+		if len(ops) == 0 {
+			return
+		}
+		res, err := d.client.Txn(ctx).Then(ops...).Commit()
+		for i, owner := range owners {
+			if err != nil {
+				results[owner].Err = err
+				continue
+			}
+			if counted[i] && res.Responses[i].GetResponseDeleteRange().Deleted > 0 {
+				results[owner].Found = true
+			}
+		}
+		ops, owners, counted = ops[:0], owners[:0], counted[:0]
+	}
+	for i, keys := range candidates {
+		n := len(keys)
+		if indexes != nil {
+			n++
+		}
+		if len(ops)+n > maxTxnOps {
+			flush()
+		}
+		for _, k := range keys {
+			ops = append(ops, clientv3.OpDelete(k))
+			owners = append(owners, i)
+			counted = append(counted, true)
+		}
+		if indexes != nil {
+			ops = append(ops, clientv3.OpDelete(indexes[i]))
+			owners = append(owners, i)
+			counted = append(counted, false)
+		}
+	}
+	flush()
+	return results, nil
+}
+
+// abort 未失败的项标记为 ErrAborted
+func abort(results []db.PutResult) []db.PutResult {
+	for i := range results {
+		if results[i].Err == nil {
+			results[i] = db.PutResult{Err: db.ErrAborted}
+		}
+	}
+	return results
+}
+
 // addPrefix 添加前缀
 func (d *Etcd) addPrefix(key string) string {
 	return d.prefix + "_" + key
@@ -174,6 +1096,12 @@ func (d *Etcd) removePrefix(key string) string {
 	return key
 }
 
+// addDataPrefix 数据集使用独立的前缀，避免与kv数据混在一起
+// format is: {prefix}/dataset/{key}
+func (d *Etcd) addDataPrefix(key string) string {
+	return d.prefix + "/dataset/" + key
+}
+
 func (d *Etcd) addPrefix2New(version string, key string) string {
 	return d.prefix + "_" + key + "_" + version
 }
@@ -194,14 +1122,295 @@ func (d *Etcd) removePrefix2(version string, key string) string {
 	return key
 }
 
+// versionKeyPrefix 应用级key的版本信息的前缀，key转义后不包含 /
+// format is: {prefix}/version/{escaped key}
+func (d *Etcd) versionKeyPrefix(key string) string {
+	return d.prefix + "/version/" + url.QueryEscape(key)
+}
+
+// addVersionPrefix 应用级key的版本信息，与数据在同一事务中写入及删除并使用相同的租约。
+// 数据的key {key}_{version} 无法区分key与版本号，按版本信息可准确列出key的版本
+// format is: {prefix}/version/{escaped key}/{escaped version}
+func (d *Etcd) addVersionPrefix(key string, version string) string {
+	return d.versionKeyPrefix(key) + "/" + url.QueryEscape(version)
+}
+
+// txnVersionPrefix TxnPut 中存储的key为 {key}_{version} 时的版本信息，否则为空
+func (d *Etcd) txnVersionPrefix(kv db.VersionKV) string {
+	if kv.Version == "" || !strings.HasSuffix(kv.Key, "_"+kv.Version) {
+		return ""
+	}
+	return d.addVersionPrefix(strings.TrimSuffix(kv.Key, "_"+kv.Version), kv.Version)
+}
+
+// parseVersionPrefix 从版本信息的key中解析出key及版本号
+func (d *Etcd) parseVersionPrefix(k string) (string, string, bool) {
+	parts := strings.Split(strings.TrimPrefix(k, d.prefix+"/version/"), "/")
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	key, err := url.QueryUnescape(parts[0])
+	if err != nil {
+		return "", "", false
+	}
+	version, err := url.QueryUnescape(parts[1])
+	if err != nil {
+		return "", "", false
+	}
+	return key, version, true
+}
+
+// userPrefix 用户级数据使用独立的前缀，用户ID及版本号转义后不包含 /，各用户的前缀互不包含
+// format is: {prefix}/user/{userID}/{version}/{key}
+func (d *Etcd) userPrefix(userID string) string {
+	return d.prefix + "/user/" + url.QueryEscape(userID) + "/"
+}
+
+func (d *Etcd) addPrefix3New(userID string, version string, key string) string {
+	return d.userPrefix(userID) + url.QueryEscape(version) + "/" + key
+}
+
+// addPrefix3 旧格式的用户级数据，只读取及删除，不再写入
+// format is: {prefix}_{userID}_{version}_{key}
 func (d *Etcd) addPrefix3(userID string, version string, key string) string {
 	return d.prefix + "_" + userID + "_" + version + "_" + key
 }
 
-func (d *Etcd) removePrefix3(userID string, version string, key string) string {
-	pre := d.prefix + "_" + userID + "_" + version + "_"
-	if strings.HasPrefix(key, pre) {
-		return key[len(pre):]
+// recordDoc 记录在etcd中保存的内容，Group、Seq 及 ID 保存在key中
+type recordDoc struct {
+	Users []string        `json:"users,omitempty"`
+	Value json.RawMessage `json:"value"`
+}
+
+// PutRecords 按maxTxnOps分批提交事务写入新的记录
+func (d *Etcd) PutRecords(ctx context.Context, collection string, records []db.Record) error {
+	for start := 0; start < len(records); start += maxTxnOps {
+		end := start + maxTxnOps
+		if end > len(records) {
+			end = len(records)
+		}
+		ops := make([]clientv3.Op, 0, end-start)
+		for _, r := range records[start:end] {
+			doc, err := json.Marshal(recordDoc{Users: r.Users, Value: r.Value})
+			if err != nil {
+				return err
+			}
+			ops = append(ops, clientv3.OpPut(d.recordKey(collection, r), string(doc)))
+		}
+		if _, err := d.client.Txn(ctx).Then(ops...).Commit(); err != nil {
+			return err
+		}
 	}
-	return key
+	return nil
+}
+
+// GetRecord 在分组内查找记录，不存在时返回nil
+func (d *Etcd) GetRecord(ctx context.Context, collection string, group string, id string) (*db.Record, error) {
+	var found *db.Record
+	err := d.walkRecords(ctx, collection, d.addGroupPrefix(collection, group), func(r db.Record) error {
+		if r.ID == id {
+			found = &r
+			return errStopWalk
+		}
+		return nil
+	})
+	if err != nil && err != errStopWalk {
+		return nil, err
+	}
+	return found, nil
+}
+
+// ListRecords 分组内的记录按 {seq}/{id} 排序保存，按key的范围查询
+func (d *Etcd) ListRecords(ctx context.Context, collection string, q db.RecordQuery) ([]db.Record, error) {
+	prefix := d.addGroupPrefix(collection, q.Group)
+	from, end := prefix, clientv3.GetPrefixRangeEnd(prefix)
+	if q.MaxSeq > 0 {
+		end = prefix + formatSeq(q.MaxSeq+1)
+	}
+	order := clientv3.SortAscend
+	if q.After != nil {
+		after := prefix + formatSeq(q.After.Seq) + "/" + q.After.ID
+		if q.Desc {
+			if after < end {
+				end = after
+			}
+		} else {
+			from = after + "\x00"
+		}
+	}
+	if q.Desc {
+		order = clientv3.SortDescend
+	}
+	list := make([]db.Record, 0)
+	if from >= end {
+		return list, nil
+	}
+	res, err := d.client.Get(ctx, from,
+		clientv3.WithRange(end),
+		clientv3.WithLimit(int64(q.Size())),
+		clientv3.WithSort(clientv3.SortByKey, order))
+	if err != nil {
+		return nil, err
+	}
+	for _, ev := range res.Kvs {
+		r, err := d.parseRecord(collection, ev)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, r)
+	}
+	return list, nil
+}
+
+// WalkRecords 分页遍历集合，返回与用户相关的记录
+func (d *Etcd) WalkRecords(ctx context.Context, collection string, userID string, fn func(record db.Record) error) error {
+	return d.walkRecords(ctx, collection, d.addRecordPrefix(collection), func(r db.Record) error {
+		if !r.HasUser(userID) {
+			return nil
+		}
+		return fn(r)
+	})
+}
+
+// UpdateRecord Seq 变化时在同一个事务中删除原来的key
+func (d *Etcd) UpdateRecord(ctx context.Context, collection string, old db.Record, record db.Record) (string, error) {
+	rev, err := strconv.ParseInt(old.Revision, 10, 64)
+	if err != nil {
+		return "", db.ErrInvalidRevision
+	}
+	record.Group, record.ID = old.Group, old.ID
+	doc, err := json.Marshal(recordDoc{Users: record.Users, Value: record.Value})
+	if err != nil {
+		return "", err
+	}
+	oldKey, key := d.recordKey(collection, old), d.recordKey(collection, record)
+	ops := []clientv3.Op{clientv3.OpPut(key, string(doc))}
+	if oldKey != key {
+		ops = append(ops, clientv3.OpDelete(oldKey))
+	}
+	res, err := d.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(oldKey), "=", rev)).
+		Then(ops...).
+		Commit()
+	if err != nil {
+		return "", err
+	}
+	if !res.Succeeded {
+		return "", db.ErrRevisionConflict
+	}
+	return strconv.FormatInt(res.Header.Revision, 10), nil
+}
+
+// DeleteRecord 删除记录，Revision 不为空时比较 mod_revision
+func (d *Etcd) DeleteRecord(ctx context.Context, collection string, record db.Record) error {
+	key := d.recordKey(collection, record)
+	if record.Revision == "" {
+		_, err := d.client.Delete(ctx, key)
+		return err
+	}
+	rev, err := strconv.ParseInt(record.Revision, 10, 64)
+	if err != nil {
+		return db.ErrInvalidRevision
+	}
+	res, err := d.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", rev)).
+		Then(clientv3.OpDelete(key)).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !res.Succeeded {
+		return db.ErrRevisionConflict
+	}
+	return nil
+}
+
+// TrimRecords 找到倒数第keep+1条记录，删除分组内该key及之前的所有key
+func (d *Etcd) TrimRecords(ctx context.Context, collection string, group string, keep int) (int64, error) {
+	if keep <= 0 {
+		return 0, nil
+	}
+	prefix := d.addGroupPrefix(collection, group)
+	res, err := d.client.Get(ctx, prefix,
+		clientv3.WithPrefix(),
+		clientv3.WithKeysOnly(),
+		clientv3.WithLimit(int64(keep+1)),
+		clientv3.WithSort(clientv3.SortByKey, clientv3.SortDescend))
+	if err != nil {
+		return 0, err
+	}
+	if len(res.Kvs) <= keep {
+		return 0, nil
+	}
+	last := string(res.Kvs[keep].Key)
+	deleted, err := d.client.Delete(ctx, prefix, clientv3.WithRange(last+"\x00"))
+	if err != nil {
+		return 0, err
+	}
+	return deleted.Deleted, nil
+}
+
+// errStopWalk 提前结束遍历
+var errStopWalk = errors.New("stop walk")
+
+// walkRecords 分页遍历前缀下的记录，所有分页读取同一个revision
+func (d *Etcd) walkRecords(ctx context.Context, collection string, prefix string, fn func(record db.Record) error) error {
+	return d.walkRange(ctx, prefix, func(kv *mvccpb.KeyValue) error {
+		r, err := d.parseRecord(collection, kv)
+		if err != nil {
+			return err
+		}
+		return fn(r)
+	})
+}
+
+// parseRecord 从key中解析出 Group、Seq 及 ID
+func (d *Etcd) parseRecord(collection string, ev *mvccpb.KeyValue) (db.Record, error) {
+	var r db.Record
+	parts := strings.Split(strings.TrimPrefix(string(ev.Key), d.addRecordPrefix(collection)), "/")
+	if len(parts) != 3 {
+		return r, fmt.Errorf("invalid record key %s", ev.Key)
+	}
+	group, err := url.QueryUnescape(parts[0])
+	if err != nil {
+		return r, err
+	}
+	seq, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return r, err
+	}
+	var doc recordDoc
+	if err := json.Unmarshal(ev.Value, &doc); err != nil {
+		return r, err
+	}
+	return db.Record{
+		Group:    group,
+		ID:       parts[2],
+		Seq:      seq,
+		Users:    doc.Users,
+		Value:    doc.Value,
+		Revision: strconv.FormatInt(ev.ModRevision, 10),
+	}, nil
+}
+
+// addRecordPrefix 记录使用独立的前缀
+// format is: {prefix}/record/{collection}/
+func (d *Etcd) addRecordPrefix(collection string) string {
+	return d.prefix + "/record/" + collection + "/"
+}
+
+// addGroupPrefix format is: {prefix}/record/{collection}/{escaped group}/
+func (d *Etcd) addGroupPrefix(collection string, group string) string {
+	return d.addRecordPrefix(collection) + url.QueryEscape(group) + "/"
+}
+
+// recordKey 分组内按key排序即按 (Seq, ID) 排序
+// format is: {prefix}/record/{collection}/{escaped group}/{seq}/{id}
+func (d *Etcd) recordKey(collection string, record db.Record) string {
+	return d.addGroupPrefix(collection, record.Group) + formatSeq(record.Seq) + "/" + record.ID
+}
+
+// formatSeq 补齐到固定长度，按字符串排序与按数值排序一致
+func formatSeq(seq int64) string {
+	return fmt.Sprintf("%020d", seq)
 }
@@ -0,0 +1,357 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"git.internal.yunify.com/qxp/persona/pkg/config"
+	"git.internal.yunify.com/qxp/persona/pkg/db"
+	"git.internal.yunify.com/qxp/persona/pkg/db/dbtest"
+	"go.etcd.io/etcd/embed"
+)
+
+var (
+	TestEtcdAPI db.BackendStorage
+	TestKey     = "Test_key_persona"
+	TestValue   = "Test_value_persona"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "persona-etcd")
+	if err != nil {
+		panic(err)
+	}
+	e, clientURL, err := startEmbedEtcd(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	TestEtcdAPI, err = NewEtcd(&config.Configs{
+		HostName: "persona",
+		Etcd: config.EtcdConfig{
+			Addrs:   []string{clientURL},
+			Timeout: 5,
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	code := m.Run()
+
+	e.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// startEmbedEtcd 启动内嵌的etcd，测试不依赖外部服务
+func startEmbedEtcd(dir string) (*embed.Etcd, string, error) {
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	clientURL, err := freeURL()
+	if err != nil {
+		return nil, "", err
+	}
+	peerURL, err := freeURL()
+	if err != nil {
+		return nil, "", err
+	}
+	cfg.LCUrls, cfg.ACUrls = []url.URL{*clientURL}, []url.URL{*clientURL}
+	cfg.LPUrls, cfg.APUrls = []url.URL{*peerURL}, []url.URL{*peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		return nil, "", err
+	}
+	<-e.Server.ReadyNotify()
+	return e, clientURL.String(), nil
+}
+
+func freeURL() (*url.URL, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+	return url.Parse(fmt.Sprintf("http://%s", l.Addr().String()))
+}
+
+func TestData(t *testing.T) {
+	ctx := context.Background()
+	key := "dataset_1"
+	data := map[string]interface{}{
+		"id":        key,
+		"name":      "persona_test",
+		"tag":       "tag_1111",
+		"type":      1,
+		"data_type": "dataSet",
+	}
+	if err := TestEtcdAPI.PutData(&ctx, &key, data); err != nil {
+		t.Fatal(err)
+	}
+	// 与kv数据互不影响
+	if err := TestEtcdAPI.Put(ctx, key, TestValue); err != nil {
+		t.Fatal(err)
+	}
+
+	update := map[string]interface{}{
+		"tag": "tag_2222",
+	}
+	if err := TestEtcdAPI.UpdateData(&ctx, &key, update); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := TestEtcdAPI.GetData(&ctx, &key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw == nil {
+		t.Fatal("not found data")
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(*raw, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["tag"] != "tag_2222" || got["name"] != "persona_test" {
+		t.Fatalf("unexpected document: %v", got)
+	}
+
+	missing := "not_exists"
+	if err := TestEtcdAPI.UpdateData(&ctx, &missing, update); err == nil {
+		t.Fatal("expect error when update missing document")
+	}
+
+	kvs := map[string]interface{}{
+		"type": int64(1),
+		"tag":  "tag_2222",
+	}
+	list, err := TestEtcdAPI.GetDataByKVs(&ctx, &kvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Fatalf("expect 1 document, got %d", len(list))
+	}
+
+	if err := TestEtcdAPI.DeleteData(&ctx, &key); err != nil {
+		t.Fatal(err)
+	}
+	raw, err = TestEtcdAPI.GetData(&ctx, &key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw != nil {
+		t.Fatal("delete data fail")
+	}
+	res, err := TestEtcdAPI.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[key] != TestValue {
+		t.Fatalf("unexpected value: %v", res)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	dbtest.Run(t, TestEtcdAPI, nil)
+}
+
+func TestWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watcher := TestEtcdAPI.(db.Watcher)
+	events, err := watcher.Watch(ctx, db.WatchFilter{Version: "v1", Prefix: "watch_"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	userCtx := dbtest.UserContext("watch_user")
+	userEvents, err := watcher.UserWatch(userCtx, db.WatchFilter{Version: "v1", Keys: []string{"watch_a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := TestEtcdAPI.MultiPutWithVersion(ctx, []db.VersionKV{
+		{Version: "v2", Key: "watch_a", Value: "other version"},
+		// 存储的key为 watch_c_x_v1，不是 watch_c_x 的v1版本
+		{Version: "x_v1", Key: "watch_c", Value: "other version"},
+		{Version: "v1", Key: "other_b", Value: "other prefix"},
+		{Version: "v1", Key: "watch_a", Value: "a"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TestEtcdAPI.MultiDeleteWithVersion(ctx, []db.VersionKV{{Version: "v1", Key: "watch_a"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TestEtcdAPI.UserMultiPutWithVersion(userCtx, []db.VersionKV{
+		{Version: "v1", Key: "watch_b", Value: "b"},
+		{Version: "v1", Key: "watch_a", Value: "user a"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	next := func(ch <-chan db.WatchEvent) db.WatchEvent {
+		select {
+		case e := <-ch:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for event")
+		}
+		return db.WatchEvent{}
+	}
+	if e := next(events); e.Key != "watch_a" || e.Value != "a" || e.Deleted || e.Revision == "" {
+		t.Fatalf("unexpected put event: %+v", e)
+	}
+	if e := next(events); e.Key != "watch_a" || !e.Deleted || e.Revision != db.RevisionNotExist {
+		t.Fatalf("unexpected delete event: %+v", e)
+	}
+	if e := next(userEvents); e.Key != "watch_a" || e.Value != "user a" {
+		t.Fatalf("unexpected user event: %+v", e)
+	}
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestWatchResume(t *testing.T) {
+	ctx := context.Background()
+	watcher := TestEtcdAPI.(db.Watcher)
+	filter := db.WatchFilter{Version: "v1", Keys: []string{"resume_b", "resume_a"}}
+	watchCtx, cancel := context.WithCancel(ctx)
+	events, err := watcher.Watch(watchCtx, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kv := range []db.VersionKV{
+		{Version: "v1", Key: "resume_a", Value: "a1"},
+		{Version: "v1", Key: "resume_b", Value: "b1"},
+		{Version: "v1", Key: "resume_a", Value: "a2"},
+	} {
+		if err := TestEtcdAPI.PutWithVersion(ctx, kv.Version, kv.Key, kv.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := <-events
+	cancel()
+	if first.Value != "a1" || first.WatchRevision == 0 {
+		t.Fatalf("unexpected first event: %+v", first)
+	}
+
+	// 从第一个事件之后恢复，之后的变更按顺序通知
+	filter.Revision = first.WatchRevision
+	watchCtx, cancel = context.WithCancel(ctx)
+	defer cancel()
+	events, err = watcher.Watch(watchCtx, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values []string
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-events:
+			values = append(values, e.Value)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for event")
+		}
+	}
+	if fmt.Sprint(values) != "[b1 a2]" {
+		t.Fatalf("expect [b1 a2] after resuming, got %v", values)
+	}
+
+	// 恢复的位置已被压缩时通知 Resync 后结束
+	res, err := TestEtcdAPI.(*Etcd).client.Get(ctx, "resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TestEtcdAPI.(*Etcd).client.Compact(ctx, res.Header.Revision); err != nil {
+		t.Fatal(err)
+	}
+	events, err = watcher.Watch(ctx, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := <-events; !e.Resync || e.WatchRevision != res.Header.Revision {
+		t.Fatalf("expect resync after compaction, got %+v", e)
+	}
+	if _, ok := <-events; ok {
+		t.Fatal("expect watch closed after resync")
+	}
+}
+
+func TestLegacyUserData(t *testing.T) {
+	ctx := dbtest.UserContext("legacyuser")
+	// 旧格式的用户级数据为 {prefix}_{userID}_{version}_{key}
+	for k, v := range map[string]string{
+		"legacyuser_v1_theme":  "dark",
+		"legacyuser_v2_page:a": "a",
+	} {
+		if err := TestEtcdAPI.Put(ctx, k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := TestEtcdAPI.UserPutWithVersion(ctx, "v1", "theme", "light"); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := TestEtcdAPI.UserGetWithVersion(ctx, "v2", "page:a"); err != nil || res["page:a"] != "a" {
+		t.Fatalf("expect legacy value, got %v %v", res, err)
+	}
+	if res, err := TestEtcdAPI.UserGetWithVersion(ctx, "v1", "theme"); err != nil || res["theme"] != "light" {
+		t.Fatalf("expect new value over legacy one, got %v %v", res, err)
+	}
+
+	kvs, err := TestEtcdAPI.ListUserData(ctx, "legacyuser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(kvs) != fmt.Sprint([]db.VersionKV{
+		{Version: "v2", Key: "page:a", Value: "a"},
+		{Version: "v1", Key: "theme", Value: "light"},
+	}) {
+		t.Fatalf("unexpected user data: %+v", kvs)
+	}
+
+	deleted, err := TestEtcdAPI.DeleteUserData(ctx, "legacyuser")
+	if err != nil || deleted != 3 {
+		t.Fatalf("expect 3 stored keys deleted, got %d %v", deleted, err)
+	}
+	for _, k := range []string{"legacyuser_v1_theme", "legacyuser_v2_page:a"} {
+		if res, err := TestEtcdAPI.Get(ctx, k); err != nil || len(res) != 0 {
+			t.Fatalf("expect legacy key %s erased, got %v %v", k, res, err)
+		}
+	}
+	if kvs, err := TestEtcdAPI.ListUserData(ctx, "legacyuser"); err != nil || len(kvs) != 0 {
+		t.Fatalf("expect no user data after erase, got %+v %v", kvs, err)
+	}
+}
+
+func TestListVersionsWithoutMetadata(t *testing.T) {
+	ctx := context.Background()
+	// 写入版本信息之前存储的数据只有 {key}_{version}
+	for k, v := range map[string]string{
+		"compat_k_v1":   "v1",
+		"compat_k_a_v2": "a_v2",
+	} {
+		if err := TestEtcdAPI.Put(ctx, k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := TestEtcdAPI.PutWithVersion(ctx, "x_y", "compat_k", "x_y"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := TestEtcdAPI.ListVersions(ctx, "compat_k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(res) != fmt.Sprint([]db.VersionKV{
+		{Version: "v1", Key: "compat_k", Value: "v1"},
+		{Version: "x_y", Key: "compat_k", Value: "x_y"},
+	}) {
+		t.Fatalf("unexpected versions: %+v", res)
+	}
+}
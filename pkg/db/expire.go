@@ -0,0 +1,39 @@
+package db
+
+import (
+	"context"
+	"strings"
+)
+
+// ExpireFunc 过期通知，ctx 携带数据所属的租户，userID 为空时为应用级数据
+type ExpireFunc func(ctx context.Context, userID string, event WatchEvent)
+
+// Expirer 可选接口，自行清理过期数据的后端(es及内存)实现。
+// 清理在后台定期执行，每删除一个过期的key调用一次 OnExpire 设置的通知，
+// 与租约到期即删除的后端(etcd)在 Watch 中产生的删除事件一致，但最多延迟一个清理间隔。
+// 多个实例同时清理时，每个key只由删除成功的实例通知
+type Expirer interface {
+	OnExpire(fn ExpireFunc)
+	// Sweep 立即清理所有租户已过期的数据，返回删除的条数
+	Sweep(ctx context.Context) (int64, error)
+}
+
+// ExpiredEvent 过期的值文档对应的删除事件及所属的用户，
+// 文档的 Key 为 {key}_{version} 或 {userID}_{version}_{key}
+func ExpiredEvent(kv Kv) (string, WatchEvent) {
+	key := strings.TrimSuffix(kv.Key, "_"+kv.Version)
+	if kv.UserID != "" {
+		key = strings.TrimPrefix(kv.Key, kv.UserID+"_"+kv.Version+"_")
+	}
+	return kv.UserID, WatchEvent{
+		Key:      key,
+		Version:  kv.Version,
+		Revision: RevisionNotExist,
+		Deleted:  true,
+	}
+}
+
+// WithTenant 返回携带租户ID的context，与请求头 Tenant-Id 一致
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, TenantHeader, tenant)
+}
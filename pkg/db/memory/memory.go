@@ -0,0 +1,798 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.internal.yunify.com/qxp/persona/pkg/config"
+	"git.internal.yunify.com/qxp/persona/pkg/db"
+	"git.internal.yunify.com/qxp/persona/pkg/misc/logger"
+)
+
+var (
+	// TypeOfDefault 默认数据类型
+	TypeOfDefault = "default"
+	// SweepInterval 清理过期数据的间隔
+	SweepInterval = time.Minute
+)
+
+// Memory 内存存储，仅用于测试及本地开发
+// key 的生成规则与 elasticsearch 保持一致，过期的数据在读取时忽略，由后台定期清理并通知
+type Memory struct {
+	mu   sync.RWMutex
+	docs map[string]json.RawMessage
+	// revs 每个文档的修订号，rev 为全局递增的修订号，语义同etcd
+	revs map[string]int64
+	rev  int64
+	// records 集合 -> ID -> 记录，Revision 为写入时的 rev
+	records map[string]map[string]db.Record
+	// sweeper 默认租户及各租户共用
+	sweeper *sweeper
+}
+
+// sweeper 所有租户的存储由同一个后台任务清理
+type sweeper struct {
+	mu      sync.Mutex
+	tenants map[string]*Memory
+	expire  db.ExpireFunc
+}
+
+// NewMemory new memory，并在后台定期清理默认租户及各租户的过期数据，ctx结束时停止清理
+func NewMemory(ctx context.Context, conf *config.Configs) (db.BackendStorage, error) {
+	d := newMemory()
+	d.sweeper = &sweeper{tenants: map[string]*Memory{"": d}}
+	go d.sweepLoop(ctx, SweepInterval)
+	return d, nil
+}
+
+func newMemory() *Memory {
+	return &Memory{
+		docs:    make(map[string]json.RawMessage),
+		revs:    make(map[string]int64),
+		records: make(map[string]map[string]db.Record),
+	}
+}
+
+// ForTenant 每个租户使用独立的内存存储
+func (d *Memory) ForTenant(ctx context.Context, tenant string) (db.BackendStorage, error) {
+	m := newMemory()
+	m.sweeper = d.sweeper
+	d.sweeper.mu.Lock()
+	defer d.sweeper.mu.Unlock()
+	d.sweeper.tenants[tenant] = m
+	return m, nil
+}
+
+// sweepLoop 每隔interval清理一次过期数据，直到ctx结束
+func (d *Memory) sweepLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := d.Sweep(ctx); err != nil {
+			logger.Logger.Errorw("sweep expired values: " + err.Error())
+		}
+	}
+}
+
+// OnExpire 设置过期通知，默认租户及各租户共用
+func (d *Memory) OnExpire(fn db.ExpireFunc) {
+	d.sweeper.mu.Lock()
+	defer d.sweeper.mu.Unlock()
+	d.sweeper.expire = fn
+}
+
+// Sweep 删除所有租户已过期的数据并通知，返回删除的条数
+func (d *Memory) Sweep(ctx context.Context) (int64, error) {
+	d.sweeper.mu.Lock()
+	tenants := make(map[string]*Memory, len(d.sweeper.tenants))
+	for tenant, m := range d.sweeper.tenants {
+		tenants[tenant] = m
+	}
+	expire := d.sweeper.expire
+	d.sweeper.mu.Unlock()
+
+	var deleted int64
+	for tenant, m := range tenants {
+		expired := m.removeExpired()
+		deleted += int64(len(expired))
+		if expire == nil {
+			continue
+		}
+		tenantCtx := db.WithTenant(ctx, tenant)
+		for _, kv := range expired {
+			userID, e := db.ExpiredEvent(kv)
+			expire(tenantCtx, userID, e)
+		}
+	}
+	return deleted, nil
+}
+
+// removeExpired 删除已过期的文档并返回
+func (d *Memory) removeExpired() []db.Kv {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	expired := make([]db.Kv, 0)
+	for _, id := range d.sortedIDs() {
+		var kv db.Kv
+		if json.Unmarshal(d.docs[id], &kv) == nil && kv.Expired() {
+			d.remove(id)
+			expired = append(expired, kv)
+		}
+	}
+	return expired
+}
+
+// Put 存储v到key
+func (d *Memory) Put(ctx context.Context, key string, value string) error {
+	data := db.Kv{
+		Key:      key,
+		Value:    value,
+		DataType: TypeOfDefault,
+	}
+	return d.PutData(&ctx, &key, &data)
+}
+
+// Get 获取key的值
+func (d *Memory) Get(ctx context.Context, key string) (map[string]string, error) {
+	res, err := d.GetData(&ctx, &key)
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		return make(map[string]string), nil
+	}
+	return db.DecodeKv(*res)
+}
+
+// MultiGet 批量获取key的值
+func (d *Memory) MultiGet(ctx context.Context, keys []string) ([]db.GetResult, error) {
+	return d.multiGet(keys), nil
+}
+
+// TxnPut 持有写锁检查所有修订号后再写入，全部写入或全部不生效
+func (d *Memory) TxnPut(ctx context.Context, kvs []db.VersionKV) ([]db.PutResult, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	results := make([]db.PutResult, len(kvs))
+	docs := make([][]byte, len(kvs))
+	aborted := false
+	for i, kv := range kvs {
+		docs[i], results[i].Err = d.check(kv)
+		aborted = aborted || results[i].Err != nil
+	}
+	if aborted {
+		for i := range results {
+			if results[i].Err == nil {
+				results[i].Err = db.ErrAborted
+			}
+		}
+		return results, db.ErrAborted
+	}
+	for i, kv := range kvs {
+		results[i].Revision = strconv.FormatInt(d.write(kv.Key, docs[i]), 10)
+	}
+	return results, nil
+}
+
+// check 检查修订号并生成 TxnPut 写入的文档，调用方需持有锁
+func (d *Memory) check(kv db.VersionKV) ([]byte, error) {
+	if kv.Revision != "" {
+		rev, err := strconv.ParseInt(kv.Revision, 10, 64)
+		if err != nil {
+			return nil, db.ErrInvalidRevision
+		}
+		if rev != d.revision(kv.Key) {
+			return nil, db.ErrRevisionConflict
+		}
+	}
+	return json.Marshal(&db.Kv{
+		Key:       kv.Key,
+		Value:     kv.Value,
+		Version:   kv.Version,
+		DataType:  TypeOfDefault,
+		ExpiresAt: db.ExpiresAt(kv.TTL),
+	})
+}
+
+// GetWithPrefix 返回匹配前缀的数据
+func (d *Memory) GetWithPrefix(ctx context.Context, key string) ([]db.ImportReqData, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.withPrefix(key), nil
+}
+
+// WalkWithPrefix 遍历匹配前缀的数据，遍历开始时的快照，回调时不持有锁
+func (d *Memory) WalkWithPrefix(ctx context.Context, key string, fn db.WalkFunc) error {
+	d.mu.RLock()
+	result := d.withPrefix(key)
+	d.mu.RUnlock()
+	for _, data := range result {
+		if err := fn(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withPrefix 匹配前缀的数据，调用方需持有锁
+func (d *Memory) withPrefix(key string) []db.ImportReqData {
+	result := make([]db.ImportReqData, 0)
+	for _, id := range d.sortedIDs() {
+		var kv db.Kv
+		if err := json.Unmarshal(d.docs[id], &kv); err != nil {
+			continue
+		}
+		if !kv.Expired() && strings.HasPrefix(kv.Key, key) {
+			result = append(result, db.ImportReqData{
+				Key:     kv.Key,
+				Value:   kv.Value,
+				Version: kv.Version,
+			})
+		}
+	}
+	return result
+}
+
+// PutWithVersion 带版本的数据
+func (d *Memory) PutWithVersion(ctx context.Context, version string, key string, value string) error {
+	k := d.genIDAndVersion(key, version)
+	data := db.Kv{
+		Key:      k,
+		Value:    value,
+		Version:  version,
+		DataType: TypeOfDefault,
+	}
+	return d.PutData(&ctx, &k, &data)
+}
+
+// GetWithVersion 获取带版本数据
+func (d *Memory) GetWithVersion(ctx context.Context, version string, key string) (map[string]string, error) {
+	return d.getValue(ctx, d.genIDAndVersion(key, version), key)
+}
+
+// UserPutWithVersion 设置用户带版本的值
+func (d *Memory) UserPutWithVersion(ctx context.Context, version string, key string, value string) error {
+	userID := logger.STDHeader(ctx)["User-Id"]
+	k := d.genIDVersionAndUserID(key, version, userID)
+	data := db.Kv{
+		Key:      k,
+		Value:    value,
+		Version:  version,
+		UserID:   userID,
+		DataType: TypeOfDefault,
+	}
+	return d.PutData(&ctx, &k, &data)
+}
+
+// UserGetWithVersion 获取用户带版本的值
+func (d *Memory) UserGetWithVersion(ctx context.Context, version string, key string) (map[string]string, error) {
+	userID := logger.STDHeader(ctx)["User-Id"]
+	return d.getValue(ctx, d.genIDVersionAndUserID(key, version, userID), key)
+}
+
+// MultiPutWithVersion 批量存储带版本的数据
+func (d *Memory) MultiPutWithVersion(ctx context.Context, kvs []db.VersionKV) ([]db.PutResult, error) {
+	docs := make([]db.Kv, 0, len(kvs))
+	for _, kv := range kvs {
+		docs = append(docs, db.Kv{
+			Key:       d.genIDAndVersion(kv.Key, kv.Version),
+			Value:     kv.Value,
+			Version:   kv.Version,
+			DataType:  TypeOfDefault,
+			ExpiresAt: db.ExpiresAt(kv.TTL),
+		})
+	}
+	return d.multiPut(docs, kvs), nil
+}
+
+// MultiGetWithVersion 批量获取带版本的数据
+func (d *Memory) MultiGetWithVersion(ctx context.Context, keys []db.VersionKV) ([]db.GetResult, error) {
+	ids := make([]string, 0, len(keys))
+	for _, k := range keys {
+		ids = append(ids, d.genIDAndVersion(k.Key, k.Version))
+	}
+	return d.multiGet(ids), nil
+}
+
+// UserMultiPutWithVersion 批量存储用户带版本的数据
+func (d *Memory) UserMultiPutWithVersion(ctx context.Context, kvs []db.VersionKV) ([]db.PutResult, error) {
+	userID := logger.STDHeader(ctx)["User-Id"]
+	docs := make([]db.Kv, 0, len(kvs))
+	for _, kv := range kvs {
+		docs = append(docs, db.Kv{
+			Key:       d.genIDVersionAndUserID(kv.Key, kv.Version, userID),
+			Value:     kv.Value,
+			Version:   kv.Version,
+			UserID:    userID,
+			DataType:  TypeOfDefault,
+			ExpiresAt: db.ExpiresAt(kv.TTL),
+		})
+	}
+	return d.multiPut(docs, kvs), nil
+}
+
+// UserMultiGetWithVersion 批量获取用户带版本的数据
+func (d *Memory) UserMultiGetWithVersion(ctx context.Context, keys []db.VersionKV) ([]db.GetResult, error) {
+	userID := logger.STDHeader(ctx)["User-Id"]
+	ids := make([]string, 0, len(keys))
+	for _, k := range keys {
+		ids = append(ids, d.genIDVersionAndUserID(k.Key, k.Version, userID))
+	}
+	return d.multiGet(ids), nil
+}
+
+// MultiDeleteWithVersion 批量删除带版本的数据
+func (d *Memory) MultiDeleteWithVersion(ctx context.Context, keys []db.VersionKV) ([]db.DeleteResult, error) {
+	ids := make([]string, 0, len(keys))
+	for _, k := range keys {
+		ids = append(ids, d.genIDAndVersion(k.Key, k.Version))
+	}
+	return d.multiDelete(ids), nil
+}
+
+// UserMultiDeleteWithVersion 批量删除用户带版本的数据
+func (d *Memory) UserMultiDeleteWithVersion(ctx context.Context, keys []db.VersionKV) ([]db.DeleteResult, error) {
+	userID := logger.STDHeader(ctx)["User-Id"]
+	ids := make([]string, 0, len(keys))
+	for _, k := range keys {
+		ids = append(ids, d.genIDVersionAndUserID(k.Key, k.Version, userID))
+	}
+	return d.multiDelete(ids), nil
+}
+
+// ListVersions 列出应用级key的所有版本
+func (d *Memory) ListVersions(ctx context.Context, key string) ([]db.VersionKV, error) {
+	return d.listVersions(key, "", func(version string) string {
+		return d.genIDAndVersion(key, version)
+	}), nil
+}
+
+// UserListVersions 列出当前用户key的所有版本
+func (d *Memory) UserListVersions(ctx context.Context, key string) ([]db.VersionKV, error) {
+	userID := logger.STDHeader(ctx)["User-Id"]
+	return d.listVersions(key, userID, func(version string) string {
+		return d.genIDVersionAndUserID(key, version, userID)
+	}), nil
+}
+
+// listVersions 以文档中的版本信息还原ID，与ID一致的即为该key的某个版本
+func (d *Memory) listVersions(key string, userID string, genID func(version string) string) []db.VersionKV {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	result := make([]db.VersionKV, 0)
+	for _, id := range d.sortedIDs() {
+		var kv db.Kv
+		if err := json.Unmarshal(d.docs[id], &kv); err != nil {
+			continue
+		}
+		if kv.Expired() || kv.UserID != userID || kv.Key != genID(kv.Version) {
+			continue
+		}
+		result = append(result, db.VersionKV{
+			Version: kv.Version,
+			Key:     key,
+			Value:   kv.Value,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Version < result[j].Version
+	})
+	return result
+}
+
+// DeleteWithPrefix 删除 GetWithPrefix 返回的所有数据，返回删除的条数
+func (d *Memory) DeleteWithPrefix(ctx context.Context, key string) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var deleted int64
+	for _, id := range d.sortedIDs() {
+		var kv db.Kv
+		if err := json.Unmarshal(d.docs[id], &kv); err != nil {
+			continue
+		}
+		if strings.HasPrefix(kv.Key, key) {
+			if !kv.Expired() {
+				deleted++
+			}
+			d.remove(id)
+		}
+	}
+	return deleted, nil
+}
+
+// ListUserData 列出用户的所有用户级数据
+func (d *Memory) ListUserData(ctx context.Context, userID string) ([]db.VersionKV, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	result := make([]db.VersionKV, 0)
+	for _, id := range d.sortedIDs() {
+		if kv, key, ok := d.userData(id, userID); ok && !kv.Expired() {
+			result = append(result, db.VersionKV{
+				Version: kv.Version,
+				Key:     key,
+				Value:   kv.Value,
+			})
+		}
+	}
+	db.SortVersionKVs(result)
+	return result, nil
+}
+
+// DeleteUserData 删除用户的所有用户级数据，返回删除的条数
+func (d *Memory) DeleteUserData(ctx context.Context, userID string) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var deleted int64
+	for _, id := range d.sortedIDs() {
+		if kv, _, ok := d.userData(id, userID); ok {
+			if !kv.Expired() {
+				deleted++
+			}
+			d.remove(id)
+		}
+	}
+	return deleted, nil
+}
+
+// userData id对应的文档是否为用户的用户级数据，是时返回文档及去掉用户和版本前缀的key
+func (d *Memory) userData(id string, userID string) (db.Kv, string, bool) {
+	var kv db.Kv
+	if err := json.Unmarshal(d.docs[id], &kv); err != nil {
+		return kv, "", false
+	}
+	if kv.UserID != userID {
+		return kv, "", false
+	}
+	pre := d.genIDVersionAndUserID("", kv.Version, userID)
+	if !strings.HasPrefix(kv.Key, pre) {
+		return kv, "", false
+	}
+	return kv, kv.Key[len(pre):], true
+}
+
+// multiPut 以文档的Key为ID批量写入，携带修订号的项做compare-and-set
+func (d *Memory) multiPut(docs []db.Kv, kvs []db.VersionKV) []db.PutResult {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	results := make([]db.PutResult, len(docs))
+	for i, doc := range docs {
+		if kvs[i].Revision != "" {
+			rev, err := strconv.ParseInt(kvs[i].Revision, 10, 64)
+			if err != nil {
+				results[i].Err = db.ErrInvalidRevision
+				continue
+			}
+			if rev != d.revision(doc.Key) {
+				results[i].Err = db.ErrRevisionConflict
+				continue
+			}
+		}
+		b, err := json.Marshal(&doc)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		results[i].Revision = strconv.FormatInt(d.write(doc.Key, b), 10)
+	}
+	return results
+}
+
+// multiGet 批量读取文档的value字段，返回的结果与ids顺序一致
+func (d *Memory) multiGet(ids []string) []db.GetResult {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	results := make([]db.GetResult, len(ids))
+	for i, id := range ids {
+		results[i].Revision = strconv.FormatInt(d.revision(id), 10)
+		doc, ok := d.docs[id]
+		if !ok || d.expired(id) {
+			continue
+		}
+		var kv db.Kv
+		if err := json.Unmarshal(doc, &kv); err != nil {
+			results[i].Err = err
+			continue
+		}
+		results[i].Value = kv.Value
+		results[i].Found = true
+	}
+	return results
+}
+
+// multiDelete 批量删除，返回的结果与ids顺序一致
+func (d *Memory) multiDelete(ids []string) []db.DeleteResult {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	results := make([]db.DeleteResult, len(ids))
+	for i, id := range ids {
+		_, results[i].Found = d.docs[id]
+		results[i].Found = results[i].Found && !d.expired(id)
+		d.remove(id)
+	}
+	return results
+}
+
+// write 写入文档并返回新的修订号，调用方需持有写锁
+func (d *Memory) write(id string, doc []byte) int64 {
+	d.rev++
+	d.docs[id] = doc
+	d.revs[id] = d.rev
+	return d.rev
+}
+
+// remove 删除文档，调用方需持有写锁
+func (d *Memory) remove(id string) {
+	delete(d.docs, id)
+	delete(d.revs, id)
+}
+
+// expired 文档是否已过期，调用方需持有锁
+func (d *Memory) expired(id string) bool {
+	var kv db.Kv
+	return json.Unmarshal(d.docs[id], &kv) == nil && kv.Expired()
+}
+
+// revision 文档的修订号，不存在或已过期时为0，调用方需持有锁
+func (d *Memory) revision(id string) int64 {
+	if d.expired(id) {
+		return 0
+	}
+	return d.revs[id]
+}
+
+// PutData 存储v到key
+func (d *Memory) PutData(ctx *context.Context, key *string, value interface{}) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.write(*key, b)
+	return nil
+}
+
+// GetData 获取key的值，不存在时返回nil
+func (d *Memory) GetData(ctx *context.Context, key *string) (*json.RawMessage, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	doc, ok := d.docs[*key]
+	if !ok || d.expired(*key) {
+		return nil, nil
+	}
+	res := make(json.RawMessage, len(doc))
+	copy(res, doc)
+	return &res, nil
+}
+
+// UpdateData 更新数据，只覆盖value中出现的字段
+// value 可传map或struct
+func (d *Memory) UpdateData(ctx *context.Context, key *string, value interface{}) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	doc, ok := d.docs[*key]
+	if !ok {
+		return fmt.Errorf("document %s missing", *key)
+	}
+	b, err := db.MergeDocument(doc, value)
+	if err != nil {
+		return err
+	}
+	d.write(*key, b)
+	return nil
+}
+
+// GetDataByKVs 根据k v过滤数据。一次返回所有数据
+func (d *Memory) GetDataByKVs(ctx *context.Context, kvs *map[string]interface{}) ([]*json.RawMessage, error) {
+	if kvs == nil {
+		return nil, errors.New("GetDataByKVs: need one or more condition(s)")
+	}
+	conditions, err := db.TermConditions(*kvs)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	resp := make([]*json.RawMessage, 0)
+	for _, id := range d.sortedIDs() {
+		if d.expired(id) || !db.MatchDocument(d.docs[id], conditions) {
+			continue
+		}
+		res := make(json.RawMessage, len(d.docs[id]))
+		copy(res, d.docs[id])
+		resp = append(resp, &res)
+	}
+	return resp, nil
+}
+
+// DeleteData 根据key删除数据
+func (d *Memory) DeleteData(ctx *context.Context, key *string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.remove(*key)
+	return nil
+}
+
+// PutRecords 写入新的记录
+func (d *Memory) PutRecords(ctx context.Context, collection string, records []db.Record) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, r := range records {
+		d.putRecord(collection, r)
+	}
+	return nil
+}
+
+// GetRecord 获取记录，不存在或不属于该分组时返回nil
+func (d *Memory) GetRecord(ctx context.Context, collection string, group string, id string) (*db.Record, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	r, ok := d.records[collection][id]
+	if !ok || r.Group != group {
+		return nil, nil
+	}
+	r = copyRecord(r)
+	return &r, nil
+}
+
+// ListRecords 查询一个分组内的记录
+func (d *Memory) ListRecords(ctx context.Context, collection string, q db.RecordQuery) ([]db.Record, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	list := make([]db.Record, 0)
+	for _, r := range d.records[collection] {
+		if r.Group == q.Group && q.Match(&r) {
+			list = append(list, copyRecord(r))
+		}
+	}
+	db.SortRecords(list, q.Desc)
+	if len(list) > q.Size() {
+		list = list[:q.Size()]
+	}
+	return list, nil
+}
+
+// WalkRecords 遍历与用户相关的记录，遍历的是调用时的快照
+func (d *Memory) WalkRecords(ctx context.Context, collection string, userID string, fn func(record db.Record) error) error {
+	d.mu.RLock()
+	list := make([]db.Record, 0)
+	for _, r := range d.records[collection] {
+		if r.HasUser(userID) {
+			list = append(list, copyRecord(r))
+		}
+	}
+	d.mu.RUnlock()
+	db.SortRecords(list, false)
+	for _, r := range list {
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpdateRecord 修订号一致时以record替换old
+func (d *Memory) UpdateRecord(ctx context.Context, collection string, old db.Record, record db.Record) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.checkRecord(collection, old); err != nil {
+		return "", err
+	}
+	record.Group, record.ID = old.Group, old.ID
+	return d.putRecord(collection, record), nil
+}
+
+// DeleteRecord 删除记录，Revision 不为空时先比较修订号
+func (d *Memory) DeleteRecord(ctx context.Context, collection string, record db.Record) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if record.Revision != "" {
+		if err := d.checkRecord(collection, record); err != nil {
+			return err
+		}
+	}
+	if r, ok := d.records[collection][record.ID]; ok && r.Group == record.Group {
+		delete(d.records[collection], record.ID)
+	}
+	return nil
+}
+
+// TrimRecords 分组只保留最后keep条记录
+func (d *Memory) TrimRecords(ctx context.Context, collection string, group string, keep int) (int64, error) {
+	if keep <= 0 {
+		return 0, nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	list := make([]db.Record, 0)
+	for _, r := range d.records[collection] {
+		if r.Group == group {
+			list = append(list, r)
+		}
+	}
+	if len(list) <= keep {
+		return 0, nil
+	}
+	db.SortRecords(list, true)
+	for _, r := range list[keep:] {
+		delete(d.records[collection], r.ID)
+	}
+	return int64(len(list) - keep), nil
+}
+
+// putRecord 写入记录并返回修订号，调用方需持有写锁
+func (d *Memory) putRecord(collection string, record db.Record) string {
+	if d.records[collection] == nil {
+		d.records[collection] = make(map[string]db.Record)
+	}
+	d.rev++
+	record = copyRecord(record)
+	record.Revision = strconv.FormatInt(d.rev, 10)
+	d.records[collection][record.ID] = record
+	return record.Revision
+}
+
+// checkRecord 记录存在且修订号一致，调用方需持有锁
+func (d *Memory) checkRecord(collection string, record db.Record) error {
+	r, ok := d.records[collection][record.ID]
+	if !ok || r.Group != record.Group || r.Revision != record.Revision {
+		return db.ErrRevisionConflict
+	}
+	return nil
+}
+
+// copyRecord 返回的记录与存储的不共享内存
+func copyRecord(r db.Record) db.Record {
+	r.Users = append([]string(nil), r.Users...)
+	r.Value = append(json.RawMessage(nil), r.Value...)
+	return r
+}
+
+// getValue 读取id对应文档的value，并以key返回
+func (d *Memory) getValue(ctx context.Context, id string, key string) (map[string]string, error) {
+	r, err := d.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	resp := make(map[string]string)
+	if len(r) > 0 {
+		resp[key] = r["value"]
+	}
+	return resp, nil
+}
+
+// sortedIDs 保证遍历顺序稳定，调用方需持有锁
+func (d *Memory) sortedIDs() []string {
+	ids := make([]string, 0, len(d.docs))
+	for id := range d.docs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// genIDAndVersion 生成ID
+// format is: {key}_{version}
+func (d *Memory) genIDAndVersion(key string, version string) string {
+	return fmt.Sprintf("%s_%s", key, version)
+}
+
+// genIDVersionAndUserID 生成某个用户对应的key及version
+// format is: {user}_{version}_{key}
+func (d *Memory) genIDVersionAndUserID(key string, version string, userID string) string {
+	return fmt.Sprintf("%s_%s_%s", userID, version, key)
+}
@@ -0,0 +1,116 @@
+package memory
+
+import (
+	"context"
+	"testing"
+
+	"git.internal.yunify.com/qxp/persona/pkg/config"
+	"git.internal.yunify.com/qxp/persona/pkg/db"
+	"git.internal.yunify.com/qxp/persona/pkg/db/dbtest"
+)
+
+var (
+	TestKey     = "Test_key_persona"
+	TestValue   = "Test_value_persona"
+	TestUserID  = "Test_userID_persona"
+	TestVersion = "v1.0.1_persona"
+)
+
+func newTestMemory(t *testing.T) db.BackendStorage {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	m, err := NewMemory(ctx, &config.Configs{HostName: "persona"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestPutAndGet(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMemory(t)
+	if err := m.Put(ctx, TestKey, TestValue); err != nil {
+		t.Fatal(err)
+	}
+	res, err := m.Get(ctx, TestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res["key"] != TestKey || res["value"] != TestValue {
+		t.Fatalf("unexpected value: %v", res)
+	}
+
+	res, err = m.Get(ctx, "not_exists")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 0 {
+		t.Fatalf("expect empty result, got %v", res)
+	}
+}
+
+func TestWithVersion(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMemory(t)
+	if err := m.PutWithVersion(ctx, TestVersion, TestKey, TestValue); err != nil {
+		t.Fatal(err)
+	}
+	res, err := m.GetWithVersion(ctx, TestVersion, TestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[TestKey] != TestValue {
+		t.Fatalf("unexpected value: %v", res)
+	}
+	// 与es一致，实际存储的key为 {key}_{version}
+	res, err = m.Get(ctx, TestKey+"_"+TestVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res["version"] != TestVersion {
+		t.Fatalf("unexpected document: %v", res)
+	}
+
+	res, err = m.GetWithVersion(ctx, "v0", TestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 0 {
+		t.Fatalf("expect empty result, got %v", res)
+	}
+}
+
+func TestUserWithVersion(t *testing.T) {
+	m := newTestMemory(t)
+	ctx := context.WithValue(context.Background(), "User-Id", TestUserID)
+	if err := m.UserPutWithVersion(ctx, TestVersion, TestKey, TestValue); err != nil {
+		t.Fatal(err)
+	}
+	res, err := m.UserGetWithVersion(ctx, TestVersion, TestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[TestKey] != TestValue {
+		t.Fatalf("unexpected value: %v", res)
+	}
+	res, err = m.Get(ctx, TestUserID+"_"+TestVersion+"_"+TestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res["user_id"] != TestUserID {
+		t.Fatalf("unexpected document: %v", res)
+	}
+
+	other := context.WithValue(context.Background(), "User-Id", "other")
+	res, err = m.UserGetWithVersion(other, TestVersion, TestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 0 {
+		t.Fatalf("expect empty result, got %v", res)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	dbtest.Run(t, newTestMemory(t), nil)
+}
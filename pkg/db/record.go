@@ -0,0 +1,95 @@
+package db
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// 记录所在的集合，各集合与kv数据及数据集分开存放(es独立索引，etcd独立前缀)
+const (
+	// CollectionHistory 值的修改记录
+	CollectionHistory = "history"
+	// CollectionDelivery 待投递的回调
+	CollectionDelivery = "delivery"
+)
+
+// Collections 所有的集合，es在初始化时为每个集合创建索引
+var Collections = []string{CollectionHistory, CollectionDelivery}
+
+// DefaultRecordLimit 查询记录时未指定条数的默认值，同时也是单次查询的上限
+const DefaultRecordLimit = 1000
+
+// Record 集合中的一条记录，集合内按 Group 分组，组内按 (Seq, ID) 排序。
+// ID 在集合内唯一且不能包含 /，Seq 不能为负数
+type Record struct {
+	Group string
+	ID    string
+	Seq   int64
+	// Users 与记录相关的用户，可按用户遍历，如删除用户数据时
+	Users []string
+	Value json.RawMessage
+	// Revision 读取时返回的修订号，UpdateRecord 及 DeleteRecord 时用于比较，写入时忽略
+	Revision string
+}
+
+// HasUser 记录是否与用户相关
+func (r *Record) HasUser(userID string) bool {
+	for _, u := range r.Users {
+		if u == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// RecordQuery 查询一个分组内的记录
+type RecordQuery struct {
+	Group string
+	// MaxSeq 大于0时只返回 Seq 不大于该值的记录
+	MaxSeq int64
+	// Desc 按 (Seq, ID) 倒序返回
+	Desc bool
+	// After 不为nil时只返回排在该记录(按 Seq 及 ID)之后的记录，用于分页
+	After *Record
+	// Limit 最多返回的条数，不大于0或超过 DefaultRecordLimit 时为 DefaultRecordLimit
+	Limit int
+}
+
+// Size 单次查询返回的条数
+func (q *RecordQuery) Size() int {
+	if q.Limit <= 0 || q.Limit > DefaultRecordLimit {
+		return DefaultRecordLimit
+	}
+	return q.Limit
+}
+
+// Match 记录是否满足 MaxSeq 及 After 条件，不比较分组
+func (q *RecordQuery) Match(r *Record) bool {
+	if q.MaxSeq > 0 && r.Seq > q.MaxSeq {
+		return false
+	}
+	if q.After == nil {
+		return true
+	}
+	if q.Desc {
+		return recordLess(r, q.After)
+	}
+	return recordLess(q.After, r)
+}
+
+// SortRecords 按 (Seq, ID) 排序
+func SortRecords(records []Record, desc bool) {
+	sort.Slice(records, func(i, j int) bool {
+		if desc {
+			return recordLess(&records[j], &records[i])
+		}
+		return recordLess(&records[i], &records[j])
+	})
+}
+
+func recordLess(a, b *Record) bool {
+	if a.Seq != b.Seq {
+		return a.Seq < b.Seq
+	}
+	return a.ID < b.ID
+}
@@ -0,0 +1,389 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+
+	"git.internal.yunify.com/qxp/persona/pkg/misc/logger"
+)
+
+// TenantHeader 请求中携带租户ID的header
+const TenantHeader = "Tenant-Id"
+
+// ErrInvalidTenant 租户ID不合法、未登记，或登记了租户时请求未携带租户ID
+var ErrInvalidTenant = errors.New("invalid tenant")
+
+// tenantPattern 租户ID只能包含小写字母、数字及 -，用于es索引名及etcd前缀
+var tenantPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// ValidTenant 租户ID是否合法，空表示默认租户
+func ValidTenant(tenant string) bool {
+	return tenant == "" || tenantPattern.MatchString(tenant)
+}
+
+// Tenanted 支持多租户的后端，ForTenant 返回只能访问该租户数据的存储，
+// 不同租户的数据由后端隔离(es独立索引，etcd独立前缀)，与key的内容无关
+type Tenanted interface {
+	BackendStorage
+	ForTenant(ctx context.Context, tenant string) (BackendStorage, error)
+}
+
+// TenantStorage 按请求的 Tenant-Id 将操作分发到对应租户的存储，BackendStorage 的各方法由 storage 选择存储后原样转发，
+// 租户不合法时返回 ErrInvalidTenant。
+// 未登记租户时只有默认租户，请求不能携带 Tenant-Id；
+// 登记了租户时请求必须携带已登记的 Tenant-Id，默认租户不再对外提供
+type TenantStorage struct {
+	base    Tenanted
+	ids     []string
+	tenants map[string]BackendStorage
+}
+
+// tenantWatcher 后端支持监听时，监听同样按租户隔离
+type tenantWatcher struct {
+	*TenantStorage
+}
+
+// tenantExpirer 后端自行清理过期数据时，由后端清理所有租户并在通知的ctx中携带租户
+type tenantExpirer struct {
+	*TenantStorage
+}
+
+// NewTenantStorage 启动时为登记的各租户创建存储(如es索引)，请求期间不再创建。
+// 后端实现 Watcher 或 Expirer 时返回的存储同样实现
+func NewTenantStorage(ctx context.Context, base Tenanted, tenants []string) (BackendStorage, error) {
+	s := &TenantStorage{
+		base:    base,
+		tenants: make(map[string]BackendStorage, len(tenants)),
+	}
+	for _, tenant := range tenants {
+		if tenant == "" || !ValidTenant(tenant) {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidTenant, tenant)
+		}
+		if _, ok := s.tenants[tenant]; ok {
+			continue
+		}
+		b, err := base.ForTenant(ctx, tenant)
+		if err != nil {
+			return nil, err
+		}
+		s.ids = append(s.ids, tenant)
+		s.tenants[tenant] = b
+	}
+	if _, ok := base.(Watcher); ok {
+		return &tenantWatcher{TenantStorage: s}, nil
+	}
+	if _, ok := base.(Expirer); ok {
+		return &tenantExpirer{TenantStorage: s}, nil
+	}
+	return s, nil
+}
+
+// storage 当前请求的租户的存储
+func (s *TenantStorage) storage(ctx context.Context) (BackendStorage, error) {
+	tenant := logger.STDHeader(ctx)[TenantHeader]
+	if len(s.ids) == 0 {
+		if tenant != "" {
+			return nil, ErrInvalidTenant
+		}
+		return s.base, nil
+	}
+	if b, ok := s.tenants[tenant]; ok {
+		return b, nil
+	}
+	return nil, ErrInvalidTenant
+}
+
+func (s *TenantStorage) Put(ctx context.Context, key string, value string) error {
+	b, err := s.storage(ctx)
+	if err != nil {
+		return err
+	}
+	return b.Put(ctx, key, value)
+}
+
+func (s *TenantStorage) Get(ctx context.Context, key string) (map[string]string, error) {
+	b, err := s.storage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return b.Get(ctx, key)
+}
+
+func (s *TenantStorage) MultiGet(ctx context.Context, keys []string) ([]GetResult, error) {
+	b, err := s.storage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return b.MultiGet(ctx, keys)
+}
+
+func (s *TenantStorage) TxnPut(ctx context.Context, kvs []VersionKV) ([]PutResult, error) {
+	b, err := s.storage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return b.TxnPut(ctx, kvs)
+}
+
+func (s *TenantStorage) GetWithPrefix(ctx context.Context, key string) ([]ImportReqData, error) {
+	b, err := s.storage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return b.GetWithPrefix(ctx, key)
+}
+
+func (s *TenantStorage) WalkWithPrefix(ctx context.Context, key string, fn WalkFunc) error {
+	b, err := s.storage(ctx)
+	if err != nil {
+		return err
+	}
+	return b.WalkWithPrefix(ctx, key, fn)
+}
+
+func (s *TenantStorage) PutWithVersion(ctx context.Context, version string, key string, value string) error {
+	b, err := s.storage(ctx)
+	if err != nil {
+		return err
+	}
+	return b.PutWithVersion(ctx, version, key, value)
+}
+
+func (s *TenantStorage) GetWithVersion(ctx context.Context, version string, key string) (map[string]string, error) {
+	b, err := s.storage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return b.GetWithVersion(ctx, version, key)
+}
+
+func (s *TenantStorage) UserPutWithVersion(ctx context.Context, version string, key string, value string) error {
+	b, err := s.storage(ctx)
+	if err != nil {
+		return err
+	}
+	return b.UserPutWithVersion(ctx, version, key, value)
+}
+
+func (s *TenantStorage) UserGetWithVersion(ctx context.Context, version string, key string) (map[string]string, error) {
+	b, err := s.storage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return b.UserGetWithVersion(ctx, version, key)
+}
+
+func (s *TenantStorage) MultiPutWithVersion(ctx context.Context, kvs []VersionKV) ([]PutResult, error) {
+	b, err := s.storage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return b.MultiPutWithVersion(ctx, kvs)
+}
+
+func (s *TenantStorage) MultiGetWithVersion(ctx context.Context, keys []VersionKV) ([]GetResult, error) {
+	b, err := s.storage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return b.MultiGetWithVersion(ctx, keys)
+}
+
+func (s *TenantStorage) UserMultiPutWithVersion(ctx context.Context, kvs []VersionKV) ([]PutResult, error) {
+	b, err := s.storage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return b.UserMultiPutWithVersion(ctx, kvs)
+}
+
+func (s *TenantStorage) UserMultiGetWithVersion(ctx context.Context, keys []VersionKV) ([]GetResult, error) {
+	b, err := s.storage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return b.UserMultiGetWithVersion(ctx, keys)
+}
+
+func (s *TenantStorage) MultiDeleteWithVersion(ctx context.Context, keys []VersionKV) ([]DeleteResult, error) {
+	b, err := s.storage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return b.MultiDeleteWithVersion(ctx, keys)
+}
+
+func (s *TenantStorage) UserMultiDeleteWithVersion(ctx context.Context, keys []VersionKV) ([]DeleteResult, error) {
+	b, err := s.storage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return b.UserMultiDeleteWithVersion(ctx, keys)
+}
+
+func (s *TenantStorage) ListVersions(ctx context.Context, key string) ([]VersionKV, error) {
+	b, err := s.storage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return b.ListVersions(ctx, key)
+}
+
+func (s *TenantStorage) UserListVersions(ctx context.Context, key string) ([]VersionKV, error) {
+	b, err := s.storage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return b.UserListVersions(ctx, key)
+}
+
+func (s *TenantStorage) DeleteWithPrefix(ctx context.Context, key string) (int64, error) {
+	b, err := s.storage(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return b.DeleteWithPrefix(ctx, key)
+}
+
+func (s *TenantStorage) ListUserData(ctx context.Context, userID string) ([]VersionKV, error) {
+	b, err := s.storage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return b.ListUserData(ctx, userID)
+}
+
+func (s *TenantStorage) DeleteUserData(ctx context.Context, userID string) (int64, error) {
+	b, err := s.storage(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return b.DeleteUserData(ctx, userID)
+}
+
+func (s *TenantStorage) PutData(ctx *context.Context, key *string, value interface{}) error {
+	b, err := s.storage(*ctx)
+	if err != nil {
+		return err
+	}
+	return b.PutData(ctx, key, value)
+}
+
+func (s *TenantStorage) GetData(ctx *context.Context, key *string) (*json.RawMessage, error) {
+	b, err := s.storage(*ctx)
+	if err != nil {
+		return nil, err
+	}
+	return b.GetData(ctx, key)
+}
+
+func (s *TenantStorage) UpdateData(ctx *context.Context, key *string, value interface{}) error {
+	b, err := s.storage(*ctx)
+	if err != nil {
+		return err
+	}
+	return b.UpdateData(ctx, key, value)
+}
+
+func (s *TenantStorage) GetDataByKVs(ctx *context.Context, kvs *map[string]interface{}) ([]*json.RawMessage, error) {
+	b, err := s.storage(*ctx)
+	if err != nil {
+		return nil, err
+	}
+	return b.GetDataByKVs(ctx, kvs)
+}
+
+func (s *TenantStorage) DeleteData(ctx *context.Context, key *string) error {
+	b, err := s.storage(*ctx)
+	if err != nil {
+		return err
+	}
+	return b.DeleteData(ctx, key)
+}
+
+func (s *TenantStorage) PutRecords(ctx context.Context, collection string, records []Record) error {
+	b, err := s.storage(ctx)
+	if err != nil {
+		return err
+	}
+	return b.PutRecords(ctx, collection, records)
+}
+
+func (s *TenantStorage) GetRecord(ctx context.Context, collection string, group string, id string) (*Record, error) {
+	b, err := s.storage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return b.GetRecord(ctx, collection, group, id)
+}
+
+func (s *TenantStorage) ListRecords(ctx context.Context, collection string, q RecordQuery) ([]Record, error) {
+	b, err := s.storage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return b.ListRecords(ctx, collection, q)
+}
+
+func (s *TenantStorage) WalkRecords(ctx context.Context, collection string, userID string, fn func(record Record) error) error {
+	b, err := s.storage(ctx)
+	if err != nil {
+		return err
+	}
+	return b.WalkRecords(ctx, collection, userID, fn)
+}
+
+func (s *TenantStorage) UpdateRecord(ctx context.Context, collection string, old Record, record Record) (string, error) {
+	b, err := s.storage(ctx)
+	if err != nil {
+		return "", err
+	}
+	return b.UpdateRecord(ctx, collection, old, record)
+}
+
+func (s *TenantStorage) DeleteRecord(ctx context.Context, collection string, record Record) error {
+	b, err := s.storage(ctx)
+	if err != nil {
+		return err
+	}
+	return b.DeleteRecord(ctx, collection, record)
+}
+
+func (s *TenantStorage) TrimRecords(ctx context.Context, collection string, group string, keep int) (int64, error) {
+	b, err := s.storage(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return b.TrimRecords(ctx, collection, group, keep)
+}
+
+// Watch 只监听请求所属租户的变更
+func (s *tenantWatcher) Watch(ctx context.Context, filter WatchFilter) (<-chan WatchEvent, error) {
+	b, err := s.storage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return b.(Watcher).Watch(ctx, filter)
+}
+
+// UserWatch 只监听请求所属租户中当前用户的变更
+func (s *tenantWatcher) UserWatch(ctx context.Context, filter WatchFilter) (<-chan WatchEvent, error) {
+	b, err := s.storage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return b.(Watcher).UserWatch(ctx, filter)
+}
+
+// OnExpire 所有租户共用同一个通知，通知的ctx中携带过期数据所属的租户
+func (s *tenantExpirer) OnExpire(fn ExpireFunc) {
+	s.base.(Expirer).OnExpire(fn)
+}
+
+// Sweep 不区分请求的租户，清理所有租户的过期数据
+func (s *tenantExpirer) Sweep(ctx context.Context) (int64, error) {
+	return s.base.(Expirer).Sweep(ctx)
+}
@@ -38,6 +38,11 @@ func New(conf Config) http.Client {
 
 // POST http post
 func POST(ctx context.Context, client *http.Client, uri string, params interface{}, entity interface{}) error {
+	return POSTWithHeader(ctx, client, uri, nil, params, entity)
+}
+
+// POSTWithHeader http post，附加header
+func POSTWithHeader(ctx context.Context, client *http.Client, uri string, header http.Header, params interface{}, entity interface{}) error {
 	paramByte, err := json.Marshal(params)
 	if err != nil {
 		return err
@@ -55,6 +60,11 @@ func POST(ctx context.Context, client *http.Client, uri string, params interface
 	for HKey, HValue := range headersCTX {
 		req.Header.Add(HKey, HValue)
 	}
+	for HKey, HValues := range header {
+		for _, HValue := range HValues {
+			req.Header.Add(HKey, HValue)
+		}
+	}
 	response, err := client.Do(req)
 	if err != nil {
 		logger.Logger.Errorw(err.Error(), logger.STDRequestID(ctx))
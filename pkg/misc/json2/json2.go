@@ -0,0 +1,359 @@
+package json2
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// json2 实现 JSON Pointer(RFC 6901)、JSON Patch(RFC 6902)及 JSON Merge Patch(RFC 7396)
+// 数字以 json.Number 保存，避免大整数丢失精度
+
+var (
+	// ErrInvalidJSON 文档不是合法的JSON
+	ErrInvalidJSON = errors.New("invalid json")
+	// ErrInvalidPatch 补丁格式不合法或无法应用
+	ErrInvalidPatch = errors.New("invalid json patch")
+	// ErrInvalidPointer JSON Pointer 格式不合法
+	ErrInvalidPointer = errors.New("invalid json pointer")
+	// ErrNotFound JSON Pointer 指向的值不存在
+	ErrNotFound = errors.New("json pointer not found")
+)
+
+// Valid 是否为合法的JSON
+func Valid(doc string) bool {
+	_, err := decode([]byte(doc))
+	return err == nil
+}
+
+// Pointer 返回 pointer 指向的值，pointer 为空时返回整个文档
+func Pointer(doc string, pointer string) (string, error) {
+	v, err := decode([]byte(doc))
+	if err != nil {
+		return "", err
+	}
+	tokens, err := parsePointer(pointer)
+	if err != nil {
+		return "", err
+	}
+	if v, err = get(v, tokens); err != nil {
+		return "", err
+	}
+	return encode(v)
+}
+
+// MergePatch 将 JSON Merge Patch 应用到 doc，doc 为空时视为null
+func MergePatch(doc string, patch string) (string, error) {
+	target, err := decodeDoc(doc)
+	if err != nil {
+		return "", err
+	}
+	p, err := decode([]byte(patch))
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidPatch, err)
+	}
+	return encode(mergePatch(target, p))
+}
+
+// Patch 将 JSON Patch 应用到 doc，doc 为空时视为null，任一操作失败时整体失败
+func Patch(doc string, patch string) (string, error) {
+	target, err := decodeDoc(doc)
+	if err != nil {
+		return "", err
+	}
+	var ops []operation
+	if err := json.Unmarshal([]byte(patch), &ops); err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidPatch, err)
+	}
+	for i, op := range ops {
+		if target, err = op.apply(target); err != nil {
+			return "", fmt.Errorf("%w: operation %d: %s", ErrInvalidPatch, i, err)
+		}
+	}
+	return encode(target)
+}
+
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{}, len(p))
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = mergePatch(t[k], v)
+	}
+	return t
+}
+
+// operation JSON Patch 中的一个操作
+type operation struct {
+	Op    string           `json:"op"`
+	Path  string           `json:"path"`
+	From  string           `json:"from"`
+	Value *json.RawMessage `json:"value"`
+}
+
+func (o operation) apply(doc interface{}) (interface{}, error) {
+	path, err := parsePointer(o.Path)
+	if err != nil {
+		return nil, err
+	}
+	switch o.Op {
+	case "add", "replace", "test":
+		if o.Value == nil {
+			return nil, errors.New("missing value")
+		}
+		value, err := decode(*o.Value)
+		if err != nil {
+			return nil, err
+		}
+		switch o.Op {
+		case "add":
+			return add(doc, path, value)
+		case "replace":
+			return replace(doc, path, value)
+		}
+		old, err := get(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !equal(old, value) {
+			return nil, fmt.Errorf("test %s failed", o.Path)
+		}
+		return doc, nil
+	case "remove":
+		doc, _, err := remove(doc, path)
+		return doc, err
+	case "move", "copy":
+		from, err := parsePointer(o.From)
+		if err != nil {
+			return nil, err
+		}
+		var value interface{}
+		if o.Op == "move" {
+			if o.Path == o.From {
+				return doc, nil
+			}
+			if strings.HasPrefix(o.Path, o.From+"/") {
+				return nil, fmt.Errorf("can not move %s into its child", o.From)
+			}
+			if doc, value, err = remove(doc, from); err != nil {
+				return nil, err
+			}
+		} else {
+			if value, err = get(doc, from); err != nil {
+				return nil, err
+			}
+			// 复制后与原值不共享
+			if value, err = clone(value); err != nil {
+				return nil, err
+			}
+		}
+		return add(doc, path, value)
+	default:
+		return nil, fmt.Errorf("unknown op %q", o.Op)
+	}
+}
+
+// parsePointer 解析 JSON Pointer，"" 表示整个文档
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("%w: %q must start with /", ErrInvalidPointer, pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func get(doc interface{}, tokens []string) (interface{}, error) {
+	for _, t := range tokens {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			v, ok := node[t]
+			if !ok {
+				return nil, ErrNotFound
+			}
+			doc = v
+		case []interface{}:
+			i, err := index(t, len(node)-1)
+			if err != nil {
+				return nil, ErrNotFound
+			}
+			doc = node[i]
+		default:
+			return nil, ErrNotFound
+		}
+	}
+	return doc, nil
+}
+
+// update 修改 tokens 的父节点，fn 接收父节点及最后一个token，返回修改后的父节点
+func update(doc interface{}, tokens []string, fn func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 1 {
+		return fn(doc, tokens[0])
+	}
+	child, err := get(doc, tokens[:1])
+	if err != nil {
+		return nil, err
+	}
+	if child, err = update(child, tokens[1:], fn); err != nil {
+		return nil, err
+	}
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		node[tokens[0]] = child
+	case []interface{}:
+		i, _ := index(tokens[0], len(node)-1)
+		node[i] = child
+	}
+	return doc, nil
+}
+
+func add(doc interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return update(doc, tokens, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			node[token] = value
+			return node, nil
+		case []interface{}:
+			i := len(node)
+			if token != "-" {
+				var err error
+				if i, err = index(token, len(node)); err != nil {
+					return nil, err
+				}
+			}
+			node = append(node, nil)
+			copy(node[i+1:], node[i:])
+			node[i] = value
+			return node, nil
+		default:
+			return nil, ErrNotFound
+		}
+	})
+}
+
+func replace(doc interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	if _, err := get(doc, tokens); err != nil {
+		return nil, err
+	}
+	return add(doc, tokens, value)
+}
+
+// remove 删除并返回被删除的值
+func remove(doc interface{}, tokens []string) (interface{}, interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, nil, errors.New("can not remove the whole document")
+	}
+	var removed interface{}
+	doc, err := update(doc, tokens, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			v, ok := node[token]
+			if !ok {
+				return nil, ErrNotFound
+			}
+			removed = v
+			delete(node, token)
+			return node, nil
+		case []interface{}:
+			i, err := index(token, len(node)-1)
+			if err != nil {
+				return nil, err
+			}
+			removed = node[i]
+			return append(node[:i], node[i+1:]...), nil
+		default:
+			return nil, ErrNotFound
+		}
+	})
+	return doc, removed, err
+}
+
+// index 解析数组下标，不允许前导0，范围为[0, max]
+func index(token string, max int) (int, error) {
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, ErrNotFound
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > max {
+		return 0, ErrNotFound
+	}
+	return i, nil
+}
+
+// equal 按JSON语义比较，数字按数值比较
+func equal(a, b interface{}) bool {
+	var x, y interface{}
+	for _, v := range []struct {
+		src interface{}
+		dst *interface{}
+	}{{a, &x}, {b, &y}} {
+		data, err := json.Marshal(v.src)
+		if err != nil || json.Unmarshal(data, v.dst) != nil {
+			return false
+		}
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+func clone(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return decode(data)
+}
+
+// decodeDoc 空文档视为null
+func decodeDoc(doc string) (interface{}, error) {
+	if doc == "" {
+		return nil, nil
+	}
+	return decode([]byte(doc))
+}
+
+func decode(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidJSON, err)
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("%w: unexpected data after value", ErrInvalidJSON)
+	}
+	return v, nil
+}
+
+func encode(v interface{}) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
@@ -0,0 +1,165 @@
+package json2
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestPatch(t *testing.T) {
+	tests := []struct {
+		doc, patch, want string
+		err              error
+	}{
+		{`{"a":1}`, `[{"op":"add","path":"/b","value":[1,2]}]`, `{"a":1,"b":[1,2]}`, nil},
+		{`{"a":[1,2]}`, `[{"op":"add","path":"/a/1","value":3}]`, `{"a":[1,3,2]}`, nil},
+		{`{"a":[1,2]}`, `[{"op":"add","path":"/a/-","value":3}]`, `{"a":[1,2,3]}`, nil},
+		{`{"a":{"b":1}}`, `[{"op":"remove","path":"/a/b"}]`, `{"a":{}}`, nil},
+		{`{"a":1}`, `[{"op":"replace","path":"/a","value":12345678901234567890}]`, `{"a":12345678901234567890}`, nil},
+		{`{"a":{"b":1}}`, `[{"op":"move","from":"/a/b","path":"/c"}]`, `{"a":{},"c":1}`, nil},
+		{`{"a":{"b":1}}`, `[{"op":"copy","from":"/a","path":"/c"}]`, `{"a":{"b":1},"c":{"b":1}}`, nil},
+		{`{"a/b":1.0}`, `[{"op":"test","path":"/a~1b","value":1}]`, `{"a/b":1.0}`, nil},
+		{``, `[{"op":"add","path":"","value":{"a":1}}]`, `{"a":1}`, nil},
+		{`{"a":1}`, `[{"op":"test","path":"/a","value":2}]`, ``, ErrInvalidPatch},
+		{`{"a":1}`, `[{"op":"replace","path":"/b","value":2}]`, ``, ErrInvalidPatch},
+		{`{"a":[1]}`, `[{"op":"add","path":"/a/01","value":2}]`, ``, ErrInvalidPatch},
+		{`{"a":1}`, `[{"op":"move","from":"","path":"/b"}]`, ``, ErrInvalidPatch},
+		{`{"a":1}`, `{"op":"add"}`, ``, ErrInvalidPatch},
+		{`{"a":`, `[]`, ``, ErrInvalidJSON},
+	}
+	for _, tt := range tests {
+		got, err := Patch(tt.doc, tt.patch)
+		if !errors.Is(err, tt.err) || got != tt.want {
+			t.Errorf("Patch(%s, %s): expect (%s, %v), got (%s, %v)", tt.doc, tt.patch, tt.want, tt.err, got, err)
+		}
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		doc, patch, want string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b","c":{"d":1,"e":2}}`, `{"a":null,"c":{"e":null,"f":3}}`, `{"c":{"d":1,"f":3}}`},
+		{`{"a":[1,2]}`, `{"a":[3]}`, `{"a":[3]}`},
+		{`[1]`, `{"a":1}`, `{"a":1}`},
+		{``, `{"a":{"b":null}}`, `{"a":{}}`},
+		{`{"a":1}`, `"x"`, `"x"`},
+	}
+	for _, tt := range tests {
+		got, err := MergePatch(tt.doc, tt.patch)
+		if err != nil || got != tt.want {
+			t.Errorf("MergePatch(%s, %s): expect %s, got (%s, %v)", tt.doc, tt.patch, tt.want, got, err)
+		}
+	}
+}
+
+func TestPointer(t *testing.T) {
+	doc := `{"a":{"b":[1,{"c":"<d>"}]},"m~n":true}`
+	tests := []struct {
+		pointer, want string
+		err           error
+	}{
+		{"", `{"a":{"b":[1,{"c":"<d>"}]},"m~n":true}`, nil},
+		{"/a/b/1/c", `"<d>"`, nil},
+		{"/m~0n", `true`, nil},
+		{"/a/b/2", ``, ErrNotFound},
+		{"/x", ``, ErrNotFound},
+		{"a", ``, ErrInvalidPointer},
+	}
+	for _, tt := range tests {
+		got, err := Pointer(doc, tt.pointer)
+		if !errors.Is(err, tt.err) || got != tt.want {
+			t.Errorf("Pointer(%s): expect (%s, %v), got (%s, %v)", tt.pointer, tt.want, tt.err, got, err)
+		}
+	}
+}
+
+func TestSchema(t *testing.T) {
+	schema, err := CompileSchema(`{
+		"$schema": "http://json-schema.org/draft-07/schema#",
+		"title": "settings",
+		"type": "object",
+		"required": ["theme"],
+		"properties": {
+			"theme": {"enum": ["dark", "light"]},
+			"size": {"type": "integer", "minimum": 1, "exclusiveMaximum": 10},
+			"name": {"type": "string", "pattern": "^[a-z]+$", "maxLength": 5},
+			"tags": {"type": "array", "items": {"type": "string"}, "uniqueItems": true},
+			"extra": {"anyOf": [{"type": "null"}, {"type": "object", "additionalProperties": false}]}
+		}
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		doc, path string
+	}{
+		{`{"theme":"dark","size":9,"name":"abc","tags":["a","b"],"extra":{}}`, ""},
+		{`{"size":1}`, "/theme"},
+		{`{"theme":"blue"}`, "/theme"},
+		{`{"theme":"dark","size":1.5}`, "/size"},
+		{`{"theme":"dark","size":10}`, "/size"},
+		{`{"theme":"dark","name":"ABC"}`, "/name"},
+		{`{"theme":"dark","name":"abcdef"}`, "/name"},
+		{`{"theme":"dark","tags":["a",1]}`, "/tags/1"},
+		{`{"theme":"dark","tags":["a","a"]}`, "/tags/1"},
+		{`{"theme":"dark","extra":{"a":1}}`, "/extra/a"},
+		{`[]`, ""},
+	}
+	for _, tt := range tests {
+		err := schema.Validate(tt.doc)
+		if tt.path == "" && tt.doc[0] == '{' {
+			if err != nil {
+				t.Errorf("Validate(%s): %v", tt.doc, err)
+			}
+			continue
+		}
+		e, ok := err.(*ValidationError)
+		if !ok || e.Path != tt.path {
+			t.Errorf("Validate(%s): expect error at %q, got %v", tt.doc, tt.path, err)
+		}
+	}
+
+	if err := schema.Validate(`{`); !errors.Is(err, ErrInvalidJSON) {
+		t.Errorf("expect invalid json, got %v", err)
+	}
+	unsupported := []string{
+		`{"$ref":"#/definitions/a"}`,
+		`{"properties":{"a":{"type":"string","format":"email"}}}`,
+		`{"patternProperties":{"^a":{"type":"string"}}}`,
+	}
+	for _, s := range append([]string{`1`, `{"pattern":"("}`, `{`}, unsupported...) {
+		if _, err := CompileSchema(s); err == nil {
+			t.Errorf("CompileSchema(%s): expect error", s)
+		}
+	}
+}
+
+func TestReplaceStrings(t *testing.T) {
+	ids := map[string]string{"a": "x", "ab": "y", "<a>": "<z>"}
+	fn := func(s string) (string, bool) {
+		r, ok := ids[s]
+		return r, ok
+	}
+	tests := []struct {
+		doc, want string
+	}{
+		{`{"a": "a", "list": ["ab", "abc", 1, "a"]}`, `{"a": "x", "list": ["y", "abc", 1, "x"]}`},
+		{`{"k":"a\"b","v":"a"}`, `{"k":"a\"b","v":"x"}`},
+		{`"<a>"`, `"<z>"`},
+		{`ab`, `y`},
+		{`abc`, `abc`},
+		{`12`, `12`},
+	}
+	for _, tt := range tests {
+		if got := ReplaceStrings(tt.doc, fn); got != tt.want {
+			t.Errorf("ReplaceStrings(%s): expect %s, got %s", tt.doc, tt.want, got)
+		}
+	}
+
+	got := Strings(`{"a":"b","c":["d",{"e":"f"}],"g":1}`)
+	if strings.Join(got, ",") != "b,d,f" {
+		t.Errorf("Strings: expect [b d f], got %v", got)
+	}
+}
@@ -0,0 +1,372 @@
+package json2
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Schema 已解析的 JSON Schema，支持常用关键字:
+// type、enum、const、properties、required、additionalProperties、items、
+// minItems、maxItems、uniqueItems、minLength、maxLength、pattern、
+// minimum、maximum、exclusiveMinimum、exclusiveMaximum、allOf、anyOf、oneOf、not，
+// 及不影响校验的注释关键字，包含其他关键字($ref、format等)的schema无法解析
+type Schema struct {
+	root     interface{}
+	patterns map[string]*regexp.Regexp
+}
+
+// keywords 支持的关键字，值为false的只作注释，不参与校验
+var keywords = map[string]bool{
+	"type": true, "enum": true, "const": true,
+	"properties": true, "required": true, "additionalProperties": true,
+	"items": true, "minItems": true, "maxItems": true, "uniqueItems": true,
+	"minLength": true, "maxLength": true, "pattern": true,
+	"minimum": true, "maximum": true, "exclusiveMinimum": true, "exclusiveMaximum": true,
+	"allOf": true, "anyOf": true, "oneOf": true, "not": true,
+	"$schema": false, "$id": false, "$comment": false,
+	"title": false, "description": false, "default": false, "examples": false,
+}
+
+// ValidationError 校验失败，Path 为不符合的值的 JSON Pointer
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	path := e.Path
+	if path == "" {
+		path = "/"
+	}
+	return fmt.Sprintf("%s: %s", path, e.Message)
+}
+
+// CompileSchema 解析schema，schema 必须是对象或布尔值
+func CompileSchema(schema string) (*Schema, error) {
+	root, err := decode([]byte(schema))
+	if err != nil {
+		return nil, err
+	}
+	s := &Schema{
+		root:     root,
+		patterns: make(map[string]*regexp.Regexp),
+	}
+	if err := s.compile(root); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// compile 检查schema的结构并预编译所有pattern，不支持的关键字返回错误，避免静默不校验
+func (s *Schema) compile(schema interface{}) error {
+	switch node := schema.(type) {
+	case bool:
+		return nil
+	case map[string]interface{}:
+		names := make([]string, 0, len(node))
+		for k := range node {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			if _, ok := keywords[k]; !ok {
+				return fmt.Errorf("%w: unsupported keyword %s", ErrInvalidJSON, k)
+			}
+		}
+		if p, ok := node["pattern"]; ok {
+			pattern, ok := p.(string)
+			if !ok {
+				return fmt.Errorf("%w: pattern must be a string", ErrInvalidJSON)
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("%w: %s", ErrInvalidJSON, err)
+			}
+			s.patterns[pattern] = re
+		}
+		for _, k := range []string{"additionalProperties", "items", "not"} {
+			if sub, ok := node[k]; ok {
+				if err := s.compile(sub); err != nil {
+					return err
+				}
+			}
+		}
+		if props, ok := node["properties"].(map[string]interface{}); ok {
+			for _, sub := range props {
+				if err := s.compile(sub); err != nil {
+					return err
+				}
+			}
+		}
+		for _, k := range []string{"allOf", "anyOf", "oneOf"} {
+			if subs, ok := node[k].([]interface{}); ok {
+				for _, sub := range subs {
+					if err := s.compile(sub); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: schema must be an object or boolean", ErrInvalidJSON)
+	}
+}
+
+// Validate 校验doc，doc 不是合法的JSON时返回 ErrInvalidJSON，不符合时返回 *ValidationError
+func (s *Schema) Validate(doc string) error {
+	v, err := decode([]byte(doc))
+	if err != nil {
+		return err
+	}
+	if e := s.validate(s.root, v, ""); e != nil {
+		return e
+	}
+	return nil
+}
+
+func (s *Schema) validate(schema interface{}, v interface{}, path string) *ValidationError {
+	node, ok := schema.(map[string]interface{})
+	if !ok {
+		if schema == false {
+			return &ValidationError{Path: path, Message: "value is not allowed"}
+		}
+		return nil
+	}
+
+	if t, ok := node["type"]; ok && !matchType(t, v) {
+		return &ValidationError{Path: path, Message: fmt.Sprintf("expect type %v, got %s", t, typeOf(v))}
+	}
+	if enum, ok := node["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if equal(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return &ValidationError{Path: path, Message: "value is not one of enum"}
+		}
+	}
+	if c, ok := node["const"]; ok && !equal(c, v) {
+		return &ValidationError{Path: path, Message: "value is not equal to const"}
+	}
+
+	var e *ValidationError
+	switch value := v.(type) {
+	case map[string]interface{}:
+		e = s.validateObject(node, value, path)
+	case []interface{}:
+		e = s.validateArray(node, value, path)
+	case string:
+		e = s.validateString(node, value, path)
+	case json.Number:
+		e = validateNumber(node, value, path)
+	}
+	if e != nil {
+		return e
+	}
+	return s.validateCombined(node, v, path)
+}
+
+func (s *Schema) validateObject(node map[string]interface{}, v map[string]interface{}, path string) *ValidationError {
+	if required, ok := node["required"].([]interface{}); ok {
+		for _, r := range required {
+			name, _ := r.(string)
+			if _, ok := v[name]; !ok {
+				return &ValidationError{Path: path + "/" + escape(name), Message: "required property is missing"}
+			}
+		}
+	}
+	props, _ := node["properties"].(map[string]interface{})
+	additional, hasAdditional := node["additionalProperties"]
+	// 按属性名顺序校验，多处不符合时返回的路径稳定
+	names := make([]string, 0, len(v))
+	for name := range v {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := v[name]
+		sub, ok := props[name]
+		if !ok {
+			if !hasAdditional {
+				continue
+			}
+			sub = additional
+		}
+		if e := s.validate(sub, value, path+"/"+escape(name)); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func (s *Schema) validateArray(node map[string]interface{}, v []interface{}, path string) *ValidationError {
+	if n, ok := number(node["minItems"]); ok && float64(len(v)) < n {
+		return &ValidationError{Path: path, Message: fmt.Sprintf("expect at least %v items", n)}
+	}
+	if n, ok := number(node["maxItems"]); ok && float64(len(v)) > n {
+		return &ValidationError{Path: path, Message: fmt.Sprintf("expect at most %v items", n)}
+	}
+	if unique, _ := node["uniqueItems"].(bool); unique {
+		for i := range v {
+			for j := i + 1; j < len(v); j++ {
+				if equal(v[i], v[j]) {
+					return &ValidationError{Path: fmt.Sprintf("%s/%d", path, j), Message: "duplicate item"}
+				}
+			}
+		}
+	}
+	if items, ok := node["items"]; ok {
+		for i, item := range v {
+			if e := s.validate(items, item, fmt.Sprintf("%s/%d", path, i)); e != nil {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Schema) validateString(node map[string]interface{}, v string, path string) *ValidationError {
+	length := float64(utf8.RuneCountInString(v))
+	if n, ok := number(node["minLength"]); ok && length < n {
+		return &ValidationError{Path: path, Message: fmt.Sprintf("expect at least %v characters", n)}
+	}
+	if n, ok := number(node["maxLength"]); ok && length > n {
+		return &ValidationError{Path: path, Message: fmt.Sprintf("expect at most %v characters", n)}
+	}
+	if pattern, ok := node["pattern"].(string); ok && !s.patterns[pattern].MatchString(v) {
+		return &ValidationError{Path: path, Message: fmt.Sprintf("does not match pattern %s", pattern)}
+	}
+	return nil
+}
+
+func validateNumber(node map[string]interface{}, v json.Number, path string) *ValidationError {
+	f, err := v.Float64()
+	if err != nil {
+		return &ValidationError{Path: path, Message: "invalid number"}
+	}
+	checks := []struct {
+		keyword string
+		fail    func(n float64) bool
+	}{
+		{"minimum", func(n float64) bool { return f < n }},
+		{"maximum", func(n float64) bool { return f > n }},
+		{"exclusiveMinimum", func(n float64) bool { return f <= n }},
+		{"exclusiveMaximum", func(n float64) bool { return f >= n }},
+	}
+	for _, c := range checks {
+		if n, ok := number(node[c.keyword]); ok && c.fail(n) {
+			return &ValidationError{Path: path, Message: fmt.Sprintf("%s is %v, got %s", c.keyword, n, v)}
+		}
+	}
+	return nil
+}
+
+func (s *Schema) validateCombined(node map[string]interface{}, v interface{}, path string) *ValidationError {
+	if subs, ok := node["allOf"].([]interface{}); ok {
+		for _, sub := range subs {
+			if e := s.validate(sub, v, path); e != nil {
+				return e
+			}
+		}
+	}
+	if subs, ok := node["anyOf"].([]interface{}); ok {
+		// 都不符合时返回路径最深的错误，通常最接近实际的问题
+		var deepest *ValidationError
+		matched := false
+		for _, sub := range subs {
+			e := s.validate(sub, v, path)
+			if e == nil {
+				matched = true
+				break
+			}
+			if deepest == nil || len(e.Path) > len(deepest.Path) {
+				deepest = e
+			}
+		}
+		if !matched && deepest != nil {
+			return deepest
+		}
+	}
+	if subs, ok := node["oneOf"].([]interface{}); ok {
+		matched := 0
+		for _, sub := range subs {
+			if s.validate(sub, v, path) == nil {
+				matched++
+			}
+		}
+		if matched != 1 {
+			return &ValidationError{Path: path, Message: fmt.Sprintf("expect exactly one schema of oneOf to match, got %d", matched)}
+		}
+	}
+	if sub, ok := node["not"]; ok && s.validate(sub, v, path) == nil {
+		return &ValidationError{Path: path, Message: "value must not match the schema of not"}
+	}
+	return nil
+}
+
+// matchType type 可以是字符串或字符串数组
+func matchType(t interface{}, v interface{}) bool {
+	switch types := t.(type) {
+	case string:
+		return isType(types, v)
+	case []interface{}:
+		for _, name := range types {
+			if s, ok := name.(string); ok && isType(s, v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isType(name string, v interface{}) bool {
+	actual := typeOf(v)
+	if name == "number" && actual == "integer" {
+		return true
+	}
+	return name == actual
+}
+
+func typeOf(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	case json.Number:
+		if f, err := value.Float64(); err == nil && f == math.Trunc(f) && !math.IsInf(f, 0) {
+			return "integer"
+		}
+		return "number"
+	}
+	return "unknown"
+}
+
+func number(v interface{}) (float64, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	f, err := n.Float64()
+	return f, err == nil
+}
+
+// escape 将属性名转义为 JSON Pointer 中的token
+func escape(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
@@ -0,0 +1,91 @@
+package json2
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// ReplaceStrings 对文档中每个字符串值(不含对象的key)调用 fn，fn 返回 true 时替换为其返回值，
+// 其余内容及格式保持不变。doc 不是合法的JSON时整体视为一个字符串
+func ReplaceStrings(doc string, fn func(s string) (string, bool)) string {
+	if !Valid(doc) {
+		if s, ok := fn(doc); ok {
+			return s
+		}
+		return doc
+	}
+
+	var buf strings.Builder
+	last := 0
+	for i := 0; i < len(doc); i++ {
+		if doc[i] != '"' {
+			continue
+		}
+		end := stringEnd(doc, i)
+		if isKey(doc, end) {
+			i = end - 1
+			continue
+		}
+		var s string
+		if err := json.Unmarshal([]byte(doc[i:end]), &s); err == nil {
+			if r, ok := fn(s); ok {
+				buf.WriteString(doc[last:i])
+				buf.WriteString(quote(r))
+				last = end
+			}
+		}
+		i = end - 1
+	}
+	if last == 0 {
+		return doc
+	}
+	buf.WriteString(doc[last:])
+	return buf.String()
+}
+
+// Strings 返回文档中所有的字符串值(不含对象的key)，doc 不是合法的JSON时返回 doc 本身
+func Strings(doc string) []string {
+	list := make([]string, 0)
+	ReplaceStrings(doc, func(s string) (string, bool) {
+		list = append(list, s)
+		return "", false
+	})
+	return list
+}
+
+// stringEnd 返回从 start 处的引号开始的字符串结束后的位置
+func stringEnd(doc string, start int) int {
+	for i := start + 1; i < len(doc); i++ {
+		switch doc[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return len(doc)
+}
+
+// isKey end 之后第一个非空白字符为 ":" 时，该字符串为对象的key
+func isKey(doc string, end int) bool {
+	for i := end; i < len(doc); i++ {
+		switch doc[i] {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case ':':
+			return true
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+func quote(s string) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(s)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
@@ -17,6 +17,7 @@ const (
 	_userID       = "User-Id"
 	_userName     = "User-Name"
 	_departmentID = "Department-Id"
+	_tenantID     = "Tenant-Id"
 )
 
 type CopyHeader map[string]string
@@ -42,13 +43,13 @@ func STDRequestID(ctx context.Context) zap.Field {
 	return zap.String(requestIDName, "")
 }
 
-// STDHeader get  User-ID ,Role,User-Name,Department-Id from std context
+// STDHeader get  User-ID ,Role,User-Name,Department-Id,Tenant-Id from std context
 func STDHeader(ctx context.Context) CopyHeader {
 	headersCTX := make(CopyHeader, 0)
 	if ctx == nil {
 		return headersCTX
 	}
-	var keys = []string{requestID, _userID, _userName, _departmentID, roleName} //copy header
+	var keys = []string{requestID, _userID, _userName, _departmentID, roleName, _tenantID} //copy header
 	CopyCTX(ctx, headersCTX, keys...)
 	return headersCTX
 }
@@ -74,6 +75,7 @@ func CTXTransfer(ctx *gin.Context) context.Context {
 	c = context.WithValue(c, _userName, ctx.Request.Header.Get(_userName))
 	c = context.WithValue(c, _userID, ctx.Request.Header.Get(_userID))
 	c = context.WithValue(c, roleName, ctx.Request.Header.Get(roleName))
+	c = context.WithValue(c, _tenantID, ctx.Request.Header.Get(_tenantID))
 	return c
 }
 